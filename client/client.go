@@ -0,0 +1,1095 @@
+// Package client wires the whole RDP stack behind a single Client
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/icodeface/tls"
+	"github.com/tomatome/grdp/core"
+	"github.com/tomatome/grdp/emission"
+	"github.com/tomatome/grdp/glog"
+	"github.com/tomatome/grdp/plugin"
+	"github.com/tomatome/grdp/protocol/disp"
+	"github.com/tomatome/grdp/protocol/drdynvc"
+	"github.com/tomatome/grdp/protocol/nla"
+	"github.com/tomatome/grdp/protocol/pdu"
+	"github.com/tomatome/grdp/protocol/rdpdr"
+	"github.com/tomatome/grdp/protocol/sec"
+	"github.com/tomatome/grdp/protocol/t125"
+	"github.com/tomatome/grdp/protocol/t125/gcc"
+	"github.com/tomatome/grdp/protocol/tpkt"
+	"github.com/tomatome/grdp/protocol/x224"
+)
+
+type Option func(*Client)
+
+// WithCredentials sets the account used by NLA and the logon info
+func WithCredentials(domain, user, password string) Option {
+	return func(c *Client) {
+		c.credentials = nla.Credentials{Domain: domain, Username: user, Password: password}
+	}
+}
+
+// WithKerberos asks for Kerberos rather than NTLM in NLA, with the
+// credentials cache ccachePath and the service principal name spn of the
+// server. Kerberos is not supported yet: Connect fails with
+// ErrKerberosNotSupported unless WithNTLMFallback is given
+func WithKerberos(ccachePath, spn string) Option {
+	return func(c *Client) {
+		c.kerberos = &kerberos{ccachePath: ccachePath, spn: spn}
+	}
+}
+
+// WithNTLMFallback authenticates with NTLM when Kerberos is not available
+func WithNTLMFallback() Option {
+	return func(c *Client) {
+		c.ntlmFallback = true
+	}
+}
+
+// WithDesktop sets the requested desktop size, default 1024x768
+func WithDesktop(width, height uint16) Option {
+	return func(c *Client) {
+		c.width, c.height = width, height
+	}
+}
+
+// WithColorDepth sets the requested color depth, default 16
+func WithColorDepth(bpp uint16) Option {
+	return func(c *Client) {
+		c.colorDepth = bpp
+	}
+}
+
+// WithRemoteFX advertises the RemoteFX codec and requests a 32 bpp session
+func WithRemoteFX() Option {
+	return func(c *Client) {
+		c.remoteFX = true
+		c.colorDepth = 32
+	}
+}
+
+// WithOrdersDisabled advertises no drawing order, the server then
+// sends the whole screen as bitmap updates
+func WithOrdersDisabled() Option {
+	return func(c *Client) {
+		c.ordersDisabled = true
+	}
+}
+
+// WithStrictPDUs reports the PDUs of unknown types as errors, they are
+// logged and skipped by default
+func WithStrictPDUs() Option {
+	return func(c *Client) {
+		c.strictPDUs = true
+	}
+}
+
+// WithMaxPDUSize fails on the fast path updates and static virtual channel
+// messages the server sends in fragments of more than n bytes once
+// reassembled, default core.DefaultMaxPDUSize
+func WithMaxPDUSize(n int) Option {
+	return func(c *Client) {
+		c.maxPDUSize = n
+	}
+}
+
+// WithNSCodec advertises NSCodec for surface bits
+func WithNSCodec() Option {
+	return func(c *Client) {
+		c.nscodec = true
+	}
+}
+
+// WithBitmapCodecs advertises the codecs, such as pdu.CODEC_ID_NSCODEC,
+// rather than those of WithRemoteFX and WithNSCodec, none forces the plain
+// bitmap updates. RemoteFX also requires WithColorDepth(32)
+func WithBitmapCodecs(codecs ...pdu.CodecID) Option {
+	return func(c *Client) {
+		// not nil once set, even without codec
+		c.bitmapCodecs = append([]pdu.CodecID{}, codecs...)
+	}
+}
+
+// WithCompression asks the server for the MPPC bulk compression with a 64K
+// history (RDP 5.0), the RDP 6.0 and 6.1 types are not supported
+func WithCompression() Option {
+	return func(c *Client) {
+		c.compression = true
+	}
+}
+
+// WithConnectionType advertises the connection type t, such as
+// gcc.CONNECTION_TYPE_LAN, for the server to tune the session quality
+func WithConnectionType(t gcc.ConnectionType) Option {
+	return func(c *Client) {
+		c.connectionType = t
+	}
+}
+
+// WithKeyboardLayout sets the keyboard layout of the session, default gcc.US,
+// see the keyboard package for the scancodes of a layout
+func WithKeyboardLayout(layout gcc.KeyboardLayout) Option {
+	return func(c *Client) {
+		c.keyboardLayout = layout
+	}
+}
+
+// WithClientName sets the client name servers log, default the host name,
+// truncated to 15 characters
+func WithClientName(name string) Option {
+	return func(c *Client) {
+		c.clientName = name
+	}
+}
+
+// WithClientBuild sets the client build number announced at connect
+func WithClientBuild(build uint32) Option {
+	return func(c *Client) {
+		c.clientBuild = build
+	}
+}
+
+// WithClientProductId sets the client digital product id, truncated to 31 characters
+func WithClientProductId(id string) Option {
+	return func(c *Client) {
+		c.clientProductId = id
+	}
+}
+
+// WithDrive shares fsys as a read only drive over the rdpdr channel,
+// which then requires TLS or NLA security
+func WithDrive(name string, fsys fs.FS) Option {
+	return func(c *Client) {
+		c.drives = append(c.drives, drive{name, fsys})
+	}
+}
+
+// WithProtocol sets the security protocols requested in x224 negotiation
+func WithProtocol(p uint32) Option {
+	return func(c *Client) {
+		c.protocol = p
+	}
+}
+
+// WithRequestedProtocol forces the security protocol p, such as
+// x224.PROTOCOL_RDP or x224.PROTOCOL_HYBRID, Connect fails with an
+// x224.ProtocolError when the server does not select it
+func WithRequestedProtocol(p uint32) Option {
+	return func(c *Client) {
+		c.protocol = p
+		c.requireProtocol = true
+	}
+}
+
+// WithRoutingToken sends the cookie "Cookie: mstshash=token" in the x224
+// connection request for the load balancer of a server farm, a token
+// starting with "Cookie:", such as the routing token of a redirection, is
+// sent as is
+func WithRoutingToken(token string) Option {
+	return func(c *Client) {
+		c.routingToken = token
+	}
+}
+
+// WithCorrelationId sends id in the x224 connection request, the server logs
+// it with the events of the connection
+func WithCorrelationId(id [16]byte) Option {
+	return func(c *Client) {
+		c.correlationId = &id
+	}
+}
+
+// SetLogLevel sets up glog to log at level on stdout. The logger is global,
+// the level applies to every client of the process
+func SetLogLevel(level glog.LEVEL) {
+	glog.SetLevel(level)
+	glog.SetLogger(log.New(os.Stdout, "", 0))
+}
+
+// SetPacketTracer traces the PDUs of every client of the process to f,
+// such as core.NewHexTracer(os.Stderr), see core.SetPacketTracer
+func SetPacketTracer(f core.PacketTracer) {
+	core.SetPacketTracer(f)
+}
+
+// Dialer opens the connection to the server, as net.Dialer.DialContext
+type Dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// WithDialer replaces net.Dial, to go through a SOCKS5 proxy of
+// golang.org/x/net/proxy or an HTTP CONNECT tunnel. The TLS upgrade of
+// PROTOCOL_SSL and PROTOCOL_HYBRID runs inside the returned conn, so the
+// proxy must relay raw TCP and the certificate remains the server one
+func WithDialer(d Dialer) Option {
+	return func(c *Client) {
+		c.dialer = d
+	}
+}
+
+// WithTimeout bounds dial and the whole connection sequence, default 10s
+func WithTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = d
+	}
+}
+
+// WithInputFlushInterval sends the events of an input batch every d
+// rather than on FlushInput only
+func WithInputFlushInterval(d time.Duration) Option {
+	return func(c *Client) {
+		c.inputFlushInterval = d
+	}
+}
+
+// WithTLSServerName verifies the certificate of the TLS upgrade against
+// name, which is also sent as SNI, rather than skipping the verification.
+// It is the server host name when dialing an address or a tunnel
+func WithTLSServerName(name string) Option {
+	return func(c *Client) {
+		c.tlsServerName = name
+	}
+}
+
+// WithDisplayControl opens the display control dynamic channel, for
+// Resize to change the desktop size of the session
+func WithDisplayControl() Option {
+	return func(c *Client) {
+		c.displayControl = true
+	}
+}
+
+// WithAutoReconnect reconnects to the session once the server sent its
+// auto-reconnect cookie, when the connection is lost on a transport error.
+// The client emits "reconnecting" then "reconnected", or "close" when it
+// fails after the WithRetry attempts, the streams of Channel must then be
+// opened again
+func WithAutoReconnect() Option {
+	return func(c *Client) {
+		c.autoReconnect = true
+	}
+}
+
+// WithDialTimeout bounds the dial alone, default the WithTimeout one
+func WithDialTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.dialTimeout = d
+	}
+}
+
+// WithRetry retries count times the connections which fail to dial or
+// in x224 negotiation, waiting backoff doubled after each attempt. Failures
+// of NLA and the later layers are not retried
+func WithRetry(count int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.retries, c.backoff = count, backoff
+	}
+}
+
+/**
+ * RDP client, after Connect it emits
+ * "bitmap" []pdu.BitmapData on screen update, the areas painted by
+ * drawing orders come as 32 bpp rectangles of the screen
+ * "palette" []uint32 0xRRGGBB colors of 8 bpp bitmaps
+ * "pointer" pdu.PointerShape and "pointer-position" x, y uint16
+ * "disconnect" t125.DisconnectReason when the server ends the session
+ * "error" error and "close" once connected
+ * "reconnecting" and "reconnected" with WithAutoReconnect
+ * "resize" width, height uint16 when the server reactivates the session
+ * with another desktop size, such as after Resize
+ * OnBitmap, OnError, OnClose and OnDisconnect register typed listeners
+ */
+type drive struct {
+	name string
+	fsys fs.FS
+}
+
+type kerberos struct {
+	ccachePath string
+	spn        string
+}
+
+type Client struct {
+	emission.Emitter
+	addr        string
+	credentials nla.Credentials
+	width       uint16
+	height      uint16
+	colorDepth  uint16
+	protocol    uint32
+	remoteFX    bool
+	nscodec     bool
+	timeout     time.Duration
+	dialTimeout time.Duration
+	retries     int
+	backoff     time.Duration
+	dialer      Dialer
+
+	tlsServerName string
+	// fail unless the server selects protocol
+	requireProtocol bool
+	routingToken    string
+	correlationId   *[16]byte
+	// reconnect on transport errors with the cookie of the server
+	autoReconnect bool
+	arcLogonId    uint32
+	arcRandom     []byte
+
+	kerberos     *kerberos
+	ntlmFallback bool
+
+	keyboardLayout  gcc.KeyboardLayout
+	connectionType  gcc.ConnectionType
+	drives          []drive
+	ordersDisabled  bool
+	strictPDUs      bool
+	maxPDUSize      int
+	clientName      string
+	clientBuild     uint32
+	clientProductId string
+
+	// auto flush of the input batches
+	inputFlushInterval time.Duration
+
+	// replaces remoteFX and nscodec unless nil
+	bitmapCodecs []pdu.CodecID
+	compression  bool
+
+	// resize over the display control channel
+	displayControl bool
+	disp           *disp.Client
+	dispErr        error
+
+	conn     net.Conn
+	tpkt     *tpkt.TPKT
+	x224     *x224.X224
+	mcs      *t125.MCSClient
+	sec      *sec.Client
+	pdu      *pdu.Client
+	channels *plugin.Channels
+	// streams of the joined static channels
+	streams map[string]io.ReadWriteCloser
+	dvc     *drdynvc.Client
+	screen  *screen
+
+	lock      sync.Mutex
+	stage     string
+	connected bool
+	closed    bool
+	// closed by Close to end Connect, its retries and the reconnections
+	stop chan struct{}
+	// first error of the connection
+	err error
+}
+
+// NewClient returns a client of addr, glog must be set up by the caller
+// unless SetLogLevel was called
+func NewClient(addr string, opts ...Option) *Client {
+	c := &Client{
+		Emitter:    *emission.NewEmitter(),
+		addr:       addr,
+		width:      1024,
+		height:     768,
+		colorDepth: 16,
+		protocol:   x224.PROTOCOL_RDP | x224.PROTOCOL_SSL | x224.PROTOCOL_HYBRID | x224.PROTOCOL_HYBRID_EX,
+		timeout:    10 * time.Second,
+		dialer:     (&net.Dialer{}).DialContext,
+
+		keyboardLayout: gcc.US,
+		dvc:            drdynvc.New(),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.displayControl {
+		ch, err := c.dvc.OpenDynamicChannel(disp.CHANNEL_NAME)
+		if err != nil {
+			// Resize then reports it
+			glog.Error("disp:", err)
+			c.dispErr = err
+		} else {
+			c.disp = disp.New(ch)
+		}
+	}
+	return c
+}
+
+func (c *Client) setStage(stage string) {
+	c.lock.Lock()
+	c.stage = stage
+	c.lock.Unlock()
+}
+
+// fail tags err with the layer whose handshake was running
+func (c *Client) fail(err error) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return errors.New(fmt.Sprintf("%s: %v", c.stage, err))
+}
+
+// Connect builds the stack and returns once the session is ready, the
+// dial and x224 failures are retried as set by WithRetry
+func (c *Client) Connect() error {
+	if c.kerberos != nil {
+		if !c.ntlmFallback {
+			return ErrKerberosNotSupported
+		}
+		glog.Warn("kerberos not supported, fall back to NTLM")
+	}
+	addr, err := core.HostPort(c.addr, "3389")
+	if err != nil {
+		return errors.New(fmt.Sprintf("dial: %v", err))
+	}
+	c.lock.Lock()
+	c.arcRandom = nil
+	c.stop = make(chan struct{})
+	c.lock.Unlock()
+	return c.connectRetry(addr)
+}
+
+func (c *Client) connectRetry(addr string) error {
+	c.lock.Lock()
+	stop := c.stop
+	c.lock.Unlock()
+	backoff := c.backoff
+	for attempt := 1; ; attempt++ {
+		retry, err := c.connect(addr, stop)
+		if err == nil || !retry || attempt > c.retries {
+			if err != nil && attempt > 1 {
+				err = errors.New(fmt.Sprintf("%v, after %d attempts", err, attempt))
+			}
+			return err
+		}
+		glog.Info("connect", c.addr, "attempt", attempt, "failed, retry in", backoff)
+		wait := time.NewTimer(backoff)
+		select {
+		case <-wait.C:
+		case <-stop:
+			wait.Stop()
+			return ErrClosed
+		}
+		backoff *= 2
+	}
+}
+
+// connect runs one connection attempt, retry tells if the attempt failed
+// below the security layers, not on the credentials. It gives up with
+// ErrClosed once stop is closed by Close
+func (c *Client) connect(addr string, stop chan struct{}) (retry bool, err error) {
+	dialTimeout := c.dialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = c.timeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	conn, err := c.dialer(ctx, "tcp", addr)
+	cancel()
+	if err != nil {
+		return true, errors.New(fmt.Sprintf("dial: %v", err))
+	}
+	c.lock.Lock()
+	c.conn = conn
+	c.screen = newScreen(int(c.width), int(c.height))
+	c.err, c.closed, c.connected = nil, false, false
+	arcLogonId, arcRandom := c.arcLogonId, c.arcRandom
+	c.lock.Unlock()
+
+	socket := core.NewSocketLayer(conn)
+	if c.tlsServerName != "" {
+		socket.SetTLSConfig(&tls.Config{ServerName: c.tlsServerName, MinVersion: tls.VersionTLS10})
+	}
+	c.tpkt = tpkt.New(socket, nla.NewNTLMv2WithCredentials(c.credentials))
+	c.x224 = x224.New(c.tpkt)
+	c.mcs = t125.NewMCSClient(c.x224)
+	c.sec = sec.NewClient(c.mcs)
+	c.pdu = pdu.NewClient(c.sec)
+	c.channels = plugin.NewChannels(c.sec)
+	if c.bitmapCodecs != nil {
+		if err = c.pdu.EnableBitmapCodecs(c.bitmapCodecs...); err != nil {
+			conn.Close()
+			return false, err
+		}
+	} else {
+		if c.remoteFX {
+			c.pdu.EnableRemoteFX()
+		}
+		if c.nscodec {
+			c.pdu.EnableNSCodec()
+		}
+	}
+	c.pdu.SetStrict(c.strictPDUs)
+	if c.maxPDUSize != 0 {
+		c.channels.SetMaxPDUSize(c.maxPDUSize)
+		c.pdu.SetMaxPDUSize(c.maxPDUSize)
+	}
+	if c.ordersDisabled {
+		c.pdu.DisableOrders()
+	}
+	c.pdu.SetInputFlushInterval(c.inputFlushInterval)
+
+	if err = c.mcs.SetDesktop(c.width, c.height); err != nil {
+		conn.Close()
+		return false, err
+	}
+	if err = c.mcs.SetColorDepth(c.colorDepth); err != nil {
+		conn.Close()
+		return false, err
+	}
+	if c.connectionType != 0 {
+		if err = c.mcs.SetConnectionType(c.connectionType); err != nil {
+			conn.Close()
+			return false, err
+		}
+	}
+	c.mcs.SetKeyboardLayout(c.keyboardLayout)
+	if c.clientName != "" {
+		c.mcs.ClientCoreData().SetClientName(c.clientName)
+	}
+	if c.clientBuild != 0 {
+		c.mcs.ClientCoreData().SetClientBuild(c.clientBuild)
+	}
+	if c.clientProductId != "" {
+		c.mcs.ClientCoreData().SetClientProductId(c.clientProductId)
+	}
+	infoFlags := sec.DefaultInfoFlags
+	if c.compression {
+		infoFlags |= sec.CompressionInfoFlags
+	}
+	c.sec.SendClientInfo(c.credentials.Domain, c.credentials.Username, c.credentials.Password, "", "", infoFlags)
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		c.sec.SetClientAddress(addr.IP)
+	}
+	if arcRandom != nil {
+		c.sec.SetClientAutoReconnect(arcLogonId, arcRandom)
+	}
+
+	c.tpkt.SetFastPathListener(c.sec)
+	c.sec.SetFastPathListener(c.pdu)
+	c.sec.SetChannelSender(c.mcs)
+	c.sec.SetFastPathSender(c.tpkt)
+	c.pdu.SetFastPathSender(c.sec)
+	c.channels.SetChannelSender(c.sec)
+	if c.requireProtocol {
+		c.x224.SetRequiredProtocol(c.protocol)
+	} else {
+		c.x224.SetRequestedProtocol(c.protocol)
+	}
+	if strings.HasPrefix(c.routingToken, "Cookie:") {
+		c.x224.SetCookie(c.routingToken)
+	} else if c.routingToken != "" {
+		c.x224.SetCookie("Cookie: mstshash=" + c.routingToken)
+	}
+	if c.correlationId != nil {
+		c.x224.SetCorrelationId(*c.correlationId)
+	}
+
+	result := make(chan error, 1)
+	done := func(err error) {
+		select {
+		case result <- err:
+		default:
+		}
+	}
+	c.setStage("x224")
+	c.x224.On("connect", func(uint32) {
+		c.setStage("mcs")
+	})
+	c.mcs.On("connect", func(clientData, serverData []interface{}, userId uint16, channels []t125.MCSChannelInfo) {
+		c.setStage("sec")
+		c.pdu.SetServerCoreData(c.mcs.ServerCoreData())
+		c.openStreams(channels)
+	})
+	c.mcs.On("disconnect", func(reason t125.DisconnectReason) {
+		c.setErr(&DisconnectError{reason})
+		c.Emit("disconnect", reason)
+	})
+	c.sec.On("connect", func(*gcc.ClientCoreData, uint16, uint16) {
+		c.setStage("pdu")
+	})
+	c.pdu.On("ready", func() {
+		if c.isConnected() {
+			c.reactivated()
+			return
+		}
+		c.lock.Lock()
+		c.connected = true
+		c.lock.Unlock()
+		done(nil)
+	}).On("error", func(err error) {
+		if c.isConnected() {
+			c.setErr(err)
+			c.Emit("error", err)
+			return
+		}
+		done(err)
+	}).On("close", func() {
+		if c.isConnected() {
+			c.lock.Lock()
+			reconnect := c.autoReconnect && c.arcRandom != nil && transient(c.err)
+			c.connected = false
+			c.closed = !reconnect
+			c.lock.Unlock()
+			if reconnect {
+				go c.reconnect(addr)
+				return
+			}
+			c.Emit("close")
+			return
+		}
+		done(errors.New("connection closed"))
+	}).On("bitmap", func(rectangles []pdu.BitmapData) {
+		c.currentScreen().draw(rectangles)
+		c.Emit("bitmap", rectangles)
+	}).On("orders", func(orders []pdu.PrimaryOrder) {
+		s := c.currentScreen()
+		if r := s.apply(orders); !r.Empty() {
+			c.Emit("bitmap", []pdu.BitmapData{s.rectangle(r)})
+		}
+	}).On("palette", func(colors []uint32) {
+		c.currentScreen().setPalette(colors)
+		c.Emit("palette", colors)
+	}).On("pointer", func(shape pdu.PointerShape) {
+		c.Emit("pointer", shape)
+	}).On("pointer-position", func(x, y uint16) {
+		c.Emit("pointer-position", x, y)
+	}).On("logon", func(sessionId uint32, domain, user string) {
+		c.Emit("logon", sessionId, domain, user)
+	}).On("reconnect-cookie", func(logonId uint32, random []byte) {
+		c.mcs.SetReconnectCookie(logonId, random)
+		c.lock.Lock()
+		c.arcLogonId, c.arcRandom = logonId, random
+		c.lock.Unlock()
+	})
+
+	if err = c.x224.Connect(); err != nil {
+		conn.Close()
+		return true, c.fail(err)
+	}
+
+	timeout := time.NewTimer(c.timeout)
+	select {
+	case err = <-result:
+	case <-stop:
+		err = ErrClosed
+	case <-timeout.C:
+		err = errors.New("timeout")
+	}
+	timeout.Stop()
+	if err == nil {
+		return false, nil
+	}
+	c.lock.Lock()
+	var (
+		protocolErr *x224.ProtocolError
+		failure     x224.NegotiationFailure
+	)
+	retry = c.stage == "x224" && !errors.Is(err, x224.ErrNLAFailed) && !errors.As(err, &protocolErr) && !errors.As(err, &failure)
+	c.lock.Unlock()
+	err = c.fail(err)
+	glog.Error("connect", c.addr, "failed:", err)
+	conn.Close()
+	return retry, err
+}
+
+// transient tells if err ended the connection below the RDP layers, so
+// that the session is still there to reconnect to
+func transient(err error) bool {
+	var netErr net.Error
+	return err == nil || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr)
+}
+
+// reconnect replaces the stack of a connection lost on a transport error,
+// logging on with the auto-reconnect cookie, then asks for the whole screen
+func (c *Client) reconnect(addr string) {
+	glog.Info("connection to", c.addr, "lost, reconnect")
+	c.Emit("reconnecting")
+	if err := c.connectRetry(addr); err != nil {
+		c.lock.Lock()
+		c.err, c.closed = err, true
+		c.lock.Unlock()
+		c.Emit("close")
+		return
+	}
+	c.Emit("reconnected")
+	c.lock.Lock()
+	width, height := c.width, c.height
+	c.lock.Unlock()
+	if err := c.pdu.SendRefreshRect([]pdu.Rect{{Right: width - 1, Bottom: height - 1}}); err != nil {
+		glog.Error("refresh after reconnect:", err)
+	}
+}
+
+// OnBitmap listens for the screen updates
+func (c *Client) OnBitmap(f func([]pdu.BitmapData)) *Client {
+	c.On("bitmap", f)
+	return c
+}
+
+// OnError listens for the errors once connected
+func (c *Client) OnError(f func(error)) *Client {
+	c.On("error", f)
+	return c
+}
+
+// OnClose listens for the end of the connection once connected, Err
+// then returns its cause
+func (c *Client) OnClose(f func()) *Client {
+	c.On("close", f)
+	return c
+}
+
+// OnDisconnect listens for the disconnect provider ultimatum of the server
+func (c *Client) OnDisconnect(f func(t125.DisconnectReason)) *Client {
+	c.On("disconnect", f)
+	return c
+}
+
+// OnLogon listens for the logon notification of the server, the plain
+// notification has no session id nor user
+func (c *Client) OnLogon(f func(sessionId uint32, domain, user string)) *Client {
+	c.On("logon", f)
+	return c
+}
+
+// SecurityInfo describes the security negotiated by a connection
+type SecurityInfo struct {
+	// x224.PROTOCOL_RDP, PROTOCOL_SSL, PROTOCOL_HYBRID or PROTOCOL_HYBRID_EX
+	Protocol uint32
+	// gcc encryption flag and level of standard RDP security, zero under TLS
+	EncryptionMethod uint32
+	EncryptionLevel  uint32
+	// version and cipher suite of the TLS connection, zero without TLS
+	TLSVersion  uint16
+	CipherSuite uint16
+}
+
+// StandardSecurity tells if the connection relies on the RC4 encryption
+// of standard RDP security
+func (s SecurityInfo) StandardSecurity() bool {
+	return s.Protocol == x224.PROTOCOL_RDP
+}
+
+// SecurityInfo returns the security negotiated by the connection, the
+// zero value before Connect
+func (c *Client) SecurityInfo() SecurityInfo {
+	var info SecurityInfo
+	if c.x224 == nil {
+		return info
+	}
+	info.Protocol = c.x224.SelectedProtocol()
+	if data := c.mcs.ServerSecurityData(); data != nil {
+		info.EncryptionMethod = data.EncryptionMethod
+		info.EncryptionLevel = data.EncryptionLevel
+	}
+	info.TLSVersion, info.CipherSuite, _ = c.tpkt.Conn.TLSState()
+	return info
+}
+
+func (c *Client) isConnected() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.connected
+}
+
+// SendInput sends slow path input events of msgType
+func (c *Client) SendInput(msgType uint16, events ...pdu.InputEventsInterface) error {
+	if !c.isConnected() {
+		return errors.New("not connected")
+	}
+	c.pdu.SendInputEvents(msgType, events)
+	return nil
+}
+
+// SendScancode sends a key press or release, over fast path when the server supports it
+func (c *Client) SendScancode(code uint16, down bool) error {
+	if !c.isConnected() {
+		return errors.New("not connected")
+	}
+	return c.pdu.SendScancode(code, down)
+}
+
+// SendUnicode types r bypassing the keyboard layout, for the characters
+// out of its scancodes
+func (c *Client) SendUnicode(r rune) error {
+	if !c.isConnected() {
+		return errors.New("not connected")
+	}
+	return c.pdu.SendUnicode(r)
+}
+
+// SendPointer sends a mouse event, over fast path when the server supports it
+func (c *Client) SendPointer(x, y uint16, flags uint16) error {
+	if !c.isConnected() {
+		return errors.New("not connected")
+	}
+	return c.pdu.SendPointer(x, y, flags)
+}
+
+// BeginInputBatch queues the input events until FlushInput, to send a drag
+// in a single PDU, WithInputFlushInterval bounds the wait
+func (c *Client) BeginInputBatch() error {
+	if !c.isConnected() {
+		return errors.New("not connected")
+	}
+	c.pdu.BeginInputBatch()
+	return nil
+}
+
+// FlushInput sends the input events queued since BeginInputBatch
+func (c *Client) FlushInput() error {
+	if !c.isConnected() {
+		return errors.New("not connected")
+	}
+	return c.pdu.FlushInput()
+}
+
+// SendExtendedPointer presses or releases the extended button 1 (back) or 2 (forward)
+func (c *Client) SendExtendedPointer(x, y uint16, button int, down bool) error {
+	if !c.isConnected() {
+		return errors.New("not connected")
+	}
+	return c.pdu.SendExtendedPointer(x, y, button, down)
+}
+
+// SendWheel scrolls by delta, 120 per notch, positive up or right
+func (c *Client) SendWheel(delta int16, horizontal bool) error {
+	if !c.isConnected() {
+		return errors.New("not connected")
+	}
+	return c.pdu.SendWheel(delta, horizontal)
+}
+
+// SendRefreshRect asks the server to redraw rects, after output was suppressed
+func (c *Client) SendRefreshRect(rects []pdu.Rect) error {
+	if !c.isConnected() {
+		return errors.New("not connected")
+	}
+	return c.pdu.SendRefreshRect(rects)
+}
+
+// SendSuppressOutput stops the display updates while the desktop is not shown,
+// allow resumes them for rect
+func (c *Client) SendSuppressOutput(allow bool, rect pdu.Rect) error {
+	if !c.isConnected() {
+		return errors.New("not connected")
+	}
+	return c.pdu.SendSuppressOutput(allow, rect)
+}
+
+// currentScreen returns the screen, which a reactivation replaces
+func (c *Client) currentScreen() *screen {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.screen
+}
+
+// Screenshot returns a copy of the desktop, waiting until every pixel was
+// received or the timeout of WithTimeout elapses
+func (c *Client) Screenshot() (*image.RGBA, error) {
+	s := c.currentScreen()
+	if s == nil {
+		return nil, errors.New("not connected")
+	}
+	return s.snapshot(c.timeout)
+}
+
+type ImageFormat int
+
+const (
+	PNG ImageFormat = iota
+	JPEG
+)
+
+// SaveScreenshot encodes the desktop of Screenshot to w
+func (c *Client) SaveScreenshot(w io.Writer, format ImageFormat) error {
+	img, err := c.Screenshot()
+	if err != nil {
+		return err
+	}
+	switch format {
+	case PNG:
+		return png.Encode(w, img)
+	case JPEG:
+		return jpeg.Encode(w, img, nil)
+	}
+	return errors.New(fmt.Sprintf("unknown image format %d", format))
+}
+
+// openStreams buffers the static channels from their join, before the server
+// starts their own handshake
+func (c *Client) openStreams(channels []t125.MCSChannelInfo) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.streams = make(map[string]io.ReadWriteCloser)
+	for _, ch := range channels {
+		if ch.Name == t125.GLOBAL_CHANNEL_NAME || ch.Name == "user" {
+			continue
+		}
+		c.streams[ch.Name] = c.mcs.Channel(t125.MCSChannel(ch.ID))
+	}
+	if s, ok := c.streams[plugin.RDPDR_SVC_CHANNEL_NAME]; ok && len(c.drives) > 0 {
+		delete(c.streams, plugin.RDPDR_SVC_CHANNEL_NAME)
+		go c.runDrives(s)
+	}
+	if s, ok := c.streams[plugin.DRDYNVC_SVC_CHANNEL_NAME]; ok {
+		delete(c.streams, plugin.DRDYNVC_SVC_CHANNEL_NAME)
+		go func() {
+			if err := c.dvc.Run(s); err != nil {
+				glog.Error("drdynvc:", err)
+			}
+		}()
+		if c.disp != nil {
+			go func() {
+				if err := c.disp.Run(); err != nil {
+					glog.Error("disp:", err)
+				}
+			}()
+		}
+	}
+}
+
+func (c *Client) runDrives(s io.ReadWriteCloser) {
+	name, _ := os.Hostname()
+	r := rdpdr.New(s, name)
+	for _, d := range c.drives {
+		r.AddDrive(d.name, d.fsys)
+	}
+	if err := r.Run(); err != nil {
+		glog.Error("rdpdr:", err)
+	}
+}
+
+/**
+ * Channel returns the stream of a joined static channel, such as
+ * cliprdr.New(c.Channel(plugin.CLIPRDR_SVC_CHANNEL_NAME)), data is not
+ * decrypted so it requires TLS or NLA security
+ */
+func (c *Client) Channel(name string) (io.ReadWriteCloser, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	s, ok := c.streams[name]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("channel %s not joined", name))
+	}
+	return s, nil
+}
+
+// Resize asks the server for the desktop size width x height, even and
+// between 200 and 8192, it requires WithDisplayControl and a server which
+// created the channel. The client emits "resize" once the server
+// reactivated the session with the new size
+func (c *Client) Resize(width, height uint32) error {
+	if c.dispErr != nil {
+		return errors.New(fmt.Sprintf("resize: %v", c.dispErr))
+	}
+	if c.disp == nil {
+		return errors.New("resize requires WithDisplayControl")
+	}
+	if !c.isConnected() {
+		return errors.New("resize: not connected")
+	}
+	return c.disp.Resize(width, height)
+}
+
+// reactivated takes the desktop size of the server after a deactivation
+// reactivation sequence, the screen is then cleared
+func (c *Client) reactivated() {
+	b, ok := c.pdu.ServerCapability(pdu.CAPSTYPE_BITMAP).(*pdu.BitmapCapability)
+	if !ok {
+		return
+	}
+	c.lock.Lock()
+	if b.DesktopWidth == c.width && b.DesktopHeight == c.height {
+		c.lock.Unlock()
+		return
+	}
+	c.width, c.height = b.DesktopWidth, b.DesktopHeight
+	c.screen = newScreen(int(c.width), int(c.height))
+	c.lock.Unlock()
+	c.Emit("resize", b.DesktopWidth, b.DesktopHeight)
+}
+
+// OpenDynamicChannel listens for the dynamic channel name, before Connect
+// so that channels created during the connection are not refused, this
+// requires TLS or NLA security as Channel does
+func (c *Client) OpenDynamicChannel(name string) (io.ReadWriteCloser, error) {
+	return c.dvc.OpenDynamicChannel(name)
+}
+
+// Channels returns the static virtual channels to register plugins on
+func (c *Client) Channels() *plugin.Channels {
+	return c.channels
+}
+
+// Close ends the connection, which stops the read loop of the transport,
+// and a Connect or a reconnection still running
+func (c *Client) Close() error {
+	c.lock.Lock()
+	conn, stop := c.conn, c.stop
+	if stop != nil {
+		select {
+		case <-stop:
+		default:
+			close(stop)
+		}
+	}
+	c.lock.Unlock()
+	if conn == nil {
+		return nil
+	}
+	c.setErr(ErrClosed)
+	c.lock.Lock()
+	c.closed = true
+	c.lock.Unlock()
+	return conn.Close()
+}
+
+// ErrClosed is the cause of a connection ended by Close
+var ErrClosed = errors.New("client closed")
+
+// ErrKerberosNotSupported is returned by Connect with WithKerberos
+var ErrKerberosNotSupported = errors.New("kerberos not supported")
+
+// DisconnectError is the cause of a connection ended by the disconnect
+// provider ultimatum of the server
+type DisconnectError struct {
+	Reason t125.DisconnectReason
+}
+
+func (e *DisconnectError) Error() string {
+	return fmt.Sprintf("disconnected by the server: %v", e.Reason)
+}
+
+func (c *Client) setErr(err error) {
+	c.lock.Lock()
+	if c.err == nil && !c.closed {
+		c.err = err
+	}
+	c.lock.Unlock()
+}
+
+// Err returns the cause of the end of the connection once closed, that is
+// the first error reported by the layers, a *DisconnectError or ErrClosed,
+// nil while the connection runs
+func (c *Client) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.closed {
+		return nil
+	}
+	if c.err == nil {
+		return errors.New("connection closed")
+	}
+	return c.err
+}
@@ -0,0 +1,424 @@
+package client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tomatome/grdp/core"
+	"github.com/tomatome/grdp/glog"
+	"github.com/tomatome/grdp/protocol/nla"
+	"github.com/tomatome/grdp/protocol/pdu"
+	"github.com/tomatome/grdp/protocol/t125"
+	"github.com/tomatome/grdp/protocol/tpkt"
+	"github.com/tomatome/grdp/protocol/x224"
+)
+
+func init() {
+	glog.SetLevel(glog.NONE)
+}
+
+func listen(t *testing.T, serve func(net.Conn)) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		serve(conn)
+	}()
+	return l
+}
+
+func TestConnectDialError(t *testing.T) {
+	l := listen(t, func(conn net.Conn) {})
+	addr := l.Addr().String()
+	l.Close()
+
+	err := NewClient(addr, WithTimeout(time.Second)).Connect()
+	if err == nil || !strings.HasPrefix(err.Error(), "dial:") {
+		t.Error("expect dial error, get", err)
+	}
+}
+
+func TestConnectBadAddress(t *testing.T) {
+	err := NewClient("host:1:2", WithTimeout(time.Second)).Connect()
+	if err == nil || !strings.HasPrefix(err.Error(), "dial: invalid address") {
+		t.Error("expect invalid address, get", err)
+	}
+}
+
+func TestConnectWithDialer(t *testing.T) {
+	var network, addr string
+	dialer := func(ctx context.Context, n, a string) (net.Conn, error) {
+		network, addr = n, a
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("dial without deadline")
+		}
+		return nil, errors.New("proxy refused")
+	}
+
+	err := NewClient("rdp.example.com", WithDialer(dialer)).Connect()
+	if err == nil || err.Error() != "dial: proxy refused" {
+		t.Error("expect proxy error, get", err)
+	}
+	if network != "tcp" || addr != "rdp.example.com:3389" {
+		t.Error("dial", network, addr)
+	}
+}
+
+func TestConnectClosedDuringNegotiation(t *testing.T) {
+	l := listen(t, func(conn net.Conn) {
+		conn.Read(make([]byte, 64))
+		conn.Close()
+	})
+	defer l.Close()
+
+	err := NewClient(l.Addr().String(), WithTimeout(5*time.Second)).Connect()
+	if err == nil || !strings.HasPrefix(err.Error(), "x224:") {
+		t.Error("expect x224 error, get", err)
+	}
+}
+
+func TestConnectTimeout(t *testing.T) {
+	l := listen(t, func(conn net.Conn) {
+		time.Sleep(time.Second)
+		conn.Close()
+	})
+	defer l.Close()
+
+	err := NewClient(l.Addr().String(), WithTimeout(50*time.Millisecond)).Connect()
+	if err == nil || err.Error() != "x224: timeout" {
+		t.Error("expect x224 timeout, get", err)
+	}
+}
+
+func TestConnectBadOption(t *testing.T) {
+	l := listen(t, func(conn net.Conn) {
+		conn.Close()
+	})
+	defer l.Close()
+
+	if err := NewClient(l.Addr().String(), WithDesktop(1022, 768)).Connect(); err == nil {
+		t.Error("expect error on bad desktop size")
+	}
+	if err := NewClient(l.Addr().String(), WithBitmapCodecs(pdu.CODEC_ID_REMOTEFX, 9)).Connect(); err == nil || err.Error() != "unknown bitmap codec id 9" {
+		t.Error("expect error on unknown codec, get", err)
+	}
+	if err := NewClient("127.0.0.1:1").SendInput(0); err == nil {
+		t.Error("expect error on input before connect")
+	}
+}
+
+func TestTypedListeners(t *testing.T) {
+	c := NewClient("127.0.0.1:1")
+	var (
+		bitmaps []pdu.BitmapData
+		err     error
+		closed  bool
+		reason  t125.DisconnectReason
+		user    string
+	)
+	c.OnBitmap(func(b []pdu.BitmapData) {
+		bitmaps = b
+	}).OnError(func(e error) {
+		err = e
+	}).OnClose(func() {
+		closed = true
+	}).OnDisconnect(func(r t125.DisconnectReason) {
+		reason = r
+	}).OnLogon(func(id uint32, domain, u string) {
+		user = domain + `\` + u
+	})
+
+	c.Emit("bitmap", []pdu.BitmapData{{Width: 8}})
+	c.Emit("error", errors.New("reset"))
+	c.Emit("close")
+	c.Emit("disconnect", t125.RN_USER_REQUESTED)
+	c.Emit("logon", uint32(2), "CORP", "bob")
+	if len(bitmaps) != 1 || bitmaps[0].Width != 8 {
+		t.Error("get bitmaps", bitmaps)
+	}
+	if err == nil || err.Error() != "reset" || !closed || reason != t125.RN_USER_REQUESTED || user != `CORP\bob` {
+		t.Error("get", err, closed, reason, user)
+	}
+}
+
+func TestSecurityInfo(t *testing.T) {
+	c := NewClient("127.0.0.1:1")
+	if info := c.SecurityInfo(); info != (SecurityInfo{}) {
+		t.Error("get", info)
+	}
+
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	c.tpkt = tpkt.New(core.NewSocketLayer(conn), nla.NewNTLMv2WithCredentials(c.credentials))
+	c.x224 = x224.New(c.tpkt)
+	c.mcs = t125.NewMCSClient(c.x224)
+	info := c.SecurityInfo()
+	if info.Protocol != x224.PROTOCOL_SSL || info.EncryptionMethod != 0 || info.TLSVersion != 0 || info.StandardSecurity() {
+		t.Error("get", info)
+	}
+}
+
+func TestConnectRetry(t *testing.T) {
+	var attempts int
+	dialer := func(ctx context.Context, n, a string) (net.Conn, error) {
+		attempts++
+		if attempts == 1 {
+			return nil, errors.New("refused")
+		}
+		// the server drops the x224 connection request
+		client, server := net.Pipe()
+		go func() {
+			server.Read(make([]byte, 64))
+			server.Close()
+		}()
+		return client, nil
+	}
+
+	err := NewClient("127.0.0.1", WithDialer(dialer), WithRetry(2, time.Millisecond), WithTimeout(time.Second)).Connect()
+	if err == nil || err.Error() != "x224: EOF, after 3 attempts" || attempts != 3 {
+		t.Error("get", attempts, err)
+	}
+
+	attempts = 0
+	err = NewClient("127.0.0.1", WithDialer(dialer), WithDialTimeout(time.Millisecond)).Connect()
+	if err == nil || err.Error() != "dial: refused" || attempts != 1 {
+		t.Error("get", attempts, err)
+	}
+}
+
+func TestErr(t *testing.T) {
+	c := NewClient("127.0.0.1:1")
+	c.conn, _ = net.Pipe()
+	c.setErr(&DisconnectError{t125.RN_PROVIDER_INITIATED})
+	c.setErr(errors.New("EOF"))
+	if err := c.Err(); err != nil {
+		t.Error("expect no error while connected, get", err)
+	}
+	c.Close()
+	var d *DisconnectError
+	if !errors.As(c.Err(), &d) || d.Reason != t125.RN_PROVIDER_INITIATED {
+		t.Error("get", c.Err())
+	}
+
+	c = NewClient("127.0.0.1:1")
+	c.conn, _ = net.Pipe()
+	c.Close()
+	if c.Err() != ErrClosed {
+		t.Error("get", c.Err())
+	}
+}
+
+func TestTransient(t *testing.T) {
+	for _, tc := range []struct {
+		err       error
+		transient bool
+	}{
+		{nil, true},
+		{io.EOF, true},
+		{&net.OpError{Op: "read", Err: errors.New("connection reset by peer")}, true},
+		{ErrClosed, false},
+		{&DisconnectError{t125.RN_USER_REQUESTED}, false},
+		{pdu.ERRINFO_LOGOFF_BY_USER, false},
+	} {
+		if transient(tc.err) != tc.transient {
+			t.Error("transient", tc.err)
+		}
+	}
+}
+
+func TestTLSServerName(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"rdp.example.com"},
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	serverName := make(chan string, 1)
+	l := listen(t, func(conn net.Conn) {
+		defer conn.Close()
+		conn.Read(make([]byte, 64))
+		// connection confirm selecting PROTOCOL_SSL
+		confirm, _ := hex.DecodeString("030000130ed000000000000200080001000000")
+		conn.Write(confirm)
+		tls.Server(conn, &tls.Config{GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			serverName <- hello.ServerName
+			return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+		}}).Handshake()
+	})
+	defer l.Close()
+
+	err := NewClient(l.Addr().String(), WithTLSServerName("rdp.example.com"), WithTimeout(5*time.Second)).Connect()
+	if err == nil || !strings.HasPrefix(err.Error(), "x224:") || !strings.Contains(err.Error(), "certificate") {
+		t.Error("expect certificate error, get", err)
+	}
+	if name := <-serverName; name != "rdp.example.com" {
+		t.Error("get server name", name)
+	}
+}
+
+func TestRequestedProtocol(t *testing.T) {
+	for confirm, expect := range map[string]string{
+		// connection confirm selecting PROTOCOL_RDP
+		"030000130ed000000000000200080000000000": "x224: server selected protocol 0 instead of 2",
+		// negotiation failure HYBRID_REQUIRED_BY_SERVER
+		"030000130ed000000000000300080005000000": "x224: negotiation of protocol 2 failed: the server requires NLA (PROTOCOL_HYBRID) (negotiation failure 5)",
+	} {
+		var attempts int
+		b, _ := hex.DecodeString(confirm)
+		dialer := func(ctx context.Context, n, a string) (net.Conn, error) {
+			attempts++
+			client, server := net.Pipe()
+			go func() {
+				defer server.Close()
+				server.Read(make([]byte, 64))
+				server.Write(b)
+				server.Read(make([]byte, 64))
+			}()
+			return client, nil
+		}
+		err := NewClient("127.0.0.1", WithDialer(dialer), WithRequestedProtocol(x224.PROTOCOL_HYBRID), WithRetry(1, time.Millisecond),
+			WithTimeout(time.Second)).Connect()
+		if err == nil || err.Error() != expect || attempts != 1 {
+			t.Error("get", attempts, err)
+		}
+	}
+}
+
+func TestRoutingToken(t *testing.T) {
+	request := make(chan []byte, 1)
+	dialer := func(ctx context.Context, n, a string) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			header, err := core.ReadBytes(4, server)
+			if err != nil {
+				return
+			}
+			body, _ := core.ReadBytes(int(header[3])-4, server)
+			request <- append(header, body...)
+		}()
+		return client, nil
+	}
+	id := [16]byte{0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, 0x01}
+	NewClient("127.0.0.1", WithDialer(dialer), WithRoutingToken("alice"), WithCorrelationId(id), WithTimeout(50*time.Millisecond)).Connect()
+	b := <-request
+	// tpkt header, x224 header, cookie, negotiation request, correlation info
+	cookie := "Cookie: mstshash=alice\r\n"
+	if len(b) != 4+7+len(cookie)+8+36 || int(b[4]) != len(b)-5 || string(b[11:11+len(cookie)]) != cookie {
+		t.Fatalf("get %q", b)
+	}
+	neg := b[11+len(cookie):]
+	if neg[0] != byte(x224.TYPE_RDP_NEG_REQ) || neg[1] != x224.CORRELATION_INFO_PRESENT || neg[8] != byte(x224.TYPE_RDP_CORRELATION_INFO) ||
+		string(neg[12:28]) != string(id[:]) {
+		t.Errorf("get %x", neg)
+	}
+
+	id[0] = 0xf4
+	err := NewClient("127.0.0.1", WithDialer(dialer), WithCorrelationId(id), WithTimeout(time.Second)).Connect()
+	if err == nil || !strings.HasPrefix(err.Error(), "x224: invalid correlation id") {
+		t.Error("get", err)
+	}
+}
+
+func TestKerberos(t *testing.T) {
+	c := NewClient("127.0.0.1:1", WithKerberos("/tmp/krb5cc", "TERMSRV/rdp.example.com"))
+	if err := c.Connect(); err != ErrKerberosNotSupported {
+		t.Error("get", err)
+	}
+	// the NTLM fallback goes on to dial
+	l := listen(t, func(conn net.Conn) {})
+	addr := l.Addr().String()
+	l.Close()
+	c = NewClient(addr, WithKerberos("/tmp/krb5cc", "TERMSRV/rdp.example.com"), WithNTLMFallback())
+	if err := c.Connect(); err == nil || !strings.HasPrefix(err.Error(), "dial:") {
+		t.Error("expect dial error, get", err)
+	}
+}
+
+func TestResize(t *testing.T) {
+	if err := NewClient("127.0.0.1:1").Resize(800, 600); err == nil || err.Error() != "resize requires WithDisplayControl" {
+		t.Error("get", err)
+	}
+	c := NewClient("127.0.0.1:1", WithDisplayControl())
+	if err := c.Resize(800, 600); err == nil || err.Error() != "resize: not connected" {
+		t.Error("get", err)
+	}
+	if _, err := c.OpenDynamicChannel("Microsoft::Windows::RDS::DisplayControl"); err == nil {
+		t.Error("expect the display control channel opened")
+	}
+}
+
+func TestCloseLeaksNoGoroutine(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	// connection closed by the server
+	l := listen(t, func(conn net.Conn) {
+		conn.Read(make([]byte, 64))
+		conn.Close()
+	})
+	if err := NewClient(l.Addr().String(), WithDisplayControl()).Connect(); err == nil {
+		t.Error("expect x224 error")
+	}
+	l.Close()
+
+	// Close during the negotiation
+	accepted := make(chan bool)
+	l = listen(t, func(conn net.Conn) {
+		conn.Read(make([]byte, 64))
+		accepted <- true
+		io.Copy(io.Discard, conn)
+	})
+	c := NewClient(l.Addr().String(), WithDisplayControl())
+	result := make(chan error, 1)
+	go func() {
+		result <- c.Connect()
+	}()
+	<-accepted
+	c.Close()
+	if err := <-result; err == nil {
+		t.Error("expect error on close")
+	}
+	l.Close()
+
+	// Close during the backoff of the retries
+	l = listen(t, func(conn net.Conn) {})
+	addr := l.Addr().String()
+	l.Close()
+	c = NewClient(addr, WithRetry(3, time.Hour))
+	go func() {
+		result <- c.Connect()
+	}()
+	time.Sleep(50 * time.Millisecond)
+	c.Close()
+	if err := <-result; err != ErrClosed {
+		t.Error("get", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("%d goroutines left", n-before)
+	}
+}
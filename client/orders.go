@@ -0,0 +1,202 @@
+package client
+
+import (
+	"image"
+	"image/draw"
+
+	"github.com/tomatome/grdp/protocol/pdu"
+)
+
+// PATCOPY raster operation
+const ropPatCopy = 0xf0
+
+// rop3 applies the ternary raster operation to the bits of the pattern,
+// source and destination, bit i of rop is the result for P<<2 | S<<1 | D
+func rop3(rop, p, src, dst byte) byte {
+	var v byte
+	for i := uint(0); i < 8; i++ {
+		if rop&(1<<i) == 0 {
+			continue
+		}
+		m := dst
+		if i&1 == 0 {
+			m = ^dst
+		}
+		if i&2 != 0 {
+			m &= src
+		} else {
+			m &= ^src
+		}
+		if i&4 != 0 {
+			m &= p
+		} else {
+			m &= ^p
+		}
+		v |= m
+	}
+	return v
+}
+
+func rect(left, top, width, height int16) image.Rectangle {
+	return image.Rect(int(left), int(top), int(left)+int(width), int(top)+int(height))
+}
+
+// orderRGB returns the color of an order
+func (s *screen) orderRGB(c pdu.Color) [3]byte {
+	v := c.Value
+	switch c.BitsPerPixel {
+	case 24, 32:
+		return [3]byte{byte(v), byte(v >> 8), byte(v >> 16)}
+	}
+	r, g, b := s.rgb(c.BitsPerPixel, []byte{byte(v), byte(v >> 8)})
+	return [3]byte{r, g, b}
+}
+
+// blt paints r with rop, src returns the source pixel at x, y and false
+// to leave the pixel as is
+func (s *screen) blt(r image.Rectangle, rop uint8, pattern [3]byte, src func(x, y int) ([3]byte, bool)) image.Rectangle {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			var sp [3]byte
+			if src != nil {
+				var ok bool
+				if sp, ok = src(x, y); !ok {
+					continue
+				}
+			}
+			i := s.img.PixOffset(x, y)
+			d := s.img.Pix[i : i+3]
+			s.set(i, rop3(rop, pattern[0], sp[0], d[0]), rop3(rop, pattern[1], sp[1], d[1]), rop3(rop, pattern[2], sp[2], d[2]))
+		}
+	}
+	return r
+}
+
+// memBlt paints the cached bitmap of o
+func (s *screen) memBlt(o *pdu.MemBlt, clip image.Rectangle) image.Rectangle {
+	b := o.Bitmap
+	if b == nil {
+		return image.Rectangle{}
+	}
+	stride := stride(b)
+	if stride == 0 {
+		return image.Rectangle{}
+	}
+	bpp := b.BytesPerPixel()
+	dx, dy := int(o.SrcX)-int(o.Left), int(o.SrcY)-int(o.Top)
+	return s.blt(rect(o.Left, o.Top, o.Width, o.Height).Intersect(clip), o.Rop, [3]byte{}, func(x, y int) ([3]byte, bool) {
+		bx, by := x+dx, y+dy
+		if bx < 0 || by < 0 || bx >= int(b.Width) || by >= int(b.Height) {
+			return [3]byte{}, false
+		}
+		// rows are bottom up
+		r, g, bl := s.rgb(b.BitsPerPixel, b.Pixels[(int(b.Height)-1-by)*stride+bx*bpp:])
+		return [3]byte{r, g, bl}, true
+	})
+}
+
+// scrBlt copies the screen area of o, the source is read before painting
+func (s *screen) scrBlt(o *pdu.ScrBlt, clip image.Rectangle) image.Rectangle {
+	dx, dy := int(o.SrcX)-int(o.Left), int(o.SrcY)-int(o.Top)
+	srcRect := rect(o.SrcX, o.SrcY, o.Width, o.Height).Intersect(s.img.Bounds())
+	src := image.NewRGBA(srcRect)
+	draw.Draw(src, srcRect, s.img, srcRect.Min, draw.Src)
+	return s.blt(rect(o.Left, o.Top, o.Width, o.Height).Intersect(clip), o.Rop, [3]byte{}, func(x, y int) ([3]byte, bool) {
+		p := image.Pt(x+dx, y+dy)
+		if !p.In(srcRect) {
+			return [3]byte{}, false
+		}
+		i := src.PixOffset(p.X, p.Y)
+		return [3]byte{src.Pix[i], src.Pix[i+1], src.Pix[i+2]}, true
+	})
+}
+
+// glyphIndex paints the opaque rectangle then the glyphs of o
+func (s *screen) glyphIndex(o *pdu.GlyphIndex, clip image.Rectangle) image.Rectangle {
+	var dirty image.Rectangle
+	op := image.Rect(int(o.OpLeft), int(o.OpTop), int(o.OpRight)+1, int(o.OpBottom)+1)
+	if o.OpRedundant != 0 {
+		op = image.Rect(int(o.BkLeft), int(o.BkTop), int(o.BkRight)+1, int(o.BkBottom)+1)
+	}
+	if o.OpRight > o.OpLeft || o.OpRedundant != 0 {
+		dirty = s.blt(op.Intersect(clip), ropPatCopy, s.orderRGB(o.ForeColor), nil)
+	}
+	if o.BkRight > o.BkLeft {
+		clip = clip.Intersect(image.Rect(int(o.BkLeft), int(o.BkTop), int(o.BkRight)+1, int(o.BkBottom)+1))
+	}
+	text := s.orderRGB(o.BackColor)
+	for _, g := range o.Glyphs {
+		r := image.Rect(g.X, g.Y, g.X+int(g.Width), g.Y+int(g.Height)).Intersect(clip)
+		stride := (int(g.Width) + 7) / 8
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				gx, gy := x-g.X, y-g.Y
+				if g.Mask[gy*stride+gx/8]&(0x80>>uint(gx%8)) != 0 {
+					s.set(s.img.PixOffset(x, y), text[0], text[1], text[2])
+				}
+			}
+		}
+		dirty = dirty.Union(r)
+	}
+	return dirty
+}
+
+/**
+ * apply paints the drawing orders, returns the area they changed.
+ * Brushes other than solid are drawn with their fore color
+ */
+func (s *screen) apply(orders []pdu.PrimaryOrder) image.Rectangle {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var dirty image.Rectangle
+	for _, o := range orders {
+		clip := s.img.Bounds()
+		if o.Bounds != nil {
+			clip = clip.Intersect(*o.Bounds)
+		}
+		var r image.Rectangle
+		switch d := o.DrawingOrder.(type) {
+		case *pdu.DstBlt:
+			r = s.blt(rect(d.Left, d.Top, d.Width, d.Height).Intersect(clip), d.Rop, [3]byte{}, nil)
+		case *pdu.PatBlt:
+			if d.Brush.Style != pdu.BS_NULL {
+				r = s.blt(rect(d.Left, d.Top, d.Width, d.Height).Intersect(clip), d.Rop, s.orderRGB(d.ForeColor), nil)
+			}
+		case *pdu.OpaqueRect:
+			r = s.blt(rect(d.Left, d.Top, d.Width, d.Height).Intersect(clip), ropPatCopy, s.orderRGB(d.Color), nil)
+		case *pdu.ScrBlt:
+			r = s.scrBlt(d, clip)
+		case *pdu.MemBlt:
+			r = s.memBlt(d, clip)
+		case *pdu.GlyphIndex:
+			r = s.glyphIndex(d, clip)
+		}
+		dirty = dirty.Union(r)
+	}
+	s.checkFull()
+	return dirty
+}
+
+// rectangle returns r of the screen as a 32 bpp bottom up bitmap
+func (s *screen) rectangle(r image.Rectangle) pdu.BitmapData {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	pixels := make([]byte, 0, r.Dx()*r.Dy()*4)
+	for y := r.Max.Y - 1; y >= r.Min.Y; y-- {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			i := s.img.PixOffset(x, y)
+			pixels = append(pixels, s.img.Pix[i+2], s.img.Pix[i+1], s.img.Pix[i], 0xff)
+		}
+	}
+	return pdu.BitmapData{
+		DestLeft:         uint16(r.Min.X),
+		DestTop:          uint16(r.Min.Y),
+		DestRight:        uint16(r.Max.X - 1),
+		DestBottom:       uint16(r.Max.Y - 1),
+		Width:            uint16(r.Dx()),
+		Height:           uint16(r.Dy()),
+		BitsPerPixel:     32,
+		BitmapDataStream: pixels,
+		Pixels:           pixels,
+	}
+}
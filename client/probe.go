@@ -0,0 +1,142 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/icodeface/tls"
+	"github.com/tomatome/grdp/core"
+	"github.com/tomatome/grdp/protocol/t125"
+	"github.com/tomatome/grdp/protocol/t125/gcc"
+	"github.com/tomatome/grdp/protocol/tpkt"
+	"github.com/tomatome/grdp/protocol/x224"
+)
+
+// ServerInfo describes a server fingerprinted by Probe
+type ServerInfo struct {
+	// x224.PROTOCOL_RDP, PROTOCOL_SSL, PROTOCOL_HYBRID and PROTOCOL_HYBRID_EX
+	// when the server selects them requested alone
+	Protocols []uint32
+	// the server refuses standard RDP or TLS security for NLA
+	NLARequired bool
+	// protocol of the connection the server data below comes from, the
+	// MCS connect response is out of reach without credentials under NLA
+	Protocol uint32
+	// gcc encryption flag and level of standard RDP security, zero under TLS
+	EncryptionMethod uint32
+	EncryptionLevel  uint32
+	// zero when the server data could not be read
+	Version gcc.VERSION
+}
+
+// Accepts tells if the server selected protocol requested alone
+func (s *ServerInfo) Accepts(protocol uint32) bool {
+	for _, p := range s.Protocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// Probe fingerprints the server of addr without credentials: it negotiates
+// each security protocol alone, reads the MCS connect response over the
+// first of standard RDP and TLS security the server accepts, then
+// disconnects. The dial, timeout and TLS server name options apply
+func Probe(addr string, opts ...Option) (*ServerInfo, error) {
+	c := NewClient(addr, opts...)
+	addr, err := core.HostPort(c.addr, "3389")
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("dial: %v", err))
+	}
+	info := &ServerInfo{}
+	var mcs *t125.MCSClient
+	for _, protocol := range []uint32{x224.PROTOCOL_RDP, x224.PROTOCOL_SSL, x224.PROTOCOL_HYBRID, x224.PROTOCOL_HYBRID_EX} {
+		nla := protocol == x224.PROTOCOL_HYBRID || protocol == x224.PROTOCOL_HYBRID_EX
+		accepted, failure, m, err := c.probe(addr, protocol, mcs == nil && !nla)
+		if err != nil {
+			return nil, err
+		}
+		if accepted {
+			info.Protocols = append(info.Protocols, protocol)
+		}
+		if failure == x224.HYBRID_REQUIRED_BY_SERVER {
+			info.NLARequired = true
+		}
+		if m != nil {
+			mcs, info.Protocol = m, protocol
+		}
+	}
+	if mcs != nil {
+		info.Version = mcs.ServerCoreData().RdpVersion
+		info.EncryptionMethod = mcs.ServerSecurityData().EncryptionMethod
+		info.EncryptionLevel = mcs.ServerSecurityData().EncryptionLevel
+	}
+	return info, nil
+}
+
+// probe negotiates protocol alone over a new connection, accepted tells if
+// the server selected it, failure is its refusal code. With connectResponse
+// it then returns the MCS client holding the server data
+func (c *Client) probe(addr string, protocol uint32, connectResponse bool) (accepted bool, failure x224.NegotiationFailure, mcs *t125.MCSClient, err error) {
+	dialTimeout := c.dialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = c.timeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	conn, err := c.dialer(ctx, "tcp", addr)
+	cancel()
+	if err != nil {
+		return false, 0, nil, errors.New(fmt.Sprintf("dial: %v", err))
+	}
+	defer conn.Close()
+
+	socket := core.NewSocketLayer(conn)
+	if c.tlsServerName != "" {
+		socket.SetTLSConfig(&tls.Config{ServerName: c.tlsServerName, MinVersion: tls.VersionTLS10})
+	}
+	// without credentials NLA stops once the server selected it
+	x := x224.New(tpkt.New(socket, nil))
+	x.SetRequiredProtocol(protocol)
+	result := make(chan error, 1)
+	done := func(err error) {
+		select {
+		case result <- err:
+		default:
+		}
+	}
+	if connectResponse {
+		mcs = t125.NewMCSClient(x)
+		mcs.On("connect-response", func() {
+			done(nil)
+		}).On("error", done)
+	} else {
+		x.On("connect", func(uint32) {
+			done(nil)
+		})
+	}
+	x.On("error", done).On("close", func() {
+		done(errors.New("connection closed"))
+	})
+	if err = x.Connect(); err != nil {
+		return false, 0, nil, err
+	}
+
+	select {
+	case err = <-result:
+	case <-time.After(c.timeout):
+		err = errors.New("timeout")
+	}
+	var protocolErr *x224.ProtocolError
+	switch {
+	case err == nil:
+		return true, 0, mcs, nil
+	case errors.As(err, &protocolErr):
+		return false, protocolErr.Failure, nil, nil
+	case protocol != x224.PROTOCOL_RDP && protocol != x224.PROTOCOL_SSL && errors.Is(err, x224.ErrNLAFailed):
+		return true, 0, nil, nil
+	}
+	return false, 0, nil, errors.New(fmt.Sprintf("probe protocol %d: %v", protocol, err))
+}
@@ -0,0 +1,97 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tomatome/grdp/core"
+	"github.com/tomatome/grdp/protocol/t125"
+	"github.com/tomatome/grdp/protocol/t125/ber"
+	"github.com/tomatome/grdp/protocol/t125/gcc"
+	"github.com/tomatome/grdp/protocol/x224"
+)
+
+// connectResponse returns the tpkt of an MCS connect response of version
+func connectResponse(version gcc.VERSION) []byte {
+	coreData := gcc.NewServerCoreData()
+	coreData.RdpVersion = version
+	networkData := gcc.NewServerNetworkData()
+	networkData.MCSChannelId = t125.MCS_GLOBAL_CHANNEL_ID
+	userData := append(append(coreData.Pack(), gcc.NewServerSecurityData().Pack()...), networkData.Pack()...)
+	resp := t125.NewConnectResponse(gcc.MakeConferenceCreateResponse(userData)).BER()
+	buff := &bytes.Buffer{}
+	ber.WriteApplicationTag(t125.MCS_TYPE_CONNECT_RESPONSE, len(resp), buff)
+	buff.Write(resp)
+	b := append([]byte{0x03, 0x00, 0, 0, 0x02, 0xf0, 0x80}, buff.Bytes()...)
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	return b
+}
+
+// probeDialer answers each request of a protocol with the confirm of
+// confirms, followed by the connect response when it selects PROTOCOL_RDP
+func probeDialer(confirms map[uint32]string) Dialer {
+	return func(ctx context.Context, n, a string) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			header, err := core.ReadBytes(4, server)
+			if err != nil {
+				return
+			}
+			body, _ := core.ReadBytes(int(binary.BigEndian.Uint16(header[2:]))-4, server)
+			confirm, _ := hex.DecodeString(confirms[binary.LittleEndian.Uint32(body[len(body)-4:])])
+			server.Write(confirm)
+			if confirm[11] == byte(x224.TYPE_RDP_NEG_RSP) && confirm[15] == byte(x224.PROTOCOL_RDP) {
+				// the connect initial
+				header, _ = core.ReadBytes(4, server)
+				core.ReadBytes(int(binary.BigEndian.Uint16(header[2:]))-4, server)
+				server.Write(connectResponse(gcc.RDP_VERSION_10_0))
+			}
+			server.Read(make([]byte, 1024))
+		}()
+		return client, nil
+	}
+}
+
+func TestProbe(t *testing.T) {
+	const (
+		selectRDP       = "030000130ed000000000000200080000000000"
+		selectHybrid    = "030000130ed000000000000200080002000000"
+		hybridRequired  = "030000130ed000000000000300080005000000"
+		sslNotAllowed   = "030000130ed000000000000300080002000000"
+		sslCertNotFound = "030000130ed000000000000300080003000000"
+	)
+	info, err := Probe("127.0.0.1", WithTimeout(time.Second), WithDialer(probeDialer(map[uint32]string{
+		x224.PROTOCOL_RDP:    hybridRequired,
+		x224.PROTOCOL_SSL:    hybridRequired,
+		x224.PROTOCOL_HYBRID: selectHybrid,
+		// the server falls back to PROTOCOL_HYBRID
+		x224.PROTOCOL_HYBRID_EX: selectHybrid,
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(info, &ServerInfo{Protocols: []uint32{x224.PROTOCOL_HYBRID}, NLARequired: true}) {
+		t.Errorf("get %+v", info)
+	}
+
+	info, err = Probe("127.0.0.1", WithTimeout(time.Second), WithDialer(probeDialer(map[uint32]string{
+		x224.PROTOCOL_RDP:       selectRDP,
+		x224.PROTOCOL_SSL:       sslCertNotFound,
+		x224.PROTOCOL_HYBRID:    sslNotAllowed,
+		x224.PROTOCOL_HYBRID_EX: sslNotAllowed,
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Accepts(x224.PROTOCOL_RDP) || len(info.Protocols) != 1 || info.NLARequired || info.Protocol != x224.PROTOCOL_RDP ||
+		info.Version != gcc.RDP_VERSION_10_0 {
+		t.Errorf("get %+v", info)
+	}
+}
@@ -0,0 +1,156 @@
+package client
+
+import (
+	"errors"
+	"image"
+	"sync"
+	"time"
+
+	"github.com/tomatome/grdp/protocol/pdu"
+)
+
+// screen is the framebuffer painted by the "bitmap" rectangles, pixels
+// never painted keep a zero alpha
+type screen struct {
+	lock    sync.Mutex
+	img     *image.RGBA
+	palette []uint32
+	painted int
+	// closed once every pixel was painted
+	full chan struct{}
+}
+
+func newScreen(width, height int) *screen {
+	return &screen{
+		img:  image.NewRGBA(image.Rect(0, 0, width, height)),
+		full: make(chan struct{}),
+	}
+}
+
+func (s *screen) setPalette(colors []uint32) {
+	s.lock.Lock()
+	s.palette = colors
+	s.lock.Unlock()
+}
+
+// rgb returns the color of the little endian pixel p of bpp
+func (s *screen) rgb(bpp uint16, p []byte) (r, g, b byte) {
+	switch bpp {
+	case 8:
+		if int(p[0]) < len(s.palette) {
+			c := s.palette[p[0]]
+			return byte(c >> 16), byte(c >> 8), byte(c)
+		}
+	case 15:
+		v := uint16(p[0]) | uint16(p[1])<<8
+		return expand5(v >> 10), expand5(v >> 5), expand5(v)
+	case 16:
+		v := uint16(p[0]) | uint16(p[1])<<8
+		return expand5(v >> 11), expand6(v >> 5), expand5(v)
+	default:
+		// 24 bpp and the 32 bpp BGRX
+		return p[2], p[1], p[0]
+	}
+	return 0, 0, 0
+}
+
+// expand5 scales the low 5 bits of v to 8 bits, 0x1f gives 0xff
+func expand5(v uint16) byte {
+	c := byte(v & 0x1f)
+	return c<<3 | c>>2
+}
+
+// expand6 scales the low 6 bits of v to 8 bits
+func expand6(v uint16) byte {
+	c := byte(v & 0x3f)
+	return c<<2 | c>>4
+}
+
+// stride returns the row length of the pixels of rect, 0 if they are too short
+func stride(rect *pdu.BitmapData) int {
+	bpp := rect.BytesPerPixel()
+	h := int(rect.Height)
+	if bpp == 0 || h == 0 {
+		return 0
+	}
+	// uncompressed rows are padded to 4 bytes
+	stride := int(rect.Width) * bpp
+	if len(rect.Pixels)%h == 0 && len(rect.Pixels)/h >= stride {
+		stride = len(rect.Pixels) / h
+	}
+	if len(rect.Pixels) < stride*h {
+		return 0
+	}
+	return stride
+}
+
+// set paints the pixel at offset i
+func (s *screen) set(i int, r, g, b byte) {
+	if s.img.Pix[i+3] == 0 {
+		s.painted++
+	}
+	s.img.Pix[i], s.img.Pix[i+1], s.img.Pix[i+2], s.img.Pix[i+3] = r, g, b, 0xff
+}
+
+// checkFull closes full once every pixel was painted
+func (s *screen) checkFull() {
+	bounds := s.img.Bounds()
+	if s.painted == bounds.Dx()*bounds.Dy() {
+		select {
+		case <-s.full:
+		default:
+			close(s.full)
+		}
+	}
+}
+
+// draw paints the decoded bottom up rectangles, clipped to the screen
+func (s *screen) draw(rectangles []pdu.BitmapData) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	bounds := s.img.Bounds()
+	for _, rect := range rectangles {
+		stride := stride(&rect)
+		if stride == 0 {
+			continue
+		}
+		bpp, h := rect.BytesPerPixel(), int(rect.Height)
+		w := int(rect.DestRight) - int(rect.DestLeft) + 1
+		if w > int(rect.Width) {
+			w = int(rect.Width)
+		}
+		if dh := int(rect.DestBottom) - int(rect.DestTop) + 1; dh < h {
+			h = dh
+		}
+		for y := 0; y < h; y++ {
+			dy := int(rect.DestTop) + y
+			if dy >= bounds.Max.Y {
+				break
+			}
+			row := rect.Pixels[(int(rect.Height)-1-y)*stride:]
+			for x := 0; x < w; x++ {
+				dx := int(rect.DestLeft) + x
+				if dx >= bounds.Max.X {
+					break
+				}
+				r, g, b := s.rgb(rect.BitsPerPixel, row[x*bpp:])
+				s.set(s.img.PixOffset(dx, dy), r, g, b)
+			}
+		}
+	}
+	s.checkFull()
+}
+
+// snapshot waits until the screen was fully painted and returns a copy of it
+func (s *screen) snapshot(timeout time.Duration) (*image.RGBA, error) {
+	select {
+	case <-s.full:
+	case <-time.After(timeout):
+		return nil, errors.New("timeout waiting for a full screen update")
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	img := image.NewRGBA(s.img.Bounds())
+	copy(img.Pix, s.img.Pix)
+	return img, nil
+}
@@ -0,0 +1,124 @@
+package client
+
+import (
+	"bytes"
+	"encoding/hex"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"testing"
+	"time"
+
+	"github.com/tomatome/grdp/protocol/pdu"
+)
+
+func TestScreenSnapshot(t *testing.T) {
+	s := newScreen(4, 2)
+	// 16 bpp left half, bottom row red then top row green and blue
+	s.draw([]pdu.BitmapData{{DestLeft: 0, DestTop: 0, DestRight: 1, DestBottom: 1, Width: 2, Height: 2,
+		BitsPerPixel: 16, Pixels: []byte{0x00, 0xf8, 0x00, 0xf8, 0xe0, 0x07, 0x1f, 0x00}}})
+	if _, err := s.snapshot(10 * time.Millisecond); err == nil {
+		t.Fatal("snapshot of a half painted screen")
+	}
+
+	// 8 bpp right half of a 4 pixels wide bitmap, only 2 are on screen
+	s.setPalette([]uint32{0x000000, 0x102030})
+	s.draw([]pdu.BitmapData{{DestLeft: 2, DestTop: 0, DestRight: 3, DestBottom: 1, Width: 4, Height: 2,
+		BitsPerPixel: 8, Pixels: []byte{0, 0, 9, 9, 1, 1, 9, 9}}})
+	img, err := s.snapshot(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := "00ff00ff" + "0000ffff" + "102030ff" + "102030ff" +
+		"ff0000ff" + "ff0000ff" + "000000ff" + "000000ff"
+	if hex.EncodeToString(img.Pix) != expect {
+		t.Errorf("get %x", img.Pix)
+	}
+}
+
+func TestSaveScreenshot(t *testing.T) {
+	s := newScreen(3, 1)
+	// white at 15, 24 and 32 bpp
+	s.draw([]pdu.BitmapData{
+		{DestLeft: 0, DestRight: 0, Width: 1, Height: 1, BitsPerPixel: 15, Pixels: []byte{0xff, 0x7f}},
+		{DestLeft: 1, DestRight: 1, Width: 1, Height: 1, BitsPerPixel: 24, Pixels: []byte{0xff, 0xff, 0xff}},
+		{DestLeft: 2, DestRight: 2, Width: 1, Height: 1, BitsPerPixel: 32, Pixels: []byte{0xff, 0xff, 0xff, 0}},
+	})
+	c := &Client{screen: s, timeout: time.Second}
+
+	buff := &bytes.Buffer{}
+	if err := c.SaveScreenshot(buff, PNG); err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for x := 0; x < 3; x++ {
+		if r, g, b, a := img.At(x, 0).RGBA(); r != 0xffff || g != 0xffff || b != 0xffff || a != 0xffff {
+			t.Errorf("pixel %d is %x %x %x %x", x, r, g, b, a)
+		}
+	}
+
+	buff.Reset()
+	if err = c.SaveScreenshot(buff, JPEG); err != nil {
+		t.Fatal(err)
+	}
+	if img, err = jpeg.Decode(buff); err != nil || img.Bounds().Dx() != 3 {
+		t.Errorf("bad jpeg %v", err)
+	}
+}
+
+func TestScreenApplyOrders(t *testing.T) {
+	s := newScreen(4, 2)
+	red := pdu.Color{BitsPerPixel: 24, Value: 0x0000ff}
+	bounds := image.Rect(0, 0, 4, 1)
+	dirty := s.apply([]pdu.PrimaryOrder{
+		{DrawingOrder: &pdu.OpaqueRect{Width: 4, Height: 2, Color: red}},
+		// blue 16 bpp bitmap pixel at 0, 1
+		{DrawingOrder: &pdu.MemBlt{Top: 1, Width: 1, Height: 1, Rop: 0xcc,
+			Bitmap: &pdu.BitmapData{Width: 1, Height: 1, BitsPerPixel: 16, Pixels: []byte{0x1f, 0x00}}}},
+		// copies it to 3, 1
+		{DrawingOrder: &pdu.ScrBlt{Left: 3, Top: 1, Width: 1, Height: 1, Rop: 0xcc}},
+		// DSTINVERT clipped to the top row
+		{DrawingOrder: &pdu.DstBlt{Left: 1, Width: 1, Height: 2, Rop: 0x55}, Bounds: &bounds},
+	})
+	if dirty != image.Rect(0, 0, 4, 2) {
+		t.Error("bad dirty area", dirty)
+	}
+	img, err := s.snapshot(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := "ff0000ff" + "00ffffff" + "ff0000ff" + "ff0000ff" +
+		"0000ffff" + "ff0000ff" + "ff0000ff" + "ff0000ff"
+	if hex.EncodeToString(img.Pix) != expect {
+		t.Errorf("get %x", img.Pix)
+	}
+
+	// text in white, the glyph is a 2x2 diagonal
+	glyph := &pdu.Glyph{Width: 2, Height: 2, Mask: []byte{0x80, 0x40, 0, 0}}
+	dirty = s.apply([]pdu.PrimaryOrder{{DrawingOrder: &pdu.GlyphIndex{
+		BackColor: pdu.Color{BitsPerPixel: 24, Value: 0xffffff},
+		BkRight:   3, BkBottom: 1,
+		Glyphs: []pdu.GlyphPlacement{{X: 2, Y: 0, Glyph: glyph}},
+	}}})
+	if dirty != image.Rect(2, 0, 4, 2) {
+		t.Error("bad glyph area", dirty)
+	}
+	b := s.rectangle(dirty)
+	if b.DestLeft != 2 || b.Width != 2 || b.BitsPerPixel != 32 ||
+		hex.EncodeToString(b.Pixels) != "0000ffff"+"ffffffff"+"ffffffff"+"0000ffff" {
+		t.Errorf("bad rectangle %+v", b)
+	}
+}
+
+func TestRop3(t *testing.T) {
+	for _, c := range []struct {
+		rop, expect byte
+	}{{0xcc, 0x0f}, {0xf0, 0x33}, {0x55, 0xaa}, {0x66, 0x5a}, {0x00, 0x00}, {0xff, 0xff}} {
+		if v := rop3(c.rop, 0x33, 0x0f, 0x55); v != c.expect {
+			t.Errorf("rop 0x%02x gives 0x%02x, expect 0x%02x", c.rop, v, c.expect)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+//go:build go1.21
+
+package client
+
+import (
+	"log/slog"
+
+	"github.com/tomatome/grdp/glog"
+)
+
+// SetSlogger routes the logs of every layer to l, with a layer field and
+// the level of its handler, instead of glog. The logger is global, l gets
+// the logs of every client of the process
+func SetSlogger(l *slog.Logger) {
+	glog.SetSlogger(l)
+}
@@ -0,0 +1,38 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// HostPort returns addr as host:port to dial, with defaultPort when addr
+// has none, IPv6 literals may be bracketed like [::1]:3389 or bare like ::1
+func HostPort(addr, defaultPort string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, ""
+		if strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]") {
+			host = addr[1 : len(addr)-1]
+		}
+		if strings.ContainsAny(host, "[]") || (strings.Contains(host, ":") && !isIPv6(host)) {
+			return "", errors.New(fmt.Sprintf("invalid address %s", addr))
+		}
+	}
+	if host == "" {
+		return "", errors.New(fmt.Sprintf("missing host in address %s", addr))
+	}
+	if port == "" {
+		port = defaultPort
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// isIPv6 tells whether host is an IPv6 literal, with an optional zone
+func isIPv6(host string) bool {
+	if i := strings.LastIndex(host, "%"); i > 0 {
+		host = host[:i]
+	}
+	return net.ParseIP(host) != nil
+}
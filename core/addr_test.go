@@ -0,0 +1,35 @@
+package core_test
+
+import (
+	"testing"
+
+	"github.com/tomatome/grdp/core"
+)
+
+func TestHostPort(t *testing.T) {
+	for _, c := range []struct {
+		addr, expect string
+	}{
+		{"10.0.0.1:3390", "10.0.0.1:3390"},
+		{"10.0.0.1", "10.0.0.1:3389"},
+		{"rdp.example.com:443", "rdp.example.com:443"},
+		{"rdp.example.com", "rdp.example.com:3389"},
+		{"[::1]:3390", "[::1]:3390"},
+		{"[::1]", "[::1]:3389"},
+		{"[::1]:", "[::1]:3389"},
+		{"::1", "[::1]:3389"},
+		{"fe80::1%eth0", "[fe80::1%eth0]:3389"},
+		{"2001:db8::10", "[2001:db8::10]:3389"},
+	} {
+		result, err := core.HostPort(c.addr, "3389")
+		if err != nil || result != c.expect {
+			t.Errorf("get %s %v for %s, expect %s", result, err, c.addr, c.expect)
+		}
+	}
+
+	for _, addr := range []string{"", ":3389", "host:1:2", "[::1", "[[::1]]"} {
+		if result, err := core.HostPort(addr, "3389"); err == nil {
+			t.Errorf("expect error for %q, get %s", addr, result)
+		}
+	}
+}
@@ -24,12 +24,18 @@ func ReadBytes(len int, r io.Reader) ([]byte, error) {
 
 func ReadByte(r io.Reader) (byte, error) {
 	b, err := ReadBytes(1, r)
-	return b[0], err
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
 }
 
 func ReadUInt8(r io.Reader) (uint8, error) {
 	b, err := ReadBytes(1, r)
-	return uint8(b[0]), err
+	if err != nil {
+		return 0, err
+	}
+	return uint8(b[0]), nil
 }
 
 func ReadUint16LE(r io.Reader) (uint16, error) {
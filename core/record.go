@@ -0,0 +1,177 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/tomatome/grdp/emission"
+)
+
+/**
+ * Recorded sessions are a sequence of frames, one per PDU
+ * direction uint8, 0 for Inbound and 1 for Outbound
+ * length  uint32 big endian
+ * data    length bytes
+ */
+
+// WriteFrame appends the frame of b to w
+func WriteFrame(dir Direction, b []byte, w io.Writer) error {
+	buff := &bytes.Buffer{}
+	WriteUInt8(uint8(dir), buff)
+	WriteUInt32BE(uint32(len(b)), buff)
+	buff.Write(b)
+	_, err := w.Write(buff.Bytes())
+	return err
+}
+
+// ReadFrame reads the next frame of r, io.EOF once r ends between frames
+func ReadFrame(r io.Reader) (Direction, []byte, error) {
+	dir, err := ReadUInt8(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if Direction(dir) != Inbound && Direction(dir) != Outbound {
+		return 0, nil, errors.New(fmt.Sprintf("invalid frame direction %d", dir))
+	}
+	header, err := ReadBytes(4, r)
+	if err != nil {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	b, err := ReadBytes(int(binary.BigEndian.Uint32(header)), r)
+	if err != nil {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	return Direction(dir), b, nil
+}
+
+// RecordTransport tees the "data" events and the writes of a transport
+// to w, so that ReplayTransport plays them back, the "data" listeners run
+// once the frame is recorded so that their writes follow it
+type RecordTransport struct {
+	Transport
+	// emitter of t returned to chain calls, data of the "data" listeners
+	emitter *emission.Emitter
+	data    *emission.Emitter
+	lock    sync.Mutex
+	w       io.Writer
+	err     error
+}
+
+func NewRecordTransport(t Transport, w io.Writer) *RecordTransport {
+	r := &RecordTransport{Transport: t, data: emission.NewEmitter(), w: w}
+	r.emitter = t.On("data", func(s []byte) {
+		r.record(Inbound, s)
+		r.data.Emit("data", s)
+	})
+	return r
+}
+
+func (r *RecordTransport) On(event, listener interface{}) *emission.Emitter {
+	if event == "data" {
+		r.data.On(event, listener)
+		return r.emitter
+	}
+	return r.Transport.On(event, listener)
+}
+
+func (r *RecordTransport) Once(event, listener interface{}) *emission.Emitter {
+	if event == "data" {
+		r.data.Once(event, listener)
+		return r.emitter
+	}
+	return r.Transport.Once(event, listener)
+}
+
+func (r *RecordTransport) RemoveListener(event, listener interface{}) *emission.Emitter {
+	if event == "data" {
+		r.data.RemoveListener(event, listener)
+		return r.emitter
+	}
+	if l, ok := r.Transport.(ListenerRemover); ok {
+		return l.RemoveListener(event, listener)
+	}
+	return r.emitter
+}
+
+func (r *RecordTransport) SetReadTimeout(d time.Duration) {
+	if t, ok := r.Transport.(TimeoutSetter); ok {
+		t.SetReadTimeout(d)
+	}
+}
+
+func (r *RecordTransport) SetWriteTimeout(d time.Duration) {
+	if t, ok := r.Transport.(TimeoutSetter); ok {
+		t.SetWriteTimeout(d)
+	}
+}
+
+func (r *RecordTransport) record(dir Direction, b []byte) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.err == nil {
+		r.err = WriteFrame(dir, b, r.w)
+	}
+}
+
+func (r *RecordTransport) Write(b []byte) (n int, err error) {
+	r.record(Outbound, b)
+	return r.Transport.Write(b)
+}
+
+// Err returns the first error writing the record
+func (r *RecordTransport) Err() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.err
+}
+
+// ReplayTransport plays a record of RecordTransport, the inbound frames
+// as "data" events, the writes are dropped
+type ReplayTransport struct {
+	emission.Emitter
+	r io.Reader
+}
+
+func NewReplayTransport(r io.Reader) *ReplayTransport {
+	return &ReplayTransport{Emitter: *emission.NewEmitter(), r: r}
+}
+
+// Replay emits every inbound frame in order then "close", it returns
+// once the listeners handled them, or on the first bad frame
+func (t *ReplayTransport) Replay() error {
+	for {
+		dir, b, err := ReadFrame(t.r)
+		if err == io.EOF {
+			t.Emit("close")
+			return nil
+		}
+		if err != nil {
+			t.Emit("error", err)
+			return err
+		}
+		if dir == Inbound {
+			t.Emit("data", b)
+		}
+	}
+}
+
+func (t *ReplayTransport) Read(b []byte) (n int, err error) {
+	return 0, io.EOF
+}
+
+func (t *ReplayTransport) Write(b []byte) (n int, err error) {
+	return len(b), nil
+}
+
+func (t *ReplayTransport) Close() error {
+	return nil
+}
+
+func (t *ReplayTransport) SetReadTimeout(d time.Duration) {}
+
+func (t *ReplayTransport) SetWriteTimeout(d time.Duration) {}
@@ -0,0 +1,42 @@
+package core_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/tomatome/grdp/core"
+)
+
+func TestRecordReplay(t *testing.T) {
+	session := &bytes.Buffer{}
+	core.WriteFrame(core.Inbound, []byte{0x2e, 0x00}, session)
+	core.WriteFrame(core.Outbound, []byte{0x28}, session)
+	core.WriteFrame(core.Inbound, []byte{0x3e}, session)
+
+	replay := core.NewReplayTransport(bytes.NewReader(session.Bytes()))
+	record := &bytes.Buffer{}
+	tr := core.NewRecordTransport(replay, record)
+	closed := false
+	tr.On("data", func(s []byte) {
+		if s[0] == 0x2e {
+			tr.Write([]byte{0x28})
+		}
+	}).On("close", func() {
+		closed = true
+	})
+	if err := replay.Replay(); err != nil {
+		t.Fatal(err)
+	}
+	if !closed || tr.Err() != nil {
+		t.Error("replay not closed", tr.Err())
+	}
+	// the write lands after the inbound frame it answers
+	if !bytes.Equal(record.Bytes(), session.Bytes()) {
+		t.Errorf("record %s not equals to %s", hex.EncodeToString(record.Bytes()), hex.EncodeToString(session.Bytes()))
+	}
+
+	if err := core.NewReplayTransport(bytes.NewReader([]byte{0x00, 0x00})).Replay(); err == nil {
+		t.Error("expect error on truncated frame")
+	}
+}
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"errors"
 	"fmt"
 	"unsafe"
 )
@@ -852,3 +853,300 @@ func Decompress(input []uint8, width, height int, Bpp int) []uint8 {
 
 	return output
 }
+
+/**
+ * interleaved RLE order codes
+ * @see MS-RDPBCGR 2.2.9.1.1.3.1.2.4 RLE Compressed Bitmap Stream
+ */
+const (
+	REGULAR_BG_RUN           = 0x00
+	MEGA_MEGA_BG_RUN         = 0xF0
+	REGULAR_FG_RUN           = 0x01
+	MEGA_MEGA_FG_RUN         = 0xF1
+	LITE_SET_FG_FG_RUN       = 0x0C
+	MEGA_MEGA_SET_FG_RUN     = 0xF6
+	LITE_DITHERED_RUN        = 0x0E
+	MEGA_MEGA_DITHERED_RUN   = 0xF8
+	REGULAR_COLOR_RUN        = 0x03
+	MEGA_MEGA_COLOR_RUN      = 0xF3
+	REGULAR_FGBG_IMAGE       = 0x02
+	MEGA_MEGA_FGBG_IMAGE     = 0xF2
+	LITE_SET_FG_FGBG_IMAGE   = 0x0D
+	MEGA_MEGA_SET_FGBG_IMAGE = 0xF7
+	REGULAR_COLOR_IMAGE      = 0x04
+	MEGA_MEGA_COLOR_IMAGE    = 0xF4
+	SPECIAL_FGBG_1           = 0xF9
+	SPECIAL_FGBG_2           = 0xFA
+	SPECIAL_WHITE            = 0xFD
+	SPECIAL_BLACK            = 0xFE
+)
+
+type rleDecoder struct {
+	in    []byte
+	out   []byte
+	pos   int
+	bpp   int
+	row   int
+	fg    []byte
+	white []byte
+	black []byte
+}
+
+func (d *rleDecoder) readByte() (int, error) {
+	if len(d.in) < 1 {
+		return 0, errors.New("rle: truncated input")
+	}
+	b := d.in[0]
+	d.in = d.in[1:]
+	return int(b), nil
+}
+
+func (d *rleDecoder) readPixel() ([]byte, error) {
+	if len(d.in) < d.bpp {
+		return nil, errors.New("rle: truncated input")
+	}
+	p := d.in[:d.bpp]
+	d.in = d.in[d.bpp:]
+	return p, nil
+}
+
+// write puts pixel p, xored with the pixel above when xor is set
+func (d *rleDecoder) write(p []byte, xor bool) error {
+	if d.pos+d.bpp > len(d.out) {
+		return errors.New("rle: output overflow")
+	}
+	for i := 0; i < d.bpp; i++ {
+		v := p[i]
+		if xor {
+			v ^= d.out[d.pos-d.row+i]
+		}
+		d.out[d.pos+i] = v
+	}
+	d.pos += d.bpp
+	return nil
+}
+
+// writeAbove copies the pixel above, black on the first scanline
+func (d *rleDecoder) writeAbove(firstLine bool) error {
+	if firstLine {
+		return d.write(d.black, false)
+	}
+	return d.write(d.black, true)
+}
+
+// writeFg puts the foreground pixel, xored with the pixel above past the first scanline
+func (d *rleDecoder) writeFg(firstLine bool) error {
+	return d.write(d.fg, !firstLine)
+}
+
+func (d *rleDecoder) writeFgBg(mask, count int, firstLine bool) error {
+	for i := 0; i < count; i++ {
+		var err error
+		if mask&(1<<uint(i)) != 0 {
+			err = d.writeFg(firstLine)
+		} else {
+			err = d.writeAbove(firstLine)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rleOrder returns the order code of header byte b
+func rleOrder(b int) int {
+	if b&0xC0 != 0xC0 {
+		return b >> 5
+	}
+	if b&0xF0 == 0xF0 {
+		return b
+	}
+	return b >> 4
+}
+
+// runLength extracts the run length of order code from header byte b
+func (d *rleDecoder) runLength(code, b int) (int, error) {
+	switch code {
+	case REGULAR_FGBG_IMAGE, LITE_SET_FG_FGBG_IMAGE:
+		mask := 0x1F
+		if code == LITE_SET_FG_FGBG_IMAGE {
+			mask = 0x0F
+		}
+		if n := b & mask; n != 0 {
+			return n * 8, nil
+		}
+		n, err := d.readByte()
+		return n + 1, err
+	case REGULAR_BG_RUN, REGULAR_FG_RUN, REGULAR_COLOR_RUN, REGULAR_COLOR_IMAGE:
+		if n := b & 0x1F; n != 0 {
+			return n, nil
+		}
+		n, err := d.readByte()
+		return n + 32, err
+	case LITE_SET_FG_FG_RUN, LITE_DITHERED_RUN:
+		if n := b & 0x0F; n != 0 {
+			return n, nil
+		}
+		n, err := d.readByte()
+		return n + 16, err
+	}
+	lo, err := d.readByte()
+	if err != nil {
+		return 0, err
+	}
+	hi, err := d.readByte()
+	return lo | hi<<8, err
+}
+
+/**
+ * DecompressRLE decodes an interleaved RLE bitmap of 8, 15, 16 or 24 bpp,
+ * pixels are little endian and rows bottom up as sent by the server
+ * @see MS-RDPBCGR 3.1.9 Interleaved RLE-Based Bitmap Codec
+ */
+func DecompressRLE(data []byte, width, height, bpp int) ([]byte, error) {
+	d := &rleDecoder{in: data}
+	switch bpp {
+	case 8:
+		d.bpp, d.white = 1, []byte{0xff}
+	case 15:
+		d.bpp, d.white = 2, []byte{0xff, 0x7f}
+	case 16:
+		d.bpp, d.white = 2, []byte{0xff, 0xff}
+	case 24:
+		d.bpp, d.white = 3, []byte{0xff, 0xff, 0xff}
+	default:
+		return nil, errors.New(fmt.Sprintf("rle: unsupported color depth %d", bpp))
+	}
+	if width <= 0 || height <= 0 {
+		return nil, errors.New(fmt.Sprintf("rle: invalid size %dx%d", width, height))
+	}
+	d.row = width * d.bpp
+	d.out = make([]byte, d.row*height)
+	d.black = make([]byte, d.bpp)
+	d.fg = d.white
+
+	insertFg, firstLine := false, true
+	for len(d.in) > 0 {
+		if firstLine && d.pos >= d.row {
+			// a background run past the first line starts with no foreground pixel
+			firstLine, insertFg = false, false
+		}
+		b, _ := d.readByte()
+		code := rleOrder(b)
+		if code == REGULAR_BG_RUN || code == MEGA_MEGA_BG_RUN {
+			if err := d.backgroundRun(code, b, insertFg, firstLine); err != nil {
+				return nil, err
+			}
+			// a following background run starts with a foreground pixel
+			insertFg = true
+			continue
+		}
+		insertFg = false
+		if err := d.order(code, b, firstLine); err != nil {
+			return nil, err
+		}
+	}
+	if d.pos != len(d.out) {
+		return nil, errors.New(fmt.Sprintf("rle: %d of %d bytes decoded", d.pos, len(d.out)))
+	}
+	return d.out, nil
+}
+
+func (d *rleDecoder) backgroundRun(code, b int, insertFg, firstLine bool) error {
+	n, err := d.runLength(code, b)
+	if err != nil {
+		return err
+	}
+	if insertFg && n > 0 {
+		if err = d.writeFg(firstLine); err != nil {
+			return err
+		}
+		n--
+	}
+	for ; n > 0; n-- {
+		if err = d.writeAbove(firstLine); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// order decodes every order but the background run
+func (d *rleDecoder) order(code, b int, firstLine bool) error {
+	switch code {
+	case SPECIAL_FGBG_1:
+		return d.writeFgBg(0x03, 8, firstLine)
+	case SPECIAL_FGBG_2:
+		return d.writeFgBg(0x05, 8, firstLine)
+	case SPECIAL_WHITE:
+		return d.write(d.white, false)
+	case SPECIAL_BLACK:
+		return d.write(d.black, false)
+	case REGULAR_FG_RUN, MEGA_MEGA_FG_RUN, LITE_SET_FG_FG_RUN, MEGA_MEGA_SET_FG_RUN,
+		LITE_DITHERED_RUN, MEGA_MEGA_DITHERED_RUN, REGULAR_COLOR_RUN, MEGA_MEGA_COLOR_RUN,
+		REGULAR_FGBG_IMAGE, MEGA_MEGA_FGBG_IMAGE, LITE_SET_FG_FGBG_IMAGE, MEGA_MEGA_SET_FGBG_IMAGE,
+		REGULAR_COLOR_IMAGE, MEGA_MEGA_COLOR_IMAGE:
+	default:
+		return errors.New(fmt.Sprintf("rle: invalid order 0x%x", b))
+	}
+
+	n, err := d.runLength(code, b)
+	if err != nil {
+		return err
+	}
+	switch code {
+	case LITE_SET_FG_FG_RUN, MEGA_MEGA_SET_FG_RUN, LITE_SET_FG_FGBG_IMAGE, MEGA_MEGA_SET_FGBG_IMAGE:
+		if d.fg, err = d.readPixel(); err != nil {
+			return err
+		}
+	}
+
+	switch code {
+	case REGULAR_FG_RUN, MEGA_MEGA_FG_RUN, LITE_SET_FG_FG_RUN, MEGA_MEGA_SET_FG_RUN:
+		for ; n > 0 && err == nil; n-- {
+			err = d.writeFg(firstLine)
+		}
+	case LITE_DITHERED_RUN, MEGA_MEGA_DITHERED_RUN:
+		var pa, pb []byte
+		if pa, err = d.readPixel(); err != nil {
+			return err
+		}
+		if pb, err = d.readPixel(); err != nil {
+			return err
+		}
+		for ; n > 0 && err == nil; n-- {
+			if err = d.write(pa, false); err == nil {
+				err = d.write(pb, false)
+			}
+		}
+	case REGULAR_COLOR_RUN, MEGA_MEGA_COLOR_RUN:
+		var p []byte
+		if p, err = d.readPixel(); err != nil {
+			return err
+		}
+		for ; n > 0 && err == nil; n-- {
+			err = d.write(p, false)
+		}
+	case REGULAR_FGBG_IMAGE, MEGA_MEGA_FGBG_IMAGE, LITE_SET_FG_FGBG_IMAGE, MEGA_MEGA_SET_FGBG_IMAGE:
+		for ; n > 0 && err == nil; n -= 8 {
+			var mask int
+			if mask, err = d.readByte(); err != nil {
+				return err
+			}
+			count := 8
+			if n < 8 {
+				count = n
+			}
+			err = d.writeFgBg(mask, count, firstLine)
+		}
+	case REGULAR_COLOR_IMAGE, MEGA_MEGA_COLOR_IMAGE:
+		for ; n > 0 && err == nil; n-- {
+			var p []byte
+			if p, err = d.readPixel(); err == nil {
+				err = d.write(p, false)
+			}
+		}
+	}
+	return err
+}
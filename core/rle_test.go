@@ -2,13 +2,110 @@
 package core
 
 import (
-	"fmt"
+	"bytes"
+	"testing"
 )
 
-func TestSum() {
+// 64x64 16 bpp bitmap captured from a server
+var rleInput = []byte{
+	192, 44, 200, 8, 132, 200, 8, 200, 8, 200, 8, 200, 8, 0, 19, 132, 232, 8, 12, 50, 142, 66, 77, 58, 208, 59, 225, 25, 1, 0, 0, 0, 0, 0, 0, 0, 132, 139, 33, 142, 66, 142, 66, 142, 66, 208, 59, 4, 43, 1, 0, 0, 0, 0, 0, 0, 0, 132, 203, 41, 142, 66, 142, 66, 142, 66, 208, 59, 96, 0, 1, 0, 0, 0, 0, 0, 0, 0, 132, 9, 17, 142, 66, 142, 66, 142, 66, 208, 59, 230, 27, 1, 0, 0, 0, 0, 0, 0, 0, 132, 200, 8, 9, 17, 139, 33, 74, 25, 243, 133, 14, 200, 8, 132, 200, 8, 200, 8, 200, 8, 200, 8,
+}
+
+func TestSum(t *testing.T) {
+	out, err := DecompressRLE(rleInput, 64, 64, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// decompress2 writes rows top down in big endian
+	ref := Decompress(rleInput, 64, 64, 2)
+	row := 64 * 2
+	for y := 0; y < 64; y++ {
+		for x := 0; x < row; x += 2 {
+			i, j := y*row+x, (63-y)*row+x
+			if out[i] != ref[j+1] || out[i+1] != ref[j] {
+				t.Fatalf("pixel %d,%d: %x, expect %x", x/2, y, out[i:i+2], ref[j:j+2])
+			}
+		}
+	}
+}
+
+func TestDecompressRLEOrders(t *testing.T) {
 	input := []byte{
-		192, 44, 200, 8, 132, 200, 8, 200, 8, 200, 8, 200, 8, 0, 19, 132, 232, 8, 12, 50, 142, 66, 77, 58, 208, 59, 225, 25, 1, 0, 0, 0, 0, 0, 0, 0, 132, 139, 33, 142, 66, 142, 66, 142, 66, 208, 59, 4, 43, 1, 0, 0, 0, 0, 0, 0, 0, 132, 203, 41, 142, 66, 142, 66, 142, 66, 208, 59, 96, 0, 1, 0, 0, 0, 0, 0, 0, 0, 132, 9, 17, 142, 66, 142, 66, 142, 66, 208, 59, 230, 27, 1, 0, 0, 0, 0, 0, 0, 0, 132, 200, 8, 9, 17, 139, 33, 74, 25, 243, 133, 14, 200, 8, 132, 200, 8, 200, 8, 200, 8, 200, 8,
+		0x64, 0x11, // color run of 4
+		0x02,       // background run of 2, copies the row above
+		0x02,       // background run of 2, starts with above ^ fg (white)
+		0xc1, 0x0f, // set fg to 0x0f and fg run of 1
+		0xfe,             // black
+		0xe1, 0xaa, 0xbb, // dithered run of 1
+	}
+	expect := []byte{
+		0x11, 0x11, 0x11, 0x11,
+		0x11, 0x11, 0xee, 0x11,
+		0x1e, 0x00, 0xaa, 0xbb,
+	}
+	out, err := DecompressRLE(input, 4, 3, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, expect) {
+		t.Errorf("get %x, expect %x", out, expect)
+	}
+
+	// background runs of the first then the second line, the second one
+	// copies the row above without a foreground pixel
+	out, err = DecompressRLE([]byte{0x04, 0x04}, 4, 2, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, make([]byte, 8)) {
+		t.Errorf("get %x", out)
+	}
+
+	// special fg/bg image 1 on the first line at 24 bpp
+	out, err = DecompressRLE([]byte{0xf9}, 8, 1, 24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect = append(bytes.Repeat([]byte{0xff}, 6), make([]byte, 18)...)
+	if !bytes.Equal(out, expect) {
+		t.Errorf("get %x, expect %x", out, expect)
+	}
+
+	// mega mega color image of 2 pixels at 15 bpp
+	out, err = DecompressRLE([]byte{0xf4, 0x02, 0x00, 0x01, 0x02, 0x03, 0x04}, 2, 1, 15)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, []byte{0x01, 0x02, 0x03, 0x04}) {
+		t.Errorf("get %x", out)
+	}
+}
+
+func TestDecompressRLEInvalid(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		input []byte
+		bpp   int
+	}{
+		{"truncated", []byte{0x64}, 8},
+		{"overflow", []byte{0x65, 0x11}, 8},
+		{"short", []byte{0x63, 0x11}, 8},
+		{"order", []byte{0xa1}, 8},
+		{"depth", []byte{0x64, 0x11}, 32},
+	} {
+		if _, err := DecompressRLE(c.input, 4, 1, c.bpp); err == nil {
+			t.Error(c.name, "accepted")
+		}
+	}
+}
+
+func BenchmarkBitmapDecompress(b *testing.B) {
+	b.SetBytes(64 * 64 * 2)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := DecompressRLE(rleInput, 64, 64, 16); err != nil {
+			b.Fatal(err)
+		}
 	}
-	out := decompress(input, 64, 64, 2)
-	fmt.Println(out)
 }
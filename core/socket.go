@@ -9,13 +9,18 @@ import (
 	//"crypto/tls"
 	"errors"
 	"net"
+	"sync/atomic"
+	"time"
 
 	"github.com/icodeface/tls"
 )
 
 type SocketLayer struct {
-	conn    net.Conn
-	tlsConn *tls.Conn
+	conn         net.Conn
+	tlsConn      *tls.Conn
+	tlsConfig    *tls.Config
+	readTimeout  int64 // time.Duration, read by the read loop so atomic
+	writeTimeout int64
 }
 
 func NewSocketLayer(conn net.Conn) *SocketLayer {
@@ -27,6 +32,11 @@ func NewSocketLayer(conn net.Conn) *SocketLayer {
 }
 
 func (s *SocketLayer) Read(b []byte) (n int, err error) {
+	if d := time.Duration(atomic.LoadInt64(&s.readTimeout)); d > 0 {
+		if err = s.conn.SetReadDeadline(time.Now().Add(d)); err != nil {
+			return 0, err
+		}
+	}
 	if s.tlsConn != nil {
 		return s.tlsConn.Read(b)
 	}
@@ -34,6 +44,11 @@ func (s *SocketLayer) Read(b []byte) (n int, err error) {
 }
 
 func (s *SocketLayer) Write(b []byte) (n int, err error) {
+	if d := time.Duration(atomic.LoadInt64(&s.writeTimeout)); d > 0 {
+		if err = s.conn.SetWriteDeadline(time.Now().Add(d)); err != nil {
+			return 0, err
+		}
+	}
 	if s.tlsConn != nil {
 		return s.tlsConn.Write(b)
 	}
@@ -50,6 +65,32 @@ func (s *SocketLayer) Close() error {
 	return s.conn.Close()
 }
 
+// SetReadTimeout sets the deadline of each read from now, including a pending one, zero disables
+func (s *SocketLayer) SetReadTimeout(d time.Duration) {
+	atomic.StoreInt64(&s.readTimeout, int64(d))
+	deadline := time.Time{}
+	if d > 0 {
+		deadline = time.Now().Add(d)
+	}
+	s.conn.SetReadDeadline(deadline)
+}
+
+// SetWriteTimeout sets the deadline of each write from now, including a pending one, zero disables
+func (s *SocketLayer) SetWriteTimeout(d time.Duration) {
+	atomic.StoreInt64(&s.writeTimeout, int64(d))
+	deadline := time.Time{}
+	if d > 0 {
+		deadline = time.Now().Add(d)
+	}
+	s.conn.SetWriteDeadline(deadline)
+}
+
+// SetTLSConfig sets the config of the TLS upgrade, nil keeps the default
+// config which skips certificate verification for self-signed hosts
+func (s *SocketLayer) SetTLSConfig(config *tls.Config) {
+	s.tlsConfig = config
+}
+
 func (s *SocketLayer) StartTLS() error {
 	config := &tls.Config{
 		InsecureSkipVerify:       true,
@@ -57,10 +98,30 @@ func (s *SocketLayer) StartTLS() error {
 		MaxVersion:               tls.VersionTLS13,
 		PreferServerCipherSuites: true,
 	}
+	if s.tlsConfig != nil {
+		config = s.tlsConfig.Clone()
+		if config.ServerName == "" && !config.InsecureSkipVerify {
+			host, _, err := net.SplitHostPort(s.conn.RemoteAddr().String())
+			if err != nil {
+				return err
+			}
+			config.ServerName = host
+		}
+	}
 	s.tlsConn = tls.Client(s.conn, config)
 	return s.tlsConn.Handshake()
 }
 
+// TLSState returns the version and cipher suite of the TLS connection,
+// false before StartTLS
+func (s *SocketLayer) TLSState() (version, cipherSuite uint16, ok bool) {
+	if s.tlsConn == nil {
+		return 0, 0, false
+	}
+	state := s.tlsConn.ConnectionState()
+	return state.Version, state.CipherSuite, true
+}
+
 type PublicKey struct {
 	N *big.Int `asn1:"explicit,tag:0"` // modulus
 	E int      `asn1:"explicit,tag:1"` // public exponent
@@ -0,0 +1,59 @@
+package core
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+)
+
+type Direction int
+
+const (
+	Inbound Direction = iota
+	Outbound
+)
+
+func (d Direction) String() string {
+	if d == Outbound {
+		return ">>"
+	}
+	return "<<"
+}
+
+// PacketTracer sees the PDUs of a layer, b must not be kept or modified
+type PacketTracer func(dir Direction, layer string, b []byte)
+
+var (
+	tracer     PacketTracer
+	tracerLock sync.Mutex
+)
+
+// SetPacketTracer traces every PDU read or written by the tpkt, fast path
+// and mcs layers to f, nil disables
+func SetPacketTracer(f PacketTracer) {
+	tracerLock.Lock()
+	defer tracerLock.Unlock()
+	tracer = f
+}
+
+// Trace passes b to the tracer of SetPacketTracer if any
+func Trace(dir Direction, layer string, b []byte) {
+	tracerLock.Lock()
+	f := tracer
+	tracerLock.Unlock()
+	if f != nil {
+		f(dir, layer, b)
+	}
+}
+
+// NewHexTracer returns a tracer writing each PDU to w as a hex dump after
+// a line with its direction, layer and length
+func NewHexTracer(w io.Writer) PacketTracer {
+	var lock sync.Mutex
+	return func(dir Direction, layer string, b []byte) {
+		lock.Lock()
+		defer lock.Unlock()
+		fmt.Fprintf(w, "%s %s %d bytes\n%s", dir, layer, len(b), hex.Dump(b))
+	}
+}
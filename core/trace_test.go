@@ -0,0 +1,22 @@
+package core_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/tomatome/grdp/core"
+)
+
+func TestHexTracer(t *testing.T) {
+	buff := &bytes.Buffer{}
+	core.SetPacketTracer(core.NewHexTracer(buff))
+	defer core.SetPacketTracer(nil)
+
+	core.Trace(core.Outbound, "tpkt", []byte{0x02, 0xf0, 0x80})
+	core.Trace(core.Inbound, "mcs", []byte{0x2e})
+	expected := ">> tpkt 3 bytes\n00000000  02 f0 80                                          |...|\n" +
+		"<< mcs 1 bytes\n00000000  2e                                                |.|\n"
+	if buff.String() != expected {
+		t.Errorf("get %q", buff.String())
+	}
+}
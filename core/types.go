@@ -1,6 +1,14 @@
 package core
 
-import "github.com/tomatome/grdp/emission"
+import (
+	"time"
+
+	"github.com/tomatome/grdp/emission"
+)
+
+// DefaultMaxPDUSize bounds the PDUs of the server, reassembled ones included,
+// to fail rather than allocate on the lengths it declares
+const DefaultMaxPDUSize = 4 * 1024 * 1024
 
 type Transport interface {
 	Read(b []byte) (n int, err error)
@@ -12,6 +20,20 @@ type Transport interface {
 	Emit(event interface{}, arguments ...interface{}) *emission.Emitter
 }
 
+// TimeoutSetter is implemented by the transports which bound every read or
+// write of the underlying conn, zero disables, a timeout fails with
+// os.ErrDeadlineExceeded
+type TimeoutSetter interface {
+	SetReadTimeout(d time.Duration)
+	SetWriteTimeout(d time.Duration)
+}
+
+// ListenerRemover is implemented by the transports whose listeners can be
+// removed, as those embedding emission.Emitter
+type ListenerRemover interface {
+	RemoveListener(event, listener interface{}) *emission.Emitter
+}
+
 type FastPathListener interface {
 	RecvFastPath(secFlag byte, s []byte)
 }
@@ -21,7 +21,8 @@ var ErrNoneFunction = errors.New("Kind of Value for listener is not Func.")
 // RecoveryListener ...
 type RecoveryListener func(interface{}, interface{}, error)
 
-// Emitter ...
+// Emitter is safe for concurrent use, listeners may be added or removed
+// from any goroutine while another one emits.
 type Emitter struct {
 	// Mutex to prevent race conditions within the Emitter.
 	*sync.Mutex
@@ -180,21 +181,26 @@ func (emitter *Emitter) Emit(event interface{}, arguments ...interface{}) *Emitt
 
 ONCES:
 	// execute onces
+	// take the onces before calling them, so that a concurrent Emit does
+	// not run them twice and the ones registered by a listener are kept
 	emitter.Lock()
 	if listeners, ok = emitter.onces[event]; !ok {
 		emitter.Unlock()
 		return emitter
 	}
+	delete(emitter.onces, event)
 	emitter.Unlock()
 	emitter.callListeners(listeners, event, arguments...)
-	// clear executed listeners
-	emitter.onces[event] = emitter.onces[event][len(listeners):]
 	return emitter
 }
 
 func (emitter *Emitter) callListeners(listeners []reflect.Value, event interface{}, arguments ...interface{}) {
 	var wg sync.WaitGroup
 
+	emitter.Lock()
+	recoverer := emitter.recoverer
+	emitter.Unlock()
+
 	wg.Add(len(listeners))
 
 	for _, fn := range listeners {
@@ -204,11 +210,11 @@ func (emitter *Emitter) callListeners(listeners []reflect.Value, event interface
 			// Recover from potential panics, supplying them to a
 			// RecoveryListener if one has been set, else allowing
 			// the panic to occur.
-			if nil != emitter.recoverer {
+			if nil != recoverer {
 				defer func() {
 					if r := recover(); nil != r {
 						err := fmt.Errorf("%v", r)
-						emitter.recoverer(event, fn.Interface(), err)
+						recoverer(event, fn.Interface(), err)
 					}
 				}()
 			}
@@ -233,6 +239,9 @@ func (emitter *Emitter) callListeners(listeners []reflect.Value, event interface
 // RecoverWith sets the listener to call when a panic occurs, recovering from
 // panics and attempting to keep the application from crashing.
 func (emitter *Emitter) RecoverWith(listener RecoveryListener) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
 	emitter.recoverer = listener
 	return emitter
 }
@@ -3,6 +3,8 @@ package glog
 import (
 	"fmt"
 	"log"
+	"runtime"
+	"strings"
 	"sync"
 )
 
@@ -14,6 +16,8 @@ var (
 	logger *log.Logger
 	level  LEVEL
 	mu     sync.Mutex
+	// sink takes the records over logger once set, see SetSlogger
+	sink Sink
 )
 
 type LEVEL int
@@ -26,6 +30,13 @@ const (
 	NONE
 )
 
+// Sink receives the records with the layer, the package of the caller,
+// and the key value pairs of the *w functions
+type Sink interface {
+	Enabled(l LEVEL) bool
+	Log(l LEVEL, layer, msg string, kv ...interface{})
+}
+
 func SetLogger(l *log.Logger) {
 	l.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
 	logger = l
@@ -35,73 +46,129 @@ func SetLevel(l LEVEL) {
 	level = l
 }
 
+// SetSink routes the records to s instead of the logger, nil restores it
+func SetSink(s Sink) {
+	mu.Lock()
+	defer mu.Unlock()
+	sink = s
+}
+
 func checkLogger() {
 	if logger == nil && level != NONE {
 		panic("logger not inited")
 	}
 }
 
-func Debug(v ...interface{}) {
+var prefixes = map[LEVEL]string{
+	DEBUG: "[DEBUG]",
+	INFO:  "[INFO]",
+	WARN:  "[WARN]",
+	ERROR: "[ERROR]",
+}
+
+// Enabled tells if the records of level l are logged, for the callers to
+// skip building costly arguments
+func Enabled(l LEVEL) bool {
+	mu.Lock()
+	s := sink
+	mu.Unlock()
+	if s != nil {
+		return s.Enabled(l)
+	}
+	return level <= l
+}
+
+// output logs msg for the caller of the exported function
+func output(l LEVEL, msg string, kv ...interface{}) {
+	mu.Lock()
+	s := sink
+	mu.Unlock()
+	if s != nil {
+		if s.Enabled(l) {
+			s.Log(l, callerLayer(3), strings.TrimSuffix(msg, "\n"), kv...)
+		}
+		return
+	}
 	checkLogger()
-	if level <= DEBUG {
+	if level <= l {
+		for i := 0; i+1 < len(kv); i += 2 {
+			msg = fmt.Sprintf("%s %v=%v", strings.TrimSuffix(msg, "\n"), kv[i], kv[i+1])
+		}
 		mu.Lock()
 		defer mu.Unlock()
-		logger.SetPrefix("[DEBUG]")
-		logger.Output(2, fmt.Sprintln(v...))
+		logger.SetPrefix(prefixes[l])
+		logger.Output(3, fmt.Sprintln(strings.TrimSuffix(msg, "\n")))
 	}
 }
+
+// callerLayer returns the package name of the caller, like t125 or pdu
+func callerLayer(skip int) string {
+	pc, _, _, ok := runtime.Caller(skip)
+	if !ok {
+		return ""
+	}
+	f := runtime.FuncForPC(pc)
+	if f == nil {
+		return ""
+	}
+	name := f.Name()
+	name = name[strings.LastIndex(name, "/")+1:]
+	if i := strings.Index(name, "."); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+func Debug(v ...interface{}) {
+	if !Enabled(DEBUG) {
+		return
+	}
+	output(DEBUG, fmt.Sprintln(v...))
+}
 func Debugf(f string, v ...interface{}) {
-	checkLogger()
-	if level <= DEBUG {
-		mu.Lock()
-		defer mu.Unlock()
-		logger.SetPrefix("[DEBUG]")
-		logger.Output(2, fmt.Sprintln(fmt.Sprintf(f, v...)))
+	if !Enabled(DEBUG) {
+		return
 	}
+	output(DEBUG, fmt.Sprintf(f, v...))
+}
+
+// Debugw logs msg with the key value pairs kv, as fields of the sink
+func Debugw(msg string, kv ...interface{}) {
+	output(DEBUG, msg, kv...)
 }
 func Info(v ...interface{}) {
-	checkLogger()
-	if level <= INFO {
-		mu.Lock()
-		defer mu.Unlock()
-		logger.SetPrefix("[INFO]")
-		logger.Output(2, fmt.Sprintln(v...))
+	if !Enabled(INFO) {
+		return
 	}
+	output(INFO, fmt.Sprintln(v...))
 }
 func Infof(f string, v ...interface{}) {
-	checkLogger()
-	if level <= INFO {
-		mu.Lock()
-		defer mu.Unlock()
-		logger.SetPrefix("[INFO]")
-		logger.Output(2, fmt.Sprintln(fmt.Sprintf(f, v...)))
+	if !Enabled(INFO) {
+		return
 	}
+	output(INFO, fmt.Sprintf(f, v...))
 }
 func Warn(v ...interface{}) {
-	checkLogger()
-	if level <= WARN {
-		mu.Lock()
-		defer mu.Unlock()
-		logger.SetPrefix("[WARN]")
-		logger.Output(2, fmt.Sprintln(v...))
+	if !Enabled(WARN) {
+		return
 	}
+	output(WARN, fmt.Sprintln(v...))
 }
 
 func Error(v ...interface{}) {
-	checkLogger()
-	if level <= ERROR {
-		mu.Lock()
-		defer mu.Unlock()
-		logger.SetPrefix("[ERROR]")
-		logger.Output(2, fmt.Sprintln(v...))
+	if !Enabled(ERROR) {
+		return
 	}
+	output(ERROR, fmt.Sprintln(v...))
 }
 func Errorf(f string, v ...interface{}) {
-	checkLogger()
-	if level <= ERROR {
-		mu.Lock()
-		defer mu.Unlock()
-		logger.SetPrefix("[ERROR]")
-		logger.Output(2, fmt.Sprintln(fmt.Sprintf(f, v...)))
+	if !Enabled(ERROR) {
+		return
 	}
+	output(ERROR, fmt.Sprintf(f, v...))
+}
+
+// Errorw logs msg with the key value pairs kv, as fields of the sink
+func Errorw(msg string, kv ...interface{}) {
+	output(ERROR, msg, kv...)
 }
@@ -0,0 +1,36 @@
+package glog_test
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/tomatome/grdp/glog"
+)
+
+// formatCounter counts its formatting
+type formatCounter int
+
+func (c *formatCounter) String() string {
+	*c++
+	return "counted"
+}
+
+func TestDisabledLevelNotFormatted(t *testing.T) {
+	buff := &bytes.Buffer{}
+	glog.SetLogger(log.New(buff, "", 0))
+	glog.SetLevel(glog.INFO)
+	defer glog.SetLevel(glog.NONE)
+
+	var c formatCounter
+	glog.Debug(&c)
+	glog.Debugf("%v", &c)
+	if c != 0 || glog.Enabled(glog.DEBUG) || buff.Len() != 0 {
+		t.Error("debug record formatted", c, buff.String())
+	}
+	glog.Info(&c)
+	if c != 1 || !strings.Contains(buff.String(), "counted") {
+		t.Error("get", c, buff.String())
+	}
+}
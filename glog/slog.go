@@ -0,0 +1,37 @@
+//go:build go1.21
+
+package glog
+
+import (
+	"context"
+	"log/slog"
+)
+
+var levels = map[LEVEL]slog.Level{
+	DEBUG: slog.LevelDebug,
+	INFO:  slog.LevelInfo,
+	WARN:  slog.LevelWarn,
+	ERROR: slog.LevelError,
+}
+
+type slogSink struct {
+	l *slog.Logger
+}
+
+func (s slogSink) Enabled(l LEVEL) bool {
+	return l != NONE && s.l.Enabled(context.Background(), levels[l])
+}
+
+func (s slogSink) Log(l LEVEL, layer, msg string, kv ...interface{}) {
+	s.l.Log(context.Background(), levels[l], msg, append([]interface{}{"layer", layer}, kv...)...)
+}
+
+// SetSlogger routes the records to l with a layer field, the level of its
+// handler replaces SetLevel, nil restores the logger of SetLogger
+func SetSlogger(l *slog.Logger) {
+	if l == nil {
+		SetSink(nil)
+		return
+	}
+	SetSink(slogSink{l})
+}
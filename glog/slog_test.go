@@ -0,0 +1,28 @@
+//go:build go1.21
+
+package glog_test
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/tomatome/grdp/glog"
+)
+
+func TestSetSlogger(t *testing.T) {
+	buff := &bytes.Buffer{}
+	glog.SetSlogger(slog.New(slog.NewTextHandler(buff, &slog.HandlerOptions{Level: slog.LevelInfo})))
+	defer glog.SetSlogger(nil)
+
+	glog.Debug("hidden")
+	glog.Errorw("read pdu", "channel", 1003)
+	out := buff.String()
+	if strings.Contains(out, "hidden") {
+		t.Error("debug record below the handler level:", out)
+	}
+	if !strings.Contains(out, `msg="read pdu" layer=glog_test channel=1003`) {
+		t.Error("get", out)
+	}
+}
@@ -43,7 +43,18 @@ func NewClient(host string, logLevel glog.LEVEL) *Client {
 }
 
 func (g *Client) Login(domain, user, pwd string) error {
-	conn, err := net.DialTimeout("tcp", g.Host, 3*time.Second)
+	return g.LoginWithCredentials(nla.Credentials{Domain: domain, Username: user, Password: pwd})
+}
+
+// LoginWithCredentials connects with NLA when the server asks for it,
+// falling back to TLS or standard RDP security
+func (g *Client) LoginWithCredentials(cred nla.Credentials) error {
+	domain, user, pwd := cred.Domain, cred.Username, cred.Password
+	addr, err := core.HostPort(g.Host, "3389")
+	if err != nil {
+		return fmt.Errorf("[dial err] %v", err)
+	}
+	conn, err := net.DialTimeout("tcp", addr, 3*time.Second)
 	if err != nil {
 		return fmt.Errorf("[dial err] %v", err)
 	}
@@ -51,7 +62,7 @@ func (g *Client) Login(domain, user, pwd string) error {
 	glog.Info(conn.LocalAddr().String())
 	//domain := strings.Split(g.Host, ":")[0]
 
-	g.tpkt = tpkt.New(core.NewSocketLayer(conn), nla.NewNTLMv2(domain, user, pwd))
+	g.tpkt = tpkt.New(core.NewSocketLayer(conn), nla.NewNTLMv2WithCredentials(cred))
 	g.x224 = x224.New(g.tpkt)
 	g.mcs = t125.NewMCSClient(g.x224)
 	g.sec = sec.NewClient(g.mcs)
@@ -69,8 +80,7 @@ func (g *Client) Login(domain, user, pwd string) error {
 	g.sec.SetChannelSender(g.mcs)
 	//g.pdu.SetFastPathSender(g.tpkt)
 
-	//g.x224.SetRequestedProtocol(x224.PROTOCOL_SSL)
-	g.x224.SetRequestedProtocol(x224.PROTOCOL_RDP)
+	g.x224.SetRequestedProtocol(x224.PROTOCOL_RDP | x224.PROTOCOL_SSL | x224.PROTOCOL_HYBRID)
 
 	err = g.x224.Connect()
 	if err != nil {
@@ -101,14 +111,18 @@ func (g *Client) Login(domain, user, pwd string) error {
 		glog.Info("on ready")
 	}).On("update", func(rectangles []pdu.BitmapData) {
 		glog.Info("on update bitmap:", len(rectangles))
-	})
+	}).On("reconnect-cookie", g.mcs.SetReconnectCookie)
 
 	wg.Wait()
 	return err
 }
 
 func (g *Client) LoginVNC() error {
-	conn, err := net.DialTimeout("tcp", g.Host, 3*time.Second)
+	addr, err := core.HostPort(g.Host, "5900")
+	if err != nil {
+		return fmt.Errorf("[dial err] %v", err)
+	}
+	conn, err := net.DialTimeout("tcp", addr, 3*time.Second)
 	if err != nil {
 		return fmt.Errorf("[dial err] %v", err)
 	}
@@ -0,0 +1,168 @@
+// Package keyboard maps runes and named keys to RDP scancode events
+package keyboard
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/tomatome/grdp/protocol/t125/gcc"
+)
+
+/**
+ * Scancodes of set 1, extended keys carry the 0xe0 prefix in the high byte
+ * as expected by pdu.Client.SendScancode
+ * @see MS-RDPBCGR 2.2.8.1.1.3.1.1.1 Keyboard Event (TS_KEYBOARD_EVENT)
+ */
+const (
+	ESCAPE    uint16 = 0x01
+	BACKSPACE uint16 = 0x0e
+	TAB       uint16 = 0x0f
+	ENTER     uint16 = 0x1c
+	LCTRL     uint16 = 0x1d
+	LSHIFT    uint16 = 0x2a
+	RSHIFT    uint16 = 0x36
+	LALT      uint16 = 0x38
+	SPACE     uint16 = 0x39
+	CAPSLOCK  uint16 = 0x3a
+	F1        uint16 = 0x3b
+	F2        uint16 = 0x3c
+	F3        uint16 = 0x3d
+	F4        uint16 = 0x3e
+	F5        uint16 = 0x3f
+	F6        uint16 = 0x40
+	F7        uint16 = 0x41
+	F8        uint16 = 0x42
+	F9        uint16 = 0x43
+	F10       uint16 = 0x44
+	NUMLOCK   uint16 = 0x45
+	SCROLL    uint16 = 0x46
+	F11       uint16 = 0x57
+	F12       uint16 = 0x58
+
+	NUMPAD_MULTIPLY uint16 = 0x37
+	NUMPAD7         uint16 = 0x47
+	NUMPAD8         uint16 = 0x48
+	NUMPAD9         uint16 = 0x49
+	NUMPAD_MINUS    uint16 = 0x4a
+	NUMPAD4         uint16 = 0x4b
+	NUMPAD5         uint16 = 0x4c
+	NUMPAD6         uint16 = 0x4d
+	NUMPAD_PLUS     uint16 = 0x4e
+	NUMPAD1         uint16 = 0x4f
+	NUMPAD2         uint16 = 0x50
+	NUMPAD3         uint16 = 0x51
+	NUMPAD0         uint16 = 0x52
+	NUMPAD_DECIMAL  uint16 = 0x53
+	NUMPAD_ENTER    uint16 = 0xe01c
+	NUMPAD_DIVIDE   uint16 = 0xe035
+
+	RCTRL       uint16 = 0xe01d
+	PRINTSCREEN uint16 = 0xe037
+	RALT        uint16 = 0xe038
+	HOME        uint16 = 0xe047
+	UP          uint16 = 0xe048
+	PAGEUP      uint16 = 0xe049
+	LEFT        uint16 = 0xe04b
+	RIGHT       uint16 = 0xe04d
+	END         uint16 = 0xe04f
+	DOWN        uint16 = 0xe050
+	PAGEDOWN    uint16 = 0xe051
+	INSERT      uint16 = 0xe052
+	DELETE      uint16 = 0xe053
+	LWIN        uint16 = 0xe05b
+	RWIN        uint16 = 0xe05c
+	APPS        uint16 = 0xe05d
+)
+
+// Modifier keys held around a key
+type Modifier uint8
+
+const (
+	Shift Modifier = 1 << iota
+	Ctrl
+	Alt
+	// right alt, ctrl+alt of european layouts
+	AltGr
+	Win
+)
+
+// modifiers in press order
+var modifierKeys = []struct {
+	mod  Modifier
+	code uint16
+}{
+	{Ctrl, LCTRL}, {Alt, LALT}, {AltGr, RALT}, {Shift, LSHIFT}, {Win, LWIN},
+}
+
+// Event is a key press or release
+type Event struct {
+	Code uint16
+	Down bool
+}
+
+// IsExtended tells if the key needs the 0xe0 prefix flag
+func (e Event) IsExtended() bool {
+	return e.Code>>8 == 0xe0
+}
+
+// Key returns the events typing code with mods held, modifiers are released in reverse order
+func Key(code uint16, mods Modifier) []Event {
+	events := make([]Event, 0, 2+2*len(modifierKeys))
+	for _, m := range modifierKeys {
+		if mods&m.mod != 0 {
+			events = append(events, Event{m.code, true})
+		}
+	}
+	events = append(events, Event{code, true}, Event{code, false})
+	for i := len(modifierKeys) - 1; i >= 0; i-- {
+		if mods&modifierKeys[i].mod != 0 {
+			events = append(events, Event{modifierKeys[i].code, false})
+		}
+	}
+	return events
+}
+
+// Lookup returns the key and the modifiers producing r on layout
+func Lookup(layout gcc.KeyboardLayout, r rune) (uint16, Modifier, error) {
+	switch r {
+	case ' ':
+		return SPACE, 0, nil
+	case '\n', '\r':
+		return ENTER, 0, nil
+	case '\t':
+		return TAB, 0, nil
+	case '\b':
+		return BACKSPACE, 0, nil
+	}
+	l, ok := layouts[layout]
+	if !ok {
+		return 0, 0, errors.New(fmt.Sprintf("unsupported keyboard layout 0x%x", uint32(layout)))
+	}
+	k, ok := l[r]
+	if !ok {
+		return 0, 0, errors.New(fmt.Sprintf("no key for %q on keyboard layout 0x%x", r, uint32(layout)))
+	}
+	return k.code, k.mod, nil
+}
+
+// Rune returns the events typing r on layout with the extra mods held
+func Rune(layout gcc.KeyboardLayout, r rune, mods Modifier) ([]Event, error) {
+	code, m, err := Lookup(layout, r)
+	if err != nil {
+		return nil, err
+	}
+	return Key(code, m|mods), nil
+}
+
+// String returns the events typing s on layout
+func String(layout gcc.KeyboardLayout, s string) ([]Event, error) {
+	var events []Event
+	for _, r := range s {
+		e, err := Rune(layout, r, 0)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e...)
+	}
+	return events, nil
+}
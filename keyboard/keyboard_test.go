@@ -0,0 +1,80 @@
+package keyboard
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tomatome/grdp/protocol/t125/gcc"
+)
+
+func TestLayouts(t *testing.T) {
+	for layout, l := range layouts {
+		if len(l) == 0 {
+			t.Errorf("empty layout 0x%x", uint32(layout))
+		}
+	}
+	for _, c := range []struct {
+		layout gcc.KeyboardLayout
+		r      rune
+		code   uint16
+		mod    Modifier
+	}{
+		{gcc.US, 'a', 0x1e, 0},
+		{gcc.US, '@', 0x03, Shift},
+		{gcc.UNITED_KINGDOM, '@', 0x28, Shift},
+		{gcc.UNITED_KINGDOM, '€', 0x05, AltGr},
+		{gcc.GERMAN, 'z', 0x15, 0},
+		{gcc.GERMAN, '@', 0x10, AltGr},
+		{gcc.GERMAN, 'ß', 0x0c, 0},
+		{gcc.GERMAN, '<', 0x56, 0},
+		{gcc.FRENCH, 'a', 0x10, 0},
+		{gcc.FRENCH, '1', 0x02, Shift},
+		{gcc.FRENCH, 'é', 0x03, 0},
+		{gcc.FRENCH, '\\', 0x09, AltGr},
+		{gcc.FRENCH, '\n', ENTER, 0},
+	} {
+		code, mod, err := Lookup(c.layout, c.r)
+		if err != nil || code != c.code || mod != c.mod {
+			t.Errorf("%q on 0x%x: get 0x%x %d %v, expect 0x%x %d", c.r, uint32(c.layout), code, mod, err, c.code, c.mod)
+		}
+	}
+}
+
+func TestRune(t *testing.T) {
+	events, err := Rune(gcc.US, 'A', Ctrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []Event{{LCTRL, true}, {LSHIFT, true}, {0x1e, true}, {0x1e, false}, {LSHIFT, false}, {LCTRL, false}}
+	if !reflect.DeepEqual(events, expect) {
+		t.Errorf("get %v, expect %v", events, expect)
+	}
+
+	if _, err := Rune(gcc.US, 'é', 0); err == nil {
+		t.Error("é accepted on US")
+	}
+	if _, err := Rune(gcc.JAPANESE, 'a', 0); err == nil {
+		t.Error("unsupported layout accepted")
+	}
+}
+
+func TestExtendedKey(t *testing.T) {
+	events := Key(LEFT, Shift)
+	if len(events) != 4 || events[0].IsExtended() || !events[1].IsExtended() || events[1].Code&0xff != 0x4b {
+		t.Errorf("bad events %v", events)
+	}
+	if NUMPAD_ENTER>>8 != 0xe0 || ENTER>>8 != 0 {
+		t.Error("numpad enter is not extended")
+	}
+}
+
+func TestString(t *testing.T) {
+	events, err := String(gcc.GERMAN, "Hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []Event{{LSHIFT, true}, {0x23, true}, {0x23, false}, {LSHIFT, false}, {0x17, true}, {0x17, false}}
+	if !reflect.DeepEqual(events, expect) {
+		t.Errorf("get %v, expect %v", events, expect)
+	}
+}
@@ -0,0 +1,65 @@
+package keyboard
+
+import "github.com/tomatome/grdp/protocol/t125/gcc"
+
+// scancodes of the printable keys, in the order of the layout rows below
+var printableKeys = []uint16{
+	0x29, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d,
+	0x10, 0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18, 0x19, 0x1a, 0x1b,
+	0x1e, 0x1f, 0x20, 0x21, 0x22, 0x23, 0x24, 0x25, 0x26, 0x27, 0x28, 0x2b,
+	0x56, 0x2c, 0x2d, 0x2e, 0x2f, 0x30, 0x31, 0x32, 0x33, 0x34, 0x35,
+}
+
+// rows of a layout, one rune per printable key, 0 where the key gives
+// nothing or a dead key
+type rows struct {
+	normal, shift, altGr string
+}
+
+type key struct {
+	code uint16
+	mod  Modifier
+}
+
+func (r rows) keys() map[rune]key {
+	m := make(map[rune]key)
+	for _, level := range []struct {
+		runes string
+		mod   Modifier
+	}{{r.altGr, AltGr}, {r.shift, Shift}, {r.normal, 0}} {
+		for i, c := range []rune(level.runes) {
+			if c != 0 {
+				m[c] = key{printableKeys[i], level.mod}
+			}
+		}
+	}
+	return m
+}
+
+const none = "\x00"
+
+var layouts = map[gcc.KeyboardLayout]map[rune]key{
+	gcc.US: rows{
+		normal: "`1234567890-=" + "qwertyuiop[]" + "asdfghjkl;'\\" + none + "zxcvbnm,./",
+		shift:  "~!@#$%^&*()_+" + "QWERTYUIOP{}" + "ASDFGHJKL:\"|" + none + "ZXCVBNM<>?",
+	}.keys(),
+	gcc.UNITED_KINGDOM: rows{
+		normal: "`1234567890-=" + "qwertyuiop[]" + "asdfghjkl;'#" + "\\zxcvbnm,./",
+		shift:  "¬!\"£$%^&*()_+" + "QWERTYUIOP{}" + "ASDFGHJKL:@~" + "|ZXCVBNM<>?",
+		altGr: "¦\x00\x00\x00€\x00\x00\x00\x00\x00\x00\x00\x00" + "\x00\x00é\x00\x00\x00úíó\x00\x00\x00" +
+			"á\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00",
+	}.keys(),
+	// ^ and ´ are dead keys
+	gcc.GERMAN: rows{
+		normal: "\x001234567890ß\x00" + "qwertzuiopü+" + "asdfghjklöä#" + "<yxcvbnm,.-",
+		shift:  "°!\"§$%&/()=?\x00" + "QWERTZUIOPÜ*" + "ASDFGHJKLÖÄ'" + ">YXCVBNM;:_",
+		altGr: "\x00\x00²³\x00\x00\x00{[]}\\\x00" + "@\x00€\x00\x00\x00\x00\x00\x00\x00\x00~" +
+			"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00" + "|\x00\x00\x00\x00\x00\x00µ",
+	}.keys(),
+	// ^ and ¨ and the altgr ~ and ` are dead keys
+	gcc.FRENCH: rows{
+		normal: "²&é\"'(-è_çà)=" + "azertyuiop\x00$" + "qsdfghjklmù*" + "<wxcvbn,;:!",
+		shift:  "\x001234567890°+" + "AZERTYUIOP\x00£" + "QSDFGHJKLM%µ" + ">WXCVBN?./§",
+		altGr:  "\x00\x00\x00#{[|\x00\\^@]}" + "\x00\x00€\x00\x00\x00\x00\x00\x00\x00\x00¤",
+	}.keys(),
+}
@@ -3,6 +3,7 @@ package plugin
 import "C"
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"unsafe"
 
@@ -185,6 +186,7 @@ var StaticVirtualChannels = map[string]int{
 		CHANNEL_OPTION_COMPRESS_RDP | CHANNEL_OPTION_SHOW_PROTOCOL,
 	RAIL_SVC_CHANNEL_NAME: CHANNEL_OPTION_INITIALIZED | CHANNEL_OPTION_ENCRYPT_RDP |
 		CHANNEL_OPTION_COMPRESS_RDP | CHANNEL_OPTION_SHOW_PROTOCOL,
+	DRDYNVC_SVC_CHANNEL_NAME: CHANNEL_OPTION_INITIALIZED | CHANNEL_OPTION_ENCRYPT_RDP | CHANNEL_OPTION_COMPRESS_RDP,
 }
 
 const (
@@ -204,12 +206,60 @@ type ChannelClient struct {
 	t ChannelTransport
 }
 
+/**
+ * reassembler accumulates the chunks of a channel PDU
+ * @see MS-RDPBCGR 2.2.6.1.1 Channel PDU Header
+ */
+type reassembler struct {
+	buff    bytes.Buffer
+	length  uint32
+	started bool
+	// bound of the messages, core.DefaultMaxPDUSize if zero
+	max int
+}
+
+// push returns the complete message on the last chunk
+func (r *reassembler) push(length, flags uint32, data []byte) ([]byte, error) {
+	if flags&CHANNEL_FLAG_FIRST != 0 {
+		max := r.max
+		if max == 0 {
+			max = core.DefaultMaxPDUSize
+		}
+		r.buff.Reset()
+		if uint64(length) > uint64(max) {
+			r.started = false
+			return nil, errors.New(fmt.Sprintf("channel length %d exceeds the maximum %d", length, max))
+		}
+		r.length = length
+		r.started = true
+	} else if !r.started {
+		return nil, errors.New("channel chunk out of order")
+	} else if length != r.length {
+		r.started = false
+		return nil, errors.New(fmt.Sprintf("channel chunk length %d, expect %d", length, r.length))
+	}
+	if uint32(r.buff.Len()+len(data)) > r.length {
+		r.started = false
+		return nil, errors.New(fmt.Sprintf("channel chunks exceed length %d", r.length))
+	}
+	r.buff.Write(data)
+	if flags&CHANNEL_FLAG_LAST == 0 {
+		return nil, nil
+	}
+	r.started = false
+	if uint32(r.buff.Len()) != r.length {
+		return nil, errors.New(fmt.Sprintf("channel data length %d, expect %d", r.buff.Len(), r.length))
+	}
+	return append([]byte{}, r.buff.Bytes()...), nil
+}
+
 type Channels struct {
 	emission.Emitter
 	channels      map[string]ChannelClient
 	transport     core.Transport
-	buff          *bytes.Buffer
+	chunks        map[string]*reassembler
 	channelSender core.ChannelSender
+	maxPDUSize    int
 }
 
 func NewChannels(t core.Transport) *Channels {
@@ -217,7 +267,7 @@ func NewChannels(t core.Transport) *Channels {
 		Emitter:   *emission.NewEmitter(),
 		channels:  make(map[string]ChannelClient, 20),
 		transport: t,
-		buff:      &bytes.Buffer{},
+		chunks:    make(map[string]*reassembler, 20),
 	}
 	t.On("channel", c.process)
 	return c
@@ -226,6 +276,16 @@ func NewChannels(t core.Transport) *Channels {
 func (c *Channels) SetChannelSender(f core.ChannelSender) {
 	c.channelSender = f
 }
+
+// SetMaxPDUSize fails on the messages longer than n bytes rather than
+// reassembling them, the default is core.DefaultMaxPDUSize
+func (c *Channels) SetMaxPDUSize(n int) {
+	c.maxPDUSize = n
+	for _, r := range c.chunks {
+		r.max = n
+	}
+}
+
 func (c *Channels) Register(t ChannelTransport) {
 	name, option := t.GetType()
 	_, ok := c.channels[name]
@@ -279,18 +339,20 @@ func (c *Channels) process(channel string, s []byte) {
 	ln, _ := core.ReadUInt32LE(r)
 	flags, _ := core.ReadUInt32LE(r)
 	glog.Debugf("channel:%s length: %d, flags: %d", channel, ln, flags)
-	if flags&CHANNEL_FLAG_FIRST == 0 || flags&CHANNEL_FLAG_LAST == 0 {
-		if flags&CHANNEL_FLAG_FIRST != 0 {
-			c.buff.Reset()
-		}
-		b, _ := core.ReadBytes(r.Len(), r)
-		c.buff.Write(b)
-		if flags&CHANNEL_FLAG_LAST == 0 {
-			return
-		}
-		s = c.buff.Bytes()
-	} else {
-		s, _ = core.ReadBytes(r.Len(), r)
+	chunks, ok := c.chunks[channel]
+	if !ok {
+		chunks = &reassembler{max: c.maxPDUSize}
+		c.chunks[channel] = chunks
+	}
+	b, _ := core.ReadBytes(r.Len(), r)
+	s, err := chunks.push(ln, flags, b)
+	if err != nil {
+		glog.Error("channel", channel, err)
+		c.Emit("error", err)
+		return
+	}
+	if s == nil {
+		return
 	}
 	cli, ok := c.channels[channel]
 	if !ok {
@@ -0,0 +1,104 @@
+package plugin
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/tomatome/grdp/core"
+	"github.com/tomatome/grdp/emission"
+	"github.com/tomatome/grdp/glog"
+)
+
+func init() {
+	glog.SetLevel(glog.NONE)
+}
+
+type fakeChannel struct {
+	messages [][]byte
+}
+
+func (f *fakeChannel) GetType() (string, uint32) {
+	return CLIPRDR_SVC_CHANNEL_NAME, 0
+}
+func (f *fakeChannel) Sender(core.ChannelSender) {}
+func (f *fakeChannel) Process(s []byte) {
+	f.messages = append(f.messages, s)
+}
+
+func chunk(length, flags uint32, data string) []byte {
+	b := &bytes.Buffer{}
+	core.WriteUInt32LE(length, b)
+	core.WriteUInt32LE(flags, b)
+	b.WriteString(data)
+	return b.Bytes()
+}
+
+func newTestChannels() (*Channels, *fakeChannel, *[]error) {
+	c := &Channels{
+		Emitter:  *emission.NewEmitter(),
+		channels: map[string]ChannelClient{},
+		chunks:   map[string]*reassembler{},
+	}
+	f := &fakeChannel{}
+	c.channels[CLIPRDR_SVC_CHANNEL_NAME] = ChannelClient{t: f}
+	errs := &[]error{}
+	c.On("error", func(err error) {
+		*errs = append(*errs, err)
+	})
+	return c, f, errs
+}
+
+func TestChannelsReassemble(t *testing.T) {
+	c, f, errs := newTestChannels()
+	c.process(CLIPRDR_SVC_CHANNEL_NAME, chunk(5, CHANNEL_FLAG_FIRST|CHANNEL_FLAG_LAST, "hello"))
+	c.process(CLIPRDR_SVC_CHANNEL_NAME, chunk(10, CHANNEL_FLAG_FIRST, "hello"))
+	// chunks of another channel must not mix in
+	c.process(RDPDR_SVC_CHANNEL_NAME, chunk(3, CHANNEL_FLAG_FIRST, "abc"))
+	c.process(CLIPRDR_SVC_CHANNEL_NAME, chunk(10, 0, "wor"))
+	c.process(CLIPRDR_SVC_CHANNEL_NAME, chunk(10, CHANNEL_FLAG_LAST, "ld"))
+
+	if len(*errs) != 0 {
+		t.Fatal(*errs)
+	}
+	if len(f.messages) != 2 || string(f.messages[0]) != "hello" || string(f.messages[1]) != "helloworld" {
+		t.Errorf("bad messages %q", f.messages)
+	}
+}
+
+func TestChannelsReassembleErrors(t *testing.T) {
+	for _, chunks := range [][][]byte{
+		{chunk(5, CHANNEL_FLAG_LAST, "hello")},
+		{chunk(4, CHANNEL_FLAG_FIRST, "hel"), chunk(4, CHANNEL_FLAG_LAST, "lo")},
+		{chunk(10, CHANNEL_FLAG_FIRST, "hel"), chunk(10, CHANNEL_FLAG_LAST, "lo")},
+		{chunk(5, CHANNEL_FLAG_FIRST, "hel"), chunk(6, CHANNEL_FLAG_LAST, "lo")},
+	} {
+		c, f, errs := newTestChannels()
+		for _, s := range chunks {
+			c.process(CLIPRDR_SVC_CHANNEL_NAME, s)
+		}
+		if len(*errs) != 1 || len(f.messages) != 0 {
+			t.Errorf("expect one error for %q, get %v %q", chunks, *errs, f.messages)
+		}
+	}
+}
+
+func TestChannelsMaxPDUSize(t *testing.T) {
+	c, f, errs := newTestChannels()
+	c.SetMaxPDUSize(8)
+	c.process(CLIPRDR_SVC_CHANNEL_NAME, chunk(10, CHANNEL_FLAG_FIRST, "hello"))
+	c.process(CLIPRDR_SVC_CHANNEL_NAME, chunk(10, CHANNEL_FLAG_LAST, "world"))
+	c.process(CLIPRDR_SVC_CHANNEL_NAME, chunk(5, CHANNEL_FLAG_FIRST|CHANNEL_FLAG_LAST, "hello"))
+	if len(*errs) != 2 || (*errs)[0].Error() != "channel length 10 exceeds the maximum 8" {
+		t.Error("get", *errs)
+	}
+	if len(f.messages) != 1 || string(f.messages[0]) != "hello" {
+		t.Errorf("bad messages %q", f.messages)
+	}
+
+	// the default bound
+	c, _, errs = newTestChannels()
+	c.process(CLIPRDR_SVC_CHANNEL_NAME, chunk(core.DefaultMaxPDUSize+1, CHANNEL_FLAG_FIRST, "hello"))
+	if len(*errs) == 0 {
+		t.Error("expect error on a length above core.DefaultMaxPDUSize")
+	}
+}
@@ -0,0 +1,101 @@
+package plugin
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/tomatome/grdp/core"
+)
+
+/**
+ * ChannelConn reads and writes whole virtual channel messages over the
+ * byte stream of a static channel, see t125.MCS.Channel
+ * Chunks are split at CHANNEL_CHUNK_LENGTH, the stream does not keep the
+ * PDU boundaries so received chunks are expected to be full but the last
+ * @see MS-RDPBCGR 3.1.5.2.2 Processing of Virtual Channel PDU
+ */
+type ChannelConn struct {
+	rw        io.ReadWriteCloser
+	options   uint32
+	chunks    reassembler
+	writeLock sync.Mutex
+}
+
+// NewChannelConn wraps rw, options are the CHANNEL_OPTION_* of the channel
+func NewChannelConn(rw io.ReadWriteCloser, options uint32) *ChannelConn {
+	return &ChannelConn{rw: rw, options: options}
+}
+
+// SetMaxPDUSize fails on the messages longer than n bytes rather than
+// reassembling them, the default is core.DefaultMaxPDUSize
+func (c *ChannelConn) SetMaxPDUSize(n int) {
+	c.chunks.max = n
+}
+
+// ReadMessage blocks until a whole message is received
+func (c *ChannelConn) ReadMessage() ([]byte, error) {
+	for {
+		b, err := core.ReadBytes(8, c.rw)
+		if err != nil {
+			return nil, err
+		}
+		r := bytes.NewReader(b)
+		length, _ := core.ReadUInt32LE(r)
+		flags, _ := core.ReadUInt32LE(r)
+
+		n := length
+		if flags&CHANNEL_FLAG_FIRST == 0 {
+			if !c.chunks.started || length != c.chunks.length {
+				return nil, errors.New(fmt.Sprintf("channel chunk of length %d out of order", length))
+			}
+			n -= uint32(c.chunks.buff.Len())
+		}
+		if n > CHANNEL_CHUNK_LENGTH {
+			n = CHANNEL_CHUNK_LENGTH
+		}
+		data, err := core.ReadBytes(int(n), c.rw)
+		if err != nil {
+			return nil, err
+		}
+		msg, err := c.chunks.push(length, flags, data)
+		if err != nil || msg != nil {
+			return msg, err
+		}
+	}
+}
+
+// WriteMessage sends s in as many chunks as needed
+func (c *ChannelConn) WriteMessage(s []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	b := &bytes.Buffer{}
+	for idx := 0; idx == 0 || idx < len(s); idx += CHANNEL_CHUNK_LENGTH {
+		var flags uint32
+		if c.options&CHANNEL_OPTION_SHOW_PROTOCOL != 0 {
+			flags |= CHANNEL_FLAG_SHOW_PROTOCOL
+		}
+		if idx == 0 {
+			flags |= CHANNEL_FLAG_FIRST
+		}
+		end := idx + CHANNEL_CHUNK_LENGTH
+		if end >= len(s) {
+			end = len(s)
+			flags |= CHANNEL_FLAG_LAST
+		}
+		b.Reset()
+		core.WriteUInt32LE(uint32(len(s)), b)
+		core.WriteUInt32LE(flags, b)
+		b.Write(s[idx:end])
+		if _, err := c.rw.Write(b.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *ChannelConn) Close() error {
+	return c.rw.Close()
+}
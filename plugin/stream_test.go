@@ -0,0 +1,50 @@
+package plugin
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+type bufferStream struct {
+	bytes.Buffer
+}
+
+func (b *bufferStream) Close() error { return nil }
+
+func TestChannelConn(t *testing.T) {
+	s := &bufferStream{}
+	c := NewChannelConn(s, CHANNEL_OPTION_SHOW_PROTOCOL)
+	long := strings.Repeat("x", CHANNEL_CHUNK_LENGTH) + "yz"
+	for _, m := range []string{"hello", long, ""} {
+		if err := c.WriteMessage([]byte(m)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the long message takes two chunks
+	b := s.Bytes()
+	if !bytes.Equal(b[:8], chunk(5, CHANNEL_FLAG_FIRST|CHANNEL_FLAG_LAST|CHANNEL_FLAG_SHOW_PROTOCOL, "")) ||
+		!bytes.Equal(b[13+8+CHANNEL_CHUNK_LENGTH:13+16+CHANNEL_CHUNK_LENGTH],
+			chunk(uint32(len(long)), CHANNEL_FLAG_LAST|CHANNEL_FLAG_SHOW_PROTOCOL, "")) {
+		t.Errorf("bad chunk headers %x", b[:16])
+	}
+
+	for _, m := range []string{"hello", long, ""} {
+		msg, err := c.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg) != m {
+			t.Errorf("get %d bytes, expect %d", len(msg), len(m))
+		}
+	}
+	if _, err := c.ReadMessage(); err != io.EOF {
+		t.Error("expect EOF, get", err)
+	}
+
+	s.Write(chunk(5, CHANNEL_FLAG_LAST, "hello"))
+	if _, err := c.ReadMessage(); err == nil {
+		t.Error("last chunk without first accepted")
+	}
+}
@@ -0,0 +1,334 @@
+// Package cliprdr synchronizes text with the clipboard of the server
+// over the cliprdr static virtual channel
+package cliprdr
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"unicode/utf16"
+
+	"github.com/tomatome/grdp/core"
+	"github.com/tomatome/grdp/glog"
+	"github.com/tomatome/grdp/plugin"
+)
+
+/**
+ * @see MS-RDPECLIP 2.2.1 Clipboard PDU Header (CLIPRDR_HEADER)
+ */
+const (
+	CB_MONITOR_READY         = 0x0001
+	CB_FORMAT_LIST           = 0x0002
+	CB_FORMAT_LIST_RESPONSE  = 0x0003
+	CB_FORMAT_DATA_REQUEST   = 0x0004
+	CB_FORMAT_DATA_RESPONSE  = 0x0005
+	CB_TEMP_DIRECTORY        = 0x0006
+	CB_CLIP_CAPS             = 0x0007
+	CB_FILECONTENTS_REQUEST  = 0x0008
+	CB_FILECONTENTS_RESPONSE = 0x0009
+	CB_LOCK_CLIPDATA         = 0x000A
+	CB_UNLOCK_CLIPDATA       = 0x000B
+)
+
+const (
+	CB_RESPONSE_OK   = 0x0001
+	CB_RESPONSE_FAIL = 0x0002
+	CB_ASCII_NAMES   = 0x0004
+)
+
+/**
+ * @see MS-RDPECLIP 2.2.2.1.1.1 General Capability Set (CLIPRDR_GENERAL_CAPABILITY)
+ */
+const (
+	CB_CAPSTYPE_GENERAL      = 0x0001
+	CB_CAPSTYPE_GENERAL_LEN  = 12
+	CB_CAPS_VERSION_2        = 0x00000002
+	CB_USE_LONG_FORMAT_NAMES = 0x00000002
+)
+
+// standard clipboard format of null terminated UTF-16LE text
+const CF_UNICODETEXT = 13
+
+// header length of a clipboard PDU
+const headerLength = 8
+
+type header struct {
+	MsgType  uint16
+	MsgFlags uint16
+	DataLen  uint32
+}
+
+func readHeader(r io.Reader) (*header, error) {
+	b, err := core.ReadBytes(headerLength, r)
+	if err != nil {
+		return nil, err
+	}
+	return &header{
+		MsgType:  uint16(b[0]) | uint16(b[1])<<8,
+		MsgFlags: uint16(b[2]) | uint16(b[3])<<8,
+		DataLen:  uint32(b[4]) | uint32(b[5])<<8 | uint32(b[6])<<16 | uint32(b[7])<<24,
+	}, nil
+}
+
+func pdu(msgType, msgFlags uint16, data []byte) []byte {
+	buff := &bytes.Buffer{}
+	core.WriteUInt16LE(msgType, buff)
+	core.WriteUInt16LE(msgFlags, buff)
+	core.WriteUInt32LE(uint32(len(data)), buff)
+	core.WriteBytes(data, buff)
+	return buff.Bytes()
+}
+
+/**
+ * Client of the clipboard channel, only CF_UNICODETEXT is exchanged
+ * @see MS-RDPECLIP 1.3.2.1 Initialization Sequence
+ */
+type Client struct {
+	conn *plugin.ChannelConn
+
+	lock      sync.Mutex
+	text      string
+	hasText   bool
+	ready     bool
+	longNames bool
+	onText    func(string)
+}
+
+// New returns a client of an opened cliprdr channel stream, see Run
+func New(rw io.ReadWriteCloser) *Client {
+	return &Client{
+		conn: plugin.NewChannelConn(rw, plugin.CHANNEL_OPTION_SHOW_PROTOCOL),
+	}
+}
+
+// OnClipboardText sets the callback receiving the text copied on the server
+func (c *Client) OnClipboardText(f func(string)) {
+	c.lock.Lock()
+	c.onText = f
+	c.lock.Unlock()
+}
+
+// SetClipboardText makes s the clipboard content offered to the server
+func (c *Client) SetClipboardText(s string) error {
+	c.lock.Lock()
+	c.text, c.hasText = s, true
+	ready := c.ready
+	c.lock.Unlock()
+	if !ready {
+		// announced on monitor ready
+		return nil
+	}
+	return c.sendFormatList()
+}
+
+// Run processes the channel until it is closed
+func (c *Client) Run() error {
+	for {
+		msg, err := c.conn.ReadMessage()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = c.process(msg); err != nil {
+			glog.Warn("cliprdr:", err)
+		}
+	}
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Client) process(msg []byte) error {
+	r := bytes.NewReader(msg)
+	h, err := readHeader(r)
+	if err != nil {
+		return err
+	}
+	data, err := core.ReadBytes(int(h.DataLen), r)
+	if err != nil {
+		return errors.New(fmt.Sprintf("message 0x%x shorter than its length %d", h.MsgType, h.DataLen))
+	}
+	glog.Debugf("cliprdr message 0x%x flags 0x%x", h.MsgType, h.MsgFlags)
+	switch h.MsgType {
+	case CB_CLIP_CAPS:
+		return c.recvCapabilities(data)
+	case CB_MONITOR_READY:
+		return c.recvMonitorReady()
+	case CB_FORMAT_LIST:
+		return c.recvFormatList(data)
+	case CB_FORMAT_LIST_RESPONSE:
+		if h.MsgFlags&CB_RESPONSE_OK == 0 {
+			glog.Warn("cliprdr: format list refused")
+		}
+	case CB_FORMAT_DATA_REQUEST:
+		return c.recvFormatDataRequest(data)
+	case CB_FORMAT_DATA_RESPONSE:
+		if h.MsgFlags&CB_RESPONSE_OK != 0 {
+			c.recvText(data)
+		}
+	}
+	return nil
+}
+
+/**
+ * @see MS-RDPECLIP 2.2.2.1 Clipboard Capabilities PDU (CLIPRDR_CAPS)
+ */
+func (c *Client) recvCapabilities(data []byte) error {
+	r := bytes.NewReader(data)
+	b, err := core.ReadBytes(4, r)
+	if err != nil {
+		return err
+	}
+	count := int(b[0]) | int(b[1])<<8
+	for i := 0; i < count; i++ {
+		b, err = core.ReadBytes(4, r)
+		if err != nil {
+			return err
+		}
+		capType := uint16(b[0]) | uint16(b[1])<<8
+		ln := int(b[2]) | int(b[3])<<8
+		if ln < 4 {
+			return errors.New(fmt.Sprintf("invalid capability set length %d", ln))
+		}
+		body, err := core.ReadBytes(ln-4, r)
+		if err != nil {
+			return err
+		}
+		if capType == CB_CAPSTYPE_GENERAL && len(body) >= 8 {
+			c.lock.Lock()
+			c.longNames = body[4]&CB_USE_LONG_FORMAT_NAMES != 0
+			c.lock.Unlock()
+		}
+	}
+	return nil
+}
+
+func (c *Client) recvMonitorReady() error {
+	buff := &bytes.Buffer{}
+	core.WriteUInt16LE(1, buff)
+	core.WriteUInt16LE(0, buff)
+	core.WriteUInt16LE(CB_CAPSTYPE_GENERAL, buff)
+	core.WriteUInt16LE(CB_CAPSTYPE_GENERAL_LEN, buff)
+	core.WriteUInt32LE(CB_CAPS_VERSION_2, buff)
+	core.WriteUInt32LE(CB_USE_LONG_FORMAT_NAMES, buff)
+	if err := c.conn.WriteMessage(pdu(CB_CLIP_CAPS, 0, buff.Bytes())); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	c.ready = true
+	c.lock.Unlock()
+	return c.sendFormatList()
+}
+
+/**
+ * Format list with CF_UNICODETEXT once text is set, empty before,
+ * names are empty in both the long and short forms
+ * @see MS-RDPECLIP 2.2.3.1 Format List PDU (CLIPRDR_FORMAT_LIST)
+ */
+func (c *Client) sendFormatList() error {
+	c.lock.Lock()
+	hasText, longNames := c.hasText, c.longNames
+	c.lock.Unlock()
+	buff := &bytes.Buffer{}
+	if hasText {
+		core.WriteUInt32LE(CF_UNICODETEXT, buff)
+		if longNames {
+			core.WriteUInt16LE(0, buff)
+		} else {
+			core.WriteBytes(make([]byte, 32), buff)
+		}
+	}
+	return c.conn.WriteMessage(pdu(CB_FORMAT_LIST, 0, buff.Bytes()))
+}
+
+// readFormats returns the format ids of a format list
+func readFormats(longNames bool, data []byte) ([]uint32, error) {
+	var formats []uint32
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		b, err := core.ReadBytes(4, r)
+		if err != nil {
+			return nil, err
+		}
+		formats = append(formats, uint32(b[0])|uint32(b[1])<<8|uint32(b[2])<<16|uint32(b[3])<<24)
+		if !longNames {
+			if _, err = core.ReadBytes(32, r); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		// null terminated wszFormatName
+		for {
+			b, err = core.ReadBytes(2, r)
+			if err != nil {
+				return nil, err
+			}
+			if b[0] == 0 && b[1] == 0 {
+				break
+			}
+		}
+	}
+	return formats, nil
+}
+
+// recvFormatList acknowledges the server copy and requests its text
+func (c *Client) recvFormatList(data []byte) error {
+	c.lock.Lock()
+	longNames := c.longNames
+	c.lock.Unlock()
+	formats, err := readFormats(longNames, data)
+	if err != nil {
+		c.conn.WriteMessage(pdu(CB_FORMAT_LIST_RESPONSE, CB_RESPONSE_FAIL, nil))
+		return err
+	}
+	if err = c.conn.WriteMessage(pdu(CB_FORMAT_LIST_RESPONSE, CB_RESPONSE_OK, nil)); err != nil {
+		return err
+	}
+	for _, f := range formats {
+		if f == CF_UNICODETEXT {
+			buff := &bytes.Buffer{}
+			core.WriteUInt32LE(CF_UNICODETEXT, buff)
+			return c.conn.WriteMessage(pdu(CB_FORMAT_DATA_REQUEST, 0, buff.Bytes()))
+		}
+	}
+	return nil
+}
+
+/**
+ * @see MS-RDPECLIP 2.2.5.2 Format Data Response PDU (CLIPRDR_FORMAT_DATA_RESPONSE)
+ */
+func (c *Client) recvFormatDataRequest(data []byte) error {
+	if len(data) < 4 {
+		return errors.New("format data request too short")
+	}
+	format := uint32(data[0]) | uint32(data[1])<<8 | uint32(data[2])<<16 | uint32(data[3])<<24
+	c.lock.Lock()
+	text, hasText := c.text, c.hasText
+	c.lock.Unlock()
+	if format != CF_UNICODETEXT || !hasText {
+		return c.conn.WriteMessage(pdu(CB_FORMAT_DATA_RESPONSE, CB_RESPONSE_FAIL, nil))
+	}
+	return c.conn.WriteMessage(pdu(CB_FORMAT_DATA_RESPONSE, CB_RESPONSE_OK, core.UnicodeEncode(text+"\x00")))
+}
+
+func (c *Client) recvText(data []byte) {
+	u := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		v := uint16(data[i]) | uint16(data[i+1])<<8
+		if v == 0 {
+			break
+		}
+		u = append(u, v)
+	}
+	c.lock.Lock()
+	f := c.onText
+	c.lock.Unlock()
+	if f != nil {
+		f(string(utf16.Decode(u)))
+	}
+}
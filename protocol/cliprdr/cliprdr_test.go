@@ -0,0 +1,94 @@
+package cliprdr
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tomatome/grdp/core"
+	"github.com/tomatome/grdp/glog"
+	"github.com/tomatome/grdp/plugin"
+)
+
+func init() {
+	glog.SetLevel(glog.NONE)
+}
+
+func expect(t *testing.T, server *plugin.ChannelConn, msg string) {
+	t.Helper()
+	b, err := server.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(b) != msg {
+		t.Fatalf("get %x, expect %s", b, msg)
+	}
+}
+
+func TestClipboardText(t *testing.T) {
+	client, conn := net.Pipe()
+	defer conn.Close()
+	server := plugin.NewChannelConn(conn, plugin.CHANNEL_OPTION_SHOW_PROTOCOL)
+	c := New(client)
+	texts := make(chan string, 1)
+	c.OnClipboardText(func(s string) {
+		texts <- s
+	})
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Run()
+	}()
+
+	// server caps with long format names, then monitor ready
+	go func() {
+		server.WriteMessage(pdu(CB_CLIP_CAPS, 0, []byte{1, 0, 0, 0, 1, 0, 12, 0, 2, 0, 0, 0, 2, 0, 0, 0}))
+		server.WriteMessage(pdu(CB_MONITOR_READY, 0, nil))
+	}()
+	expect(t, server, "07000000100000000100000001000c000200000002000000")
+	// nothing copied yet
+	expect(t, server, "0200000000000000")
+
+	go c.SetClipboardText("hé")
+	expect(t, server, "02000000060000000d0000000000")
+	go server.WriteMessage(pdu(CB_FORMAT_DATA_REQUEST, 0, []byte{13, 0, 0, 0}))
+	expect(t, server, "0500010006000000"+hex.EncodeToString(core.UnicodeEncode("hé\x00")))
+
+	// copy on the server, a named format then CF_UNICODETEXT
+	list := append([]byte{0x10, 0xd0, 0, 0}, core.UnicodeEncode("HTML Format\x00")...)
+	list = append(list, 13, 0, 0, 0, 0, 0)
+	go server.WriteMessage(pdu(CB_FORMAT_LIST, 0, list))
+	expect(t, server, "0300010000000000")
+	expect(t, server, "04000000040000000d000000")
+	go server.WriteMessage(pdu(CB_FORMAT_DATA_RESPONSE, CB_RESPONSE_OK, core.UnicodeEncode("ok€\x00")))
+	select {
+	case s := <-texts:
+		if s != "ok€" {
+			t.Errorf("get %q", s)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no clipboard text")
+	}
+
+	conn.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("run not stopped by close")
+	}
+}
+
+func TestReadFormatsShortNames(t *testing.T) {
+	data := make([]byte, 72)
+	data[0], data[36] = 13, 1
+	formats, err := readFormats(false, data)
+	if err != nil || len(formats) != 2 || formats[0] != CF_UNICODETEXT || formats[1] != 1 {
+		t.Errorf("bad formats %v %v", formats, err)
+	}
+	if _, err := readFormats(true, []byte{13, 0, 0, 0, 'a', 0}); err == nil {
+		t.Error("unterminated name accepted")
+	}
+}
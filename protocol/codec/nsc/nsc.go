@@ -0,0 +1,163 @@
+// Package nsc decodes NSCodec (MS-RDPNSC) encoded surface bits
+package nsc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+/**
+ * TS_NSCODEC_CAPABILITYSET used as the codec properties of NSCodec,
+ * dynamic fidelity and subsampling allowed with color loss level 3
+ * @see MS-RDPNSC 2.2.1 TS_NSCODEC_CAPABILITYSET
+ */
+func CapabilitySet() []byte {
+	return []byte{0x01, 0x01, 0x03}
+}
+
+// TS_NSCODEC_BITMAP_STREAM header length
+const headerLength = 20
+
+// luma, orange chroma, green chroma and alpha
+const planeCount = 4
+
+func roundUp(v, n int) int {
+	return (v + n - 1) / n * n
+}
+
+/**
+ * decodeRLE expands a plane of originalSize bytes
+ * @see MS-RDPNSC 3.1.8.1.3 RLE Decoding
+ */
+func decodeRLE(in []byte, originalSize int) ([]byte, error) {
+	out := make([]byte, 0, originalSize)
+	left := originalSize
+	for left > 4 {
+		if len(in) < 1 {
+			return nil, errors.New("nsc: truncated rle plane")
+		}
+		value := in[0]
+		in = in[1:]
+		if left == 5 || len(in) < 1 || in[0] != value {
+			out = append(out, value)
+			left--
+			continue
+		}
+		in = in[1:]
+		if len(in) < 1 {
+			return nil, errors.New("nsc: truncated rle run")
+		}
+		var run int
+		if in[0] < 0xff {
+			run = int(in[0]) + 2
+			in = in[1:]
+		} else {
+			if len(in) < 5 {
+				return nil, errors.New("nsc: truncated rle run")
+			}
+			run = int(binary.LittleEndian.Uint32(in[1:]))
+			in = in[5:]
+		}
+		if run > left {
+			return nil, errors.New("nsc: rle run overflows the plane")
+		}
+		for i := 0; i < run; i++ {
+			out = append(out, value)
+		}
+		left -= run
+	}
+	// the last 4 bytes are raw
+	if len(in) < left {
+		return nil, errors.New("nsc: truncated rle plane end")
+	}
+	return append(out, in[:left]...), nil
+}
+
+func clamp(v int) byte {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return byte(v)
+}
+
+/**
+ * DecodeNSCodec decodes a TS_NSCODEC_BITMAP_STREAM of width x height,
+ * returns 32 bpp BGRA rows top down
+ * @see MS-RDPNSC 3.1.8 Decompressing Bitmap Data
+ */
+func DecodeNSCodec(data []byte, width, height int) ([]byte, error) {
+	if width <= 0 || height <= 0 {
+		return nil, errors.New(fmt.Sprintf("nsc: invalid size %dx%d", width, height))
+	}
+	if len(data) < headerLength {
+		return nil, errors.New("nsc: truncated bitmap stream header")
+	}
+	colorLoss := int(data[16])
+	subsampling := data[17] != 0
+	if colorLoss < 1 || colorLoss > 7 {
+		return nil, errors.New(fmt.Sprintf("nsc: invalid color loss level %d", colorLoss))
+	}
+
+	// decoded plane sizes, chroma is subsampled 2x2 over a width padded to 8
+	rw := roundUp(width, 8)
+	sizes := [planeCount]int{width * height, width * height, width * height, width * height}
+	if subsampling {
+		sizes[0] = rw * height
+		sizes[1] = (rw / 2) * (roundUp(height, 2) / 2)
+		sizes[2] = sizes[1]
+	}
+
+	var planes [planeCount][]byte
+	in := data[headerLength:]
+	for i := 0; i < planeCount; i++ {
+		n := int(binary.LittleEndian.Uint32(data[i*4:]))
+		if n > len(in) {
+			return nil, errors.New(fmt.Sprintf("nsc: truncated plane %d", i))
+		}
+		switch {
+		case n == 0:
+			planes[i] = make([]byte, sizes[i])
+			for j := range planes[i] {
+				planes[i][j] = 0xff
+			}
+		case n < sizes[i]:
+			plane, err := decodeRLE(in[:n], sizes[i])
+			if err != nil {
+				return nil, err
+			}
+			planes[i] = plane
+		default:
+			planes[i] = in[:sizes[i]]
+		}
+		in = in[n:]
+	}
+
+	// YCoCg to RGB, the chroma planes carry the color loss shift
+	shift := uint(colorLoss - 1)
+	out := make([]byte, 0, width*height*4)
+	for y := 0; y < height; y++ {
+		yRow, cRow := y*width, y*width
+		if subsampling {
+			yRow, cRow = y*rw, (y/2)*(rw/2)
+		}
+		for x := 0; x < width; x++ {
+			c := cRow + x
+			if subsampling {
+				c = cRow + x/2
+			}
+			yv := int(planes[0][yRow+x])
+			co := int(int8(planes[1][c] << shift))
+			cg := int(int8(planes[2][c] << shift))
+			out = append(out,
+				clamp(yv-co-cg),
+				clamp(yv+cg),
+				clamp(yv+co-cg),
+				planes[3][y*width+x])
+		}
+	}
+	return out, nil
+}
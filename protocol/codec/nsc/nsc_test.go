@@ -0,0 +1,57 @@
+package nsc
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// 4x2 without subsampling: rle luma, raw chroma and no alpha plane
+const streamHex = "07000000" + "08000000" + "08000000" + "00000000" + "01000000" +
+	"646402" + "6464323c" +
+	"0000000000000a00" +
+	"0000000000000005"
+
+// 2x2 subsampled at color loss level 2, chroma shared by the 4 pixels
+const subsampledHex = "10000000" + "04000000" + "04000000" + "04000000" + "02010000" +
+	"0a14000000000000" + "1e28000000000000" +
+	"08000000" +
+	"fc000000" +
+	"01020304"
+
+func TestDecodeNSCodec(t *testing.T) {
+	data, _ := hex.DecodeString(streamHex)
+	out, err := DecodeNSCodec(data, 4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := "646464ff646464ff646464ff646464ff" + "646464ff646464ff" + "28323cff" + "374137ff"
+	if len(out) != 4*2*4 || hex.EncodeToString(out) != expect {
+		t.Errorf("get %x, expect %s", out, expect)
+	}
+
+	data, _ = hex.DecodeString(subsampledHex)
+	out, err = DecodeNSCodec(data, 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect = "02022201" + "0c0c2c02" + "16163603" + "20204004"
+	if len(out) != 2*2*4 || hex.EncodeToString(out) != expect {
+		t.Errorf("get %x, expect %s", out, expect)
+	}
+}
+
+func TestDecodeNSCodecInvalid(t *testing.T) {
+	data, _ := hex.DecodeString(streamHex)
+	for name, b := range map[string][]byte{
+		"header":    data[:12],
+		"truncated": data[:len(data)-1],
+		"overflow":  append(append([]byte{}, data[:20]...), 0x64, 0x64, 0x10, 0, 0, 0, 0),
+	} {
+		if _, err := DecodeNSCodec(b, 4, 2); err == nil {
+			t.Error(name, "accepted")
+		}
+	}
+	if _, err := DecodeNSCodec(data, 0, 2); err == nil {
+		t.Error("empty size accepted")
+	}
+}
@@ -0,0 +1,329 @@
+// Package rfx decodes RemoteFX (MS-RDPRFX) encoded surface bits
+package rfx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/tomatome/grdp/core"
+	"github.com/tomatome/grdp/glog"
+)
+
+// message block types
+// @see MS-RDPRFX 2.2.2.1.1 TS_RFX_BLOCKT
+const (
+	WBT_SYNC           = 0xCCC0
+	WBT_CODEC_VERSIONS = 0xCCC1
+	WBT_CHANNELS       = 0xCCC2
+	WBT_CONTEXT        = 0xCCC3
+	WBT_FRAME_BEGIN    = 0xCCC4
+	WBT_FRAME_END      = 0xCCC5
+	WBT_REGION         = 0xCCC6
+	WBT_EXTENSION      = 0xCCC7
+	CBT_REGION         = 0xCAC1
+	CBT_TILESET        = 0xCAC2
+	CBT_TILE           = 0xCAC3
+)
+
+// capability block types
+// @see MS-RDPRFX 2.2.1.1 TS_RFX_CLNT_CAPS_CONTAINER
+const (
+	CBY_CAPS   = 0xCBC0
+	CBY_CAPSET = 0xCBC1
+	CLY_CAPSET = 0xCFC0
+)
+
+const (
+	WF_MAGIC        = 0xCACCACCA
+	WF_VERSION_1_0  = 0x0100
+	CLW_VERSION_1_0 = 0x0100
+)
+
+const (
+	CLW_ENTROPY_RLGR1 = 0x01
+	CLW_ENTROPY_RLGR3 = 0x04
+)
+
+const (
+	CARDP_CAPS_CAPTURE_NON_CAC = 0x00000001
+	CODEC_MODE_IMAGE           = 0x02
+	CLW_COL_CONV_ICT           = 0x1
+	CLW_XFORM_DWT_53_A         = 0x1
+	CT_TILE_64x64              = 0x0040
+)
+
+/**
+ * TS_RFX_CLNT_CAPS_CONTAINER advertising 64x64 tiles with RLGR1 and RLGR3,
+ * used as the codec properties of the RemoteFX bitmap codec
+ * @see MS-RDPRFX 2.2.1.1 TS_RFX_CLNT_CAPS_CONTAINER
+ */
+func ClientCapsContainer() []byte {
+	icaps := &bytes.Buffer{}
+	for _, entropy := range []uint8{CLW_ENTROPY_RLGR1, CLW_ENTROPY_RLGR3} {
+		core.WriteUInt16LE(CLW_VERSION_1_0, icaps)
+		core.WriteUInt16LE(CT_TILE_64x64, icaps)
+		core.WriteUInt8(CODEC_MODE_IMAGE, icaps)
+		core.WriteUInt8(CLW_COL_CONV_ICT, icaps)
+		core.WriteUInt8(CLW_XFORM_DWT_53_A, icaps)
+		core.WriteUInt8(entropy, icaps)
+	}
+
+	caps := &bytes.Buffer{}
+	core.WriteUInt16LE(CBY_CAPS, caps)
+	core.WriteUInt32LE(8, caps)
+	core.WriteUInt16LE(1, caps)
+	core.WriteUInt16LE(CBY_CAPSET, caps)
+	core.WriteUInt32LE(uint32(13+icaps.Len()), caps)
+	core.WriteUInt8(0x01, caps)
+	core.WriteUInt16LE(CLY_CAPSET, caps)
+	core.WriteUInt16LE(2, caps)
+	core.WriteUInt16LE(8, caps)
+	core.WriteBytes(icaps.Bytes(), caps)
+
+	buff := &bytes.Buffer{}
+	core.WriteUInt32LE(uint32(12+caps.Len()), buff)
+	core.WriteUInt32LE(CARDP_CAPS_CAPTURE_NON_CAC, buff)
+	core.WriteUInt32LE(uint32(caps.Len()), buff)
+	core.WriteBytes(caps.Bytes(), buff)
+	return buff.Bytes()
+}
+
+type Rect struct {
+	X, Y, Width, Height uint16
+}
+
+// Tile is a decoded 64x64 tile at X, Y, Pixels are BGRA rows top down
+type Tile struct {
+	X, Y   uint16
+	Pixels []byte
+}
+
+// Frame is the content of one RemoteFX frame, only Rects must be painted
+type Frame struct {
+	Index uint32
+	Rects []Rect
+	Tiles []Tile
+}
+
+// Decoder keeps the stream state sent once in sync and context messages
+type Decoder struct {
+	width   uint16
+	height  uint16
+	entropy uint8
+	frame   *Frame
+	buff    [3][tileCoefficients]int16
+	tmp     [tileCoefficients]int16
+}
+
+func NewDecoder() *Decoder {
+	return &Decoder{entropy: CLW_ENTROPY_RLGR1}
+}
+
+/**
+ * Decode the messages of one surface bits command,
+ * returns the frames ended in data
+ * @see MS-RDPRFX 2.2.2 Message Syntax
+ */
+func (d *Decoder) Decode(data []byte) ([]*Frame, error) {
+	var frames []*Frame
+	for len(data) > 0 {
+		if len(data) < 6 {
+			return frames, errors.New("rfx: truncated block header")
+		}
+		blockType := binary.LittleEndian.Uint16(data)
+		blockLen := int(binary.LittleEndian.Uint32(data[2:]))
+		if blockLen < 6 || blockLen > len(data) {
+			return frames, errors.New(fmt.Sprintf("rfx: invalid block 0x%04x length %d", blockType, blockLen))
+		}
+		block := data[6:blockLen]
+		data = data[blockLen:]
+		if blockType >= WBT_CONTEXT && blockType <= WBT_EXTENSION {
+			// TS_RFX_CODEC_CHANNELT codecId and channelId
+			if len(block) < 2 {
+				return frames, errors.New(fmt.Sprintf("rfx: truncated block 0x%04x", blockType))
+			}
+			block = block[2:]
+		}
+
+		var err error
+		switch blockType {
+		case WBT_SYNC:
+			err = d.readSync(block)
+		case WBT_CODEC_VERSIONS:
+		case WBT_CHANNELS:
+			err = d.readChannels(block)
+		case WBT_CONTEXT:
+			err = d.readContext(block)
+		case WBT_FRAME_BEGIN:
+			if len(block) < 6 {
+				return frames, errors.New("rfx: truncated frame begin")
+			}
+			d.frame = &Frame{Index: binary.LittleEndian.Uint32(block)}
+		case WBT_FRAME_END:
+			if d.frame == nil {
+				return frames, errors.New("rfx: frame end without frame begin")
+			}
+			frames = append(frames, d.frame)
+			d.frame = nil
+		case WBT_REGION:
+			err = d.readRegion(block)
+		case WBT_EXTENSION:
+			err = d.readTileSet(block)
+		default:
+			glog.Debugf("rfx: skip block 0x%04x", blockType)
+		}
+		if err != nil {
+			return frames, err
+		}
+	}
+	return frames, nil
+}
+
+// @see MS-RDPRFX 2.2.2.2.1 TS_RFX_SYNC
+func (d *Decoder) readSync(b []byte) error {
+	if len(b) < 6 {
+		return errors.New("rfx: truncated sync")
+	}
+	if magic := binary.LittleEndian.Uint32(b); magic != WF_MAGIC {
+		return errors.New(fmt.Sprintf("rfx: invalid sync magic 0x%08x", magic))
+	}
+	if version := binary.LittleEndian.Uint16(b[4:]); version != WF_VERSION_1_0 {
+		return errors.New(fmt.Sprintf("rfx: unsupported version 0x%04x", version))
+	}
+	return nil
+}
+
+// @see MS-RDPRFX 2.2.2.2.3 TS_RFX_CHANNELS
+func (d *Decoder) readChannels(b []byte) error {
+	if len(b) < 1 || int(b[0]) < 1 || len(b) < 1+5*int(b[0]) {
+		return errors.New("rfx: invalid channels")
+	}
+	d.width = binary.LittleEndian.Uint16(b[2:])
+	d.height = binary.LittleEndian.Uint16(b[4:])
+	return nil
+}
+
+// @see MS-RDPRFX 2.2.2.2.4 TS_RFX_CONTEXT
+func (d *Decoder) readContext(b []byte) error {
+	if len(b) < 5 {
+		return errors.New("rfx: truncated context")
+	}
+	if tileSize := binary.LittleEndian.Uint16(b[1:]); tileSize != CT_TILE_64x64 {
+		return errors.New(fmt.Sprintf("rfx: unsupported tile size %d", tileSize))
+	}
+	properties := binary.LittleEndian.Uint16(b[3:])
+	return d.setEntropy(uint8(properties >> 9 & 0xf))
+}
+
+func (d *Decoder) setEntropy(entropy uint8) error {
+	if entropy != CLW_ENTROPY_RLGR1 && entropy != CLW_ENTROPY_RLGR3 {
+		return errors.New(fmt.Sprintf("rfx: unsupported entropy 0x%x", entropy))
+	}
+	d.entropy = entropy
+	return nil
+}
+
+// @see MS-RDPRFX 2.2.2.3.3 TS_RFX_REGION
+func (d *Decoder) readRegion(b []byte) error {
+	if d.frame == nil {
+		return errors.New("rfx: region outside of a frame")
+	}
+	if len(b) < 3 {
+		return errors.New("rfx: truncated region")
+	}
+	numRects := int(binary.LittleEndian.Uint16(b[1:]))
+	if numRects == 0 {
+		// the whole channel is updated
+		d.frame.Rects = append(d.frame.Rects, Rect{Width: d.width, Height: d.height})
+		return nil
+	}
+	b = b[3:]
+	if len(b) < numRects*8 {
+		return errors.New("rfx: truncated region rectangles")
+	}
+	for i := 0; i < numRects; i++ {
+		r := b[i*8:]
+		d.frame.Rects = append(d.frame.Rects, Rect{
+			X:      binary.LittleEndian.Uint16(r),
+			Y:      binary.LittleEndian.Uint16(r[2:]),
+			Width:  binary.LittleEndian.Uint16(r[4:]),
+			Height: binary.LittleEndian.Uint16(r[6:]),
+		})
+	}
+	return nil
+}
+
+// @see MS-RDPRFX 2.2.2.3.4 TS_RFX_TILESET
+func (d *Decoder) readTileSet(b []byte) error {
+	if d.frame == nil {
+		return errors.New("rfx: tileset outside of a frame")
+	}
+	if len(b) < 14 {
+		return errors.New("rfx: truncated tileset")
+	}
+	if subtype := binary.LittleEndian.Uint16(b); subtype != CBT_TILESET {
+		return errors.New(fmt.Sprintf("rfx: invalid tileset subtype 0x%04x", subtype))
+	}
+	properties := binary.LittleEndian.Uint16(b[4:])
+	if err := d.setEntropy(uint8(properties >> 10 & 0xf)); err != nil {
+		return err
+	}
+	numQuant := int(b[6])
+	if b[7] != TILE_SIZE {
+		return errors.New(fmt.Sprintf("rfx: unsupported tile size %d", b[7]))
+	}
+	numTiles := int(binary.LittleEndian.Uint16(b[8:]))
+	b = b[14:]
+	if len(b) < numQuant*5 {
+		return errors.New("rfx: truncated quantization values")
+	}
+	quants := make([]Quant, numQuant)
+	for i := range quants {
+		quants[i] = readQuant(b[i*5:])
+	}
+	b = b[numQuant*5:]
+
+	for i := 0; i < numTiles; i++ {
+		if len(b) < 6 {
+			return errors.New(fmt.Sprintf("rfx: truncated tile %d", i))
+		}
+		blockType := binary.LittleEndian.Uint16(b)
+		blockLen := int(binary.LittleEndian.Uint32(b[2:]))
+		if blockType != CBT_TILE || blockLen < 19 || blockLen > len(b) {
+			return errors.New(fmt.Sprintf("rfx: invalid tile %d", i))
+		}
+		tile, err := d.decodeTile(b[6:blockLen], quants)
+		if err != nil {
+			return errors.New(fmt.Sprintf("rfx: tile %d: %v", i, err))
+		}
+		d.frame.Tiles = append(d.frame.Tiles, tile)
+		b = b[blockLen:]
+	}
+	return nil
+}
+
+// @see MS-RDPRFX 2.2.2.3.4.1 TS_RFX_TILE
+func (d *Decoder) decodeTile(b []byte, quants []Quant) (Tile, error) {
+	tile := Tile{
+		X: binary.LittleEndian.Uint16(b[3:]) * TILE_SIZE,
+		Y: binary.LittleEndian.Uint16(b[5:]) * TILE_SIZE,
+	}
+	data := b[13:]
+	for i := 0; i < 3; i++ {
+		if int(b[i]) >= len(quants) {
+			return tile, errors.New(fmt.Sprintf("invalid quantization index %d", b[i]))
+		}
+		ln := int(binary.LittleEndian.Uint16(b[7+i*2:]))
+		if ln > len(data) {
+			return tile, errors.New("truncated component data")
+		}
+		rlgrDecode(data[:ln], d.entropy, d.buff[i][:])
+		decodeComponent(d.buff[i][:], &quants[b[i]], d.tmp[:])
+		data = data[ln:]
+	}
+	tile.Pixels = make([]byte, tileCoefficients*4)
+	toBGRA(d.buff[0][:], d.buff[1][:], d.buff[2][:], tile.Pixels)
+	return tile, nil
+}
@@ -0,0 +1,141 @@
+package rfx
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/tomatome/grdp/core"
+	"github.com/tomatome/grdp/glog"
+)
+
+func init() {
+	glog.SetLevel(glog.NONE)
+}
+
+func TestRLGR1(t *testing.T) {
+	// run of 2 zeros then 3, then a zero in GR mode
+	out := make([]int16, 8)
+	rlgrDecode([]byte{0x48}, CLW_ENTROPY_RLGR1, out)
+	expect := []int16{0, 0, 3, 0, 0, 0, 0, 0}
+	for i := range out {
+		if out[i] != expect[i] {
+			t.Fatalf("get %v, expect %v", out, expect)
+		}
+	}
+}
+
+func TestRLGR3(t *testing.T) {
+	// run of 2 zeros then 3, then the pair -1, 1 in GR mode
+	out := make([]int16, 8)
+	rlgrDecode([]byte{0x49, 0x50}, CLW_ENTROPY_RLGR3, out)
+	expect := []int16{0, 0, 3, -1, 1, 0, 0, 0}
+	for i := range out {
+		if out[i] != expect[i] {
+			t.Fatalf("get %v, expect %v", out, expect)
+		}
+	}
+}
+
+func TestDecodeComponent(t *testing.T) {
+	var buff, tmp [tileCoefficients]int16
+	buff[offsetLL3] = 127
+	q := Quant{6, 6, 6, 6, 6, 6, 6, 6, 6, 6}
+	decodeComponent(buff[:], &q, tmp[:])
+	for i, v := range buff {
+		if v != 127<<5 {
+			t.Fatalf("sample %d is %d, expect %d", i, v, 127<<5)
+		}
+	}
+
+	var zero [tileCoefficients]int16
+	pixels := make([]byte, tileCoefficients*4)
+	toBGRA(buff[:], zero[:], zero[:], pixels)
+	if !bytes.Equal(pixels[:8], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}) {
+		t.Errorf("expect white, get %x", pixels[:8])
+	}
+}
+
+func block(blockType uint16, channel bool, body []byte) []byte {
+	buff := &bytes.Buffer{}
+	core.WriteUInt16LE(blockType, buff)
+	ln := 6 + len(body)
+	if channel {
+		ln += 2
+	}
+	core.WriteUInt32LE(uint32(ln), buff)
+	if channel {
+		core.WriteBytes([]byte{0x01, 0x00}, buff)
+	}
+	core.WriteBytes(body, buff)
+	return buff.Bytes()
+}
+
+func message() []byte {
+	buff := &bytes.Buffer{}
+	core.WriteBytes(block(WBT_SYNC, false, []byte{0xca, 0xac, 0xcc, 0xca, 0x00, 0x01}), buff)
+	core.WriteBytes(block(WBT_CODEC_VERSIONS, false, []byte{0x01, 0x01, 0x00, 0x01}), buff)
+	core.WriteBytes(block(WBT_CHANNELS, false, []byte{0x01, 0x00, 0x80, 0x00, 0x40, 0x00}), buff)
+	// tile size 64, RLGR1 entropy
+	core.WriteBytes(block(WBT_CONTEXT, true, []byte{0x00, 0x40, 0x00, 0x28, 0x02}), buff)
+	core.WriteBytes(block(WBT_FRAME_BEGIN, true, []byte{0x07, 0x00, 0x00, 0x00, 0x01, 0x00}), buff)
+	// one 16x8 rectangle at 60,0
+	core.WriteBytes(block(WBT_REGION, true, []byte{0x01, 0x01, 0x00,
+		0x3c, 0x00, 0x00, 0x00, 0x10, 0x00, 0x08, 0x00,
+		0xc1, 0xca, 0x01, 0x00}), buff)
+
+	// empty component data decodes to mid gray
+	tile := block(CBT_TILE, false, []byte{0x00, 0x00, 0x00,
+		0x01, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+	tileset := &bytes.Buffer{}
+	core.WriteUInt16LE(CBT_TILESET, tileset)
+	core.WriteUInt16LE(0, tileset)
+	core.WriteUInt16LE(CLW_ENTROPY_RLGR1<<10, tileset)
+	core.WriteUInt8(1, tileset)
+	core.WriteUInt8(TILE_SIZE, tileset)
+	core.WriteUInt16LE(1, tileset)
+	core.WriteUInt32LE(uint32(len(tile)), tileset)
+	core.WriteBytes([]byte{0x66, 0x66, 0x77, 0x88, 0x98}, tileset)
+	core.WriteBytes(tile, tileset)
+	core.WriteBytes(block(WBT_EXTENSION, true, tileset.Bytes()), buff)
+	core.WriteBytes(block(WBT_FRAME_END, true, nil), buff)
+	return buff.Bytes()
+}
+
+func TestDecode(t *testing.T) {
+	d := NewDecoder()
+	frames, err := d.Decode(message())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 1 {
+		t.Fatalf("expect 1 frame, get %d", len(frames))
+	}
+	f := frames[0]
+	if f.Index != 7 || len(f.Rects) != 1 || f.Rects[0] != (Rect{60, 0, 16, 8}) {
+		t.Errorf("bad frame %+v", f)
+	}
+	if d.width != 128 || d.height != 64 {
+		t.Errorf("bad channel size %dx%d", d.width, d.height)
+	}
+	if len(f.Tiles) != 1 || f.Tiles[0].X != 64 || f.Tiles[0].Y != 0 {
+		t.Fatalf("bad tiles %+v", f.Tiles)
+	}
+	pixels := f.Tiles[0].Pixels
+	if len(pixels) != TILE_SIZE*TILE_SIZE*4 || !bytes.Equal(pixels[:4], []byte{0x80, 0x80, 0x80, 0xff}) {
+		t.Errorf("expect gray tile, get %x", pixels[:4])
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	data := message()
+	for name, b := range map[string][]byte{
+		"magic":     block(WBT_SYNC, false, []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x01}),
+		"truncated": data[:len(data)-3],
+		"frame end": block(WBT_FRAME_END, true, nil),
+	} {
+		if _, err := NewDecoder().Decode(b); err == nil {
+			t.Error(name, "accepted")
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package rfx
+
+/**
+ * RLGR entropy decoding
+ * @see MS-RDPRFX 3.1.8.1.7.3 RLGR1/RLGR3 Pseudocode
+ */
+const (
+	kpMax = 80 // max value for kp or krp
+	lsGR  = 3  // shift count to convert kp to k
+	upGR  = 4  // increase in kp after a zero run in RL mode
+	dnGR  = 6  // decrease in kp after a nonzero symbol in RL mode
+	uqGR  = 3  // increase in kp after zero symbol in GR mode
+	dqGR  = 3  // decrease in kp after nonzero symbol in GR mode
+)
+
+type bitReader struct {
+	data []byte
+	pos  int // in bits
+}
+
+func (b *bitReader) eof() bool {
+	return b.pos >= len(b.data)*8
+}
+
+// bits reads n bits msb first, missing bits past the end read as 0
+func (b *bitReader) bits(n int) int {
+	v := 0
+	for i := 0; i < n; i++ {
+		v <<= 1
+		if !b.eof() && b.data[b.pos>>3]&(0x80>>uint(b.pos&7)) != 0 {
+			v |= 1
+		}
+		b.pos++
+	}
+	return v
+}
+
+// grCode reads a Golomb-Rice code and adapts kr
+func (b *bitReader) grCode(krp, kr *int) int {
+	vk := 0
+	for !b.eof() && b.bits(1) == 1 {
+		vk++
+	}
+	mag := vk<<uint(*kr) | b.bits(*kr)
+	if vk == 0 {
+		*krp -= 2
+		if *krp < 0 {
+			*krp = 0
+		}
+		*kr = *krp >> lsGR
+	} else if vk != 1 {
+		*krp += vk
+		if *krp > kpMax {
+			*krp = kpMax
+		}
+		*kr = *krp >> lsGR
+	}
+	return mag
+}
+
+func fromTwoMagSign(v int) int16 {
+	if v&1 != 0 {
+		return int16(-((v + 1) >> 1))
+	}
+	return int16(v >> 1)
+}
+
+func minBits(v int) int {
+	n := 0
+	for v != 0 {
+		v >>= 1
+		n++
+	}
+	return n
+}
+
+// rlgrDecode fills out with the coefficients in data, out is zero padded
+func rlgrDecode(data []byte, entropy uint8, out []int16) {
+	b := &bitReader{data: data}
+	k, kp := 1, 1<<lsGR
+	kr, krp := 1, 1<<lsGR
+	i := 0
+	write := func(v int16) {
+		if i < len(out) {
+			out[i] = v
+			i++
+		}
+	}
+
+	for !b.eof() && i < len(out) {
+		if k != 0 {
+			// run length mode
+			run := 0
+			for !b.eof() && b.bits(1) == 0 {
+				run += 1 << uint(k)
+				kp += upGR
+				if kp > kpMax {
+					kp = kpMax
+				}
+				k = kp >> lsGR
+			}
+			run += b.bits(k)
+			sign := b.bits(1)
+			mag := b.grCode(&krp, &kr) + 1
+			for ; run > 0; run-- {
+				write(0)
+			}
+			if sign != 0 {
+				write(int16(-mag))
+			} else {
+				write(int16(mag))
+			}
+			kp -= dnGR
+			if kp < 0 {
+				kp = 0
+			}
+			k = kp >> lsGR
+			continue
+		}
+
+		// Golomb-Rice mode
+		mag := b.grCode(&krp, &kr)
+		if entropy == CLW_ENTROPY_RLGR1 {
+			if mag == 0 {
+				write(0)
+				kp += uqGR
+				if kp > kpMax {
+					kp = kpMax
+				}
+			} else {
+				write(fromTwoMagSign(mag))
+				kp -= dqGR
+				if kp < 0 {
+					kp = 0
+				}
+			}
+			k = kp >> lsGR
+			continue
+		}
+		val1 := b.bits(minBits(mag))
+		val2 := mag - val1
+		if val1 != 0 && val2 != 0 {
+			kp -= 2 * dqGR
+			if kp < 0 {
+				kp = 0
+			}
+		} else if val1 == 0 && val2 == 0 {
+			kp += 2 * uqGR
+			if kp > kpMax {
+				kp = kpMax
+			}
+		}
+		k = kp >> lsGR
+		write(fromTwoMagSign(val1))
+		write(fromTwoMagSign(val2))
+	}
+	for ; i < len(out); i++ {
+		out[i] = 0
+	}
+}
@@ -0,0 +1,142 @@
+package rfx
+
+const (
+	TILE_SIZE = 64
+	// coefficients of one tile component
+	tileCoefficients = TILE_SIZE * TILE_SIZE
+)
+
+// subband offsets in the linear coefficient buffer
+// @see MS-RDPRFX 3.1.8.2 Encoding of Tiles
+const (
+	offsetHL1 = 0
+	offsetLH1 = 1024
+	offsetHH1 = 2048
+	offsetHL2 = 3072
+	offsetLH2 = 3328
+	offsetHH2 = 3584
+	offsetHL3 = 3840
+	offsetLH3 = 3904
+	offsetHH3 = 3968
+	offsetLL3 = 4032
+)
+
+/**
+ * TS_RFX_CODEC_QUANT, one 4 bit factor per subband
+ * @see MS-RDPRFX 2.2.2.1.5 TS_RFX_CODEC_QUANT
+ */
+type Quant struct {
+	LL3, LH3, HL3, HH3, LH2, HL2, HH2, LH1, HL1, HH1 uint8
+}
+
+func readQuant(b []byte) Quant {
+	return Quant{
+		LL3: b[0] & 0xf, LH3: b[0] >> 4,
+		HL3: b[1] & 0xf, HH3: b[1] >> 4,
+		LH2: b[2] & 0xf, HL2: b[2] >> 4,
+		HH2: b[3] & 0xf, LH1: b[3] >> 4,
+		HL1: b[4] & 0xf, HH1: b[4] >> 4,
+	}
+}
+
+// dequantize scales each subband back by 2^(factor-1)
+// @see MS-RDPRFX 3.1.8.1.5 Quantization
+func dequantize(buff []int16, q *Quant) {
+	for _, band := range []struct {
+		offset, length int
+		factor         uint8
+	}{
+		{offsetHL1, 1024, q.HL1}, {offsetLH1, 1024, q.LH1}, {offsetHH1, 1024, q.HH1},
+		{offsetHL2, 256, q.HL2}, {offsetLH2, 256, q.LH2}, {offsetHH2, 256, q.HH2},
+		{offsetHL3, 64, q.HL3}, {offsetLH3, 64, q.LH3}, {offsetHH3, 64, q.HH3},
+		{offsetLL3, 64, q.LL3},
+	} {
+		if band.factor < 2 {
+			continue
+		}
+		shift := uint(band.factor - 1)
+		for i := band.offset; i < band.offset+band.length; i++ {
+			buff[i] <<= shift
+		}
+	}
+}
+
+// inverse DWT of one level, the subbands are stored HL, LH, HH, LL from buff[0]
+// @see MS-RDPRFX 3.1.8.1.4 DWT
+func idwtBlock(buff, tmp []int16, width int) {
+	total := width * 2
+	hl, lh, hh, ll := buff, buff[width*width:], buff[2*width*width:], buff[3*width*width:]
+	l, h := tmp, tmp[2*width*width:]
+
+	// horizontal, L from LL and HL, H from LH and HH
+	for y := 0; y < width; y++ {
+		row, band := y*total, y*width
+		l[row] = int16(int(ll[band]) - ((int(hl[band])*2 + 1) >> 1))
+		h[row] = int16(int(lh[band]) - ((int(hh[band])*2 + 1) >> 1))
+		for n := 1; n < width; n++ {
+			x := row + n*2
+			l[x] = int16(int(ll[band+n]) - ((int(hl[band+n-1]) + int(hl[band+n]) + 1) >> 1))
+			h[x] = int16(int(lh[band+n]) - ((int(hh[band+n-1]) + int(hh[band+n]) + 1) >> 1))
+		}
+		for n := 0; n < width-1; n++ {
+			x := row + n*2
+			l[x+1] = int16(int(hl[band+n])<<1 + (int(l[x])+int(l[x+2]))>>1)
+			h[x+1] = int16(int(hh[band+n])<<1 + (int(h[x])+int(h[x+2]))>>1)
+		}
+		n, x := width-1, row+(width-1)*2
+		l[x+1] = int16(int(hl[band+n])<<1 + int(l[x]))
+		h[x+1] = int16(int(hh[band+n])<<1 + int(h[x]))
+	}
+
+	// vertical, back into buff
+	for x := 0; x < total; x++ {
+		buff[x] = int16(int(l[x]) - ((int(h[x])*2 + 1) >> 1))
+		for n := 1; n < width; n++ {
+			even, odd := (2*n)*total+x, (2*n-1)*total+x
+			hp, hn := int(h[(n-1)*total+x]), int(h[n*total+x])
+			buff[even] = int16(int(l[n*total+x]) - ((hp + hn + 1) >> 1))
+			buff[odd] = int16(hp<<1 + (int(buff[odd-total])+int(buff[even]))>>1)
+		}
+		last := (2*width-1)*total + x
+		buff[last] = int16(int(h[(width-1)*total+x])<<1 + int(buff[last-total]))
+	}
+}
+
+// decodeComponent turns the rlgr coefficients of a component into 64x64 samples
+func decodeComponent(buff []int16, q *Quant, tmp []int16) {
+	// LL3 is differentially encoded
+	for i := offsetLL3 + 1; i < tileCoefficients; i++ {
+		buff[i] += buff[i-1]
+	}
+	dequantize(buff, q)
+	idwtBlock(buff[offsetHL3:], tmp, 8)
+	idwtBlock(buff[offsetHL2:], tmp, 16)
+	idwtBlock(buff[offsetHL1:], tmp, 32)
+}
+
+func clamp(v int) byte {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return byte(v)
+}
+
+// toBGRA converts samples in 11.5 fixed point to 32 bpp BGRA
+// @see MS-RDPRFX 3.1.8.1.3 Color Conversion
+func toBGRA(y, cb, cr []int16, out []byte) {
+	const shift = 16
+	for i := 0; i < tileCoefficients; i++ {
+		yv := (int64(y[i]) + 4096) << shift
+		cbv, crv := int64(cb[i]), int64(cr[i])
+		r := (yv + crv*91915) >> shift
+		g := (yv - cbv*22526 - crv*46818) >> shift
+		b := (yv + cbv*115992) >> shift
+		out[i*4] = clamp(int(b) >> 5)
+		out[i*4+1] = clamp(int(g) >> 5)
+		out[i*4+2] = clamp(int(r) >> 5)
+		out[i*4+3] = 0xff
+	}
+}
@@ -0,0 +1,157 @@
+// Package disp resizes the remote desktop over the display control dynamic
+// virtual channel
+package disp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/tomatome/grdp/core"
+	"github.com/tomatome/grdp/glog"
+)
+
+// CHANNEL_NAME is the dynamic virtual channel to open for the Client
+const CHANNEL_NAME = "Microsoft::Windows::RDS::DisplayControl"
+
+/**
+ * @see MS-RDPEDISP 2.2.1.1 DISPLAYCONTROL_HEADER
+ */
+const (
+	DISPLAYCONTROL_PDU_TYPE_MONITOR_LAYOUT = 0x00000002
+	DISPLAYCONTROL_PDU_TYPE_CAPS           = 0x00000005
+)
+
+/**
+ * @see MS-RDPEDISP 2.2.2.2.1 DISPLAYCONTROL_MONITOR_LAYOUT
+ */
+const (
+	DISPLAYCONTROL_MONITOR_PRIMARY = 0x00000001
+	monitorLayoutSize              = 40
+)
+
+// bounds of the monitor width and height
+const (
+	MIN_MONITOR_SIZE = 200
+	MAX_MONITOR_SIZE = 8192
+)
+
+// headerLength of a display control PDU
+const headerLength = 8
+
+/**
+ * Client of the display control channel, the server sends its capabilities
+ * when it creates the channel, then takes the monitor layouts of Resize
+ * @see MS-RDPEDISP 1.3 Overview
+ */
+type Client struct {
+	rw io.ReadWriteCloser
+
+	lock sync.Mutex
+	// DISPLAYCONTROL_CAPS_PDU, zero before it is received
+	maxNumMonitors        uint32
+	maxMonitorAreaFactorA uint32
+	maxMonitorAreaFactorB uint32
+}
+
+// New returns a client of the display control channel rw, see Run
+func New(rw io.ReadWriteCloser) *Client {
+	return &Client{rw: rw}
+}
+
+// Run processes the channel until it is closed
+func (c *Client) Run() error {
+	for {
+		b, err := core.ReadBytes(headerLength, c.rw)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		r := bytes.NewReader(b)
+		pduType, _ := core.ReadUInt32LE(r)
+		length, _ := core.ReadUInt32LE(r)
+		if length < headerLength {
+			return errors.New(fmt.Sprintf("display control pdu length %d", length))
+		}
+		data, err := core.ReadBytes(int(length-headerLength), c.rw)
+		if err != nil {
+			return err
+		}
+		if pduType != DISPLAYCONTROL_PDU_TYPE_CAPS {
+			glog.Warn("disp: skip pdu type", pduType)
+			continue
+		}
+		if err = c.recvCapabilities(data); err != nil {
+			return err
+		}
+	}
+}
+
+// Close closes the channel
+func (c *Client) Close() error {
+	return c.rw.Close()
+}
+
+// recvCapabilities reads the DISPLAYCONTROL_CAPS_PDU after its header
+func (c *Client) recvCapabilities(data []byte) error {
+	if len(data) < 12 {
+		return errors.New(fmt.Sprintf("display control capabilities of %d bytes", len(data)))
+	}
+	r := bytes.NewReader(data)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.maxNumMonitors, _ = core.ReadUInt32LE(r)
+	c.maxMonitorAreaFactorA, _ = core.ReadUInt32LE(r)
+	c.maxMonitorAreaFactorB, _ = core.ReadUInt32LE(r)
+	glog.Debug("disp capabilities:", c.maxNumMonitors, c.maxMonitorAreaFactorA, c.maxMonitorAreaFactorB)
+	return nil
+}
+
+// Ready tells if the server sent its capabilities, Resize fails before
+func (c *Client) Ready() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.maxNumMonitors != 0
+}
+
+/**
+ * Resize asks the server for a single monitor desktop of width x height,
+ * both even and between MIN_MONITOR_SIZE and MAX_MONITOR_SIZE
+ * @see MS-RDPEDISP 2.2.2.2 DISPLAYCONTROL_MONITOR_LAYOUT_PDU
+ */
+func (c *Client) Resize(width, height uint32) error {
+	if width%2 != 0 || width < MIN_MONITOR_SIZE || width > MAX_MONITOR_SIZE {
+		return errors.New(fmt.Sprintf("invalid desktop width %d", width))
+	}
+	if height%2 != 0 || height < MIN_MONITOR_SIZE || height > MAX_MONITOR_SIZE {
+		return errors.New(fmt.Sprintf("invalid desktop height %d", height))
+	}
+	c.lock.Lock()
+	maxArea := uint64(c.maxNumMonitors) * uint64(c.maxMonitorAreaFactorA) * uint64(c.maxMonitorAreaFactorB)
+	c.lock.Unlock()
+	if maxArea == 0 {
+		return errors.New("display control capabilities not received")
+	}
+	if uint64(width)*uint64(height) > maxArea {
+		return errors.New(fmt.Sprintf("desktop of %dx%d above the maximum area %d", width, height, maxArea))
+	}
+
+	buff := &bytes.Buffer{}
+	core.WriteUInt32LE(DISPLAYCONTROL_PDU_TYPE_MONITOR_LAYOUT, buff)
+	core.WriteUInt32LE(headerLength+8+monitorLayoutSize, buff)
+	core.WriteUInt32LE(monitorLayoutSize, buff)
+	core.WriteUInt32LE(1, buff) // NumMonitors
+	core.WriteUInt32LE(DISPLAYCONTROL_MONITOR_PRIMARY, buff)
+	core.WriteUInt32LE(0, buff) // Left
+	core.WriteUInt32LE(0, buff) // Top
+	core.WriteUInt32LE(width, buff)
+	core.WriteUInt32LE(height, buff)
+	// physical size, orientation and scale factors left to the server
+	core.WriteBytes(make([]byte, 20), buff)
+	_, err := c.rw.Write(buff.Bytes())
+	return err
+}
@@ -0,0 +1,53 @@
+package disp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"testing"
+
+	"github.com/tomatome/grdp/glog"
+)
+
+func init() {
+	glog.SetLevel(glog.NONE)
+}
+
+// channel reads the PDUs of the server and records the written ones
+type channel struct {
+	io.Reader
+	written bytes.Buffer
+}
+
+func (c *channel) Write(p []byte) (int, error) { return c.written.Write(p) }
+func (c *channel) Close() error                { return nil }
+
+func TestResize(t *testing.T) {
+	// caps of 16 monitors of 8192 x 8192, then an unknown pdu
+	caps, _ := hex.DecodeString("05000000" + "14000000" + "10000000" + "00200000" + "00200000" + "09000000" + "08000000")
+	ch := &channel{Reader: bytes.NewReader(caps)}
+	c := New(ch)
+	if err := c.Resize(1024, 768); err == nil {
+		t.Error("resize before the capabilities accepted")
+	}
+	if err := c.Run(); err != nil || !c.Ready() {
+		t.Fatal(err)
+	}
+
+	for _, size := range [][2]uint32{{1023, 768}, {1024, 199}, {8194, 768}, {0, 0}} {
+		if err := c.Resize(size[0], size[1]); err == nil {
+			t.Errorf("%dx%d accepted", size[0], size[1])
+		}
+	}
+	if ch.written.Len() != 0 {
+		t.Fatalf("get %x", ch.written.Bytes())
+	}
+	if err := c.Resize(1920, 1080); err != nil {
+		t.Fatal(err)
+	}
+	expect := "02000000" + "38000000" + "28000000" + "01000000" +
+		"01000000" + "00000000" + "00000000" + "80070000" + "38040000" + hex.EncodeToString(make([]byte, 20))
+	if hex.EncodeToString(ch.written.Bytes()) != expect {
+		t.Errorf("get %x, expect %s", ch.written.Bytes(), expect)
+	}
+}
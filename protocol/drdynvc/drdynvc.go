@@ -0,0 +1,489 @@
+// Package drdynvc multiplexes dynamic virtual channels over the drdynvc
+// static virtual channel
+package drdynvc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/tomatome/grdp/core"
+	"github.com/tomatome/grdp/glog"
+	"github.com/tomatome/grdp/plugin"
+)
+
+/**
+ * @see MS-RDPEDYC 2.2 Message Syntax
+ */
+const (
+	CMD_CREATE                = 0x01
+	CMD_DATA_FIRST            = 0x02
+	CMD_DATA                  = 0x03
+	CMD_CLOSE                 = 0x04
+	CMD_CAPABILITY            = 0x05
+	CMD_DATA_FIRST_COMPRESSED = 0x06
+	CMD_DATA_COMPRESSED       = 0x07
+	CMD_SOFT_SYNC_REQUEST     = 0x08
+	CMD_SOFT_SYNC_RESPONSE    = 0x09
+)
+
+// highest capability version implemented, version 3 adds compression
+const version = 0x0002
+
+// CreationStatus refusing a channel without listener
+const STATUS_UNSUCCESSFUL = 0xC0000001
+
+// maximum size of a PDU, including its header
+const maxPDULength = plugin.CHANNEL_CHUNK_LENGTH
+
+// sizeCode returns the 2 bits code of the smallest field holding v
+func sizeCode(v uint32) uint8 {
+	switch {
+	case v <= 0xff:
+		return 0
+	case v <= 0xffff:
+		return 1
+	}
+	return 2
+}
+
+func writeVar(code uint8, v uint32, buff *bytes.Buffer) {
+	switch code {
+	case 0:
+		core.WriteUInt8(uint8(v), buff)
+	case 1:
+		core.WriteUInt16LE(uint16(v), buff)
+	default:
+		core.WriteUInt32LE(v, buff)
+	}
+}
+
+func readVar(code uint8, r io.Reader) (uint32, error) {
+	n := 4
+	switch code {
+	case 0:
+		n = 1
+	case 1:
+		n = 2
+	}
+	b, err := core.ReadBytes(n, r)
+	if err != nil {
+		return 0, err
+	}
+	var v uint32
+	for i := n - 1; i >= 0; i-- {
+		v = v<<8 | uint32(b[i])
+	}
+	return v, nil
+}
+
+// header writes the Cmd, Sp and cbChId byte followed by the channel id
+func header(cmd, sp uint8, channelId uint32, buff *bytes.Buffer) {
+	cbChId := sizeCode(channelId)
+	core.WriteUInt8(cmd<<4|sp<<2|cbChId, buff)
+	writeVar(cbChId, channelId, buff)
+}
+
+/**
+ * Client of the drdynvc channel, the server creates dynamic channels
+ * which are accepted when a listener of their name is opened
+ * @see MS-RDPEDYC 1.3 Overview
+ */
+type Client struct {
+	lock      sync.Mutex
+	conn      *plugin.ChannelConn
+	listeners map[string]*Channel
+	channels  map[uint32]*Channel
+	closed    bool
+}
+
+// New returns a client waiting for Run, listeners should be opened before
+func New() *Client {
+	return &Client{
+		listeners: make(map[string]*Channel),
+		channels:  make(map[uint32]*Channel),
+	}
+}
+
+/**
+ * OpenDynamicChannel listens for the channel name created by the server,
+ * writes block until it is created and a read returns the data of one
+ * message at most
+ */
+func (c *Client) OpenDynamicChannel(name string) (io.ReadWriteCloser, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return nil, errors.New("drdynvc closed")
+	}
+	if _, ok := c.listeners[name]; ok {
+		return nil, errors.New(fmt.Sprintf("dynamic channel %s already opened", name))
+	}
+	ch := newChannel(c, name)
+	c.listeners[name] = ch
+	return ch, nil
+}
+
+// Run processes the drdynvc static channel stream rw until it is closed
+func (c *Client) Run(rw io.ReadWriteCloser) error {
+	conn := plugin.NewChannelConn(rw, 0)
+	c.lock.Lock()
+	c.conn = conn
+	c.lock.Unlock()
+	defer c.shutdown()
+	for {
+		msg, err := conn.ReadMessage()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = c.process(msg); err != nil {
+			glog.Warn("drdynvc:", err)
+		}
+	}
+}
+
+// Close closes the static channel and all the dynamic channels
+func (c *Client) Close() error {
+	c.lock.Lock()
+	conn := c.conn
+	c.lock.Unlock()
+	c.shutdown()
+	if conn == nil {
+		return nil
+	}
+	return conn.Close()
+}
+
+func (c *Client) shutdown() {
+	c.lock.Lock()
+	c.closed = true
+	listeners := c.listeners
+	c.listeners = make(map[string]*Channel)
+	c.channels = make(map[uint32]*Channel)
+	c.lock.Unlock()
+	for _, ch := range listeners {
+		ch.setClosed()
+	}
+}
+
+func (c *Client) write(b []byte) error {
+	c.lock.Lock()
+	conn := c.conn
+	c.lock.Unlock()
+	if conn == nil {
+		return errors.New("drdynvc not running")
+	}
+	return conn.WriteMessage(b)
+}
+
+func (c *Client) process(msg []byte) error {
+	if len(msg) == 0 {
+		return errors.New("empty message")
+	}
+	cmd, sp, cbChId := msg[0]>>4, (msg[0]>>2)&0x3, msg[0]&0x3
+	r := bytes.NewReader(msg[1:])
+	glog.Debugf("drdynvc cmd 0x%x", cmd)
+	if cmd == CMD_CAPABILITY {
+		return c.recvCapabilities(r)
+	}
+	channelId, err := readVar(cbChId, r)
+	if err != nil {
+		return err
+	}
+	switch cmd {
+	case CMD_CREATE:
+		return c.recvCreate(channelId, r)
+	case CMD_DATA_FIRST:
+		length, err := readVar(sp, r)
+		if err != nil {
+			return err
+		}
+		if ch := c.channel(channelId); ch != nil {
+			return ch.recvFirst(length, msg[len(msg)-r.Len():])
+		}
+	case CMD_DATA:
+		if ch := c.channel(channelId); ch != nil {
+			return ch.recv(msg[len(msg)-r.Len():])
+		}
+	case CMD_CLOSE:
+		c.lock.Lock()
+		ch := c.channels[channelId]
+		delete(c.channels, channelId)
+		if ch != nil {
+			delete(c.listeners, ch.name)
+		}
+		c.lock.Unlock()
+		if ch == nil {
+			return nil
+		}
+		ch.setClosed()
+		// @see MS-RDPEDYC 2.2.4 Closing a DVC (DYNVC_CLOSE)
+		buff := &bytes.Buffer{}
+		header(CMD_CLOSE, 0, channelId, buff)
+		return c.write(buff.Bytes())
+	default:
+		return errors.New(fmt.Sprintf("unsupported cmd 0x%x", cmd))
+	}
+	return nil
+}
+
+func (c *Client) channel(id uint32) *Channel {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ch := c.channels[id]
+	if ch == nil {
+		glog.Warn(fmt.Sprintf("drdynvc: data of unknown channel %d", id))
+	}
+	return ch
+}
+
+/**
+ * @see MS-RDPEDYC 2.2.1.1 Version 1 Caps Request PDU (DYNVC_CAPS_VERSION1)
+ * @see MS-RDPEDYC 2.2.1.2 Caps Response PDU (DYNVC_CAPS_RSP)
+ */
+func (c *Client) recvCapabilities(r io.Reader) error {
+	b, err := core.ReadBytes(3, r)
+	if err != nil {
+		return err
+	}
+	v := uint16(b[1]) | uint16(b[2])<<8
+	if v > version {
+		v = version
+	}
+	buff := &bytes.Buffer{}
+	core.WriteUInt8(CMD_CAPABILITY<<4, buff)
+	core.WriteUInt8(0, buff)
+	core.WriteUInt16LE(v, buff)
+	return c.write(buff.Bytes())
+}
+
+/**
+ * @see MS-RDPEDYC 2.2.2.1 DVC Create Request PDU (DYNVC_CREATE_REQ)
+ * @see MS-RDPEDYC 2.2.2.2 DVC Create Response PDU (DYNVC_CREATE_RSP)
+ */
+func (c *Client) recvCreate(channelId uint32, r *bytes.Reader) error {
+	b, err := core.ReadBytes(r.Len(), r)
+	if err != nil {
+		return err
+	}
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	name := string(b)
+
+	c.lock.Lock()
+	ch := c.listeners[name]
+	if ch != nil && ch.isOpened() {
+		// a single channel per listener
+		ch = nil
+	}
+	if ch != nil {
+		c.channels[channelId] = ch
+	}
+	c.lock.Unlock()
+
+	var status uint32 = STATUS_UNSUCCESSFUL
+	if ch != nil {
+		status = 0
+	} else {
+		glog.Info("drdynvc: refuse channel", name)
+	}
+	buff := &bytes.Buffer{}
+	header(CMD_CREATE, 0, channelId, buff)
+	core.WriteUInt32LE(status, buff)
+	if err = c.write(buff.Bytes()); err != nil {
+		return err
+	}
+	if ch != nil {
+		ch.setOpened(channelId)
+	}
+	return nil
+}
+
+/**
+ * send writes data to the channel id, in a data first PDU followed by data
+ * PDUs when it does not fit in a single PDU
+ * @see MS-RDPEDYC 2.2.3.1 DVC Data First PDU (DYNVC_DATA_FIRST)
+ * @see MS-RDPEDYC 2.2.3.2 DVC Data PDU (DYNVC_DATA)
+ */
+func (c *Client) send(channelId uint32, data []byte) error {
+	buff := &bytes.Buffer{}
+	header(CMD_DATA, 0, channelId, buff)
+	if buff.Len()+len(data) <= maxPDULength {
+		buff.Write(data)
+		return c.write(buff.Bytes())
+	}
+	for idx := 0; idx < len(data); {
+		buff.Reset()
+		if idx == 0 {
+			code := sizeCode(uint32(len(data)))
+			header(CMD_DATA_FIRST, code, channelId, buff)
+			writeVar(code, uint32(len(data)), buff)
+		} else {
+			header(CMD_DATA, 0, channelId, buff)
+		}
+		end := idx + maxPDULength - buff.Len()
+		if end > len(data) {
+			end = len(data)
+		}
+		buff.Write(data[idx:end])
+		if err := c.write(buff.Bytes()); err != nil {
+			return err
+		}
+		idx = end
+	}
+	return nil
+}
+
+// Channel is a dynamic virtual channel, see OpenDynamicChannel
+type Channel struct {
+	client *Client
+	name   string
+
+	lock     sync.Mutex
+	cond     *sync.Cond
+	id       uint32
+	opened   bool
+	closed   bool
+	messages [][]byte
+	// reassembly of data first PDUs
+	fragment *bytes.Buffer
+	length   uint32
+}
+
+func newChannel(c *Client, name string) *Channel {
+	ch := &Channel{client: c, name: name}
+	ch.cond = sync.NewCond(&ch.lock)
+	return ch
+}
+
+func (ch *Channel) isOpened() bool {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	return ch.opened
+}
+
+func (ch *Channel) setOpened(id uint32) {
+	ch.lock.Lock()
+	ch.id, ch.opened = id, true
+	ch.lock.Unlock()
+	ch.cond.Broadcast()
+}
+
+func (ch *Channel) setClosed() {
+	ch.lock.Lock()
+	ch.closed = true
+	ch.lock.Unlock()
+	ch.cond.Broadcast()
+}
+
+func (ch *Channel) push(msg []byte) {
+	ch.lock.Lock()
+	ch.messages = append(ch.messages, msg)
+	ch.lock.Unlock()
+	ch.cond.Broadcast()
+}
+
+func (ch *Channel) recvFirst(length uint32, data []byte) error {
+	if uint64(length) > core.DefaultMaxPDUSize {
+		return errors.New(fmt.Sprintf("channel %s message of %d bytes exceeds the maximum %d", ch.name, length, core.DefaultMaxPDUSize))
+	}
+	if uint32(len(data)) >= length {
+		ch.push(append([]byte{}, data...))
+		return nil
+	}
+	ch.lock.Lock()
+	ch.fragment = bytes.NewBuffer(append([]byte{}, data...))
+	ch.length = length
+	ch.lock.Unlock()
+	return nil
+}
+
+func (ch *Channel) recv(data []byte) error {
+	ch.lock.Lock()
+	f := ch.fragment
+	if f == nil {
+		ch.lock.Unlock()
+		ch.push(append([]byte{}, data...))
+		return nil
+	}
+	f.Write(data)
+	if uint32(f.Len()) < ch.length {
+		ch.lock.Unlock()
+		return nil
+	}
+	ch.fragment = nil
+	ch.lock.Unlock()
+	if uint32(f.Len()) > ch.length {
+		return errors.New(fmt.Sprintf("channel %s message of %d bytes, expect %d", ch.name, f.Len(), ch.length))
+	}
+	ch.push(f.Bytes())
+	return nil
+}
+
+// Read returns the data of one message at most, the rest is kept for the next read
+func (ch *Channel) Read(p []byte) (int, error) {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	for len(ch.messages) == 0 {
+		if ch.closed {
+			return 0, io.EOF
+		}
+		ch.cond.Wait()
+	}
+	n := copy(p, ch.messages[0])
+	if n < len(ch.messages[0]) {
+		ch.messages[0] = ch.messages[0][n:]
+	} else {
+		ch.messages = ch.messages[1:]
+	}
+	return n, nil
+}
+
+// Write sends p as one message once the server has created the channel
+func (ch *Channel) Write(p []byte) (int, error) {
+	ch.lock.Lock()
+	for !ch.opened && !ch.closed {
+		ch.cond.Wait()
+	}
+	closed, id := ch.closed, ch.id
+	ch.lock.Unlock()
+	if closed {
+		return 0, io.ErrClosedPipe
+	}
+	if err := ch.client.send(id, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close closes the channel, the server is told when it was created
+func (ch *Channel) Close() error {
+	ch.lock.Lock()
+	wasOpen := ch.opened && !ch.closed
+	ch.closed = true
+	id := ch.id
+	ch.lock.Unlock()
+	ch.cond.Broadcast()
+
+	c := ch.client
+	c.lock.Lock()
+	if c.listeners[ch.name] == ch {
+		delete(c.listeners, ch.name)
+	}
+	if wasOpen {
+		delete(c.channels, id)
+	}
+	c.lock.Unlock()
+	if !wasOpen {
+		return nil
+	}
+	buff := &bytes.Buffer{}
+	header(CMD_CLOSE, 0, id, buff)
+	return c.write(buff.Bytes())
+}
@@ -0,0 +1,115 @@
+package drdynvc
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tomatome/grdp/core"
+	"github.com/tomatome/grdp/glog"
+	"github.com/tomatome/grdp/plugin"
+)
+
+func init() {
+	glog.SetLevel(glog.NONE)
+}
+
+func expect(t *testing.T, server *plugin.ChannelConn, msg string) {
+	t.Helper()
+	b, err := server.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(b) != msg {
+		t.Fatalf("get %x, expect %s", b, msg)
+	}
+}
+
+func send(t *testing.T, server *plugin.ChannelConn, msg string, data []byte) {
+	t.Helper()
+	b, _ := hex.DecodeString(msg)
+	if err := server.WriteMessage(append(b, data...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDynamicChannel(t *testing.T) {
+	client, conn := net.Pipe()
+	defer conn.Close()
+	server := plugin.NewChannelConn(conn, 0)
+	c := New()
+	rw, err := c.OpenDynamicChannel("ECHO")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.OpenDynamicChannel("ECHO"); err == nil {
+		t.Error("listener opened twice")
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Run(client)
+	}()
+
+	// version 3 is answered with version 2
+	send(t, server, "50000300"+"0000000000000000", nil)
+	expect(t, server, "50000200")
+	send(t, server, "1003", []byte("UNKNOWN\x00"))
+	expect(t, server, "1003"+"010000c0")
+	send(t, server, "113412", []byte("ECHO\x00"))
+	expect(t, server, "113412"+"00000000")
+
+	go rw.Write([]byte("ping"))
+	expect(t, server, "313412"+hex.EncodeToString([]byte("ping")))
+	send(t, server, "313412", []byte("pong"))
+	b := make([]byte, 3)
+	if n, err := rw.Read(b); err != nil || string(b[:n]) != "pon" {
+		t.Fatalf("read %q %v", b[:n], err)
+	}
+	if n, err := rw.Read(b); err != nil || string(b[:n]) != "g" {
+		t.Fatalf("read %q %v", b[:n], err)
+	}
+
+	// a data first PDU with the 2 bytes length then a data PDU
+	large := bytes.Repeat([]byte("0123456789"), 300)
+	go rw.Write(large)
+	expect(t, server, "253412"+"b80b"+hex.EncodeToString(large[:1595]))
+	expect(t, server, "313412"+hex.EncodeToString(large[1595:]))
+	send(t, server, "253412"+"d007", large[:1000])
+	send(t, server, "313412", large[1000:2000])
+	b = make([]byte, 4000)
+	if n, err := rw.Read(b); err != nil || !bytes.Equal(b[:n], large[:2000]) {
+		t.Fatalf("read %d bytes %v", n, err)
+	}
+
+	send(t, server, "413412", nil)
+	expect(t, server, "413412")
+	if _, err := rw.Read(b); err != io.EOF {
+		t.Errorf("read after close %v", err)
+	}
+	if _, err := rw.Write([]byte("ping")); err == nil {
+		t.Error("write after close")
+	}
+
+	conn.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("run not stopped by close")
+	}
+}
+
+func TestRecvFirstMaxPDUSize(t *testing.T) {
+	ch := newChannel(New(), "echo")
+	if err := ch.recvFirst(core.DefaultMaxPDUSize+1, []byte{1}); err == nil {
+		t.Error("expect error on a message above core.DefaultMaxPDUSize")
+	}
+	if err := ch.recvFirst(2, []byte{1}); err != nil || ch.fragment == nil {
+		t.Error("get", err)
+	}
+}
@@ -1,6 +1,7 @@
 package lic
 
 import (
+	"bytes"
 	"io"
 
 	"github.com/tomatome/grdp/core"
@@ -17,6 +18,21 @@ const (
 	ERROR_ALERT                 = 0xFF
 )
 
+// preamble flags
+const (
+	PREAMBLE_VERSION_2_0         = 0x02
+	PREAMBLE_VERSION_3_0         = 0x03
+	EXTENDED_ERROR_MSG_SUPPORTED = 0x80
+)
+
+const KEY_EXCHANGE_ALG_RSA = 0x00000001
+
+// platform id of the client
+const (
+	CLIENT_OS_ID_WINNT_POST_52 = 0x04000000
+	CLIENT_IMAGE_ID_MICROSOFT  = 0x00010000
+)
+
 // error code
 const (
 	ERR_INVALID_SERVER_CERTIFICATE = 0x00000001
@@ -103,12 +119,12 @@ func ReadLicensePacket(r io.Reader) *LicensePacket {
 */
 type LicenseBinaryBlob struct {
 	WBlobType uint16 `struc:"little"`
-	WBlobLen  uint16 `struc:"little"`
-	BlobData  []byte `struc:"sizefrom=WBlobLen"`
+	WBlobLen  uint16 `struc:"little,sizeof=BlobData"`
+	BlobData  []byte
 }
 
-func NewLicenseBinaryBlob(WBlobType uint16) *LicenseBinaryBlob {
-	return &LicenseBinaryBlob{}
+func NewLicenseBinaryBlob(WBlobType uint16, data []byte) *LicenseBinaryBlob {
+	return &LicenseBinaryBlob{WBlobType: WBlobType, BlobData: data}
 }
 
 /*
@@ -152,7 +168,7 @@ type ServerLicenseRequest struct {
 type ClientNewLicenseRequest struct {
 	PreferredKeyExchangeAlg  uint32            `struc:"little"`
 	PlatformId               uint32            `struc:"little"`
-	ClientRandom             []byte            `struc:"little"`
+	ClientRandom             []byte            `struc:"[32]byte"`
 	EncryptedPreMasterSecret LicenseBinaryBlob `struc:"little"`
 	ClientUserName           LicenseBinaryBlob `struc:"little"`
 	ClientMachineName        LicenseBinaryBlob `struc:"little"`
@@ -163,7 +179,7 @@ type ClientNewLicenseRequest struct {
 @see: http://msdn.microsoft.com/en-us/library/cc241921.aspx
 */
 type ServerPlatformChallenge struct {
-	ConnectFlags               uint32
+	ConnectFlags               uint32 `struc:"little"`
 	EncryptedPlatformChallenge LicenseBinaryBlob
 	MACData                    [16]byte
 }
@@ -177,5 +193,16 @@ type ServerPlatformChallenge struct {
 type ClientPLatformChallengeResponse struct {
 	EncryptedPlatformChallengeResponse LicenseBinaryBlob
 	EncryptedHWID                      LicenseBinaryBlob
-	MACData                            []byte //[16]byte
+	MACData                            []byte `struc:"[16]byte"`
+}
+
+// WriteLicensePacket prefixes message with the preamble of msgType
+// @see MS-RDPBCGR 2.2.1.12.1.1 Licensing Preamble
+func WriteLicensePacket(msgType uint8, message []byte) []byte {
+	buff := &bytes.Buffer{}
+	core.WriteUInt8(msgType, buff)
+	core.WriteUInt8(PREAMBLE_VERSION_3_0, buff)
+	core.WriteUInt16LE(uint16(len(message)+4), buff)
+	core.WriteBytes(message, buff)
+	return buff.Bytes()
 }
@@ -4,9 +4,8 @@ import (
 	"crypto/hmac"
 	"crypto/md5"
 	"crypto/rc4"
-	"strings"
 
-	"github.com/tomatome/grdp/core"
+	"github.com/tomatome/grdp/protocol/nla/ntlm"
 	"golang.org/x/crypto/md4"
 )
 
@@ -30,12 +29,12 @@ func HMAC_MD5(key, data []byte) []byte {
 
 // Version 2 of NTLM hash function
 func NTOWFv2(password, user, domain string) []byte {
-	return HMAC_MD5(MD4(core.UnicodeEncode(password)), core.UnicodeEncode(strings.ToUpper(user)+domain))
+	return ntlm.NTOWFv2(password, user, domain)
 }
 
 // Same as NTOWFv2
 func LMOWFv2(password, user, domain string) []byte {
-	return NTOWFv2(password, user, domain)
+	return ntlm.LMOWFv2(password, user, domain)
 }
 
 func RC4K(key, src []byte) []byte {
@@ -0,0 +1,588 @@
+// Package ntlm builds the NTLMv2 messages of the NLA authentication
+// @see MS-NLMP
+package ntlm
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rc4"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lunixbochs/struc"
+	"github.com/tomatome/grdp/core"
+	"github.com/tomatome/grdp/glog"
+	"golang.org/x/crypto/md4"
+)
+
+const (
+	WINDOWS_MINOR_VERSION_0 = 0x00
+	WINDOWS_MINOR_VERSION_1 = 0x01
+	WINDOWS_MINOR_VERSION_2 = 0x02
+	WINDOWS_MINOR_VERSION_3 = 0x03
+
+	WINDOWS_MAJOR_VERSION_5 = 0x05
+	WINDOWS_MAJOR_VERSION_6 = 0x06
+	NTLMSSP_REVISION_W2K3   = 0x0F
+)
+
+/**
+ * @see MS-NLMP 2.2.2.1 AV_PAIR
+ */
+const (
+	MsvAvEOL             = 0x0000
+	MsvAvNbComputerName  = 0x0001
+	MsvAvNbDomainName    = 0x0002
+	MsvAvDnsComputerName = 0x0003
+	MsvAvDnsDomainName   = 0x0004
+	MsvAvDnsTreeName     = 0x0005
+	MsvAvFlags           = 0x0006
+	MsvAvTimestamp       = 0x0007
+	MsvAvSingleHost      = 0x0008
+	MsvAvTargetName      = 0x0009
+	MsvChannelBindings   = 0x000A
+)
+
+// MsvAvFlags value telling the authenticate message has a MIC
+const MSV_AV_FLAGS_MIC = 0x00000002
+
+type AVPair struct {
+	Id    uint16 `struc:"little"`
+	Len   uint16 `struc:"little,sizeof=Value"`
+	Value []byte `struc:"little"`
+}
+
+/**
+ * @see MS-NLMP 2.2.2.5 NEGOTIATE
+ */
+const (
+	NTLMSSP_NEGOTIATE_56                       = 0x80000000
+	NTLMSSP_NEGOTIATE_KEY_EXCH                 = 0x40000000
+	NTLMSSP_NEGOTIATE_128                      = 0x20000000
+	NTLMSSP_NEGOTIATE_VERSION                  = 0x02000000
+	NTLMSSP_NEGOTIATE_TARGET_INFO              = 0x00800000
+	NTLMSSP_REQUEST_NON_NT_SESSION_KEY         = 0x00400000
+	NTLMSSP_NEGOTIATE_IDENTIFY                 = 0x00100000
+	NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY = 0x00080000
+	NTLMSSP_TARGET_TYPE_SERVER                 = 0x00020000
+	NTLMSSP_TARGET_TYPE_DOMAIN                 = 0x00010000
+	NTLMSSP_NEGOTIATE_ALWAYS_SIGN              = 0x00008000
+	NTLMSSP_NEGOTIATE_OEM_WORKSTATION_SUPPLIED = 0x00002000
+	NTLMSSP_NEGOTIATE_OEM_DOMAIN_SUPPLIED      = 0x00001000
+	NTLMSSP_NEGOTIATE_NTLM                     = 0x00000200
+	NTLMSSP_NEGOTIATE_LM_KEY                   = 0x00000080
+	NTLMSSP_NEGOTIATE_DATAGRAM                 = 0x00000040
+	NTLMSSP_NEGOTIATE_SEAL                     = 0x00000020
+	NTLMSSP_NEGOTIATE_SIGN                     = 0x00000010
+	NTLMSSP_REQUEST_TARGET                     = 0x00000004
+	NTLM_NEGOTIATE_OEM                         = 0x00000002
+	NTLMSSP_NEGOTIATE_UNICODE                  = 0x00000001
+)
+
+var signature = [8]byte{'N', 'T', 'L', 'M', 'S', 'S', 'P', 0x00}
+
+type NVersion struct {
+	ProductMajorVersion uint8   `struc:"little"`
+	ProductMinorVersion uint8   `struc:"little"`
+	ProductBuild        uint16  `struc:"little"`
+	Reserved            [3]byte `struc:"little"`
+	NTLMRevisionCurrent uint8   `struc:"little"`
+}
+
+func NewNVersion() NVersion {
+	return NVersion{
+		ProductMajorVersion: WINDOWS_MAJOR_VERSION_6,
+		ProductMinorVersion: WINDOWS_MINOR_VERSION_0,
+		ProductBuild:        6002,
+		NTLMRevisionCurrent: NTLMSSP_REVISION_W2K3,
+	}
+}
+
+/**
+ * @see MS-NLMP 2.2.1.1 NEGOTIATE_MESSAGE
+ */
+type NegotiateMessage struct {
+	Signature               [8]byte  `struc:"little"`
+	MessageType             uint32   `struc:"little"`
+	NegotiateFlags          uint32   `struc:"little"`
+	DomainNameLen           uint16   `struc:"little"`
+	DomainNameMaxLen        uint16   `struc:"little"`
+	DomainNameBufferOffset  uint32   `struc:"little"`
+	WorkstationLen          uint16   `struc:"little"`
+	WorkstationMaxLen       uint16   `struc:"little"`
+	WorkstationBufferOffset uint32   `struc:"little"`
+	Version                 NVersion `struc:"little"`
+}
+
+func (m *NegotiateMessage) Serialize() []byte {
+	buff := &bytes.Buffer{}
+	struc.Pack(buff, m)
+	return buff.Bytes()
+}
+
+/**
+ * @see MS-NLMP 2.2.1.2 CHALLENGE_MESSAGE
+ */
+type ChallengeMessage struct {
+	Signature              [8]byte  `struc:"little"`
+	MessageType            uint32   `struc:"little"`
+	TargetNameLen          uint16   `struc:"little"`
+	TargetNameMaxLen       uint16   `struc:"little"`
+	TargetNameBufferOffset uint32   `struc:"little"`
+	NegotiateFlags         uint32   `struc:"little"`
+	ServerChallenge        [8]byte  `struc:"little"`
+	Reserved               [8]byte  `struc:"little"`
+	TargetInfoLen          uint16   `struc:"little"`
+	TargetInfoMaxLen       uint16   `struc:"little"`
+	TargetInfoBufferOffset uint32   `struc:"little"`
+	Version                NVersion `struc:"skip"`
+	TargetName             []byte   `struc:"skip"`
+	TargetInfo             []byte   `struc:"skip"`
+	// message as received, part of the MIC
+	raw []byte
+}
+
+/**
+ * @see MS-NLMP 2.2.1.3 AUTHENTICATE_MESSAGE
+ */
+type AuthenticateMessage struct {
+	Signature                          [8]byte  `struc:"little"`
+	MessageType                        uint32   `struc:"little"`
+	LmChallengeResponseLen             uint16   `struc:"little"`
+	LmChallengeResponseMaxLen          uint16   `struc:"little"`
+	LmChallengeResponseBufferOffset    uint32   `struc:"little"`
+	NtChallengeResponseLen             uint16   `struc:"little"`
+	NtChallengeResponseMaxLen          uint16   `struc:"little"`
+	NtChallengeResponseBufferOffset    uint32   `struc:"little"`
+	DomainNameLen                      uint16   `struc:"little"`
+	DomainNameMaxLen                   uint16   `struc:"little"`
+	DomainNameBufferOffset             uint32   `struc:"little"`
+	UserNameLen                        uint16   `struc:"little"`
+	UserNameMaxLen                     uint16   `struc:"little"`
+	UserNameBufferOffset               uint32   `struc:"little"`
+	WorkstationLen                     uint16   `struc:"little"`
+	WorkstationMaxLen                  uint16   `struc:"little"`
+	WorkstationBufferOffset            uint32   `struc:"little"`
+	EncryptedRandomSessionLen          uint16   `struc:"little"`
+	EncryptedRandomSessionMaxLen       uint16   `struc:"little"`
+	EncryptedRandomSessionBufferOffset uint32   `struc:"little"`
+	NegotiateFlags                     uint32   `struc:"little"`
+	Version                            NVersion `struc:"little"`
+	MIC                                [16]byte `struc:"little"`
+	Payload                            []byte   `struc:"skip"`
+}
+
+// size of the fixed part, the payload follows
+func (m *AuthenticateMessage) BaseLen() uint32 {
+	return 88
+}
+
+func NewAuthenticateMessage(negFlag uint32, domain, user, workstation []byte,
+	lmchallResp, ntchallResp, enRandomSessKey []byte) *AuthenticateMessage {
+	msg := &AuthenticateMessage{
+		Signature:      signature,
+		MessageType:    0x00000003,
+		NegotiateFlags: negFlag,
+	}
+	payloadBuff := &bytes.Buffer{}
+
+	msg.LmChallengeResponseLen = uint16(len(lmchallResp))
+	msg.LmChallengeResponseMaxLen = msg.LmChallengeResponseLen
+	msg.LmChallengeResponseBufferOffset = msg.BaseLen()
+	payloadBuff.Write(lmchallResp)
+
+	msg.NtChallengeResponseLen = uint16(len(ntchallResp))
+	msg.NtChallengeResponseMaxLen = msg.NtChallengeResponseLen
+	msg.NtChallengeResponseBufferOffset = msg.LmChallengeResponseBufferOffset + uint32(msg.LmChallengeResponseLen)
+	payloadBuff.Write(ntchallResp)
+
+	msg.DomainNameLen = uint16(len(domain))
+	msg.DomainNameMaxLen = msg.DomainNameLen
+	msg.DomainNameBufferOffset = msg.NtChallengeResponseBufferOffset + uint32(msg.NtChallengeResponseLen)
+	payloadBuff.Write(domain)
+
+	msg.UserNameLen = uint16(len(user))
+	msg.UserNameMaxLen = msg.UserNameLen
+	msg.UserNameBufferOffset = msg.DomainNameBufferOffset + uint32(msg.DomainNameLen)
+	payloadBuff.Write(user)
+
+	msg.WorkstationLen = uint16(len(workstation))
+	msg.WorkstationMaxLen = msg.WorkstationLen
+	msg.WorkstationBufferOffset = msg.UserNameBufferOffset + uint32(msg.UserNameLen)
+	payloadBuff.Write(workstation)
+
+	msg.EncryptedRandomSessionLen = uint16(len(enRandomSessKey))
+	msg.EncryptedRandomSessionMaxLen = msg.EncryptedRandomSessionLen
+	msg.EncryptedRandomSessionBufferOffset = msg.WorkstationBufferOffset + uint32(msg.WorkstationLen)
+	payloadBuff.Write(enRandomSessKey)
+
+	if (msg.NegotiateFlags & NTLMSSP_NEGOTIATE_VERSION) != 0 {
+		msg.Version = NewNVersion()
+	}
+	msg.Payload = payloadBuff.Bytes()
+
+	return msg
+}
+
+func (m *AuthenticateMessage) Serialize() []byte {
+	buff := &bytes.Buffer{}
+	struc.Pack(buff, m)
+	buff.Write(m.Payload)
+	return buff.Bytes()
+}
+
+// Version 2 of NTLM hash function
+// @see MS-NLMP 3.3.2 NTLM v2 Authentication
+func NTOWFv2(password, user, domain string) []byte {
+	h := md4.New()
+	h.Write(core.UnicodeEncode(password))
+	return hmacMD5(h.Sum(nil), core.UnicodeEncode(strings.ToUpper(user)+domain))
+}
+
+// Same as NTOWFv2
+func LMOWFv2(password, user, domain string) []byte {
+	return NTOWFv2(password, user, domain)
+}
+
+func hmacMD5(key []byte, data ...[]byte) []byte {
+	h := hmac.New(md5.New, key)
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+func md5Sum(data ...[]byte) []byte {
+	h := md5.New()
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+/**
+ * NTLMv2 responses and session base key
+ * @see MS-NLMP 3.3.2 NTLM v2 Authentication
+ */
+func ComputeResponseV2(respKeyNT, respKeyLM, serverChallenge, clientChallenge,
+	timestamp, serverInfo []byte) (ntChallResp, lmChallResp, SessBaseKey []byte) {
+
+	tempBuff := &bytes.Buffer{}
+	tempBuff.Write([]byte{0x01, 0x01}) // Responser version, HiResponser version
+	tempBuff.Write([]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+	tempBuff.Write(timestamp)
+	tempBuff.Write(clientChallenge)
+	tempBuff.Write([]byte{0x00, 0x00, 0x00, 0x00})
+	tempBuff.Write(serverInfo)
+	tempBuff.Write([]byte{0x00, 0x00, 0x00, 0x00})
+
+	ntProof := hmacMD5(respKeyNT, serverChallenge, tempBuff.Bytes())
+	ntChallResp = append(ntProof, tempBuff.Bytes()...)
+	lmChallResp = append(hmacMD5(respKeyLM, serverChallenge, clientChallenge), clientChallenge...)
+	SessBaseKey = hmacMD5(respKeyNT, ntProof)
+	return
+}
+
+var (
+	clientSigning = []byte("session key to client-to-server signing key magic constant\x00")
+	serverSigning = []byte("session key to server-to-client signing key magic constant\x00")
+	clientSealing = []byte("session key to client-to-server sealing key magic constant\x00")
+	serverSealing = []byte("session key to server-to-client sealing key magic constant\x00")
+)
+
+// SIGNKEY of the client or the server side
+// @see MS-NLMP 3.4.5.2 SIGNKEY
+func SIGNKEY(exportedSessionKey []byte, client bool) []byte {
+	if client {
+		return md5Sum(exportedSessionKey, clientSigning)
+	}
+	return md5Sum(exportedSessionKey, serverSigning)
+}
+
+// SEALKEY of the client or the server side, weakened to the negotiated key size
+// @see MS-NLMP 3.4.5.3 SEALKEY
+func SEALKEY(negFlag uint32, exportedSessionKey []byte, client bool) []byte {
+	key := exportedSessionKey
+	if negFlag&NTLMSSP_NEGOTIATE_128 == 0 {
+		if negFlag&NTLMSSP_NEGOTIATE_56 != 0 {
+			key = key[:7]
+		} else {
+			key = key[:5]
+		}
+	}
+	if client {
+		return md5Sum(key, clientSealing)
+	}
+	return md5Sum(key, serverSealing)
+}
+
+// Client runs the client side of a NTLMv2 authentication
+type Client struct {
+	// Workstation sent in the authenticate message
+	Workstation string
+	// ChannelBindings is the application data of the channel bindings, as
+	// "tls-server-end-point:" followed by the certificate hash, none if nil
+	ChannelBindings []byte
+
+	negotiate []byte
+	random    func(n int) []byte
+	now       func() uint64
+}
+
+func New() *Client {
+	return &Client{
+		random: func(n int) []byte {
+			b := make([]byte, n)
+			rand.Read(b)
+			return b
+		},
+		now: fileTime,
+	}
+}
+
+// fileTime returns the windows file time, 100 ns since 1601
+func fileTime() uint64 {
+	return uint64(time.Now().UnixNano()/100) + 116444736000000000
+}
+
+// Negotiate returns the first handshake message
+func (c *Client) Negotiate() []byte {
+	m := &NegotiateMessage{
+		Signature:   signature,
+		MessageType: 0x00000001,
+		NegotiateFlags: NTLMSSP_NEGOTIATE_KEY_EXCH |
+			NTLMSSP_NEGOTIATE_128 |
+			NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY |
+			NTLMSSP_NEGOTIATE_ALWAYS_SIGN |
+			NTLMSSP_NEGOTIATE_NTLM |
+			NTLMSSP_NEGOTIATE_SEAL |
+			NTLMSSP_NEGOTIATE_SIGN |
+			NTLMSSP_REQUEST_TARGET |
+			NTLMSSP_NEGOTIATE_UNICODE,
+	}
+	c.negotiate = m.Serialize()
+	return c.negotiate
+}
+
+// payload returns the field of b at offset, or an error if out of the message
+func payload(b []byte, l uint16, offset uint32) ([]byte, error) {
+	if l == 0 {
+		return nil, nil
+	}
+	if uint64(offset)+uint64(l) > uint64(len(b)) {
+		return nil, errors.New(fmt.Sprintf("field at %d of len %d out of the message", offset, l))
+	}
+	return b[offset : offset+uint32(l)], nil
+}
+
+// Challenge parses the challenge message of the server
+func (c *Client) Challenge(b []byte) (*ChallengeMessage, error) {
+	m := &ChallengeMessage{}
+	r := bytes.NewReader(b)
+	if err := struc.Unpack(r, m); err != nil {
+		return nil, errors.New(fmt.Sprintf("read challenge message: %v", err))
+	}
+	if m.Signature != signature || m.MessageType != 0x00000002 {
+		return nil, errors.New(fmt.Sprintf("not a challenge message %x", b[:12]))
+	}
+	if m.NegotiateFlags&NTLMSSP_NEGOTIATE_VERSION != 0 {
+		if err := struc.Unpack(r, &m.Version); err != nil {
+			return nil, errors.New(fmt.Sprintf("read version: %v", err))
+		}
+	}
+	var err error
+	if m.TargetName, err = payload(b, m.TargetNameLen, m.TargetNameBufferOffset); err != nil {
+		return nil, err
+	}
+	if m.TargetInfo, err = payload(b, m.TargetInfoLen, m.TargetInfoBufferOffset); err != nil {
+		return nil, err
+	}
+	m.raw = b
+	glog.Debugf("challengeMsg:%+v", m)
+	return m, nil
+}
+
+// readAVPairs returns the pairs of the target info, without the MsvAvEOL
+func readAVPairs(data []byte) ([]AVPair, error) {
+	var pairs []AVPair
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		p := AVPair{}
+		if err := struc.Unpack(r, &p); err != nil {
+			return nil, errors.New(fmt.Sprintf("read target info: %v", err))
+		}
+		if p.Id == MsvAvEOL {
+			break
+		}
+		pairs = append(pairs, p)
+	}
+	return pairs, nil
+}
+
+func writeAVPairs(pairs []AVPair) []byte {
+	buff := &bytes.Buffer{}
+	for _, p := range pairs {
+		core.WriteUInt16LE(p.Id, buff)
+		core.WriteUInt16LE(uint16(len(p.Value)), buff)
+		core.WriteBytes(p.Value, buff)
+	}
+	core.WriteUInt32LE(MsvAvEOL, buff)
+	return buff.Bytes()
+}
+
+// hash of the gss_channel_bindings_struct without addresses
+func channelBindingsHash(application []byte) []byte {
+	buff := &bytes.Buffer{}
+	core.WriteBytes(make([]byte, 16), buff)
+	core.WriteUInt32LE(uint32(len(application)), buff)
+	core.WriteBytes(application, buff)
+	return md5Sum(buff.Bytes())
+}
+
+/**
+ * Authenticate returns the authenticate message answering challenge, with a
+ * MIC if the server sent its time, and the security of the session
+ * @see MS-NLMP 3.1.5.1.2 Client Receives a CHALLENGE_MESSAGE from the Server
+ */
+func (c *Client) Authenticate(challenge *ChallengeMessage, domain, user, password string) ([]byte, *Security, error) {
+	pairs, err := readAVPairs(challenge.TargetInfo)
+	if err != nil {
+		return nil, nil, err
+	}
+	var timestamp []byte
+	for _, p := range pairs {
+		if p.Id == MsvAvTimestamp {
+			timestamp = p.Value
+		}
+	}
+	computeMIC := timestamp != nil
+	if computeMIC {
+		flags := make([]byte, 4)
+		binary.LittleEndian.PutUint32(flags, MSV_AV_FLAGS_MIC)
+		pairs = append(pairs, AVPair{Id: MsvAvFlags, Value: flags})
+	} else {
+		timestamp = make([]byte, 8)
+		binary.LittleEndian.PutUint64(timestamp, c.now())
+	}
+	if c.ChannelBindings != nil {
+		pairs = append(pairs, AVPair{Id: MsvChannelBindings, Value: channelBindingsHash(c.ChannelBindings)})
+	}
+	glog.Infof("serverName=%+v", string(challenge.TargetName))
+
+	respKeyNT := NTOWFv2(password, user, domain)
+	respKeyLM := LMOWFv2(password, user, domain)
+	clientChallenge := c.random(8)
+	ntChallengeResponse, lmChallengeResponse, sessionBaseKey := ComputeResponseV2(respKeyNT, respKeyLM,
+		challenge.ServerChallenge[:], clientChallenge, timestamp, writeAVPairs(pairs))
+	if computeMIC {
+		// the time of the nt response makes the lm one useless
+		lmChallengeResponse = make([]byte, 24)
+	}
+
+	flags := challenge.NegotiateFlags
+	exportedSessionKey := sessionBaseKey
+	var encryptedRandomSessionKey []byte
+	if flags&NTLMSSP_NEGOTIATE_KEY_EXCH != 0 {
+		exportedSessionKey = c.random(16)
+		encryptedRandomSessionKey = make([]byte, 16)
+		rc, _ := rc4.NewCipher(sessionBaseKey)
+		rc.XORKeyStream(encryptedRandomSessionKey, exportedSessionKey)
+	}
+
+	var encode func(string) []byte
+	if flags&NTLMSSP_NEGOTIATE_UNICODE != 0 {
+		encode = core.UnicodeEncode
+	} else {
+		encode = func(s string) []byte { return []byte(s) }
+	}
+	m := NewAuthenticateMessage(flags, encode(domain), encode(user), encode(c.Workstation),
+		lmChallengeResponse, ntChallengeResponse, encryptedRandomSessionKey)
+	if computeMIC {
+		if c.negotiate == nil {
+			return nil, nil, errors.New("no negotiate message for the MIC")
+		}
+		copy(m.MIC[:], hmacMD5(exportedSessionKey, c.negotiate, challenge.raw, m.Serialize()))
+	}
+	return m.Serialize(), NewSecurity(flags, exportedSessionKey), nil
+}
+
+/**
+ * Security seals the messages of the client with the session keys
+ * @see MS-NLMP 3.4 Session Security Details
+ */
+type Security struct {
+	EncryptRC4 *rc4.Cipher
+	DecryptRC4 *rc4.Cipher
+	SigningKey []byte
+	VerifyKey  []byte
+	SeqNum     uint32
+	// checksums are sealed with the key exchange
+	keyExch bool
+}
+
+func NewSecurity(negFlag uint32, exportedSessionKey []byte) *Security {
+	encryptRC4, _ := rc4.NewCipher(SEALKEY(negFlag, exportedSessionKey, true))
+	decryptRC4, _ := rc4.NewCipher(SEALKEY(negFlag, exportedSessionKey, false))
+	return &Security{
+		EncryptRC4: encryptRC4,
+		DecryptRC4: decryptRC4,
+		SigningKey: SIGNKEY(exportedSessionKey, true),
+		VerifyKey:  SIGNKEY(exportedSessionKey, false),
+		keyExch:    negFlag&NTLMSSP_NEGOTIATE_KEY_EXCH != 0,
+	}
+}
+
+// GssEncrypt returns the signature followed by the sealed s
+// @see MS-NLMP 3.4.4.2 GSS_WrapEx
+func (n *Security) GssEncrypt(s []byte) []byte {
+	p := make([]byte, len(s))
+	n.EncryptRC4.XORKeyStream(p, s)
+	b := &bytes.Buffer{}
+
+	//signature
+	seqNum := make([]byte, 4)
+	binary.LittleEndian.PutUint32(seqNum, n.SeqNum)
+	checksum := hmacMD5(n.SigningKey, seqNum, s)[:8]
+	if n.keyExch {
+		n.EncryptRC4.XORKeyStream(checksum, checksum)
+	}
+	core.WriteUInt32LE(0x00000001, b)
+	core.WriteBytes(checksum, b)
+	core.WriteUInt32LE(n.SeqNum, b)
+
+	core.WriteBytes(p, b)
+
+	n.SeqNum++
+
+	return b.Bytes()
+}
+
+// GssDecrypt returns the unsealed data of s, nil if its signature is invalid
+// @see MS-NLMP 3.4.4.2 GSS_UnwrapEx
+func (n *Security) GssDecrypt(s []byte) []byte {
+	if len(s) < 16 {
+		return nil
+	}
+	checksum := s[4:12]
+	seqNum := s[12:16]
+	data := s[16:]
+
+	p := make([]byte, len(data))
+	n.DecryptRC4.XORKeyStream(p, data)
+
+	check := make([]byte, len(checksum))
+	copy(check, checksum)
+	if n.keyExch {
+		n.DecryptRC4.XORKeyStream(check, checksum)
+	}
+	verify := hmacMD5(n.VerifyKey, seqNum, p)[:8]
+	if !hmac.Equal(verify, check) {
+		return nil
+	}
+	return p
+}
@@ -0,0 +1,194 @@
+package ntlm
+
+import (
+	"bytes"
+	"crypto/rc4"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+
+	"github.com/tomatome/grdp/core"
+	"github.com/tomatome/grdp/glog"
+)
+
+func init() {
+	glog.SetLevel(glog.NONE)
+}
+
+// challenge of the NTLMv2 example, server "Server" of domain "Domain"
+// @see MS-NLMP 4.2.4.3 Messages
+const challengeV2 = "4e544c4d53535000020000000c000c003800000033828ae20123456789abcdef" +
+	"00000000000000002400240044000000060070170000000f5300650072007600" +
+	"6500720002000c0044006f006d00610069006e0001000c005300650072007600" +
+	"6500720000000000"
+
+func testClient() *Client {
+	c := New()
+	c.random = func(n int) []byte {
+		if n == 8 {
+			return bytes.Repeat([]byte{0xaa}, n)
+		}
+		return bytes.Repeat([]byte{0x55}, n)
+	}
+	c.now = func() uint64 { return 0 }
+	c.Workstation = "COMPUTER"
+	return c
+}
+
+func field(t *testing.T, b []byte, offset int) []byte {
+	l := binary.LittleEndian.Uint16(b[offset:])
+	start := binary.LittleEndian.Uint32(b[offset+4:])
+	if int(start)+int(l) > len(b) {
+		t.Fatalf("field at %d out of the message", offset)
+	}
+	return b[start : start+uint32(l)]
+}
+
+func TestNegotiate(t *testing.T) {
+	result := hex.EncodeToString(New().Negotiate())
+	expected := "4e544c4d535350000100000035820860000000000000000000000000000000000000000000000000"
+	if result != expected {
+		t.Error(result, " not equals to", expected)
+	}
+}
+
+func TestNTOWFv2(t *testing.T) {
+	// @see MS-NLMP 4.2.4.1.1 NTOWFv2() and LMOWFv2()
+	res := hex.EncodeToString(NTOWFv2("Password", "User", "Domain"))
+	expected := "0c868a403bfd7a93a3001ef22ef02e3f"
+	if res != expected {
+		t.Error(res, "not equal to", expected)
+	}
+}
+
+func TestSIGNKEY(t *testing.T) {
+	exportedSessionKey, _ := hex.DecodeString("be32c3c56ea6683200a35329d67880c3")
+	result := hex.EncodeToString(SIGNKEY(exportedSessionKey, true))
+	expected := "79b4f9a4113230f378a0af99f784adae"
+	if result != expected {
+		t.Error(result, "not equal to", expected)
+	}
+}
+
+// @see MS-NLMP 4.2.4 NTLMv2 Authentication
+func TestAuthenticate(t *testing.T) {
+	c := testClient()
+	c.Negotiate()
+	b, _ := hex.DecodeString(challengeV2)
+	challenge, err := c.Challenge(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(challenge.TargetName) != string(core.UnicodeEncode("Server")) || len(challenge.TargetInfo) != 36 {
+		t.Fatalf("bad challenge %+v", challenge)
+	}
+	auth, sec, err := c.Authenticate(challenge, "Domain", "User", "Password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expects := []struct {
+		name   string
+		offset int
+		value  string
+	}{
+		{"LmChallengeResponse", 12, "86c35097ac9cec102554764a57cccc19aaaaaaaaaaaaaaaa"},
+		{"DomainName", 28, hex.EncodeToString(core.UnicodeEncode("Domain"))},
+		{"UserName", 36, hex.EncodeToString(core.UnicodeEncode("User"))},
+		{"Workstation", 44, hex.EncodeToString(core.UnicodeEncode("COMPUTER"))},
+		{"EncryptedRandomSessionKey", 52, "c5dad2544fc9799094ce1ce90bc9d03e"},
+	}
+	for _, e := range expects {
+		if v := hex.EncodeToString(field(t, auth, e.offset)); v != e.value {
+			t.Errorf("%s is %s, expect %s", e.name, v, e.value)
+		}
+	}
+	nt := hex.EncodeToString(field(t, auth, 20))
+	if nt[:32] != "68cd0ab851e51c96aabc927bebef6a1c" {
+		t.Errorf("NTProofStr is %s", nt[:32])
+	}
+	if mic := auth[72:88]; !bytes.Equal(mic, make([]byte, 16)) {
+		t.Errorf("MIC %x without server time", mic)
+	}
+
+	// @see MS-NLMP 4.2.4.4 GSS_WrapEx Examples
+	plaintext := core.UnicodeEncode("Plaintext")
+	if hex.EncodeToString(sec.SigningKey) != "4788dc861b4782f35d43fd98fe1a2d39" {
+		t.Errorf("signing key %x", sec.SigningKey)
+	}
+	wrap := hex.EncodeToString(sec.GssEncrypt(plaintext))
+	expected := "010000007fb38ec5c55d497600000000" + "54e50165bf1936dc996020c1811b0f06fb5f"
+	if wrap != expected {
+		t.Error(wrap, "not equal to", expected)
+	}
+}
+
+func TestAuthenticateMIC(t *testing.T) {
+	c := testClient()
+	c.ChannelBindings = []byte("tls-server-end-point:0123")
+	negotiate := c.Negotiate()
+	// challenge of the example with the server time in the target info
+	b, _ := hex.DecodeString(challengeV2[:len(challengeV2)-8] + "07000800" + "0102030405060708" + "00000000")
+	b[40] += 12
+	b[42] += 12
+	challenge, err := c.Challenge(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, _, err := c.Authenticate(challenge, "Domain", "User", "Password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lm := field(t, auth, 12); !bytes.Equal(lm, make([]byte, 24)) {
+		t.Errorf("LmChallengeResponse %x with a MIC", lm)
+	}
+	nt := field(t, auth, 20)
+	info, err := readAVPairs(nt[44:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var flags, bindings []byte
+	for _, p := range info {
+		switch p.Id {
+		case MsvAvFlags:
+			flags = p.Value
+		case MsvChannelBindings:
+			bindings = p.Value
+		}
+	}
+	if hex.EncodeToString(flags) != "02000000" {
+		t.Errorf("MsvAvFlags is %x", flags)
+	}
+	if !bytes.Equal(bindings, channelBindingsHash(c.ChannelBindings)) {
+		t.Errorf("MsvChannelBindings is %x", bindings)
+	}
+	if hex.EncodeToString(nt[24:32]) != "0102030405060708" {
+		t.Errorf("timestamp is %x, expect the server one", nt[24:32])
+	}
+
+	mic := append([]byte{}, auth[72:88]...)
+	copy(auth[72:88], make([]byte, 16))
+	exportedSessionKey := bytes.Repeat([]byte{0x55}, 16)
+	if !bytes.Equal(mic, hmacMD5(exportedSessionKey, negotiate, b, auth)) {
+		t.Errorf("bad MIC %x", mic)
+	}
+}
+
+func TestGssDecrypt(t *testing.T) {
+	key := bytes.Repeat([]byte{0x55}, 16)
+	flags := uint32(NTLMSSP_NEGOTIATE_KEY_EXCH | NTLMSSP_NEGOTIATE_128)
+	client := NewSecurity(flags, key)
+	// the server seals with the keys of the other side
+	encryptRC4, _ := rc4.NewCipher(SEALKEY(flags, key, false))
+	decryptRC4, _ := rc4.NewCipher(SEALKEY(flags, key, true))
+	server := &Security{encryptRC4, decryptRC4, SIGNKEY(key, false), SIGNKEY(key, true), 0, true}
+
+	if p := client.GssDecrypt(server.GssEncrypt([]byte("pubkey"))); string(p) != "pubkey" {
+		t.Errorf("get %q", p)
+	}
+	s := server.GssEncrypt([]byte("pubkey"))
+	s[4] ^= 0xff
+	if p := client.GssDecrypt(s); p != nil {
+		t.Errorf("accept a bad signature %q", p)
+	}
+}
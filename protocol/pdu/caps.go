@@ -229,10 +229,18 @@ const (
 	PTRFLAGS_BUTTON3        = 0x4000
 )
 
+// extended buttons of TS_POINTERX_EVENT, back and forward
 const (
-	KBDFLAGS_EXTENDED = 0x0100
-	KBDFLAGS_DOWN     = 0x4000
-	KBDFLAGS_RELEASE  = 0x8000
+	PTRXFLAGS_DOWN    = 0x8000
+	PTRXFLAGS_BUTTON1 = 0x0001
+	PTRXFLAGS_BUTTON2 = 0x0002
+)
+
+const (
+	KBDFLAGS_EXTENDED  = 0x0100
+	KBDFLAGS_EXTENDED1 = 0x0200
+	KBDFLAGS_DOWN      = 0x4000
+	KBDFLAGS_RELEASE   = 0x8000
 )
 
 type Capability interface {
@@ -299,6 +307,32 @@ func (*BitmapCacheCapability) Type() CapsType {
 	return CAPSTYPE_BITMAPCACHE
 }
 
+// CacheFlags of the revision 2 bitmap cache
+const (
+	PERSISTENT_KEYS_EXPECTED_FLAG = 0x0001
+	ALLOW_CACHE_WAITING_LIST_FLAG = 0x0002
+)
+
+// persistent flag of a revision 2 cell info
+const BITMAPCACHE_CELL_PERSISTENT = 0x80000000
+
+// see https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-rdpbcgr/8678ae1f-1a9f-4e4b-8c2e-d4b3b44eb7d1
+type BitmapCacheRev2Capability struct {
+	CacheFlags           uint16   `struc:"little"`
+	Pad2                 uint8    `struc:"little"`
+	NumCellCaches        uint8    `struc:"little"`
+	BitmapCache0CellInfo uint32   `struc:"little"`
+	BitmapCache1CellInfo uint32   `struc:"little"`
+	BitmapCache2CellInfo uint32   `struc:"little"`
+	BitmapCache3CellInfo uint32   `struc:"little"`
+	BitmapCache4CellInfo uint32   `struc:"little"`
+	Pad3                 [12]byte `struc:"[12]byte"`
+}
+
+func (*BitmapCacheRev2Capability) Type() CapsType {
+	return CAPSTYPE_BITMAPCACHE_REV2
+}
+
 type OrderCapability struct {
 	// 030058000000000000000000000000000000000000000000010014000000010000000a0000000000000000000000000000000000000000000000000000000000000000000000000000000000008403000000000000000000
 	TerminalDescriptor      [16]byte
@@ -486,6 +520,23 @@ func (*DrawGDIPlusCapability) Type() CapsType {
 	return CAPSTYPE_DRAWGDIPLUS
 }
 
+// CODEC_GUID_REMOTEFX {76772F12-BD72-4463-AFB3-B73C9C6F7886}
+var CODEC_GUID_REMOTEFX = [16]byte{0x12, 0x2f, 0x77, 0x76, 0x72, 0xbd, 0x63, 0x44,
+	0xaf, 0xb3, 0xb7, 0x3c, 0x9c, 0x6f, 0x78, 0x86}
+
+// CODEC_GUID_NSCODEC {CA8D1BB9-000F-154F-589F-AE2D1A87E2D6}
+var CODEC_GUID_NSCODEC = [16]byte{0xb9, 0x1b, 0x8d, 0xca, 0x0f, 0x00, 0x4f, 0x15,
+	0x58, 0x9f, 0xae, 0x2d, 0x1a, 0x87, 0xe2, 0xd6}
+
+// CodecID identifies a bitmap codec of the client, one of CODEC_ID_*
+type CodecID uint8
+
+// codec ids the client assigns in its bitmap codecs capability
+const (
+	CODEC_ID_NSCODEC  = 0x01
+	CODEC_ID_REMOTEFX = 0x03
+)
+
 // see https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-rdpbcgr/86507fed-a0ee-4242-b802-237534a8f65e
 type BitmapCodec struct {
 	GUID             [16]byte
@@ -509,6 +560,9 @@ func (*BitmapCodecsCapability) Type() CapsType {
 	return CAPSETTYPE_BITMAP_CODECS
 }
 
+// CacheVersion of the bitmap cache host support
+const BITMAPCACHE_REV2 = 0x01
+
 // see https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-rdpbcgr/fc05c385-46c3-42cb-9ed2-c475a3990e0b
 type BitmapCacheHostSupportCapability struct {
 	CacheVersion uint8
@@ -558,6 +612,12 @@ func (*DesktopCompositionCapability) Type() CapsType {
 	return CAPSETTYPE_COMPDESK
 }
 
+const (
+	SURFCMDS_SETSURFACEBITS    = 0x00000002
+	SURFCMDS_FRAMEMARKER       = 0x00000010
+	SURFCMDS_STREAMSURFACEBITS = 0x00000040
+)
+
 // see https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-rdpbcgr/aa953018-c0a8-4761-bb12-86586c2cd56a
 type SurfaceCommandsCapability struct {
 	CmdFlags uint32 `struc:"little"`
@@ -627,6 +687,8 @@ func readCapability(r io.Reader) (Capability, error) {
 		c = &DrawGDIPlusCapability{}
 	case CAPSETTYPE_BITMAP_CODECS:
 		c = &BitmapCodecsCapability{}
+	case CAPSTYPE_BITMAPCACHE_REV2:
+		c = &BitmapCacheRev2Capability{}
 	case CAPSTYPE_BITMAPCACHE_HOSTSUPPORT:
 		c = &BitmapCacheHostSupportCapability{}
 	case CAPSETTYPE_LARGE_POINTER:
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strings"
 
 	"github.com/lunixbochs/struc"
 	"github.com/tomatome/grdp/core"
@@ -46,6 +47,13 @@ const (
 	PDUTYPE2_MONITOR_LAYOUT_PDU          = 0x37
 )
 
+const (
+	UPDATETYPE_ORDERS      = 0x0000
+	UPDATETYPE_BITMAP      = 0x0001
+	UPDATETYPE_PALETTE     = 0x0002
+	UPDATETYPE_SYNCHRONIZE = 0x0003
+)
+
 const (
 	CTRLACTION_REQUEST_CONTROL = 0x0001
 	CTRLACTION_GRANTED_CONTROL = 0x0002
@@ -74,6 +82,23 @@ const (
 	FASTPATH_UPDATETYPE_POINTER      = 0xB
 )
 
+const (
+	FASTPATH_FRAGMENT_SINGLE = 0x0
+	FASTPATH_FRAGMENT_LAST   = 0x1
+	FASTPATH_FRAGMENT_FIRST  = 0x2
+	FASTPATH_FRAGMENT_NEXT   = 0x3
+)
+
+const (
+	CMDTYPE_SET_SURFACE_BITS    = 0x0001
+	CMDTYPE_FRAME_MARKER        = 0x0004
+	CMDTYPE_STREAM_SURFACE_BITS = 0x0006
+)
+
+const (
+	EX_COMPRESSED_BITMAP_HEADER_PRESENT = 0x01
+)
+
 const (
 	BITMAP_COMPRESSION = 0x0001
 	//NO_BITMAP_COMPRESSION_HDR = 0x0400
@@ -327,42 +352,91 @@ func NewDataPDU(data DataPDUData, shareId uint32) *DataPDU {
 	}
 }
 
-func readDataPDU(r io.Reader) (*DataPDU, error) {
+// UnknownPDUError is returned for a PDU of a type without reader, the
+// client skips it unless strict
+type UnknownPDUError struct {
+	// "pdu", "data pdu" or "fast path update"
+	Kind string
+	Type uint16
+}
+
+func (e *UnknownPDUError) Error() string {
+	return fmt.Sprintf("unknown %s type 0x%02x", e.Kind, e.Type)
+}
+
+// unpack returns a reader of the data PDUs packed as the struct of newData
+func unpack(newData func() DataPDUData) func(io.Reader) (DataPDUData, error) {
+	return func(r io.Reader) (DataPDUData, error) {
+		d := newData()
+		if err := struc.Unpack(r, d); err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
+}
+
+// dataPDUReaders read the data PDUs by type2
+var dataPDUReaders = map[uint8]func(io.Reader) (DataPDUData, error){
+	PDUTYPE2_SYNCHRONIZE:        unpack(func() DataPDUData { return &SynchronizeDataPDU{} }),
+	PDUTYPE2_CONTROL:            unpack(func() DataPDUData { return &ControlDataPDU{} }),
+	PDUTYPE2_FONTLIST:           unpack(func() DataPDUData { return &FontListDataPDU{} }),
+	PDUTYPE2_SET_ERROR_INFO_PDU: unpack(func() DataPDUData { return &ErrorInfoDataPDU{} }),
+	PDUTYPE2_FONTMAP:            unpack(func() DataPDUData { return &FontMapDataPDU{} }),
+	PDUTYPE2_SAVE_SESSION_INFO: func(r io.Reader) (DataPDUData, error) {
+		// the logon info is read as far as it goes
+		s := &SaveSessionInfo{}
+		s.Unpack(r)
+		return s, nil
+	},
+	PDUTYPE2_UPDATE: func(r io.Reader) (DataPDUData, error) {
+		u := &UpdateDataPDU{}
+		if err := u.Unpack(r); err != nil {
+			return nil, err
+		}
+		return u, nil
+	},
+	PDUTYPE2_POINTER: func(r io.Reader) (DataPDUData, error) {
+		p := &PointerPDU{}
+		if err := p.Unpack(r); err != nil {
+			return nil, err
+		}
+		return p, nil
+	},
+}
+
+// readDataPDU reads a data pdu, bulk decompresses it unless nil
+func readDataPDU(r io.Reader, bulk *mppc) (*DataPDU, error) {
 	header := &ShareDataHeader{}
 	err := struc.Unpack(r, header)
 	if err != nil {
 		glog.Error("read data pdu header error", err)
 		return nil, err
 	}
-	var d DataPDUData
-	glog.Debugf("header=%02x", header.PDUType2)
-	switch header.PDUType2 {
-	case PDUTYPE2_SYNCHRONIZE:
-		d = &SynchronizeDataPDU{}
-	case PDUTYPE2_CONTROL:
-		d = &ControlDataPDU{}
-	case PDUTYPE2_FONTLIST:
-		d = &FontListDataPDU{}
-	case PDUTYPE2_SET_ERROR_INFO_PDU:
-		d = &ErrorInfoDataPDU{}
-	case PDUTYPE2_FONTMAP:
-		d = &FontMapDataPDU{}
-	case PDUTYPE2_SAVE_SESSION_INFO:
-		s := &SaveSessionInfo{}
-		s.Unpack(r)
-		d = s
-	default:
-		err = errors.New(fmt.Sprintf("Unknown data pdu type2 0x%02x", header.PDUType2))
-		glog.Error(err)
-		return nil, err
-	}
-
-	if header.PDUType2 != PDUTYPE2_SAVE_SESSION_INFO {
-		err = struc.Unpack(r, d)
+	if bulk != nil && bulkCompressed(header.CompressedType) {
+		// the compressed length counts the share control and share data headers
+		if header.CompressedLength < 18 {
+			return nil, errors.New(fmt.Sprintf("bad compressed length %d", header.CompressedLength))
+		}
+		data, err := core.ReadBytes(int(header.CompressedLength)-18, r)
 		if err != nil {
-			glog.Error("read data pdu error", err)
 			return nil, err
 		}
+		if data, err = bulk.decompress(data, header.CompressedType); err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+	} else if header.CompressedType&PACKET_COMPRESSED != 0 {
+		return nil, errors.New(fmt.Sprintf("compressed data pdu type2 0x%02x", header.PDUType2))
+	}
+	read, ok := dataPDUReaders[header.PDUType2]
+	if !ok {
+		return nil, &UnknownPDUError{"data pdu", uint16(header.PDUType2)}
+	}
+	glog.Debugf("header=%02x", header.PDUType2)
+	d, err := read(r)
+	if err != nil {
+		glog.Error("read data pdu error", err)
+		return nil, err
 	}
 
 	glog.Debugf("d=%+v", d)
@@ -433,6 +507,36 @@ func (*FontMapDataPDU) Type2() uint8 {
 	return PDUTYPE2_FONTMAP
 }
 
+// Rect is an inclusive rectangle
+type Rect struct {
+	Left   uint16 `struc:"little"`
+	Top    uint16 `struc:"little"`
+	Right  uint16 `struc:"little"`
+	Bottom uint16 `struc:"little"`
+}
+
+type RefreshRectDataPDU struct {
+	NumberOfAreas  uint8   `struc:"uint8,sizeof=AreasToRefresh"`
+	Pad3Octets     [3]byte `struc:"[3]byte"`
+	AreasToRefresh []Rect
+}
+
+func (*RefreshRectDataPDU) Type2() uint8 {
+	return PDUTYPE2_REFRESH_RECT
+}
+
+// SuppressOutputDataPDU has a desktop rectangle only when display updates
+// are allowed, so the allow flag is also the number of rectangles
+type SuppressOutputDataPDU struct {
+	AllowDisplayUpdates uint8   `struc:"uint8,sizeof=DesktopRect"`
+	Pad3Octets          [3]byte `struc:"[3]byte"`
+	DesktopRect         []Rect
+}
+
+func (*SuppressOutputDataPDU) Type2() uint8 {
+	return PDUTYPE2_SUPPRESS_OUTPUT
+}
+
 type InfoType uint32
 
 const (
@@ -459,20 +563,33 @@ type SaveSessionInfo struct {
 	FieldsPresent uint32
 	LogonId       uint32
 	Random        []byte
+	// confirmed by the logon info
+	Domain   string
+	UserName string
+	// TS_LOGON_ERRORS_INFO of the extended info
+	ErrorNotificationType uint32
+	ErrorNotificationData uint32
+}
+
+// logonString decodes the first cb bytes of the null terminated b
+func logonString(b []byte, cb uint32) string {
+	if int(cb) < len(b) {
+		b = b[:cb]
+	}
+	return strings.TrimRight(core.UnicodeDecode(b), "\x00")
 }
 
 func (s *SaveSessionInfo) logonInfoV1(r io.Reader) (err error) {
-	core.ReadUInt32LE(r) // cbDomain
+	cbDomain, _ := core.ReadUInt32LE(r)
 	b, _ := core.ReadBytes(52, r)
-	domain := core.UnicodeDecode(b)
+	s.Domain = logonString(b, cbDomain)
 
-	core.ReadUInt32LE(r) // cbUserName
+	cbUserName, _ := core.ReadUInt32LE(r)
 	b, _ = core.ReadBytes(512, r)
-	userName := core.UnicodeDecode(b)
+	s.UserName = logonString(b, cbUserName)
 
-	sessionId, _ := core.ReadUInt32LE(r)
-	s.LogonId = sessionId
-	glog.Infof("SessionId:[%d] UserName:[%s] Domain:[%s]", s.LogonId, userName, domain)
+	s.LogonId, err = core.ReadUInt32LE(r)
+	glog.Infof("SessionId:[%d] UserName:[%s] Domain:[%s]", s.LogonId, s.UserName, s.Domain)
 	return err
 }
 func (s *SaveSessionInfo) logonInfoV2(r io.Reader) (err error) {
@@ -485,10 +602,10 @@ func (s *SaveSessionInfo) logonInfoV2(r io.Reader) (err error) {
 	core.ReadBytes(558, r)
 
 	b, _ := core.ReadBytes(int(cbDomain), r)
-	domain := core.UnicodeDecode(b)
-	b, _ = core.ReadBytes(int(cbUserName), r)
-	userName := core.UnicodeDecode(b)
-	glog.Infof("SessionId:[%d] UserName:[ %s] Domain:[ %s]", s.LogonId, userName, domain)
+	s.Domain = logonString(b, cbDomain)
+	b, err = core.ReadBytes(int(cbUserName), r)
+	s.UserName = logonString(b, cbUserName)
+	glog.Infof("SessionId:[%d] UserName:[%s] Domain:[%s]", s.LogonId, s.UserName, s.Domain)
 
 	return err
 }
@@ -513,12 +630,13 @@ func (s *SaveSessionInfo) logonInfoExtended(r io.Reader) (err error) {
 		}
 		b, _ = core.ReadUInt32LE(r)
 		s.LogonId = b
-		s.Random, _ = core.ReadBytes(16, r)
-	} else { // logon error info
+		s.Random, err = core.ReadBytes(16, r)
+	}
+	// logon error info
+	if s.FieldsPresent&LOGON_EX_LOGONERRORS != 0 {
 		core.ReadUInt32LE(r)
-		b, _ := core.ReadUInt32LE(r)
-		b, _ = core.ReadUInt32LE(r)
-		s.LogonId = b
+		s.ErrorNotificationType, _ = core.ReadUInt32LE(r)
+		s.ErrorNotificationData, err = core.ReadUInt32LE(r)
 	}
 	core.ReadBytes(570, r)
 	return err
@@ -546,6 +664,50 @@ func (*SaveSessionInfo) Type2() uint8 {
 	return PDUTYPE2_SAVE_SESSION_INFO
 }
 
+/**
+ * Slow path update, bitmap and orders updates are decoded
+ * @see MS-RDPBCGR 2.2.9.1.1.3.1.2 Bitmap Update
+ * @see MS-RDPEGDI 2.2.2.1 Orders Update (TS_UPDATE_ORDERS_PDU_DATA)
+ */
+type UpdateDataPDU struct {
+	UpdateType uint16
+	Bitmap     *FastPathBitmapUpdateDataPDU
+	Orders     *FastPathOrdersPDU
+}
+
+func (u *UpdateDataPDU) Unpack(r io.Reader) error {
+	b, err := core.ReadBytes(2, r)
+	if err != nil {
+		return err
+	}
+	u.UpdateType = uint16(b[0]) | uint16(b[1])<<8
+	switch u.UpdateType {
+	case UPDATETYPE_BITMAP:
+		u.Bitmap = &FastPathBitmapUpdateDataPDU{Header: u.UpdateType}
+		return u.Bitmap.unpackRectangles(r)
+	case UPDATETYPE_ORDERS:
+		// numberOrders between 2 bytes of padding
+		if _, err = core.ReadBytes(2, r); err != nil {
+			return err
+		}
+		u.Orders = &FastPathOrdersPDU{}
+		if err = u.Orders.Unpack(r); err != nil {
+			return err
+		}
+		if len(u.Orders.OrderData) < 2 {
+			return errors.New("orders update shorter than its header")
+		}
+		u.Orders.OrderData = u.Orders.OrderData[2:]
+		return nil
+	}
+	glog.Debugf("Unhandled update type 0x%x", u.UpdateType)
+	return nil
+}
+
+func (*UpdateDataPDU) Type2() uint8 {
+	return PDUTYPE2_UPDATE
+}
+
 type PersistKeyPDU struct {
 	NumEntriesCache0   uint16 `struc:"little"`
 	NumEntriesCache1   uint16 `struc:"little"`
@@ -590,12 +752,89 @@ type BitmapData struct {
 	BitmapLength     uint16 `struc:"little,sizeof=BitmapDataStream"`
 	BitmapComprHdr   *BitmapCompressedDataHeader
 	BitmapDataStream []byte
+	// decompressed pixels, set on "bitmap" events
+	Pixels []byte `struc:"skip"`
 }
 
 func (b *BitmapData) IsCompress() bool {
 	return b.Flags&BITMAP_COMPRESSION != 0
 }
 
+// BytesPerPixel of the bitmap, 0 if the color depth is unknown
+func (b *BitmapData) BytesPerPixel() int {
+	switch b.BitsPerPixel {
+	case 8:
+		return 1
+	case 15, 16:
+		return 2
+	case 24:
+		return 3
+	case 32:
+		return 4
+	}
+	return 0
+}
+
+// Decompress returns the pixels of the rectangle, rows are as sent by the server
+func (b *BitmapData) Decompress() ([]byte, error) {
+	bpp := b.BytesPerPixel()
+	if bpp == 0 {
+		return nil, errors.New(fmt.Sprintf("invalid bitmap color depth %d", b.BitsPerPixel))
+	}
+	if !b.IsCompress() {
+		if len(b.BitmapDataStream) < int(b.Width)*int(b.Height)*bpp {
+			return nil, errors.New("bitmap data shorter than its size")
+		}
+		return b.BitmapDataStream, nil
+	}
+	if bpp == 4 {
+		return core.Decompress(b.BitmapDataStream, int(b.Width), int(b.Height), bpp), nil
+	}
+	return core.DecompressRLE(b.BitmapDataStream, int(b.Width), int(b.Height), int(b.BitsPerPixel))
+}
+
+/**
+ * TS_BITMAP_DATA
+ * @see MS-RDPBCGR 2.2.9.1.1.3.1.2.2 Bitmap Data
+ */
+func readBitmapData(r io.Reader) (BitmapData, error) {
+	rect := BitmapData{}
+	if err := readUint16s(r, &rect.DestLeft, &rect.DestTop, &rect.DestRight, &rect.DestBottom,
+		&rect.Width, &rect.Height, &rect.BitsPerPixel, &rect.Flags, &rect.BitmapLength); err != nil {
+		return rect, err
+	}
+	ln := int(rect.BitmapLength)
+	if rect.Flags&BITMAP_COMPRESSION != 0 && (rect.Flags&NO_BITMAP_COMPRESSION_HDR == 0) {
+		if ln < 8 {
+			return rect, errors.New("bitmap length shorter than its compression header")
+		}
+		hdr, err := core.ReadBytes(8, r)
+		if err != nil {
+			return rect, err
+		}
+		rect.BitmapComprHdr = new(BitmapCompressedDataHeader)
+		if err = struc.Unpack(bytes.NewReader(hdr), rect.BitmapComprHdr); err != nil {
+			return rect, err
+		}
+		ln -= 8
+	}
+	var err error
+	rect.BitmapDataStream, err = core.ReadBytes(ln, r)
+	return rect, err
+}
+
+// readUint16s reads little endian values, unlike core.ReadUint16LE it reports short reads
+func readUint16s(r io.Reader, values ...*uint16) error {
+	for _, v := range values {
+		b, err := core.ReadBytes(2, r)
+		if err != nil {
+			return err
+		}
+		*v = uint16(b[0]) | uint16(b[1])<<8
+	}
+	return nil
+}
+
 type FastPathBitmapUpdateDataPDU struct {
 	Header           uint16 `struc:"little"`
 	NumberRectangles uint16 `struc:"little,sizeof=Rectangles"`
@@ -604,60 +843,189 @@ type FastPathBitmapUpdateDataPDU struct {
 
 func (f *FastPathBitmapUpdateDataPDU) Unpack(r io.Reader) error {
 	var err error
-	f.Header, err = core.ReadUint16LE(r)
-	f.NumberRectangles, err = core.ReadUint16LE(r)
+	if f.Header, err = core.ReadUint16LE(r); err != nil {
+		return err
+	}
+	return f.unpackRectangles(r)
+}
+
+func (f *FastPathBitmapUpdateDataPDU) unpackRectangles(r io.Reader) error {
+	b, err := core.ReadBytes(2, r)
+	if err != nil {
+		return err
+	}
+	f.NumberRectangles = uint16(b[0]) | uint16(b[1])<<8
 	f.Rectangles = make([]BitmapData, 0, f.NumberRectangles)
 	for i := 0; i < int(f.NumberRectangles); i++ {
-		rect := BitmapData{}
-		rect.DestLeft, err = core.ReadUint16LE(r)
-		rect.DestTop, err = core.ReadUint16LE(r)
-		rect.DestRight, err = core.ReadUint16LE(r)
-		rect.DestBottom, err = core.ReadUint16LE(r)
-		rect.Width, err = core.ReadUint16LE(r)
-		rect.Height, err = core.ReadUint16LE(r)
-		rect.BitsPerPixel, err = core.ReadUint16LE(r)
-		rect.Flags, err = core.ReadUint16LE(r)
-		rect.BitmapLength, err = core.ReadUint16LE(r)
-		ln := rect.BitmapLength
-		if rect.Flags&BITMAP_COMPRESSION != 0 && (rect.Flags&NO_BITMAP_COMPRESSION_HDR == 0) {
-			rect.BitmapComprHdr = new(BitmapCompressedDataHeader)
-			rect.BitmapComprHdr.CbCompFirstRowSize, err = core.ReadUint16LE(r)
-			rect.BitmapComprHdr.CbCompMainBodySize, err = core.ReadUint16LE(r)
-			rect.BitmapComprHdr.CbScanWidth, err = core.ReadUint16LE(r)
-			rect.BitmapComprHdr.CbUncompressedSize, err = core.ReadUint16LE(r)
-			ln = rect.BitmapComprHdr.CbCompMainBodySize
+		rect, err := readBitmapData(r)
+		if err != nil {
+			return errors.New(fmt.Sprintf("bitmap rectangle %d: %v", i, err))
 		}
-
-		rect.BitmapDataStream, err = core.ReadBytes(int(ln), r)
 		f.Rectangles = append(f.Rectangles, rect)
 	}
-	return err
+	return nil
 }
 
 func (*FastPathBitmapUpdateDataPDU) FastPathUpdateType() uint8 {
 	return FASTPATH_UPDATETYPE_BITMAP
 }
 
+/**
+ * TS_SURFCMD_SET_SURF_BITS or TS_SURFCMD_STREAM_SURF_BITS with its TS_BITMAP_DATA_EX
+ * @see MS-RDPBCGR 2.2.9.2.1 Set Surface Bits Command
+ */
+type SurfaceBits struct {
+	CmdType    uint16
+	DestLeft   uint16
+	DestTop    uint16
+	DestRight  uint16
+	DestBottom uint16
+	Bpp        uint8
+	Flags      uint8
+	CodecId    uint8
+	Width      uint16
+	Height     uint16
+	BitmapData []byte
+}
+
+/**
+ * Surface commands, frame markers are skipped
+ * @see MS-RDPBCGR 2.2.9.1.2.1.10 Fast-Path Surface Commands Update
+ */
+type FastPathSurfaceCommandsPDU struct {
+	Commands []SurfaceBits
+}
+
+func (f *FastPathSurfaceCommandsPDU) Unpack(r io.Reader) error {
+	for {
+		var cmdType uint16
+		if err := readUint16s(r, &cmdType); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		switch cmdType {
+		case CMDTYPE_FRAME_MARKER:
+			// frameAction and frameId
+			if _, err := core.ReadBytes(6, r); err != nil {
+				return err
+			}
+		case CMDTYPE_SET_SURFACE_BITS, CMDTYPE_STREAM_SURFACE_BITS:
+			cmd, err := readSurfaceBits(cmdType, r)
+			if err != nil {
+				return err
+			}
+			f.Commands = append(f.Commands, cmd)
+		default:
+			return errors.New(fmt.Sprintf("unknown surface command 0x%x", cmdType))
+		}
+	}
+}
+
+// @see MS-RDPBCGR 2.2.9.2.1.1 Extended Bitmap Data
+func readSurfaceBits(cmdType uint16, r io.Reader) (SurfaceBits, error) {
+	cmd := SurfaceBits{CmdType: cmdType}
+	if err := readUint16s(r, &cmd.DestLeft, &cmd.DestTop, &cmd.DestRight, &cmd.DestBottom); err != nil {
+		return cmd, err
+	}
+	b, err := core.ReadBytes(12, r)
+	if err != nil {
+		return cmd, err
+	}
+	cmd.Bpp, cmd.Flags, cmd.CodecId = b[0], b[1], b[3]
+	cmd.Width = uint16(b[4]) | uint16(b[5])<<8
+	cmd.Height = uint16(b[6]) | uint16(b[7])<<8
+	ln := int(b[8]) | int(b[9])<<8 | int(b[10])<<16 | int(b[11])<<24
+	if cmd.Flags&EX_COMPRESSED_BITMAP_HEADER_PRESENT != 0 {
+		// TS_COMPRESSED_BITMAP_HEADER_EX
+		if _, err = core.ReadBytes(24, r); err != nil {
+			return cmd, err
+		}
+	}
+	cmd.BitmapData, err = core.ReadBytes(ln, r)
+	return cmd, err
+}
+
+func (*FastPathSurfaceCommandsPDU) FastPathUpdateType() uint8 {
+	return FASTPATH_UPDATETYPE_SURFCMDS
+}
+
+/**
+ * TS_UPDATE_PALETTE_DATA, colors are 0xRRGGBB
+ * @see MS-RDPBCGR 2.2.9.1.1.3.1.1 Palette Update Data
+ */
+type FastPathPaletteUpdatePDU struct {
+	Header       uint16
+	NumberColors uint32
+	Colors       []uint32
+}
+
+func (f *FastPathPaletteUpdatePDU) Unpack(r io.Reader) error {
+	b, err := core.ReadBytes(8, r)
+	if err != nil {
+		return err
+	}
+	f.Header = uint16(b[0]) | uint16(b[1])<<8
+	f.NumberColors = uint32(b[4]) | uint32(b[5])<<8 | uint32(b[6])<<16 | uint32(b[7])<<24
+	if f.NumberColors > 256 {
+		return errors.New(fmt.Sprintf("invalid palette of %d colors", f.NumberColors))
+	}
+	entries, err := core.ReadBytes(int(f.NumberColors)*3, r)
+	if err != nil {
+		return err
+	}
+	f.Colors = make([]uint32, f.NumberColors)
+	for i := range f.Colors {
+		f.Colors[i] = uint32(entries[i*3])<<16 | uint32(entries[i*3+1])<<8 | uint32(entries[i*3+2])
+	}
+	return nil
+}
+
+func (*FastPathPaletteUpdatePDU) FastPathUpdateType() uint8 {
+	return FASTPATH_UPDATETYPE_PALETTE
+}
+
 type FastPathUpdatePDU struct {
 	UpdateHeader     uint8
 	CompressionFlags uint8
 	Size             uint16
 	Data             UpdateData
+	// raw data of a fragment, Data is nil
+	Fragment []byte
+}
+
+func (f *FastPathUpdatePDU) UpdateCode() uint8 {
+	return f.UpdateHeader & 0xf
+}
+
+func (f *FastPathUpdatePDU) Fragmentation() uint8 {
+	return (f.UpdateHeader >> 4) & 0x3
 }
 
 const (
 	FASTPATH_OUTPUT_COMPRESSION_USED = 0x2
 )
 
-func readFastPathUpdatePDU(r io.Reader) (*FastPathUpdatePDU, error) {
+// compression flags of a fast path update
+// @see MS-RDPBCGR 2.2.9.1.2.1 Fast-Path Update (TS_FP_UPDATE)
+const (
+	PACKET_COMPRESSED = 0x20
+	PACKET_AT_FRONT   = 0x40
+	PACKET_FLUSHED    = 0x80
+)
+
+// readFastPathUpdatePDU reads a fast path update, bulk decompresses it unless nil
+func readFastPathUpdatePDU(r io.Reader, bulk *mppc) (*FastPathUpdatePDU, error) {
 	f := &FastPathUpdatePDU{}
 	var err error
 	f.UpdateHeader, err = core.ReadUInt8(r)
 	if err != nil {
 		return nil, err
 	}
-	if (f.UpdateHeader>>4)&FASTPATH_OUTPUT_COMPRESSION_USED != 0 {
-		f.CompressionFlags, err = core.ReadUInt8(r)
+	if (f.UpdateHeader>>6)&FASTPATH_OUTPUT_COMPRESSION_USED != 0 {
+		if f.CompressionFlags, err = core.ReadUInt8(r); err != nil {
+			return nil, err
+		}
 	}
 
 	f.Size, err = core.ReadUint16LE(r)
@@ -665,7 +1033,9 @@ func readFastPathUpdatePDU(r io.Reader) (*FastPathUpdatePDU, error) {
 		return nil, err
 	}
 	if f.Size == 0 {
-		return f, nil
+		// such as the null and default pointers
+		f.Data, err = readUpdateData(f.UpdateCode(), nil)
+		return f, err
 	}
 	dataBytes, err := core.ReadBytes(int(f.Size), r)
 	if err != nil {
@@ -673,27 +1043,49 @@ func readFastPathUpdatePDU(r io.Reader) (*FastPathUpdatePDU, error) {
 		return nil, err
 	}
 
+	// the update is skipped on a decoding error, the next one is still readable
+	if bulk != nil && bulkCompressed(f.CompressionFlags) {
+		if dataBytes, err = bulk.decompress(dataBytes, f.CompressionFlags); err != nil {
+			return f, err
+		}
+	} else if f.CompressionFlags&PACKET_COMPRESSED != 0 {
+		return f, errors.New(fmt.Sprintf("compressed fast path update 0x%x not supported", f.UpdateCode()))
+	}
+	if f.Fragmentation() != FASTPATH_FRAGMENT_SINGLE {
+		f.Fragment = dataBytes
+		return f, nil
+	}
+	f.Data, err = readUpdateData(f.UpdateCode(), dataBytes)
+	return f, err
+}
+
+// readUpdateData unpacks the data of a whole fast path update of type code
+func readUpdateData(code uint8, data []byte) (UpdateData, error) {
 	var d UpdateData
-	glog.Debugf("Fast Path PDU type 0x%x", f.UpdateHeader)
-	switch f.UpdateHeader & 0xf {
+	glog.Debugf("Fast Path PDU type 0x%x", code)
+	switch code {
+	case FASTPATH_UPDATETYPE_ORDERS:
+		d = &FastPathOrdersPDU{}
 	case FASTPATH_UPDATETYPE_BITMAP:
 		d = &FastPathBitmapUpdateDataPDU{}
-
+	case FASTPATH_UPDATETYPE_PALETTE:
+		d = &FastPathPaletteUpdatePDU{}
+	case FASTPATH_UPDATETYPE_SURFCMDS:
+		d = &FastPathSurfaceCommandsPDU{}
+	case FASTPATH_UPDATETYPE_PTR_NULL, FASTPATH_UPDATETYPE_PTR_DEFAULT, FASTPATH_UPDATETYPE_PTR_POSITION,
+		FASTPATH_UPDATETYPE_COLOR, FASTPATH_UPDATETYPE_CACHED, FASTPATH_UPDATETYPE_POINTER:
+		d = &FastPathPointerUpdatePDU{Code: code}
+	case FASTPATH_UPDATETYPE_SYNCHRONIZE:
+		// no data
+		return nil, nil
 	default:
-		glog.Debugf("Unknown Fast Path PDU type 0x%x", f.UpdateHeader)
-		return f, errors.New(fmt.Sprintf("Unknown Fast Path PDU type 0x%x", f.UpdateHeader))
-		//d = nil
+		return nil, &UnknownPDUError{"fast path update", uint16(code)}
 	}
-	if d != nil {
-		err = d.Unpack(bytes.NewReader(dataBytes))
-		if err != nil {
-			glog.Error("Unpack:", err)
-			return nil, err
-		}
+	if err := d.Unpack(bytes.NewReader(data)); err != nil {
+		glog.Error("Unpack:", err)
+		return nil, err
 	}
-
-	f.Data = d
-	return f, nil
+	return d, nil
 }
 
 type ShareControlHeader struct {
@@ -718,7 +1110,7 @@ func NewPDU(userId uint16, message PDUMessage) *PDU {
 	return pdu
 }
 
-func readPDU(r io.Reader) (*PDU, error) {
+func readPDU(r io.Reader, bulk *mppc) (*PDU, error) {
 	pdu := &PDU{}
 	var err error
 	header := &ShareControlHeader{}
@@ -736,7 +1128,7 @@ func readPDU(r io.Reader) (*PDU, error) {
 		d, err = readDemandActivePDU(r)
 	case PDUTYPE_DATAPDU:
 		glog.Debug("PDUTYPE_DATAPDU")
-		d, err = readDataPDU(r)
+		d, err = readDataPDU(r, bulk)
 	case PDUTYPE_CONFIRMACTIVEPDU:
 		glog.Debug("PDUTYPE_CONFIRMACTIVEPDU")
 		d, err = readConfirmActivePDU(r)
@@ -744,7 +1136,7 @@ func readPDU(r io.Reader) (*PDU, error) {
 		glog.Debug("PDUTYPE_DEACTIVATEALLPDU")
 		d, err = readDeactiveAllPDU(r)
 	default:
-		glog.Errorf("PDU invalid pdu type: 0x%02x", pdu.ShareCtrlHeader.PDUType)
+		err = &UnknownPDUError{"pdu", pdu.ShareCtrlHeader.PDUType}
 	}
 	if err != nil {
 		return nil, err
@@ -814,6 +1206,91 @@ func (p *UnicodeKeyEvent) Serialize() []byte {
 	return buff.Bytes()
 }
 
+// fast path input event codes
+// @see MS-RDPBCGR 2.2.8.1.2.2 Fast-Path Input Event (TS_FP_INPUT_EVENT)
+const (
+	FASTPATH_INPUT_EVENT_SCANCODE = 0x0
+	FASTPATH_INPUT_EVENT_MOUSE    = 0x1
+	FASTPATH_INPUT_EVENT_MOUSEX   = 0x2
+	FASTPATH_INPUT_EVENT_SYNC     = 0x3
+	FASTPATH_INPUT_EVENT_UNICODE  = 0x4
+)
+
+const (
+	FASTPATH_INPUT_KBDFLAGS_RELEASE   = 0x01
+	FASTPATH_INPUT_KBDFLAGS_EXTENDED  = 0x02
+	FASTPATH_INPUT_KBDFLAGS_EXTENDED1 = 0x04
+)
+
+/**
+ * TS_FP_KEYBOARD_EVENT, a code above 0xff is prefixed, 0xe0 for extended and 0xe1 for extended1 keys
+ * @see MS-RDPBCGR 2.2.8.1.2.2.1 Fast-Path Keyboard Event
+ */
+func fastPathScancodeEvent(code uint16, down bool) []byte {
+	var flags uint8
+	if !down {
+		flags |= FASTPATH_INPUT_KBDFLAGS_RELEASE
+	}
+	switch code >> 8 {
+	case 0xe0:
+		flags |= FASTPATH_INPUT_KBDFLAGS_EXTENDED
+	case 0xe1:
+		flags |= FASTPATH_INPUT_KBDFLAGS_EXTENDED1
+	}
+	return []byte{FASTPATH_INPUT_EVENT_SCANCODE<<5 | flags, uint8(code)}
+}
+
+/**
+ * TS_FP_UNICODE_KEYBOARD_EVENT of an UTF-16 code unit
+ * @see MS-RDPBCGR 2.2.8.1.2.2.2 Fast-Path Unicode Keyboard Event
+ */
+func fastPathUnicodeEvent(unit uint16, down bool) []byte {
+	var flags uint8
+	if !down {
+		flags |= FASTPATH_INPUT_KBDFLAGS_RELEASE
+	}
+	return []byte{FASTPATH_INPUT_EVENT_UNICODE<<5 | flags, uint8(unit), uint8(unit >> 8)}
+}
+
+/**
+ * TS_FP_POINTER_EVENT
+ * @see MS-RDPBCGR 2.2.8.1.2.2.3 Fast-Path Mouse Event
+ */
+func fastPathPointerEvent(x, y, flags uint16) []byte {
+	return fastPathMouseEvent(FASTPATH_INPUT_EVENT_MOUSE, x, y, flags)
+}
+
+/**
+ * TS_FP_POINTERX_EVENT, flags are PTRXFLAGS_*
+ * @see MS-RDPBCGR 2.2.8.1.2.2.4 Fast-Path Extended Mouse Event
+ */
+func fastPathPointerXEvent(x, y, flags uint16) []byte {
+	return fastPathMouseEvent(FASTPATH_INPUT_EVENT_MOUSEX, x, y, flags)
+}
+
+func fastPathMouseEvent(code uint8, x, y, flags uint16) []byte {
+	buff := &bytes.Buffer{}
+	core.WriteUInt8(code<<5, buff)
+	core.WriteUInt16LE(flags, buff)
+	core.WriteUInt16LE(x, buff)
+	core.WriteUInt16LE(y, buff)
+	return buff.Bytes()
+}
+
+/**
+ * fpInputEvents of a TS_FP_INPUT_PDU, led by the optional numEvents field
+ * as the header byte keeps numEvents 0
+ * @see MS-RDPBCGR 2.2.8.1.2 Client Fast-Path Input Event PDU (TS_FP_INPUT_PDU)
+ */
+func fastPathInputEvents(events ...[]byte) []byte {
+	buff := &bytes.Buffer{}
+	core.WriteUInt8(uint8(len(events)), buff)
+	for _, e := range events {
+		core.WriteBytes(e, buff)
+	}
+	return buff.Bytes()
+}
+
 type ClientInputEventPDU struct {
 	NumEvents           uint16               `struc:"little,sizeof=SlowPathInputEvents"`
 	Pad2Octets          uint16               `struc:"little"`
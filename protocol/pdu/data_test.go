@@ -0,0 +1,149 @@
+package pdu
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/lunixbochs/struc"
+	"github.com/tomatome/grdp/glog"
+)
+
+func init() {
+	glog.SetLevel(glog.NONE)
+}
+
+// two 16 bpp rectangles, a raw 2x1 one and a compressed one with header
+const bitmapUpdateHex = "01000200" +
+	"0000000001000000020001001000000004001122" + "3344" +
+	"0a0000000b0000000100010010000100" + "0a00" + "0000020002000200" + "abcd"
+
+func TestReadDataPDUBitmapUpdate(t *testing.T) {
+	data, _ := hex.DecodeString(bitmapUpdateHex)
+	buff := &bytes.Buffer{}
+	struc.Pack(buff, NewShareDataHeader(len(data), PDUTYPE2_UPDATE, 0x103ea))
+	buff.Write(data)
+
+	p, err := readDataPDU(buff, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := p.Data.(*UpdateDataPDU)
+	if u.UpdateType != UPDATETYPE_BITMAP || u.Bitmap == nil || len(u.Bitmap.Rectangles) != 2 {
+		t.Fatalf("bad update %+v", u)
+	}
+	raw, compressed := u.Bitmap.Rectangles[0], u.Bitmap.Rectangles[1]
+	if raw.DestRight != 1 || raw.Width != 2 || raw.Height != 1 || raw.IsCompress() {
+		t.Errorf("bad raw rectangle %+v", raw)
+	}
+	pixels, err := raw.Decompress()
+	if err != nil || hex.EncodeToString(pixels) != "11223344" {
+		t.Error("bad raw pixels", pixels, err)
+	}
+	if compressed.DestLeft != 10 || !compressed.IsCompress() || compressed.BitmapComprHdr == nil ||
+		hex.EncodeToString(compressed.BitmapDataStream) != "abcd" {
+		t.Errorf("bad compressed rectangle %+v", compressed)
+	}
+}
+
+func TestReadBitmapDataTruncated(t *testing.T) {
+	data, _ := hex.DecodeString(bitmapUpdateHex)
+	for _, n := range []int{6, 20, 27, 40} {
+		u := &UpdateDataPDU{}
+		if err := u.Unpack(bytes.NewReader(data[:n])); err == nil {
+			t.Error("expect error on", n, "bytes")
+		}
+	}
+}
+
+func TestBitmapDecompressErrors(t *testing.T) {
+	for _, b := range []BitmapData{
+		{Width: 2, Height: 2, BitsPerPixel: 16, BitmapDataStream: make([]byte, 7)},
+		{Width: 1, Height: 1, BitsPerPixel: 12, BitmapDataStream: make([]byte, 4)},
+		{Width: 1, Height: 1, BitsPerPixel: 24, Flags: BITMAP_COMPRESSION},
+	} {
+		if _, err := b.Decompress(); err == nil {
+			t.Errorf("expect error for %+v", b)
+		}
+	}
+}
+
+// a frame marker and a set surface bits command
+const surfaceCommandsHex = "0400" + "0000" + "01000000" +
+	"0100" + "0a00140049005300" + "2000000340004000" + "02000000" + "abcd"
+
+func TestReadFastPathSurfaceCommands(t *testing.T) {
+	data, _ := hex.DecodeString(surfaceCommandsHex)
+	update := append([]byte{FASTPATH_UPDATETYPE_SURFCMDS, byte(len(data)), 0x00}, data...)
+	f, err := readFastPathUpdatePDU(bytes.NewReader(update), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmds := f.Data.(*FastPathSurfaceCommandsPDU).Commands
+	if len(cmds) != 1 {
+		t.Fatalf("expect 1 command, get %+v", cmds)
+	}
+	cmd := cmds[0]
+	if cmd.CmdType != CMDTYPE_SET_SURFACE_BITS || cmd.DestLeft != 10 || cmd.DestTop != 20 ||
+		cmd.Bpp != 32 || cmd.CodecId != CODEC_ID_REMOTEFX || cmd.Width != 64 || cmd.Height != 64 ||
+		hex.EncodeToString(cmd.BitmapData) != "abcd" {
+		t.Errorf("bad surface bits %+v", cmd)
+	}
+
+	for _, n := range []int{4, 20, len(data) - 1} {
+		if _, err := readUpdateData(FASTPATH_UPDATETYPE_SURFCMDS, data[:n]); err == nil {
+			t.Error("expect error on", n, "bytes")
+		}
+	}
+}
+
+func TestReadFastPathFragment(t *testing.T) {
+	// a first fragment, with the compression bits clear
+	f, err := readFastPathUpdatePDU(bytes.NewReader([]byte{FASTPATH_FRAGMENT_FIRST<<4 | FASTPATH_UPDATETYPE_SURFCMDS, 0x02, 0x00, 0x04, 0x00}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Data != nil || f.Fragmentation() != FASTPATH_FRAGMENT_FIRST || hex.EncodeToString(f.Fragment) != "0400" {
+		t.Errorf("bad fragment %+v", f)
+	}
+}
+
+func TestReadFastPathPalette(t *testing.T) {
+	data, _ := hex.DecodeString("0200" + "0000" + "02000000" + "ff0000" + "0080ff")
+	d, err := readUpdateData(FASTPATH_UPDATETYPE_PALETTE, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	colors := d.(*FastPathPaletteUpdatePDU).Colors
+	if len(colors) != 2 || colors[0] != 0xff0000 || colors[1] != 0x0080ff {
+		t.Errorf("bad palette %x", colors)
+	}
+	if _, err := readUpdateData(FASTPATH_UPDATETYPE_PALETTE, data[:len(data)-1]); err == nil {
+		t.Error("truncated palette accepted")
+	}
+}
+
+func TestReadPDUShareHeaders(t *testing.T) {
+	data := NewPDU(1007, NewDataPDU(NewSynchronizeDataPDU(1002), 0x103ea)).serialize()
+	p, err := readPDU(bytes.NewReader(data), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ShareCtrlHeader.PDUType != PDUTYPE_DATAPDU || p.ShareCtrlHeader.PDUSource != 1007 ||
+		int(p.ShareCtrlHeader.TotalLength) != len(data) {
+		t.Errorf("bad share control header %+v", p.ShareCtrlHeader)
+	}
+	d := p.Message.(*DataPDU)
+	if d.Header.SharedId != 0x103ea || d.Header.PDUType2 != PDUTYPE2_SYNCHRONIZE {
+		t.Errorf("bad share data header %+v", d.Header)
+	}
+	if s, ok := d.Data.(*SynchronizeDataPDU); !ok || s.TargetUser != 1002 {
+		t.Errorf("bad synchronize pdu %+v", d.Data)
+	}
+
+	// share data header compressedType
+	data[6+9] = PACKET_COMPRESSED
+	if _, err = readPDU(bytes.NewReader(data), nil); err == nil {
+		t.Error("expect error on compressed data pdu")
+	}
+}
@@ -0,0 +1,225 @@
+package pdu
+
+import (
+	"fmt"
+)
+
+// ErrorInfo is the code of a Set Error Info PDU, it tells why the
+// server is about to disconnect
+type ErrorInfo uint32
+
+/**
+ * @see MS-RDPBCGR 2.2.5.1.1 Set Error Info PDU Data (TS_SET_ERROR_INFO_PDU)
+ */
+const (
+	ERRINFO_NONE                                 ErrorInfo = 0x00000000
+	ERRINFO_RPC_INITIATED_DISCONNECT             ErrorInfo = 0x00000001
+	ERRINFO_RPC_INITIATED_LOGOFF                 ErrorInfo = 0x00000002
+	ERRINFO_IDLE_TIMEOUT                         ErrorInfo = 0x00000003
+	ERRINFO_LOGON_TIMEOUT                        ErrorInfo = 0x00000004
+	ERRINFO_DISCONNECTED_BY_OTHERCONNECTION      ErrorInfo = 0x00000005
+	ERRINFO_OUT_OF_MEMORY                        ErrorInfo = 0x00000006
+	ERRINFO_SERVER_DENIED_CONNECTION             ErrorInfo = 0x00000007
+	ERRINFO_SERVER_INSUFFICIENT_PRIVILEGES       ErrorInfo = 0x00000009
+	ERRINFO_SERVER_FRESH_CREDENTIALS_REQUIRED    ErrorInfo = 0x0000000A
+	ERRINFO_RPC_INITIATED_DISCONNECT_BYUSER      ErrorInfo = 0x0000000B
+	ERRINFO_LOGOFF_BY_USER                       ErrorInfo = 0x0000000C
+	ERRINFO_CLOSE_STACK_ON_DRIVER_NOT_READY      ErrorInfo = 0x0000000F
+	ERRINFO_SERVER_DWM_CRASH                     ErrorInfo = 0x00000010
+	ERRINFO_CLOSE_STACK_ON_DRIVER_FAILURE        ErrorInfo = 0x00000011
+	ERRINFO_CLOSE_STACK_ON_DRIVER_IFACE_FAILURE  ErrorInfo = 0x00000012
+	ERRINFO_SERVER_WINLOGON_CRASH                ErrorInfo = 0x00000017
+	ERRINFO_SERVER_CSRSS_CRASH                   ErrorInfo = 0x00000018
+	ERRINFO_SERVER_SHUTDOWN                      ErrorInfo = 0x00000019
+	ERRINFO_SERVER_REBOOT                        ErrorInfo = 0x0000001A
+	ERRINFO_LICENSE_INTERNAL                     ErrorInfo = 0x00000100
+	ERRINFO_LICENSE_NO_LICENSE_SERVER            ErrorInfo = 0x00000101
+	ERRINFO_LICENSE_NO_LICENSE                   ErrorInfo = 0x00000102
+	ERRINFO_LICENSE_BAD_CLIENT_MSG               ErrorInfo = 0x00000103
+	ERRINFO_LICENSE_HWID_DOESNT_MATCH_LICENSE    ErrorInfo = 0x00000104
+	ERRINFO_LICENSE_BAD_CLIENT_LICENSE           ErrorInfo = 0x00000105
+	ERRINFO_LICENSE_CANT_FINISH_PROTOCOL         ErrorInfo = 0x00000106
+	ERRINFO_LICENSE_CLIENT_ENDED_PROTOCOL        ErrorInfo = 0x00000107
+	ERRINFO_LICENSE_BAD_CLIENT_ENCRYPTION        ErrorInfo = 0x00000108
+	ERRINFO_LICENSE_CANT_UPGRADE_LICENSE         ErrorInfo = 0x00000109
+	ERRINFO_LICENSE_NO_REMOTE_CONNECTIONS        ErrorInfo = 0x0000010A
+	ERRINFO_CB_DESTINATION_NOT_FOUND             ErrorInfo = 0x00000400
+	ERRINFO_CB_LOADING_DESTINATION               ErrorInfo = 0x00000402
+	ERRINFO_CB_REDIRECTING_TO_DESTINATION        ErrorInfo = 0x00000404
+	ERRINFO_CB_SESSION_ONLINE_VM_WAKE            ErrorInfo = 0x00000405
+	ERRINFO_CB_SESSION_ONLINE_VM_BOOT            ErrorInfo = 0x00000406
+	ERRINFO_CB_SESSION_ONLINE_VM_NO_DNS          ErrorInfo = 0x00000407
+	ERRINFO_CB_DESTINATION_POOL_NOT_FREE         ErrorInfo = 0x00000408
+	ERRINFO_CB_CONNECTION_CANCELLED              ErrorInfo = 0x00000409
+	ERRINFO_CB_CONNECTION_ERROR_INVALID_SETTINGS ErrorInfo = 0x00000410
+	ERRINFO_CB_SESSION_ONLINE_VM_BOOT_TIMEOUT    ErrorInfo = 0x00000411
+	ERRINFO_CB_SESSION_ONLINE_VM_SESSMON_FAILED  ErrorInfo = 0x00000412
+	ERRINFO_UNKNOWNPDUTYPE2                      ErrorInfo = 0x000010C9
+	ERRINFO_UNKNOWNPDUTYPE                       ErrorInfo = 0x000010CA
+	ERRINFO_DATAPDUSEQUENCE                      ErrorInfo = 0x000010CB
+	ERRINFO_CONTROLPDUSEQUENCE                   ErrorInfo = 0x000010CD
+	ERRINFO_INVALIDCONTROLPDUACTION              ErrorInfo = 0x000010CE
+	ERRINFO_INVALIDINPUTPDUTYPE                  ErrorInfo = 0x000010CF
+	ERRINFO_INVALIDINPUTPDUMOUSE                 ErrorInfo = 0x000010D0
+	ERRINFO_INVALIDREFRESHRECTPDU                ErrorInfo = 0x000010D1
+	ERRINFO_CREATEUSERDATAFAILED                 ErrorInfo = 0x000010D2
+	ERRINFO_CONNECTFAILED                        ErrorInfo = 0x000010D3
+	ERRINFO_CONFIRMACTIVEWRONGSHAREID            ErrorInfo = 0x000010D4
+	ERRINFO_CONFIRMACTIVEWRONGORIGINATOR         ErrorInfo = 0x000010D5
+	ERRINFO_PERSISTENTKEYPDUBADLENGTH            ErrorInfo = 0x000010DA
+	ERRINFO_PERSISTENTKEYPDUILLEGALFIRST         ErrorInfo = 0x000010DB
+	ERRINFO_PERSISTENTKEYPDUTOOMANYTOTALKEYS     ErrorInfo = 0x000010DC
+	ERRINFO_PERSISTENTKEYPDUTOOMANYCACHEKEYS     ErrorInfo = 0x000010DD
+	ERRINFO_INPUTPDUBADLENGTH                    ErrorInfo = 0x000010DE
+	ERRINFO_BITMAPCACHEERRORPDUBADLENGTH         ErrorInfo = 0x000010DF
+	ERRINFO_SECURITYDATATOOSHORT                 ErrorInfo = 0x000010E0
+	ERRINFO_VCHANNELDATATOOSHORT                 ErrorInfo = 0x000010E1
+	ERRINFO_SHAREDATATOOSHORT                    ErrorInfo = 0x000010E2
+	ERRINFO_BADSUPRESSOUTPUTPDU                  ErrorInfo = 0x000010E3
+	ERRINFO_CONFIRMACTIVEPDUTOOSHORT             ErrorInfo = 0x000010E5
+	ERRINFO_CAPABILITYSETTOOSMALL                ErrorInfo = 0x000010E7
+	ERRINFO_CAPABILITYSETTOOLARGE                ErrorInfo = 0x000010E8
+	ERRINFO_NOCURSORCACHE                        ErrorInfo = 0x000010E9
+	ERRINFO_BADCAPABILITIES                      ErrorInfo = 0x000010EA
+	ERRINFO_VIRTUALCHANNELDECOMPRESSIONERR       ErrorInfo = 0x000010EC
+	ERRINFO_INVALIDVCCOMPRESSIONTYPE             ErrorInfo = 0x000010ED
+	ERRINFO_INVALIDCHANNELID                     ErrorInfo = 0x000010EF
+	ERRINFO_VCHANNELSTOOMANY                     ErrorInfo = 0x000010F0
+	ERRINFO_REMOTEAPPSNOTENABLED                 ErrorInfo = 0x000010F3
+	ERRINFO_CACHECAPNOTSET                       ErrorInfo = 0x000010F4
+	ERRINFO_BITMAPCACHEERRORPDUBADLENGTH2        ErrorInfo = 0x000010F5
+	ERRINFO_OFFSCRCACHEERRORPDUBADLENGTH         ErrorInfo = 0x000010F6
+	ERRINFO_DNGCACHEERRORPDUBADLENGTH            ErrorInfo = 0x000010F7
+	ERRINFO_GDIPLUSPDUBADLENGTH                  ErrorInfo = 0x000010F8
+	ERRINFO_SECURITYDATATOOSHORT2                ErrorInfo = 0x00001111
+	ERRINFO_SECURITYDATATOOSHORT3                ErrorInfo = 0x00001112
+	ERRINFO_BADMONITORDATA                       ErrorInfo = 0x00001129
+	ERRINFO_VCDECOMPRESSEDREASSEMBLEFAILED       ErrorInfo = 0x0000112A
+	ERRINFO_VCDATATOOLONG                        ErrorInfo = 0x0000112B
+	ERRINFO_BAD_FRAME_ACK_DATA                   ErrorInfo = 0x0000112C
+	ERRINFO_GRAPHICSMODENOTSUPPORTED             ErrorInfo = 0x0000112D
+	ERRINFO_GRAPHICSSUBSYSTEMRESETFAILED         ErrorInfo = 0x0000112E
+	ERRINFO_GRAPHICSSUBSYSTEMFAILED              ErrorInfo = 0x0000112F
+	ERRINFO_TIMEZONEKEYNAMELENGTHTOOSHORT        ErrorInfo = 0x00001130
+	ERRINFO_TIMEZONEKEYNAMELENGTHTOOLONG         ErrorInfo = 0x00001131
+	ERRINFO_DYNAMICDSTDISABLEDFIELDMISSING       ErrorInfo = 0x00001132
+	ERRINFO_VCDECODINGERROR                      ErrorInfo = 0x00001133
+	ERRINFO_VIRTUALDESKTOPTOOLARGE               ErrorInfo = 0x00001134
+	ERRINFO_MONITORGEOMETRYVALIDATIONFAILED      ErrorInfo = 0x00001135
+	ERRINFO_INVALIDMONITORCOUNT                  ErrorInfo = 0x00001136
+	ERRINFO_UPDATESESSIONKEYFAILED               ErrorInfo = 0x00001191
+	ERRINFO_DECRYPTFAILED                        ErrorInfo = 0x00001192
+	ERRINFO_ENCRYPTFAILED                        ErrorInfo = 0x00001193
+	ERRINFO_ENCPKGMISMATCH                       ErrorInfo = 0x00001194
+	ERRINFO_DECRYPTFAILED2                       ErrorInfo = 0x00001195
+)
+
+var errorInfoMessages = map[ErrorInfo]string{
+	ERRINFO_RPC_INITIATED_DISCONNECT:             "disconnected by an administrative tool on the server",
+	ERRINFO_RPC_INITIATED_LOGOFF:                 "logged off by an administrative tool on the server",
+	ERRINFO_IDLE_TIMEOUT:                         "the idle session limit has elapsed",
+	ERRINFO_LOGON_TIMEOUT:                        "the active session limit has elapsed",
+	ERRINFO_DISCONNECTED_BY_OTHERCONNECTION:      "another user connected to the session",
+	ERRINFO_OUT_OF_MEMORY:                        "the server ran out of memory",
+	ERRINFO_SERVER_DENIED_CONNECTION:             "the server denied the connection",
+	ERRINFO_SERVER_INSUFFICIENT_PRIVILEGES:       "the user has no privilege to log on remotely",
+	ERRINFO_SERVER_FRESH_CREDENTIALS_REQUIRED:    "the server does not accept saved credentials",
+	ERRINFO_RPC_INITIATED_DISCONNECT_BYUSER:      "disconnected by an administrative tool in the user session",
+	ERRINFO_LOGOFF_BY_USER:                       "the user logged off",
+	ERRINFO_CLOSE_STACK_ON_DRIVER_NOT_READY:      "the display driver of the server was not ready",
+	ERRINFO_SERVER_DWM_CRASH:                     "the desktop window manager of the server crashed",
+	ERRINFO_CLOSE_STACK_ON_DRIVER_FAILURE:        "the display driver of the server failed to start",
+	ERRINFO_CLOSE_STACK_ON_DRIVER_IFACE_FAILURE:  "the display driver of the server has a bad interface",
+	ERRINFO_SERVER_WINLOGON_CRASH:                "winlogon crashed on the server",
+	ERRINFO_SERVER_CSRSS_CRASH:                   "csrss crashed on the server",
+	ERRINFO_SERVER_SHUTDOWN:                      "the server is shutting down",
+	ERRINFO_SERVER_REBOOT:                        "the server is rebooting",
+	ERRINFO_LICENSE_INTERNAL:                     "internal error in the licensing protocol",
+	ERRINFO_LICENSE_NO_LICENSE_SERVER:            "no license server is available",
+	ERRINFO_LICENSE_NO_LICENSE:                   "no client access license is available",
+	ERRINFO_LICENSE_BAD_CLIENT_MSG:               "the server got an invalid licensing message",
+	ERRINFO_LICENSE_HWID_DOESNT_MATCH_LICENSE:    "the client license was issued to another computer",
+	ERRINFO_LICENSE_BAD_CLIENT_LICENSE:           "the client license is invalid",
+	ERRINFO_LICENSE_CANT_FINISH_PROTOCOL:         "the licensing protocol did not complete",
+	ERRINFO_LICENSE_CLIENT_ENDED_PROTOCOL:        "the client ended the licensing protocol",
+	ERRINFO_LICENSE_BAD_CLIENT_ENCRYPTION:        "a licensing message was incorrectly encrypted",
+	ERRINFO_LICENSE_CANT_UPGRADE_LICENSE:         "the client license could not be upgraded",
+	ERRINFO_LICENSE_NO_REMOTE_CONNECTIONS:        "the server does not accept remote connections",
+	ERRINFO_CB_DESTINATION_NOT_FOUND:             "the connection broker found no destination",
+	ERRINFO_CB_LOADING_DESTINATION:               "the destination is still loading",
+	ERRINFO_CB_REDIRECTING_TO_DESTINATION:        "the connection broker redirected the connection",
+	ERRINFO_CB_SESSION_ONLINE_VM_WAKE:            "the destination virtual machine could not be woken",
+	ERRINFO_CB_SESSION_ONLINE_VM_BOOT:            "the destination virtual machine could not be booted",
+	ERRINFO_CB_SESSION_ONLINE_VM_NO_DNS:          "the destination virtual machine has no dns name",
+	ERRINFO_CB_DESTINATION_POOL_NOT_FREE:         "no free virtual machine in the pool",
+	ERRINFO_CB_CONNECTION_CANCELLED:              "the connection broker cancelled the connection",
+	ERRINFO_CB_CONNECTION_ERROR_INVALID_SETTINGS: "the routing token is invalid",
+	ERRINFO_CB_SESSION_ONLINE_VM_BOOT_TIMEOUT:    "the destination virtual machine timed out booting",
+	ERRINFO_CB_SESSION_ONLINE_VM_SESSMON_FAILED:  "the session monitoring of the destination failed",
+	ERRINFO_UNKNOWNPDUTYPE2:                      "the server got an unknown data pdu type2",
+	ERRINFO_UNKNOWNPDUTYPE:                       "the server got an unknown pdu type",
+	ERRINFO_DATAPDUSEQUENCE:                      "the server got a data pdu out of sequence",
+	ERRINFO_CONTROLPDUSEQUENCE:                   "the server got a control pdu out of sequence",
+	ERRINFO_INVALIDCONTROLPDUACTION:              "the server got a control pdu with an invalid action",
+	ERRINFO_INVALIDINPUTPDUTYPE:                  "the server got an input event of invalid type",
+	ERRINFO_INVALIDINPUTPDUMOUSE:                 "the server got an invalid mouse event",
+	ERRINFO_INVALIDREFRESHRECTPDU:                "the server got an invalid refresh rect pdu",
+	ERRINFO_CREATEUSERDATAFAILED:                 "the server failed to build its user data",
+	ERRINFO_CONNECTFAILED:                        "the server failed to connect the client",
+	ERRINFO_CONFIRMACTIVEWRONGSHAREID:            "the confirm active pdu has a wrong share id",
+	ERRINFO_CONFIRMACTIVEWRONGORIGINATOR:         "the confirm active pdu has a wrong originator id",
+	ERRINFO_PERSISTENTKEYPDUBADLENGTH:            "the persistent key list pdu is too short",
+	ERRINFO_PERSISTENTKEYPDUILLEGALFIRST:         "the persistent key list pdu has a wrong first flag",
+	ERRINFO_PERSISTENTKEYPDUTOOMANYTOTALKEYS:     "the persistent key list pdu has too many keys",
+	ERRINFO_PERSISTENTKEYPDUTOOMANYCACHEKEYS:     "the persistent key list pdu has too many keys in a cache",
+	ERRINFO_INPUTPDUBADLENGTH:                    "the server got an input pdu too short",
+	ERRINFO_BITMAPCACHEERRORPDUBADLENGTH:         "the server got a bitmap cache error pdu too short",
+	ERRINFO_SECURITYDATATOOSHORT:                 "the server got a security header too short",
+	ERRINFO_VCHANNELDATATOOSHORT:                 "the server got a channel pdu too short",
+	ERRINFO_SHAREDATATOOSHORT:                    "the server got a share data header too short",
+	ERRINFO_BADSUPRESSOUTPUTPDU:                  "the server got an invalid suppress output pdu",
+	ERRINFO_CONFIRMACTIVEPDUTOOSHORT:             "the confirm active pdu is too short",
+	ERRINFO_CAPABILITYSETTOOSMALL:                "a capability set is too short",
+	ERRINFO_CAPABILITYSETTOOLARGE:                "a capability set is too long",
+	ERRINFO_NOCURSORCACHE:                        "the client pointer cache size is zero",
+	ERRINFO_BADCAPABILITIES:                      "the server got invalid capabilities",
+	ERRINFO_VIRTUALCHANNELDECOMPRESSIONERR:       "the server failed to decompress channel data",
+	ERRINFO_INVALIDVCCOMPRESSIONTYPE:             "the server got an invalid channel compression type",
+	ERRINFO_INVALIDCHANNELID:                     "the server got an invalid channel id",
+	ERRINFO_VCHANNELSTOOMANY:                     "the client requested too many channels",
+	ERRINFO_REMOTEAPPSNOTENABLED:                 "remote applications are not enabled on the server",
+	ERRINFO_CACHECAPNOTSET:                       "the client did not send a bitmap cache capability",
+	ERRINFO_BITMAPCACHEERRORPDUBADLENGTH2:        "the bitmap cache error pdu has a wrong length",
+	ERRINFO_OFFSCRCACHEERRORPDUBADLENGTH:         "the offscreen cache error pdu is too short",
+	ERRINFO_DNGCACHEERRORPDUBADLENGTH:            "the drawninegrid cache error pdu is too short",
+	ERRINFO_GDIPLUSPDUBADLENGTH:                  "the gdi+ error pdu is too short",
+	ERRINFO_SECURITYDATATOOSHORT2:                "the server got a security header too short",
+	ERRINFO_SECURITYDATATOOSHORT3:                "the server got a security header too short",
+	ERRINFO_BADMONITORDATA:                       "the client monitor data is invalid",
+	ERRINFO_VCDECOMPRESSEDREASSEMBLEFAILED:       "the server failed to reassemble decompressed channel data",
+	ERRINFO_VCDATATOOLONG:                        "the channel data is too long",
+	ERRINFO_BAD_FRAME_ACK_DATA:                   "the frame acknowledge pdu is invalid",
+	ERRINFO_GRAPHICSMODENOTSUPPORTED:             "the graphics mode is not supported by the server",
+	ERRINFO_GRAPHICSSUBSYSTEMRESETFAILED:         "the server failed to reset its graphics",
+	ERRINFO_GRAPHICSSUBSYSTEMFAILED:              "the graphics of the server failed",
+	ERRINFO_TIMEZONEKEYNAMELENGTHTOOSHORT:        "the time zone key name is too short",
+	ERRINFO_TIMEZONEKEYNAMELENGTHTOOLONG:         "the time zone key name is too long",
+	ERRINFO_DYNAMICDSTDISABLEDFIELDMISSING:       "the dynamic daylight time field is missing",
+	ERRINFO_VCDECODINGERROR:                      "the server failed to decode channel data",
+	ERRINFO_VIRTUALDESKTOPTOOLARGE:               "the virtual desktop is too large",
+	ERRINFO_MONITORGEOMETRYVALIDATIONFAILED:      "the monitor layout is invalid",
+	ERRINFO_INVALIDMONITORCOUNT:                  "the monitor count is invalid",
+	ERRINFO_UPDATESESSIONKEYFAILED:               "the server failed to update the session keys",
+	ERRINFO_DECRYPTFAILED:                        "the server failed to decrypt a pdu",
+	ERRINFO_ENCRYPTFAILED:                        "the server failed to encrypt a pdu",
+	ERRINFO_ENCPKGMISMATCH:                       "the encryption package of the pdu does not match",
+	ERRINFO_DECRYPTFAILED2:                       "the server failed to decrypt a pdu",
+}
+
+// Error returns the description of the code, ErrorInfo is usable as an error
+func (e ErrorInfo) Error() string {
+	if m, ok := errorInfoMessages[e]; ok {
+		return fmt.Sprintf("%s (errinfo 0x%08x)", m, uint32(e))
+	}
+	return fmt.Sprintf("unknown error info 0x%08x", uint32(e))
+}
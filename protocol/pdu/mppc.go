@@ -0,0 +1,196 @@
+package pdu
+
+import (
+	"errors"
+	"fmt"
+)
+
+/**
+ * bulk compression types, in the low bits of the compression flags
+ * @see MS-RDPBCGR 2.2.1.11.1.1 Info Packet (TS_INFO_PACKET)
+ */
+const (
+	PACKET_COMPR_TYPE_8K    = 0x0
+	PACKET_COMPR_TYPE_64K   = 0x1
+	PACKET_COMPR_TYPE_RDP6  = 0x2
+	PACKET_COMPR_TYPE_RDP61 = 0x3
+	CompressionTypeMask     = 0x0f
+)
+
+// bulkCompressed tells if flags require the bulk decompressor, which also
+// resets its history on the flushed and at front packets
+func bulkCompressed(flags uint8) bool {
+	return flags&(PACKET_COMPRESSED|PACKET_AT_FRONT|PACKET_FLUSHED) != 0
+}
+
+/**
+ * mppc decompresses the RDP 4.0 (8K history) and RDP 5.0 (64K history) bulk
+ * compressed data of the server, the history goes on from a packet to the next.
+ * The RDP 6.0 and 6.1 types of MS-RDPEGDI 3.1.8 are not implemented
+ * @see MS-RDPBCGR 3.1.8 MPPC-Based Bulk Data Compression
+ */
+type mppc struct {
+	history []byte
+	offset  int
+	// bits of the data being decompressed
+	in        []byte
+	pos       int
+	truncated bool
+}
+
+func newMPPC() *mppc {
+	return &mppc{}
+}
+
+func (m *mppc) remaining() int {
+	return len(m.in)*8 - m.pos
+}
+
+// bits reads n bits, the most significant first, as 0 past the end
+func (m *mppc) bits(n int) int {
+	v := 0
+	for i := 0; i < n; i++ {
+		if m.pos >= len(m.in)*8 {
+			m.truncated = true
+			return 0
+		}
+		v = v<<1 | int(m.in[m.pos/8]>>(7-uint(m.pos%8))&1)
+		m.pos++
+	}
+	return v
+}
+
+// ones counts the 1 bits up to the first 0 or max bits
+func (m *mppc) ones(max int) int {
+	n := 0
+	for n < max && m.bits(1) == 1 {
+		n++
+	}
+	return n
+}
+
+// copyOffset reads the copy-offset after its leading 11 bits
+func (m *mppc) copyOffset(large bool) int {
+	if large {
+		switch m.ones(3) {
+		case 0:
+			// 110 + 16 bits
+			return m.bits(16) + 2368
+		case 1:
+			// 1110 + 11 bits
+			return m.bits(11) + 320
+		case 2:
+			// 11110 + 8 bits
+			return m.bits(8) + 64
+		default:
+			// 11111 + 6 bits
+			return m.bits(6)
+		}
+	}
+	switch m.ones(2) {
+	case 0:
+		// 110 + 13 bits
+		return m.bits(13) + 320
+	case 1:
+		// 1110 + 8 bits
+		return m.bits(8) + 64
+	default:
+		// 1111 + 6 bits
+		return m.bits(6)
+	}
+}
+
+// lengthOfMatch reads the length-of-match, 3 is 0 and the lengths between
+// 2^k and 2^(k+1)-1 are k-1 1 bits, a 0 bit and k bits
+func (m *mppc) lengthOfMatch(large bool) (int, error) {
+	max := 11
+	if large {
+		max = 14
+	}
+	k := m.ones(max + 1)
+	if k > max {
+		return 0, errors.New("mppc: invalid length of match")
+	}
+	if k == 0 {
+		return 3, nil
+	}
+	return 1<<uint(k+1) + m.bits(k+1), nil
+}
+
+// decompress returns the data of a packet with the PACKET_* flags
+func (m *mppc) decompress(data []byte, flags uint8) ([]byte, error) {
+	var size int
+	switch flags & CompressionTypeMask {
+	case PACKET_COMPR_TYPE_8K:
+		size = 8 * 1024
+	case PACKET_COMPR_TYPE_64K:
+		size = 64 * 1024
+	default:
+		return nil, errors.New(fmt.Sprintf("mppc: unsupported compression type %d", flags&CompressionTypeMask))
+	}
+	if len(m.history) != size {
+		m.history, m.offset = make([]byte, size), 0
+	}
+	if flags&PACKET_AT_FRONT != 0 {
+		m.offset = 0
+	}
+	if flags&PACKET_FLUSHED != 0 {
+		m.offset = 0
+		for i := range m.history {
+			m.history[i] = 0
+		}
+	}
+	if flags&PACKET_COMPRESSED == 0 {
+		return data, nil
+	}
+
+	large := size > 8*1024
+	start := m.offset
+	m.in, m.pos, m.truncated = data, 0, false
+	// the last byte is padded with less than 8 bits, shorter than a token
+	for m.remaining() >= 8 {
+		var err error
+		switch {
+		case m.bits(1) == 0:
+			err = m.literal(byte(m.bits(7)))
+		case m.bits(1) == 0:
+			err = m.literal(byte(0x80 | m.bits(7)))
+		default:
+			err = m.copy(large)
+		}
+		if err == nil && m.truncated {
+			err = errors.New("mppc: truncated data")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return append([]byte{}, m.history[start:m.offset]...), nil
+}
+
+func (m *mppc) literal(b byte) error {
+	if m.offset >= len(m.history) {
+		return errors.New("mppc: history overflow")
+	}
+	m.history[m.offset] = b
+	m.offset++
+	return nil
+}
+
+func (m *mppc) copy(large bool) error {
+	offset := m.copyOffset(large)
+	length, err := m.lengthOfMatch(large)
+	if err != nil || m.truncated {
+		return err
+	}
+	src := m.offset - offset
+	if src < 0 || m.offset+length > len(m.history) {
+		return errors.New(fmt.Sprintf("mppc: copy of %d bytes at offset %d out of the history", length, offset))
+	}
+	// the source may overlap the copy
+	for i := 0; i < length; i++ {
+		m.history[m.offset+i] = m.history[src+i]
+	}
+	m.offset += length
+	return nil
+}
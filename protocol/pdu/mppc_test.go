@@ -0,0 +1,115 @@
+package pdu
+
+import (
+	"bytes"
+	"testing"
+)
+
+// bitWriter packs MPPC tokens, the most significant bit first
+type bitWriter struct {
+	data []byte
+	n    int
+}
+
+func (w *bitWriter) write(v, n int) *bitWriter {
+	for i := n - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.data = append(w.data, 0)
+		}
+		w.data[w.n/8] |= byte(v>>uint(i)&1) << uint(7-w.n%8)
+		w.n++
+	}
+	return w
+}
+
+func (w *bitWriter) literal(b byte) *bitWriter {
+	if b < 0x80 {
+		return w.write(int(b), 8)
+	}
+	return w.write(0x2, 2).write(int(b&0x7f), 7)
+}
+
+func TestMPPCDecompress(t *testing.T) {
+	m := newMPPC()
+	flags := uint8(PACKET_COMPRESSED | PACKET_FLUSHED | PACKET_AT_FRONT | PACKET_COMPR_TYPE_64K)
+	// "abc", 0xe9, then 6 bytes from 4 bytes back: 11111 + offset 4, 10 + length 6 = 4 + 2
+	w := (&bitWriter{}).literal('a').literal('b').literal('c').literal(0xe9)
+	w.write(0x1f, 5).write(4, 6).write(0x2, 2).write(2, 2)
+	data, err := m.decompress(w.data, flags)
+	want := []byte{'a', 'b', 'c', 0xe9, 'a', 'b', 'c', 0xe9, 'a', 'b'}
+	if err != nil || !bytes.Equal(data, want) {
+		t.Fatal("get", data, err)
+	}
+
+	// the history goes on: 3 bytes from 11 bytes back
+	w = (&bitWriter{}).literal('x').write(0x1f, 5).write(11, 6).write(0, 1)
+	data, err = m.decompress(w.data, PACKET_COMPRESSED|PACKET_COMPR_TYPE_64K)
+	if err != nil || string(data) != "xabc" {
+		t.Fatal("get", data, err)
+	}
+
+	// uncompressed data is kept as is, the flushed history is cleared
+	if data, err = m.decompress([]byte("raw"), PACKET_FLUSHED|PACKET_COMPR_TYPE_64K); err != nil || string(data) != "raw" {
+		t.Fatal("get", data, err)
+	}
+	w = (&bitWriter{}).literal('y').write(0x1f, 5).write(1, 6).write(0, 1)
+	if data, err = m.decompress(w.data, PACKET_COMPRESSED|PACKET_COMPR_TYPE_64K); err != nil || string(data) != "yyyy" {
+		t.Fatal("get", data, err)
+	}
+}
+
+func TestMPPCDecompress8K(t *testing.T) {
+	m := newMPPC()
+	// 1111 + offset 2, 1110 + length 17 = 16 + 1
+	w := (&bitWriter{}).literal('-').literal('+').write(0xf, 4).write(2, 6).write(0xe, 4).write(1, 4)
+	data, err := m.decompress(w.data, PACKET_COMPRESSED|PACKET_FLUSHED|PACKET_COMPR_TYPE_8K)
+	if err != nil || string(data) != "-+-+-+-+-+-+-+-+-+-" {
+		t.Fatal("get", string(data), err)
+	}
+	// 110 + 13 bits offsets start at 320
+	w = (&bitWriter{}).write(0x6, 3).write(0, 13).write(0, 1)
+	if _, err = m.decompress(w.data, PACKET_COMPRESSED|PACKET_COMPR_TYPE_8K); err == nil {
+		t.Error("expect error on offset out of the history")
+	}
+}
+
+func TestMPPCDecompressErrors(t *testing.T) {
+	m := newMPPC()
+	if _, err := m.decompress([]byte{0}, PACKET_COMPRESSED|PACKET_COMPR_TYPE_RDP6); err == nil {
+		t.Error("expect error on RDP 6.0 compression")
+	}
+	// the offset is cut by the end of the data
+	w := (&bitWriter{}).literal('a').write(0x1f, 5).write(1, 3)
+	if _, err := m.decompress(w.data, PACKET_COMPRESSED|PACKET_FLUSHED|PACKET_COMPR_TYPE_64K); err == nil {
+		t.Error("expect error on truncated data")
+	}
+}
+
+func TestReadCompressedPDU(t *testing.T) {
+	m := newMPPC()
+	data := NewPDU(1007, NewDataPDU(NewSynchronizeDataPDU(1002), 0x103ea)).serialize()
+	// the synchronize pdu body as literals
+	w := &bitWriter{}
+	for _, b := range data[18:] {
+		w.literal(b)
+	}
+	compressed := append(append([]byte{}, data[:18]...), w.data...)
+	compressed[6+9] = PACKET_COMPRESSED | PACKET_FLUSHED | PACKET_COMPR_TYPE_64K
+	compressed[6+10] = byte(len(compressed))
+	p, err := readPDU(bytes.NewReader(compressed), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := p.Message.(*DataPDU).Data.(*SynchronizeDataPDU); !ok || s.TargetUser != 1002 {
+		t.Errorf("bad synchronize pdu %+v", p.Message)
+	}
+
+	// fast path synchronize update with the compression flags
+	w = &bitWriter{}
+	w.literal(0)
+	f, err := readFastPathUpdatePDU(bytes.NewReader([]byte{FASTPATH_OUTPUT_COMPRESSION_USED<<6 | FASTPATH_UPDATETYPE_SYNCHRONIZE,
+		PACKET_COMPRESSED | PACKET_COMPR_TYPE_64K, 1, 0, w.data[0]}), m)
+	if err != nil || f.Data != nil {
+		t.Error("get", f, err)
+	}
+}
@@ -0,0 +1,764 @@
+package pdu
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+
+	"github.com/tomatome/grdp/core"
+)
+
+/**
+ * controlFlags of a drawing order
+ * @see MS-RDPEGDI 2.2.2.2.1.1.2 Primary Drawing Order (PRIMARY_DRAWING_ORDER)
+ */
+const (
+	TS_STANDARD             = 0x01
+	TS_SECONDARY            = 0x02
+	TS_BOUNDS               = 0x04
+	TS_TYPE_CHANGE          = 0x08
+	TS_DELTA_COORDINATES    = 0x10
+	TS_ZERO_BOUNDS_DELTAS   = 0x20
+	TS_ZERO_FIELD_BYTE_BIT0 = 0x40
+	TS_ZERO_FIELD_BYTE_BIT1 = 0x80
+)
+
+// primary drawing orders
+const (
+	TS_ENC_DSTBLT_ORDER     = 0x00
+	TS_ENC_PATBLT_ORDER     = 0x01
+	TS_ENC_SCRBLT_ORDER     = 0x02
+	TS_ENC_OPAQUERECT_ORDER = 0x0A
+	TS_ENC_MEMBLT_ORDER     = 0x0D
+	TS_ENC_INDEX_ORDER      = 0x1B
+)
+
+// secondary drawing orders
+const (
+	TS_CACHE_BITMAP_UNCOMPRESSED      = 0x00
+	TS_CACHE_COLOR_TABLE              = 0x01
+	TS_CACHE_BITMAP_COMPRESSED        = 0x02
+	TS_CACHE_GLYPH                    = 0x03
+	TS_CACHE_BITMAP_UNCOMPRESSED_REV2 = 0x04
+	TS_CACHE_BITMAP_COMPRESSED_REV2   = 0x05
+)
+
+// flags of the revision 2 cache bitmap order
+const (
+	CBR2_HEIGHT_SAME_AS_WIDTH      = 0x01
+	CBR2_PERSISTENT_KEY_PRESENT    = 0x02
+	CBR2_NO_BITMAP_COMPRESSION_HDR = 0x08
+	CBR2_DO_NOT_CACHE              = 0x10
+)
+
+// cache index of the bitmaps only kept in the waiting list
+const BITMAPCACHE_WAITING_LIST_INDEX = 32767
+
+// alternate secondary drawing orders
+const (
+	TS_ALTSEC_FRAME_MARKER = 0x0D
+)
+
+// flAccel of the glyph index order
+const (
+	SO_HORIZONTAL             = 0x02
+	SO_VERTICAL               = 0x04
+	SO_CHAR_INC_EQUAL_BM_BASE = 0x20
+)
+
+// brush styles
+const (
+	BS_SOLID   = 0x00
+	BS_NULL    = 0x01
+	BS_HATCHED = 0x02
+	BS_PATTERN = 0x03
+)
+
+// the field bytes of the primary orders we decode, and advertise
+var orderFieldBytes = map[uint8]int{
+	TS_ENC_DSTBLT_ORDER:     1,
+	TS_ENC_PATBLT_ORDER:     2,
+	TS_ENC_SCRBLT_ORDER:     1,
+	TS_ENC_OPAQUERECT_ORDER: 1,
+	TS_ENC_MEMBLT_ORDER:     2,
+	TS_ENC_INDEX_ORDER:      3,
+}
+
+// supportedOrders is the orderSupport of the order capability
+var supportedOrders = [32]byte{
+	TS_NEG_DSTBLT_INDEX: 1,
+	TS_NEG_PATBLT_INDEX: 1,
+	TS_NEG_SCRBLT_INDEX: 1,
+	TS_NEG_MEMBLT_INDEX: 1,
+	TS_NEG_INDEX_INDEX:  1,
+}
+
+/**
+ * Color of an order in the session color depth, Value is the
+ * TS_COLOR as sent: a palette index at 8 bpp, the little endian pixel
+ * at 15 and 16 bpp, red, green and blue from the low byte above
+ * @see MS-RDPEGDI 2.2.2.2.1.1.1.8 Generic Color (TS_COLOR)
+ */
+type Color struct {
+	BitsPerPixel uint16
+	Value        uint32
+}
+
+type Brush struct {
+	X, Y    uint8
+	Style   uint8
+	Hatch   uint8
+	Pattern [7]byte
+}
+
+// DrawingOrder is a decoded primary drawing order
+type DrawingOrder interface {
+	OrderType() uint8
+}
+
+// PrimaryOrder is emitted on "orders", Bounds clips the order when set
+type PrimaryOrder struct {
+	DrawingOrder
+	Bounds *image.Rectangle
+}
+
+type DstBlt struct {
+	Left, Top     int16
+	Width, Height int16
+	Rop           uint8
+}
+
+func (*DstBlt) OrderType() uint8 {
+	return TS_ENC_DSTBLT_ORDER
+}
+
+type PatBlt struct {
+	Left, Top     int16
+	Width, Height int16
+	Rop           uint8
+	BackColor     Color
+	ForeColor     Color
+	Brush         Brush
+}
+
+func (*PatBlt) OrderType() uint8 {
+	return TS_ENC_PATBLT_ORDER
+}
+
+type ScrBlt struct {
+	Left, Top     int16
+	Width, Height int16
+	Rop           uint8
+	SrcX, SrcY    int16
+}
+
+func (*ScrBlt) OrderType() uint8 {
+	return TS_ENC_SCRBLT_ORDER
+}
+
+type OpaqueRect struct {
+	Left, Top     int16
+	Width, Height int16
+	Color         Color
+}
+
+func (*OpaqueRect) OrderType() uint8 {
+	return TS_ENC_OPAQUERECT_ORDER
+}
+
+// MemBlt copies a cached bitmap, Bitmap is nil if the cache entry is not set
+type MemBlt struct {
+	CacheId       uint16
+	Left, Top     int16
+	Width, Height int16
+	Rop           uint8
+	SrcX, SrcY    int16
+	CacheIndex    uint16
+	Bitmap        *BitmapData
+}
+
+func (*MemBlt) OrderType() uint8 {
+	return TS_ENC_MEMBLT_ORDER
+}
+
+/**
+ * Glyph of the glyph cache, Mask is 1 bpp top down with rows
+ * padded to a byte, X and Y offset it from the text origin
+ * @see MS-RDPEGDI 2.2.2.2.1.2.5.1 Cache Glyph Data (TS_CACHE_GLYPH_DATA)
+ */
+type Glyph struct {
+	X, Y          int16
+	Width, Height uint16
+	Mask          []byte
+}
+
+// GlyphPlacement is a glyph of a glyph index order at its screen position
+type GlyphPlacement struct {
+	X, Y int
+	*Glyph
+}
+
+/**
+ * GlyphIndex draws text, the opaque rectangle is filled with ForeColor
+ * and the glyphs with BackColor, rectangles are inclusive
+ * @see MS-RDPEGDI 2.2.2.2.1.1.2.13 GlyphIndex (GLYPHINDEX_ORDER)
+ */
+type GlyphIndex struct {
+	CacheId     uint8
+	FlAccel     uint8
+	CharInc     uint8
+	OpRedundant uint8
+	BackColor   Color
+	ForeColor   Color
+	BkLeft      int16
+	BkTop       int16
+	BkRight     int16
+	BkBottom    int16
+	OpLeft      int16
+	OpTop       int16
+	OpRight     int16
+	OpBottom    int16
+	Brush       Brush
+	X, Y        int16
+	Data        []byte
+	Glyphs      []GlyphPlacement
+}
+
+func (*GlyphIndex) OrderType() uint8 {
+	return TS_ENC_INDEX_ORDER
+}
+
+/**
+ * TS_FP_UPDATE_ORDERS and TS_UPDATE_ORDERS_PDU_DATA, the orders are
+ * decoded by the client as they depend on the previous ones
+ * @see MS-RDPEGDI 2.2.2.2 Fast-Path Orders Update (TS_FP_UPDATE_ORDERS)
+ */
+type FastPathOrdersPDU struct {
+	NumberOrders uint16
+	OrderData    []byte
+}
+
+func (f *FastPathOrdersPDU) Unpack(r io.Reader) error {
+	var err error
+	if f.NumberOrders, err = core.ReadUint16LE(r); err != nil {
+		return err
+	}
+	f.OrderData, err = io.ReadAll(r)
+	return err
+}
+
+func (*FastPathOrdersPDU) FastPathUpdateType() uint8 {
+	return FASTPATH_UPDATETYPE_ORDERS
+}
+
+type cacheKey struct {
+	id, index uint16
+}
+
+// orderDecoder keeps the fields of the last orders and the caches
+type orderDecoder struct {
+	bpp       uint16
+	orderType uint8
+	bounds    [4]int16
+	dstBlt    DstBlt
+	patBlt    PatBlt
+	scrBlt    ScrBlt
+	opaque    OpaqueRect
+	memBlt    MemBlt
+	index     GlyphIndex
+	bitmaps   map[cacheKey]*BitmapData
+	glyphs    map[cacheKey]*Glyph
+	fragments map[uint8][]byte
+}
+
+func newOrderDecoder() *orderDecoder {
+	return &orderDecoder{
+		bpp:       16,
+		orderType: TS_ENC_PATBLT_ORDER,
+		bitmaps:   make(map[cacheKey]*BitmapData),
+		glyphs:    make(map[cacheKey]*Glyph),
+		fragments: make(map[uint8][]byte),
+	}
+}
+
+// orderReader keeps the first error, reads return zero after it
+type orderReader struct {
+	r   *bytes.Reader
+	err error
+}
+
+func (o *orderReader) bytes(n int) []byte {
+	if o.err != nil {
+		return make([]byte, n)
+	}
+	b, err := core.ReadBytes(n, o.r)
+	if err != nil {
+		o.err = err
+		return make([]byte, n)
+	}
+	return b
+}
+
+func (o *orderReader) uint8() uint8 {
+	return o.bytes(1)[0]
+}
+
+func (o *orderReader) uint16() uint16 {
+	b := o.bytes(2)
+	return uint16(b[0]) | uint16(b[1])<<8
+}
+
+func (o *orderReader) uint32(n int) uint32 {
+	var v uint32
+	for i, b := range o.bytes(n) {
+		v |= uint32(b) << (8 * uint(i))
+	}
+	return v
+}
+
+// uint2 reads a two byte unsigned encoding, the high bit of the first
+// byte tells if a second byte follows
+func (o *orderReader) uint2() uint16 {
+	v := uint16(o.uint8())
+	if v&0x80 != 0 {
+		v = (v&0x7f)<<8 | uint16(o.uint8())
+	}
+	return v
+}
+
+// uint4 reads a four byte unsigned encoding, the two high bits of the
+// first byte are the number of bytes that follow
+func (o *orderReader) uint4() uint32 {
+	b := o.uint8()
+	v := uint32(b & 0x3f)
+	for i := 0; i < int(b>>6); i++ {
+		v = v<<8 | uint32(o.uint8())
+	}
+	return v
+}
+
+// fields reads the fields of a primary order present in flags
+type fields struct {
+	*orderReader
+	flags uint32
+	delta bool
+}
+
+func (f *fields) has(n uint) bool {
+	return f.flags&(1<<(n-1)) != 0
+}
+
+func (f *fields) byte(n uint, v *uint8) {
+	if f.has(n) {
+		*v = f.uint8()
+	}
+}
+
+func (f *fields) word(n uint, v *uint16) {
+	if f.has(n) {
+		*v = f.uint16()
+	}
+}
+
+func (f *fields) short(n uint, v *int16) {
+	if f.has(n) {
+		*v = int16(f.uint16())
+	}
+}
+
+// coord reads a coordinate, a signed byte added to the previous value
+// with TS_DELTA_COORDINATES
+func (f *fields) coord(n uint, v *int16) {
+	if !f.has(n) {
+		return
+	}
+	if f.delta {
+		*v += int16(int8(f.uint8()))
+		return
+	}
+	*v = int16(f.uint16())
+}
+
+func (f *fields) color(n uint, c *Color) {
+	if f.has(n) {
+		c.Value = f.uint32(3)
+	}
+}
+
+// brush reads the 5 brush fields from n
+func (f *fields) brush(n uint, b *Brush) {
+	f.byte(n, &b.X)
+	f.byte(n+1, &b.Y)
+	f.byte(n+2, &b.Style)
+	f.byte(n+3, &b.Hatch)
+	if f.has(n + 4) {
+		copy(b.Pattern[:], f.bytes(7))
+	}
+}
+
+// decode returns the primary orders of data, the caches are updated
+// by the secondary ones. It stops on the first order it cannot size
+// @see MS-RDPEGDI 3.2.5.1 Processing Drawing Orders
+func (d *orderDecoder) decode(number int, data []byte) ([]PrimaryOrder, error) {
+	r := &orderReader{r: bytes.NewReader(data)}
+	orders := make([]PrimaryOrder, 0, number)
+	for i := 0; i < number; i++ {
+		flags := r.uint8()
+		if r.err != nil {
+			break
+		}
+		switch {
+		case flags&TS_STANDARD == 0:
+			if flags>>2 != TS_ALTSEC_FRAME_MARKER {
+				return orders, errors.New(fmt.Sprintf("unsupported alternate secondary order 0x%x", flags>>2))
+			}
+			r.bytes(4)
+		case flags&TS_SECONDARY != 0:
+			if err := d.secondary(r); err != nil {
+				return orders, err
+			}
+		default:
+			o, err := d.primary(r, flags)
+			if err != nil {
+				return orders, err
+			}
+			orders = append(orders, o)
+		}
+	}
+	if r.err != nil {
+		return orders, errors.New(fmt.Sprintf("truncated drawing order: %v", r.err))
+	}
+	return orders, nil
+}
+
+func (d *orderDecoder) primary(r *orderReader, flags uint8) (PrimaryOrder, error) {
+	if flags&TS_TYPE_CHANGE != 0 {
+		d.orderType = r.uint8()
+	}
+	n, ok := orderFieldBytes[d.orderType]
+	if !ok {
+		return PrimaryOrder{}, errors.New(fmt.Sprintf("unsupported primary order 0x%x", d.orderType))
+	}
+	if flags&TS_ZERO_FIELD_BYTE_BIT0 != 0 {
+		n--
+	}
+	if flags&TS_ZERO_FIELD_BYTE_BIT1 != 0 {
+		n -= 2
+	}
+	if n < 0 {
+		n = 0
+	}
+	f := &fields{orderReader: r, flags: r.uint32(n), delta: flags&TS_DELTA_COORDINATES != 0}
+
+	var o PrimaryOrder
+	if flags&TS_BOUNDS != 0 {
+		if flags&TS_ZERO_BOUNDS_DELTAS == 0 {
+			d.readBounds(r)
+		}
+		b := image.Rect(int(d.bounds[0]), int(d.bounds[1]), int(d.bounds[2])+1, int(d.bounds[3])+1)
+		o.Bounds = &b
+	}
+
+	switch d.orderType {
+	case TS_ENC_DSTBLT_ORDER:
+		p := &d.dstBlt
+		f.coord(1, &p.Left)
+		f.coord(2, &p.Top)
+		f.coord(3, &p.Width)
+		f.coord(4, &p.Height)
+		f.byte(5, &p.Rop)
+		v := *p
+		o.DrawingOrder = &v
+	case TS_ENC_PATBLT_ORDER:
+		p := &d.patBlt
+		f.coord(1, &p.Left)
+		f.coord(2, &p.Top)
+		f.coord(3, &p.Width)
+		f.coord(4, &p.Height)
+		f.byte(5, &p.Rop)
+		f.color(6, &p.BackColor)
+		f.color(7, &p.ForeColor)
+		f.brush(8, &p.Brush)
+		v := *p
+		v.BackColor.BitsPerPixel, v.ForeColor.BitsPerPixel = d.bpp, d.bpp
+		o.DrawingOrder = &v
+	case TS_ENC_SCRBLT_ORDER:
+		p := &d.scrBlt
+		f.coord(1, &p.Left)
+		f.coord(2, &p.Top)
+		f.coord(3, &p.Width)
+		f.coord(4, &p.Height)
+		f.byte(5, &p.Rop)
+		f.coord(6, &p.SrcX)
+		f.coord(7, &p.SrcY)
+		v := *p
+		o.DrawingOrder = &v
+	case TS_ENC_OPAQUERECT_ORDER:
+		p := &d.opaque
+		f.coord(1, &p.Left)
+		f.coord(2, &p.Top)
+		f.coord(3, &p.Width)
+		f.coord(4, &p.Height)
+		// one field by color byte
+		for i := uint(0); i < 3; i++ {
+			if f.has(5 + i) {
+				p.Color.Value = p.Color.Value&^(0xff<<(8*i)) | uint32(f.uint8())<<(8*i)
+			}
+		}
+		v := *p
+		v.Color.BitsPerPixel = d.bpp
+		o.DrawingOrder = &v
+	case TS_ENC_MEMBLT_ORDER:
+		p := &d.memBlt
+		f.word(1, &p.CacheId)
+		f.coord(2, &p.Left)
+		f.coord(3, &p.Top)
+		f.coord(4, &p.Width)
+		f.coord(5, &p.Height)
+		f.byte(6, &p.Rop)
+		f.coord(7, &p.SrcX)
+		f.coord(8, &p.SrcY)
+		f.word(9, &p.CacheIndex)
+		v := *p
+		// the high byte is the color table of 8 bpp bitmaps
+		v.Bitmap = d.bitmaps[cacheKey{p.CacheId & 0xff, p.CacheIndex}]
+		o.DrawingOrder = &v
+	case TS_ENC_INDEX_ORDER:
+		p := &d.index
+		f.byte(1, &p.CacheId)
+		f.byte(2, &p.FlAccel)
+		f.byte(3, &p.CharInc)
+		f.byte(4, &p.OpRedundant)
+		f.color(5, &p.BackColor)
+		f.color(6, &p.ForeColor)
+		f.short(7, &p.BkLeft)
+		f.short(8, &p.BkTop)
+		f.short(9, &p.BkRight)
+		f.short(10, &p.BkBottom)
+		f.short(11, &p.OpLeft)
+		f.short(12, &p.OpTop)
+		f.short(13, &p.OpRight)
+		f.short(14, &p.OpBottom)
+		f.brush(15, &p.Brush)
+		f.short(20, &p.X)
+		f.short(21, &p.Y)
+		if f.has(22) {
+			p.Data = f.bytes(int(f.uint8()))
+		}
+		v := *p
+		v.BackColor.BitsPerPixel, v.ForeColor.BitsPerPixel = d.bpp, d.bpp
+		v.Glyphs = d.placeGlyphs(p)
+		o.DrawingOrder = &v
+	}
+	return o, r.err
+}
+
+// readBounds updates the bounds, each side is absolute or a delta
+// @see MS-RDPEGDI 2.2.2.2.1.1.1.1 Bounds (TS_BOUNDS)
+func (d *orderDecoder) readBounds(r *orderReader) {
+	flags := r.uint8()
+	for i := range d.bounds {
+		if flags&(1<<uint(i)) != 0 {
+			d.bounds[i] = int16(r.uint16())
+		} else if flags&(0x10<<uint(i)) != 0 {
+			d.bounds[i] += int16(int8(r.uint8()))
+		}
+	}
+}
+
+/**
+ * placeGlyphs walks the glyph indices of o, updating the fragment cache
+ * @see MS-RDPEGDI 2.2.2.2.1.1.2.13 GlyphIndex, the data field
+ */
+func (d *orderDecoder) placeGlyphs(o *GlyphIndex) []GlyphPlacement {
+	var glyphs []GlyphPlacement
+	x, y := int(o.X), int(o.Y)
+	// deltas follow the indices of proportional fonts
+	deltas := o.CharInc == 0 && o.FlAccel&SO_CHAR_INC_EQUAL_BM_BASE == 0
+	advance := func(delta int) {
+		if o.FlAccel&SO_VERTICAL != 0 {
+			y += delta
+		} else {
+			x += delta
+		}
+	}
+	// glyph places the glyph at data[i], returns the next index
+	glyph := func(data []byte, i int) int {
+		g := d.glyphs[cacheKey{uint16(o.CacheId), uint16(data[i])}]
+		i++
+		if deltas && i < len(data) {
+			delta := int(data[i])
+			if delta&0x80 != 0 && i+2 < len(data) {
+				delta = int(int16(uint16(data[i+1]) | uint16(data[i+2])<<8))
+				i += 2
+			}
+			i++
+			advance(delta)
+		}
+		if g == nil {
+			return i
+		}
+		glyphs = append(glyphs, GlyphPlacement{X: x + int(g.X), Y: y + int(g.Y), Glyph: g})
+		if o.FlAccel&SO_CHAR_INC_EQUAL_BM_BASE != 0 {
+			advance(int(g.Width))
+		} else if o.CharInc != 0 {
+			advance(int(o.CharInc))
+		}
+		return i
+	}
+
+	data := o.Data
+	for i := 0; i < len(data); {
+		switch data[i] {
+		case 0xff:
+			// add the previous bytes as a fragment
+			if i+2 < len(data) && int(data[i+2]) <= i {
+				d.fragments[data[i+1]] = append([]byte{}, data[i-int(data[i+2]):i]...)
+			}
+			i += 3
+		case 0xfe:
+			if i+1 >= len(data) {
+				return glyphs
+			}
+			fragment := d.fragments[data[i+1]]
+			if deltas && i+2 < len(data) {
+				advance(int(data[i+2]))
+			}
+			for j := 0; j < len(fragment); {
+				j = glyph(fragment, j)
+			}
+			i += 3
+		default:
+			i = glyph(data, i)
+		}
+	}
+	return glyphs
+}
+
+// secondary updates the caches, unknown secondary orders are skipped
+// @see MS-RDPEGDI 2.2.2.2.1.2.1.1 Secondary Drawing Order Header
+func (d *orderDecoder) secondary(r *orderReader) error {
+	length := int(int16(r.uint16())) + 7
+	extraFlags := r.uint16()
+	orderType := r.uint8()
+	if length < 0 {
+		return errors.New(fmt.Sprintf("invalid secondary order length %d", length))
+	}
+	body := &orderReader{r: bytes.NewReader(r.bytes(length))}
+	if r.err != nil {
+		return nil
+	}
+	switch orderType {
+	case TS_CACHE_BITMAP_UNCOMPRESSED, TS_CACHE_BITMAP_COMPRESSED:
+		return d.cacheBitmap(body, orderType, extraFlags)
+	case TS_CACHE_BITMAP_UNCOMPRESSED_REV2, TS_CACHE_BITMAP_COMPRESSED_REV2:
+		return d.cacheBitmapRev2(body, orderType, extraFlags)
+	case TS_CACHE_GLYPH:
+		return d.cacheGlyph(body)
+	}
+	return nil
+}
+
+// cacheBitmap decodes a TS_CACHE_BITMAP_ORDER
+// @see MS-RDPEGDI 2.2.2.2.1.2.2 Cache Bitmap - Revision 1
+func (d *orderDecoder) cacheBitmap(r *orderReader, orderType uint8, extraFlags uint16) error {
+	id := r.uint8()
+	r.uint8()
+	b := &BitmapData{Width: uint16(r.uint8()), Height: uint16(r.uint8()), BitsPerPixel: uint16(r.uint8())}
+	length := int(r.uint16())
+	index := r.uint16()
+	if orderType == TS_CACHE_BITMAP_COMPRESSED {
+		b.Flags = BITMAP_COMPRESSION
+		if extraFlags&NO_BITMAP_COMPRESSION_HDR == 0 {
+			r.bytes(8)
+			length -= 8
+		}
+	}
+	if length < 0 {
+		return errors.New("cache bitmap shorter than its compression header")
+	}
+	b.BitmapDataStream = r.bytes(length)
+	if r.err != nil {
+		return errors.New(fmt.Sprintf("cache bitmap: %v", r.err))
+	}
+	b.DestRight, b.DestBottom = b.Width-1, b.Height-1
+	pixels, err := b.Decompress()
+	if err != nil {
+		return errors.New(fmt.Sprintf("cache bitmap: %v", err))
+	}
+	b.Pixels = pixels
+	d.bitmaps[cacheKey{uint16(id), index}] = b
+	return nil
+}
+
+// bits per pixel of the revision 2 cache bitmap order by id
+var cbr2BitsPerPixel = map[uint16]uint16{3: 8, 4: 16, 5: 24, 6: 32}
+
+// cacheBitmapRev2 decodes a TS_CACHE_BITMAP_REV2_ORDER, extraFlags holds
+// the cache id, the bits per pixel id and the CBR2_* flags
+// @see MS-RDPEGDI 2.2.2.2.1.2.3 Cache Bitmap - Revision 2
+func (d *orderDecoder) cacheBitmapRev2(r *orderReader, orderType uint8, extraFlags uint16) error {
+	id := extraFlags & 0x07
+	flags := extraFlags >> 7
+	bpp, ok := cbr2BitsPerPixel[(extraFlags&0x78)>>3]
+	if !ok {
+		return errors.New(fmt.Sprintf("cache bitmap: invalid bits per pixel id %d", (extraFlags&0x78)>>3))
+	}
+	if flags&CBR2_PERSISTENT_KEY_PRESENT != 0 {
+		// key1 and key2 of the persistent cache, not kept
+		r.bytes(8)
+	}
+	b := &BitmapData{BitsPerPixel: bpp}
+	b.Width = r.uint2()
+	b.Height = b.Width
+	if flags&CBR2_HEIGHT_SAME_AS_WIDTH == 0 {
+		b.Height = r.uint2()
+	}
+	length := int(r.uint4())
+	index := r.uint2()
+	if orderType == TS_CACHE_BITMAP_COMPRESSED_REV2 {
+		b.Flags = BITMAP_COMPRESSION
+		if flags&CBR2_NO_BITMAP_COMPRESSION_HDR == 0 {
+			r.bytes(8)
+			length -= 8
+		}
+	}
+	if length < 0 {
+		return errors.New("cache bitmap shorter than its compression header")
+	}
+	b.BitmapDataStream = r.bytes(length)
+	if r.err != nil {
+		return errors.New(fmt.Sprintf("cache bitmap: %v", r.err))
+	}
+	if flags&CBR2_DO_NOT_CACHE != 0 || index == BITMAPCACHE_WAITING_LIST_INDEX {
+		return nil
+	}
+	b.DestRight, b.DestBottom = b.Width-1, b.Height-1
+	pixels, err := b.Decompress()
+	if err != nil {
+		return errors.New(fmt.Sprintf("cache bitmap: %v", err))
+	}
+	b.Pixels = pixels
+	d.bitmaps[cacheKey{id, index}] = b
+	return nil
+}
+
+// cacheGlyph decodes a TS_CACHE_GLYPH_ORDER
+// @see MS-RDPEGDI 2.2.2.2.1.2.5 Cache Glyph - Revision 1
+func (d *orderDecoder) cacheGlyph(r *orderReader) error {
+	id := r.uint8()
+	n := int(r.uint8())
+	for i := 0; i < n; i++ {
+		index := r.uint16()
+		g := &Glyph{X: int16(r.uint16()), Y: int16(r.uint16()), Width: r.uint16(), Height: r.uint16()}
+		size := (int(g.Width)+7)/8*int(g.Height) + 3
+		g.Mask = r.bytes(size &^ 3)
+		if r.err != nil {
+			return errors.New(fmt.Sprintf("cache glyph: %v", r.err))
+		}
+		d.glyphs[cacheKey{uint16(id), index}] = g
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package pdu
+
+import (
+	"bytes"
+	"image"
+	"testing"
+
+	"github.com/tomatome/grdp/core"
+)
+
+// secondaryOrder wraps body in a secondary order header of orderType
+func secondaryOrder(orderType uint8, body []byte) []byte {
+	buff := &bytes.Buffer{}
+	core.WriteUInt8(TS_STANDARD|TS_SECONDARY, buff)
+	core.WriteUInt16LE(uint16(len(body)-7), buff)
+	core.WriteUInt16LE(0, buff)
+	core.WriteUInt8(orderType, buff)
+	buff.Write(body)
+	return buff.Bytes()
+}
+
+func TestDecodeOrders(t *testing.T) {
+	buff := &bytes.Buffer{}
+	// glyph 5 of cache 0, 3x2 above the baseline
+	buff.Write(secondaryOrder(TS_CACHE_GLYPH, []byte{0, 1, 5, 0, 0, 0, 0xfe, 0xff, 3, 0, 2, 0, 0xa0, 0x40, 0, 0}))
+	// 2x1 16 bpp bitmap 7 of cache 1
+	buff.Write(secondaryOrder(TS_CACHE_BITMAP_UNCOMPRESSED, []byte{1, 0, 2, 1, 16, 4, 0, 7, 0, 0x1f, 0x00, 0xe0, 0x07}))
+	// opaque rect with all its fields
+	buff.Write([]byte{TS_STANDARD | TS_TYPE_CHANGE, TS_ENC_OPAQUERECT_ORDER, 0x7f,
+		10, 0, 20, 0, 30, 0, 40, 0, 0x11, 0x22, 0x33})
+	// same order type, bounded, moved by deltas
+	buff.Write([]byte{TS_STANDARD | TS_BOUNDS | TS_DELTA_COORDINATES, 0x03,
+		0x0f, 1, 0, 2, 0, 100, 0, 200, 0, 5, 0xfc})
+	buff.Write([]byte{TS_STANDARD | TS_TYPE_CHANGE, TS_ENC_MEMBLT_ORDER, 0xff, 0x01,
+		1, 0, 3, 0, 4, 0, 2, 0, 1, 0, 0xcc, 0, 0, 0, 0, 7, 0})
+	// two glyphs of a fixed pitch font
+	buff.Write([]byte{TS_STANDARD | TS_TYPE_CHANGE, TS_ENC_INDEX_ORDER, 0x17, 0x00, 0x38,
+		0, 0, 4, 0xff, 0xff, 0x00, 100, 0, 50, 0, 2, 5, 5})
+
+	d := newOrderDecoder()
+	orders, err := d.decode(6, buff.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orders) != 4 {
+		t.Fatalf("expect 4 primary orders, get %d", len(orders))
+	}
+
+	first := orders[0].DrawingOrder.(*OpaqueRect)
+	if *first != (OpaqueRect{10, 20, 30, 40, Color{16, 0x332211}}) || orders[0].Bounds != nil {
+		t.Errorf("bad opaque rect %+v", first)
+	}
+	second := orders[1].DrawingOrder.(*OpaqueRect)
+	if *second != (OpaqueRect{15, 16, 30, 40, Color{16, 0x332211}}) {
+		t.Errorf("bad delta opaque rect %+v", second)
+	}
+	if b := orders[1].Bounds; b == nil || *b != image.Rect(1, 2, 101, 201) {
+		t.Errorf("bad bounds %v", b)
+	}
+
+	mem := orders[2].DrawingOrder.(*MemBlt)
+	if mem.Left != 3 || mem.Top != 4 || mem.Width != 2 || mem.Rop != 0xcc || mem.CacheIndex != 7 {
+		t.Errorf("bad memblt %+v", mem)
+	}
+	if mem.Bitmap == nil || !bytes.Equal(mem.Bitmap.Pixels, []byte{0x1f, 0x00, 0xe0, 0x07}) {
+		t.Errorf("bad cached bitmap %+v", mem.Bitmap)
+	}
+
+	text := orders[3].DrawingOrder.(*GlyphIndex)
+	if text.BackColor != (Color{16, 0xffff}) || len(text.Glyphs) != 2 {
+		t.Fatalf("bad glyph index %+v", text)
+	}
+	if g := text.Glyphs[1]; g.X != 104 || g.Y != 48 || g.Width != 3 || !bytes.Equal(g.Mask[:2], []byte{0xa0, 0x40}) {
+		t.Errorf("bad glyph %+v", g)
+	}
+}
+
+func TestDecodeOrdersErrors(t *testing.T) {
+	d := newOrderDecoder()
+	// an unknown primary order cannot be skipped
+	if _, err := d.decode(1, []byte{TS_STANDARD | TS_TYPE_CHANGE, 0x16, 0}); err == nil {
+		t.Error("expect error on polyline")
+	}
+	// unknown secondary orders are skipped by their length
+	data := append(secondaryOrder(0x07, make([]byte, 9)), TS_STANDARD|TS_TYPE_CHANGE, TS_ENC_DSTBLT_ORDER, 0x10, 0x55)
+	orders, err := d.decode(2, data)
+	if err != nil || len(orders) != 1 || orders[0].DrawingOrder.(*DstBlt).Rop != 0x55 {
+		t.Errorf("get %+v, %v", orders, err)
+	}
+	if _, err = d.decode(1, []byte{TS_STANDARD, 0x7f}); err == nil {
+		t.Error("expect error on truncated order")
+	}
+}
+
+func TestDecodeCacheBitmapRev2(t *testing.T) {
+	r := &orderReader{r: bytes.NewReader([]byte{0x05, 0x81, 0x02, 0x41, 0x02, 0x3f})}
+	if v := r.uint2(); v != 5 {
+		t.Error("bad one byte encoding", v)
+	}
+	if v := r.uint2(); v != 0x102 {
+		t.Error("bad two byte encoding", v)
+	}
+	if v := r.uint4(); v != 0x102 {
+		t.Error("bad four byte encoding", v)
+	}
+	if v := r.uint4(); v != 0x3f || r.err != nil {
+		t.Error("bad four byte encoding", v, r.err)
+	}
+
+	// 2x2 16 bpp bitmap 256 of cache 1, the height is the width
+	pixels := []byte{1, 0, 2, 0, 3, 0, 4, 0}
+	body := append([]byte{0x02, 0x08, 0x81, 0x00}, pixels...)
+	data := &bytes.Buffer{}
+	core.WriteUInt8(TS_STANDARD|TS_SECONDARY, data)
+	core.WriteUInt16LE(uint16(len(body)-7), data)
+	core.WriteUInt16LE(1|4<<3|CBR2_HEIGHT_SAME_AS_WIDTH<<7, data)
+	core.WriteUInt8(TS_CACHE_BITMAP_UNCOMPRESSED_REV2, data)
+	data.Write(body)
+	// memblt of the cached bitmap
+	data.Write([]byte{TS_STANDARD | TS_TYPE_CHANGE, TS_ENC_MEMBLT_ORDER, 0x01, 0x01, 1, 0, 0, 1})
+
+	d := newOrderDecoder()
+	orders, err := d.decode(2, data.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := orders[0].DrawingOrder.(*MemBlt).Bitmap
+	if b == nil || b.Width != 2 || b.Height != 2 || b.BitsPerPixel != 16 || !bytes.Equal(b.Pixels, pixels) {
+		t.Errorf("bad cached bitmap %+v", b)
+	}
+
+	// bitmaps not to cache are skipped
+	data.Reset()
+	core.WriteUInt8(TS_STANDARD|TS_SECONDARY, data)
+	core.WriteUInt16LE(uint16(len(body)-7), data)
+	core.WriteUInt16LE(2|4<<3|(CBR2_HEIGHT_SAME_AS_WIDTH|CBR2_DO_NOT_CACHE)<<7, data)
+	core.WriteUInt8(TS_CACHE_BITMAP_UNCOMPRESSED_REV2, data)
+	data.Write(body)
+	if _, err := d.decode(1, data.Bytes()); err != nil || d.bitmaps[cacheKey{2, 256}] != nil {
+		t.Error("bitmap cached", err)
+	}
+}
@@ -3,19 +3,29 @@ package pdu
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
 
 	"github.com/tomatome/grdp/core"
 	"github.com/tomatome/grdp/emission"
 	"github.com/tomatome/grdp/glog"
+	"github.com/tomatome/grdp/protocol/codec/nsc"
+	"github.com/tomatome/grdp/protocol/codec/rfx"
 	"github.com/tomatome/grdp/protocol/t125/gcc"
 )
 
 type PDULayer struct {
 	emission.Emitter
-	transport          core.Transport
-	sharedId           uint32
-	userId             uint16
-	channelId          uint16
+	transport core.Transport
+	sharedId  uint32
+	userId    uint16
+	channelId uint16
+	// the capabilities of the last demand active, read by the senders
+	capsLock           sync.Mutex
 	serverCapabilities map[CapsType]Capability
 	clientCapabilities map[CapsType]Capability
 	fastPathSender     core.FastPathSender
@@ -68,13 +78,27 @@ func NewPDULayer(t core.Transport) *PDULayer {
 				DesktopSaveYGranularity: 20,
 				MaximumOrderLevel:       1,
 				OrderFlags:              NEGOTIATEORDERSUPPORT,
+				OrderSupport:            supportedOrders,
 				DesktopSaveSize:         480 * 480,
 			},
-			CAPSTYPE_BITMAPCACHE:           &BitmapCacheCapability{},
-			CAPSTYPE_POINTER:               &PointerCapability{ColorPointerCacheSize: 20},
-			CAPSTYPE_INPUT:                 &InputCapability{},
-			CAPSTYPE_BRUSH:                 &BrushCapability{},
-			CAPSTYPE_GLYPHCACHE:            &GlyphCapability{},
+			CAPSTYPE_BITMAPCACHE: &BitmapCacheCapability{
+				Cache0Entries:         600,
+				Cache0MaximumCellSize: 256,
+				Cache1Entries:         300,
+				Cache1MaximumCellSize: 1024,
+				Cache2Entries:         262,
+				Cache2MaximumCellSize: 4096,
+			},
+			CAPSTYPE_POINTER: &PointerCapability{ColorPointerCacheSize: pointerCacheSize},
+			CAPSTYPE_INPUT:   &InputCapability{},
+			CAPSTYPE_BRUSH:   &BrushCapability{},
+			CAPSTYPE_GLYPHCACHE: &GlyphCapability{
+				GlyphCache: [10]cacheEntry{{254, 4}, {254, 4}, {254, 8}, {254, 8}, {254, 16},
+					{254, 32}, {254, 64}, {254, 128}, {254, 256}, {64, 2048}},
+				// 256 fragments of 256 bytes
+				FragCache:    0x01000100,
+				SupportLevel: GLYPH_SUPPORT_FULL,
+			},
 			CAPSTYPE_OFFSCREENCACHE:        &OffscreenBitmapCacheCapability{},
 			CAPSTYPE_VIRTUALCHANNEL:        &VirtualChannelCapability{},
 			CAPSTYPE_SOUND:                 &SoundCapability{},
@@ -100,6 +124,14 @@ func NewPDULayer(t core.Transport) *PDULayer {
 	return p
 }
 
+// ServerCapability returns the capability set t of the server, nil until
+// the demand active or when the server did not send it
+func (p *PDULayer) ServerCapability(t CapsType) Capability {
+	p.capsLock.Lock()
+	defer p.capsLock.Unlock()
+	return p.serverCapabilities[t]
+}
+
 func (p *PDULayer) sendPDU(message PDUMessage) {
 	pdu := NewPDU(p.userId, message)
 	p.transport.Write(pdu.serialize())
@@ -114,19 +146,156 @@ func (p *PDULayer) SetFastPathSender(f core.FastPathSender) {
 	p.fastPathSender = f
 }
 
+// capabilities introduced after RDP 5, which RDP 4 servers disconnect on
+var rdp5Capabilities = map[CapsType]bool{
+	CAPSETTYPE_MULTIFRAGMENTUPDATE: true,
+	CAPSETTYPE_SURFACE_COMMANDS:    true,
+	CAPSETTYPE_BITMAP_CODECS:       true,
+	CAPSTYPE_RAIL:                  true,
+}
+
 type Client struct {
 	*PDULayer
 	clientCoreData *gcc.ClientCoreData
+	serverCoreData *gcc.ServerCoreData
+	rfx            *rfx.Decoder
+	nscodec        bool
+	// fast path update being reassembled
+	fragment []byte
+	// color pointers by cache index
+	pointers [pointerCacheSize]*PointerShape
+	orders   *orderDecoder
+	// history of the bulk compressed data of the server
+	bulk *mppc
+	// emit the unknown PDUs as errors rather than skipping them
+	strict bool
+	// bound of the reassembled updates, core.DefaultMaxPDUSize if zero
+	maxPDUSize int
+	// recvPDU listens from the first activation, a reactivation reuses it
+	activated bool
+
+	// fast path input events queued by BeginInputBatch
+	inputLock     sync.Mutex
+	batching      bool
+	pendingInput  [][]byte
+	flushInterval time.Duration
+	flushTimer    *time.Timer
 }
 
 func NewClient(t core.Transport) *Client {
 	c := &Client{
 		PDULayer: NewPDULayer(t),
+		orders:   newOrderDecoder(),
+		bulk:     newMPPC(),
 	}
 	c.transport.Once("connect", c.connect)
+	c.transport.Once("close", c.dropInput)
 	return c
 }
 
+// dropInput stops the input batch of a closed connection with its timer
+func (c *Client) dropInput() {
+	c.inputLock.Lock()
+	defer c.inputLock.Unlock()
+	if c.flushTimer != nil {
+		c.flushTimer.Stop()
+		c.flushTimer = nil
+	}
+	c.batching, c.pendingInput = false, nil
+}
+
+// addBitmapCodec advertises codec for surface bits
+func (c *Client) addBitmapCodec(codec BitmapCodec) {
+	c.clientCapabilities[CAPSETTYPE_SURFACE_COMMANDS] = &SurfaceCommandsCapability{
+		CmdFlags: SURFCMDS_SETSURFACEBITS | SURFCMDS_FRAMEMARKER | SURFCMDS_STREAMSURFACEBITS,
+	}
+	codecs, ok := c.clientCapabilities[CAPSETTYPE_BITMAP_CODECS].(*BitmapCodecsCapability)
+	if !ok {
+		codecs = &BitmapCodecsCapability{}
+		c.clientCapabilities[CAPSETTYPE_BITMAP_CODECS] = codecs
+	}
+	codecs.SupportedBitmapCodecs.Array = append(codecs.SupportedBitmapCodecs.Array, codec)
+}
+
+// EnableRemoteFX advertises the RemoteFX codec, servers only use it in 32 bpp sessions
+func (c *Client) EnableRemoteFX() {
+	c.rfx = rfx.NewDecoder()
+	c.addBitmapCodec(BitmapCodec{
+		GUID:       CODEC_GUID_REMOTEFX,
+		ID:         CODEC_ID_REMOTEFX,
+		Properties: rfx.ClientCapsContainer(),
+	})
+}
+
+// EnableNSCodec advertises NSCodec
+func (c *Client) EnableNSCodec() {
+	c.nscodec = true
+	c.addBitmapCodec(BitmapCodec{
+		GUID:       CODEC_GUID_NSCODEC,
+		ID:         CODEC_ID_NSCODEC,
+		Properties: nsc.CapabilitySet(),
+	})
+}
+
+// EnableBitmapCodecs advertises the codecs ids in this order and no other
+// one, none leaves the plain bitmap updates
+func (c *Client) EnableBitmapCodecs(ids ...CodecID) error {
+	for _, id := range ids {
+		if id != CODEC_ID_REMOTEFX && id != CODEC_ID_NSCODEC {
+			return errors.New(fmt.Sprintf("unknown bitmap codec id %d", id))
+		}
+	}
+	delete(c.clientCapabilities, CAPSETTYPE_BITMAP_CODECS)
+	delete(c.clientCapabilities, CAPSETTYPE_SURFACE_COMMANDS)
+	c.rfx, c.nscodec = nil, false
+	for _, id := range ids {
+		switch {
+		case id == CODEC_ID_REMOTEFX && c.rfx == nil:
+			c.EnableRemoteFX()
+		case id == CODEC_ID_NSCODEC && !c.nscodec:
+			c.EnableNSCodec()
+		}
+	}
+	return nil
+}
+
+// SetStrict makes the unknown PDUs errors, they are logged and skipped by default
+func (c *Client) SetStrict(strict bool) {
+	c.strict = strict
+}
+
+// SetMaxPDUSize fails on the fast path updates reassembled past n bytes,
+// the default is core.DefaultMaxPDUSize
+func (c *Client) SetMaxPDUSize(n int) {
+	c.maxPDUSize = n
+}
+
+// DisableOrders advertises no drawing order, to receive bitmap updates only
+func (c *Client) DisableOrders() {
+	orderCapa := c.clientCapabilities[CAPSTYPE_ORDER].(*OrderCapability)
+	orderCapa.OrderSupport = [32]byte{}
+}
+
+// SetServerCoreData gates the capabilities on the version of the server
+func (c *Client) SetServerCoreData(data *gcc.ServerCoreData) {
+	c.serverCoreData = data
+}
+
+// confirmCapabilities returns the client capabilities the server supports
+func (c *Client) confirmCapabilities() []Capability {
+	rdp4 := c.serverCoreData != nil && c.serverCoreData.RdpVersion < gcc.RDP_VERSION_5_PLUS
+	caps := make([]Capability, 0, len(c.clientCapabilities))
+	for _, v := range c.clientCapabilities {
+		if rdp4 && rdp5Capabilities[v.Type()] {
+			glog.Debugf("skip clientCapabilities 0x%04x for RDP 4 server", v.Type())
+			continue
+		}
+		glog.Debugf("clientCapabilities: 0x%04x", v.Type())
+		caps = append(caps, v)
+	}
+	return caps
+}
+
 func (c *Client) connect(data *gcc.ClientCoreData, userId uint16, channelId uint16) {
 	glog.Debug("pdu connect:", userId, ",", channelId)
 	c.clientCoreData = data
@@ -137,10 +306,8 @@ func (c *Client) connect(data *gcc.ClientCoreData, userId uint16, channelId uint
 
 func (c *Client) recvDemandActivePDU(s []byte) {
 	glog.Debug("PDU recvDemandActivePDU", hex.EncodeToString(s))
-	r := bytes.NewReader(s)
-	pdu, err := readPDU(r)
-	if err != nil {
-		glog.Error(err)
+	pdu, ok := c.recv(s, c.recvDemandActivePDU)
+	if !ok {
 		return
 	}
 	if pdu.ShareCtrlHeader.PDUType != PDUTYPE_DEMANDACTIVEPDU {
@@ -150,9 +317,11 @@ func (c *Client) recvDemandActivePDU(s []byte) {
 	}
 	c.sharedId = pdu.Message.(*DemandActivePDU).SharedId
 	c.demandActivePDU = pdu.Message.(*DemandActivePDU)
+	c.capsLock.Lock()
 	for _, caps := range pdu.Message.(*DemandActivePDU).CapabilitySets {
 		c.serverCapabilities[caps.Type()] = caps
 	}
+	c.capsLock.Unlock()
 
 	c.sendConfirmActivePDU()
 	c.sendClientFinalizeSynchronizePDU()
@@ -173,14 +342,46 @@ func (c *Client) sendConfirmActivePDU() {
 
 	bitmapCapa := c.clientCapabilities[CAPSTYPE_BITMAP].(*BitmapCapability)
 	bitmapCapa.PreferredBitsPerPixel = c.clientCoreData.HighColorDepth
+	if c.clientCoreData.EarlyCapabilityFlags&gcc.RNS_UD_CS_WANT_32BPP_SESSION != 0 {
+		bitmapCapa.PreferredBitsPerPixel = 32
+	}
 	bitmapCapa.DesktopWidth = c.clientCoreData.DesktopWidth
 	bitmapCapa.DesktopHeight = c.clientCoreData.DesktopHeight
+	// the server may keep the size of the session it reconnects to
+	if s, ok := c.ServerCapability(CAPSTYPE_BITMAP).(*BitmapCapability); ok && s.DesktopWidth != 0 && s.DesktopHeight != 0 {
+		bitmapCapa.DesktopWidth = s.DesktopWidth
+		bitmapCapa.DesktopHeight = s.DesktopHeight
+	}
+
+	// servers hosting revision 2 bitmap caches get them instead of revision 1
+	if s, ok := c.ServerCapability(CAPSTYPE_BITMAPCACHE_HOSTSUPPORT).(*BitmapCacheHostSupportCapability); ok && s.CacheVersion == BITMAPCACHE_REV2 {
+		delete(c.clientCapabilities, CAPSTYPE_BITMAPCACHE)
+		c.clientCapabilities[CAPSTYPE_BITMAPCACHE_REV2] = &BitmapCacheRev2Capability{
+			NumCellCaches:        3,
+			BitmapCache0CellInfo: 600,
+			BitmapCache1CellInfo: 600,
+			BitmapCache2CellInfo: 2048,
+		}
+	}
 
 	orderCapa := c.clientCapabilities[CAPSTYPE_ORDER].(*OrderCapability)
 	orderCapa.OrderFlags |= ZEROBOUNDSDELTASSUPPORT
+	c.orders.bpp = uint16(bitmapCapa.PreferredBitsPerPixel)
+	if s, ok := c.ServerCapability(CAPSTYPE_BITMAP).(*BitmapCapability); ok && s.PreferredBitsPerPixel != 0 {
+		c.orders.bpp = uint16(s.PreferredBitsPerPixel)
+	}
+
+	if c.rfx != nil {
+		// a whole RemoteFX frame may cover the desktop
+		multiFragmentCapa := c.clientCapabilities[CAPSETTYPE_MULTIFRAGMENTUPDATE].(*MultiFragmentUpdate)
+		multiFragmentCapa.MaxRequestSize = uint32(c.clientCoreData.DesktopWidth) * uint32(c.clientCoreData.DesktopHeight) * 4
+	}
 
 	inputCapa := c.clientCapabilities[CAPSTYPE_INPUT].(*InputCapability)
-	inputCapa.Flags = INPUT_FLAG_SCANCODES | INPUT_FLAG_MOUSEX | INPUT_FLAG_UNICODE
+	inputCapa.Flags = INPUT_FLAG_SCANCODES | INPUT_FLAG_MOUSEX | INPUT_FLAG_UNICODE | INPUT_FLAG_MOUSE_HWHEEL
+	if c.fastPathSender != nil {
+		inputCapa.Flags |= INPUT_FLAG_FASTPATH_INPUT | INPUT_FLAG_FASTPATH_INPUT2
+	}
 	inputCapa.KeyboardLayout = c.clientCoreData.KbdLayout
 	inputCapa.KeyboardType = c.clientCoreData.KeyboardType
 	inputCapa.KeyboardSubType = c.clientCoreData.KeyboardSubType
@@ -189,10 +390,7 @@ func (c *Client) sendConfirmActivePDU() {
 
 	pdu.SharedId = c.sharedId
 	pdu.NumberCapabilities = c.demandActivePDU.NumberCapabilities
-	for _, v := range c.clientCapabilities {
-		glog.Debugf("clientCapabilities: 0x%04x", v.Type())
-		pdu.CapabilitySets = append(pdu.CapabilitySets, v)
-	}
+	pdu.CapabilitySets = append(pdu.CapabilitySets, c.confirmCapabilities()...)
 
 	pdu.LengthSourceDescriptor = c.demandActivePDU.LengthSourceDescriptor
 	pdu.SourceDescriptor = c.demandActivePDU.SourceDescriptor
@@ -212,10 +410,8 @@ func (c *Client) sendClientFinalizeSynchronizePDU() {
 
 func (c *Client) recvServerSynchronizePDU(s []byte) {
 	glog.Debug("PDU recvServerSynchronizePDU")
-	r := bytes.NewReader(s)
-	pdu, err := readPDU(r)
-	if err != nil {
-		glog.Error(err)
+	pdu, ok := c.recv(s, c.recvServerSynchronizePDU)
+	if !ok {
 		return
 	}
 	dataPdu, ok := pdu.Message.(*DataPDU)
@@ -234,10 +430,8 @@ func (c *Client) recvServerSynchronizePDU(s []byte) {
 
 func (c *Client) recvServerControlCooperatePDU(s []byte) {
 	glog.Debug("PDU recvServerControlCooperatePDU")
-	r := bytes.NewReader(s)
-	pdu, err := readPDU(r)
-	if err != nil {
-		glog.Error(err)
+	pdu, ok := c.recv(s, c.recvServerControlCooperatePDU)
+	if !ok {
 		return
 	}
 	dataPdu, ok := pdu.Message.(*DataPDU)
@@ -260,10 +454,8 @@ func (c *Client) recvServerControlCooperatePDU(s []byte) {
 
 func (c *Client) recvServerControlGrantedPDU(s []byte) {
 	glog.Debug("PDU recvServerControlGrantedPDU")
-	r := bytes.NewReader(s)
-	pdu, err := readPDU(r)
-	if err != nil {
-		glog.Error(err)
+	pdu, ok := c.recv(s, c.recvServerControlGrantedPDU)
+	if !ok {
 		return
 	}
 	dataPdu, ok := pdu.Message.(*DataPDU)
@@ -286,10 +478,8 @@ func (c *Client) recvServerControlGrantedPDU(s []byte) {
 
 func (c *Client) recvServerFontMapPDU(s []byte) {
 	glog.Debug("PDU recvServerFontMapPDU")
-	r := bytes.NewReader(s)
-	pdu, err := readPDU(r)
-	if err != nil {
-		glog.Error(err)
+	pdu, ok := c.recv(s, c.recvServerFontMapPDU)
+	if !ok {
 		return
 	}
 	dataPdu, ok := pdu.Message.(*DataPDU)
@@ -301,22 +491,139 @@ func (c *Client) recvServerFontMapPDU(s []byte) {
 		}
 		return
 	}
-	c.transport.On("data", c.recvPDU)
+	if !c.activated {
+		c.activated = true
+		c.transport.On("data", c.recvPDU)
+	}
 	c.Emit("ready")
 }
 
 func (c *Client) recvPDU(s []byte) {
-	glog.Debug("PDU recvPDU", hex.EncodeToString(s))
-	r := bytes.NewReader(s)
-	if r.Len() > 0 {
-		p, err := readPDU(r)
-		if err != nil {
-			glog.Error(err)
+	if glog.Enabled(glog.DEBUG) {
+		glog.Debug("PDU recvPDU", hex.EncodeToString(s))
+	}
+	if len(s) > 0 {
+		p, ok := c.recv(s, nil)
+		if !ok {
 			return
 		}
-		if p.ShareCtrlHeader.PDUType == PDUTYPE_DEACTIVATEALLPDU {
+		glog.Debugw("pdu recv", "pdu", p.ShareCtrlHeader.PDUType)
+		switch p.ShareCtrlHeader.PDUType {
+		case PDUTYPE_DEACTIVATEALLPDU:
 			c.transport.Once("data", c.recvDemandActivePDU)
+		case PDUTYPE_DATAPDU:
+			c.recvDataPDU(p.Message.(*DataPDU))
+		}
+	}
+}
+
+// recv reads the PDU of s, an unknown PDU is skipped, waiting for the next
+// one with next unless nil, or emitted as an error by a strict client
+func (c *Client) recv(s []byte, next func([]byte)) (*PDU, bool) {
+	p, err := readPDU(bytes.NewReader(s), c.bulk)
+	if err == nil {
+		return p, true
+	}
+	var unknown *UnknownPDUError
+	switch {
+	case !errors.As(err, &unknown):
+		glog.Errorw("read pdu", "error", err)
+	case c.strict:
+		c.Emit("error", err)
+	default:
+		glog.Warn("skip", err)
+		if next != nil {
+			c.transport.Once("data", next)
+		}
+	}
+	return nil, false
+}
+
+func (c *Client) recvDataPDU(d *DataPDU) {
+	switch d.Header.PDUType2 {
+	case PDUTYPE2_SAVE_SESSION_INFO:
+		info := d.Data.(*SaveSessionInfo)
+		switch info.InfoType {
+		case INFOTYPE_LOGON, INFOTYPE_LOGON_LONG, INFOTYPE_LOGON_PLAINNOTIFY:
+			c.Emit("logon", info.LogonId, info.Domain, info.UserName)
+		case INFOTYPE_LOGON_EXTENDED_INFO:
+			if info.FieldsPresent&LOGON_EX_AUTORECONNECTCOOKIE != 0 {
+				c.Emit("reconnect-cookie", info.LogonId, info.Random)
+			}
+			if info.FieldsPresent&LOGON_EX_LOGONERRORS != 0 {
+				glog.Infof("logon error type 0x%x data 0x%x", info.ErrorNotificationType, info.ErrorNotificationData)
+			}
+		}
+	case PDUTYPE2_UPDATE:
+		u := d.Data.(*UpdateDataPDU)
+		if u.Bitmap != nil {
+			c.emitBitmap(u.Bitmap.Rectangles)
+		}
+		if u.Orders != nil {
+			c.recvOrders(u.Orders)
+		}
+	case PDUTYPE2_POINTER:
+		c.recvPointer(d.Data.(*PointerPDU).Pointer)
+	case PDUTYPE2_SET_ERROR_INFO_PDU:
+		// the server sends ERRINFO_NONE when the session goes on
+		if code := ErrorInfo(d.Data.(*ErrorInfoDataPDU).ErrorInfo); code != ERRINFO_NONE {
+			glog.Errorw("server error info", "error", code)
+			c.Emit("error", code)
+		}
+	}
+}
+
+// recvPointer emits "pointer-position" for moves and "pointer" for shapes,
+// keeping the color pointers to replay the cached pointer updates
+func (c *Client) recvPointer(u *PointerUpdate) {
+	switch u.MessageType {
+	case TS_PTRMSGTYPE_POSITION:
+		c.Emit("pointer-position", u.X, u.Y)
+	case TS_PTRMSGTYPE_CACHED:
+		if int(u.CacheIndex) >= len(c.pointers) || c.pointers[u.CacheIndex] == nil {
+			glog.Warn("pointer cache index not set:", u.CacheIndex)
+			return
+		}
+		c.Emit("pointer", *c.pointers[u.CacheIndex])
+	case TS_PTRMSGTYPE_COLOR, TS_PTRMSGTYPE_POINTER:
+		if int(u.Shape.CacheIndex) >= len(c.pointers) {
+			glog.Warn("pointer cache index out of range:", u.Shape.CacheIndex)
+		} else {
+			c.pointers[u.Shape.CacheIndex] = u.Shape
+		}
+		c.Emit("pointer", *u.Shape)
+	case TS_PTRMSGTYPE_SYSTEM:
+		c.Emit("pointer", *u.Shape)
+	}
+}
+
+// recvOrders emits the primary orders on "orders", the ones decoded
+// before an error are still emitted
+func (c *Client) recvOrders(o *FastPathOrdersPDU) {
+	orders, err := c.orders.decode(int(o.NumberOrders), o.OrderData)
+	if err != nil {
+		glog.Warn("drawing orders:", err)
+	}
+	if len(orders) > 0 {
+		c.Emit("orders", orders)
+	}
+}
+
+// emitBitmap emits the raw rectangles on "update" and the decoded ones on "bitmap"
+func (c *Client) emitBitmap(rectangles []BitmapData) {
+	c.Emit("update", rectangles)
+	decoded := make([]BitmapData, 0, len(rectangles))
+	for _, rect := range rectangles {
+		pixels, err := rect.Decompress()
+		if err != nil {
+			glog.Warn("bitmap decompress:", err)
+			continue
 		}
+		rect.Pixels = pixels
+		decoded = append(decoded, rect)
+	}
+	if len(decoded) > 0 {
+		c.Emit("bitmap", decoded)
 	}
 }
 
@@ -325,16 +632,378 @@ func (c *Client) RecvFastPath(secFlag byte, s []byte) {
 	glog.Debug("PDU RecvFastPath", secFlag&0x2 != 0)
 	r := bytes.NewReader(s)
 	for r.Len() > 0 {
-		p, err := readFastPathUpdatePDU(r)
-		if err != nil {
+		p, err := readFastPathUpdatePDU(r, c.bulk)
+		if p == nil {
 			glog.Debug("readFastPathUpdatePDU:", err)
-			//continue
 			return
 		}
-		if p.UpdateHeader == FASTPATH_UPDATETYPE_BITMAP {
-			c.Emit("update", p.Data.(*FastPathBitmapUpdateDataPDU).Rectangles)
+		if err != nil {
+			var unknown *UnknownPDUError
+			if c.strict && errors.As(err, &unknown) {
+				c.Emit("error", err)
+			}
+			glog.Debug("readFastPathUpdatePDU:", err)
+			continue
+		}
+		data := p.Data
+		if p.Fragmentation() != FASTPATH_FRAGMENT_SINGLE {
+			if data, err = c.defragment(p); err != nil {
+				glog.Debug("readFastPathUpdatePDU:", err)
+				continue
+			}
+		}
+		switch d := data.(type) {
+		case *FastPathBitmapUpdateDataPDU:
+			c.emitBitmap(d.Rectangles)
+		case *FastPathOrdersPDU:
+			c.recvOrders(d)
+		case *FastPathPaletteUpdatePDU:
+			c.Emit("palette", d.Colors)
+		case *FastPathSurfaceCommandsPDU:
+			c.emitSurfaceBits(d.Commands)
+		case *FastPathPointerUpdatePDU:
+			c.recvPointer(d.Pointer)
+		}
+	}
+}
+
+// defragment collects the fragments of an update, returns its data on the last one
+// @see MS-RDPBCGR 2.2.9.1.2.1 Fast-Path Update (TS_FP_UPDATE)
+func (c *Client) defragment(p *FastPathUpdatePDU) (UpdateData, error) {
+	switch p.Fragmentation() {
+	case FASTPATH_FRAGMENT_FIRST:
+		c.fragment = append([]byte{}, p.Fragment...)
+		return nil, nil
+	case FASTPATH_FRAGMENT_NEXT:
+		if err := c.checkFragmentSize(len(p.Fragment)); err != nil {
+			return nil, err
+		}
+		c.fragment = append(c.fragment, p.Fragment...)
+		return nil, nil
+	}
+	if c.fragment == nil {
+		return nil, errors.New("fast path last fragment without first")
+	}
+	if err := c.checkFragmentSize(len(p.Fragment)); err != nil {
+		return nil, err
+	}
+	data := append(c.fragment, p.Fragment...)
+	c.fragment = nil
+	return readUpdateData(p.UpdateCode(), data)
+}
+
+// checkFragmentSize drops the update being reassembled and emits an error
+// when n more bytes exceed the maximum PDU size
+func (c *Client) checkFragmentSize(n int) error {
+	max := c.maxPDUSize
+	if max == 0 {
+		max = core.DefaultMaxPDUSize
+	}
+	if len(c.fragment)+n <= max {
+		return nil
+	}
+	err := errors.New(fmt.Sprintf("fast path update of %d bytes exceeds the maximum %d", len(c.fragment)+n, max))
+	c.fragment = nil
+	c.Emit("error", err)
+	return err
+}
+
+// emitSurfaceBits emits the decoded surface bits on "bitmap" as 32 bpp bottom up rectangles
+func (c *Client) emitSurfaceBits(commands []SurfaceBits) {
+	var rectangles []BitmapData
+	for _, cmd := range commands {
+		switch {
+		case cmd.CodecId == CODEC_ID_REMOTEFX && c.rfx != nil:
+			frames, err := c.rfx.Decode(cmd.BitmapData)
+			if err != nil {
+				glog.Warn("rfx decode:", err)
+			}
+			for _, f := range frames {
+				rectangles = append(rectangles, frameRectangles(cmd.DestLeft, cmd.DestTop, f)...)
+			}
+		case cmd.CodecId == CODEC_ID_NSCODEC && c.nscodec:
+			pixels, err := nsc.DecodeNSCodec(cmd.BitmapData, int(cmd.Width), int(cmd.Height))
+			if err != nil {
+				glog.Warn("nscodec decode:", err)
+				continue
+			}
+			rectangles = append(rectangles, surfaceRectangle(cmd, pixels))
+		default:
+			glog.Debugf("Unhandled surface bits codec %d", cmd.CodecId)
+		}
+	}
+	if len(rectangles) > 0 {
+		c.Emit("bitmap", rectangles)
+	}
+}
+
+// surfaceRectangle places the top down 32 bpp pixels of cmd bottom up
+func surfaceRectangle(cmd SurfaceBits, pixels []byte) BitmapData {
+	stride := int(cmd.Width) * 4
+	rows := make([]byte, 0, len(pixels))
+	for y := int(cmd.Height) - 1; y >= 0; y-- {
+		rows = append(rows, pixels[y*stride:(y+1)*stride]...)
+	}
+	return BitmapData{
+		DestLeft:         cmd.DestLeft,
+		DestTop:          cmd.DestTop,
+		DestRight:        cmd.DestLeft + cmd.Width - 1,
+		DestBottom:       cmd.DestTop + cmd.Height - 1,
+		Width:            cmd.Width,
+		Height:           cmd.Height,
+		BitsPerPixel:     32,
+		BitmapDataStream: rows,
+		Pixels:           rows,
+	}
+}
+
+// frameRectangles clips the tiles of f to its region, at left, top
+func frameRectangles(left, top uint16, f *rfx.Frame) []BitmapData {
+	var rectangles []BitmapData
+	for _, tile := range f.Tiles {
+		for _, r := range f.Rects {
+			x0, y0 := int(tile.X), int(tile.Y)
+			x1, y1 := x0+rfx.TILE_SIZE, y0+rfx.TILE_SIZE
+			if int(r.X) > x0 {
+				x0 = int(r.X)
+			}
+			if int(r.Y) > y0 {
+				y0 = int(r.Y)
+			}
+			if int(r.X)+int(r.Width) < x1 {
+				x1 = int(r.X) + int(r.Width)
+			}
+			if int(r.Y)+int(r.Height) < y1 {
+				y1 = int(r.Y) + int(r.Height)
+			}
+			if x0 >= x1 || y0 >= y1 {
+				continue
+			}
+			w, h := x1-x0, y1-y0
+			pixels := make([]byte, 0, w*h*4)
+			for y := y1 - 1; y >= y0; y-- {
+				i := ((y-int(tile.Y))*rfx.TILE_SIZE + x0 - int(tile.X)) * 4
+				pixels = append(pixels, tile.Pixels[i:i+w*4]...)
+			}
+			rectangles = append(rectangles, BitmapData{
+				DestLeft:         left + uint16(x0),
+				DestTop:          top + uint16(y0),
+				DestRight:        left + uint16(x1-1),
+				DestBottom:       top + uint16(y1-1),
+				Width:            uint16(w),
+				Height:           uint16(h),
+				BitsPerPixel:     32,
+				BitmapLength:     uint16(len(pixels)),
+				BitmapDataStream: pixels,
+				Pixels:           pixels,
+			})
+		}
+	}
+	return rectangles
+}
+
+// fastPathInput tells if input can skip the slow path headers
+func (c *Client) fastPathInput() bool {
+	if c.fastPathSender == nil {
+		return false
+	}
+	inputCapa, ok := c.ServerCapability(CAPSTYPE_INPUT).(*InputCapability)
+	return ok && inputCapa.Flags&(INPUT_FLAG_FASTPATH_INPUT|INPUT_FLAG_FASTPATH_INPUT2) != 0
+}
+
+// the numEvents field of TS_FP_INPUT_PDU is one byte
+const maxInputEvents = 0xff
+
+// SetInputFlushInterval sets the delay after which the events queued by
+// BeginInputBatch are sent without waiting for FlushInput, 0 waits
+func (c *Client) SetInputFlushInterval(d time.Duration) {
+	c.inputLock.Lock()
+	c.flushInterval = d
+	c.inputLock.Unlock()
+}
+
+// BeginInputBatch queues the fast path input events until FlushInput,
+// they are then sent in a single PDU. Slow path input is not queued
+func (c *Client) BeginInputBatch() {
+	c.inputLock.Lock()
+	c.batching = true
+	c.inputLock.Unlock()
+}
+
+// FlushInput sends the queued input events and ends the batch
+func (c *Client) FlushInput() error {
+	c.inputLock.Lock()
+	defer c.inputLock.Unlock()
+	c.batching = false
+	return c.flushInput()
+}
+
+// flushInput sends the queued events by PDUs of maxInputEvents, with inputLock held
+func (c *Client) flushInput() error {
+	if c.flushTimer != nil {
+		c.flushTimer.Stop()
+		c.flushTimer = nil
+	}
+	for len(c.pendingInput) > 0 {
+		n := len(c.pendingInput)
+		if n > maxInputEvents {
+			n = maxInputEvents
+		}
+		events := c.pendingInput[:n]
+		c.pendingInput = c.pendingInput[n:]
+		if _, err := c.fastPathSender.SendFastPath(0, fastPathInputEvents(events...)); err != nil {
+			c.pendingInput = nil
+			return err
+		}
+	}
+	c.pendingInput = nil
+	return nil
+}
+
+// sendFastPathInput sends events in a TS_FP_INPUT_PDU, or queues them in a batch
+func (c *Client) sendFastPathInput(events ...[]byte) error {
+	c.inputLock.Lock()
+	defer c.inputLock.Unlock()
+	if !c.batching {
+		_, err := c.fastPathSender.SendFastPath(0, fastPathInputEvents(events...))
+		return err
+	}
+	c.pendingInput = append(c.pendingInput, events...)
+	if len(c.pendingInput) >= maxInputEvents {
+		return c.flushInput()
+	}
+	if c.flushInterval > 0 && c.flushTimer == nil {
+		c.flushTimer = time.AfterFunc(c.flushInterval, func() {
+			c.inputLock.Lock()
+			defer c.inputLock.Unlock()
+			if err := c.flushInput(); err != nil {
+				glog.Error("flush input:", err)
+			}
+		})
+	}
+	return nil
+}
+
+// SendScancode sends a key press or release, see fastPathScancodeEvent for extended codes
+func (c *Client) SendScancode(code uint16, down bool) error {
+	if c.fastPathInput() {
+		return c.sendFastPathInput(fastPathScancodeEvent(code, down))
+	}
+	e := &ScancodeKeyEvent{KeyCode: code & 0xff}
+	if !down {
+		e.KeyboardFlags |= KBDFLAGS_RELEASE
+	}
+	switch code >> 8 {
+	case 0xe0:
+		e.KeyboardFlags |= KBDFLAGS_EXTENDED
+	case 0xe1:
+		e.KeyboardFlags |= KBDFLAGS_EXTENDED1
+	}
+	c.SendInputEvents(INPUT_EVENT_SCANCODE, []InputEventsInterface{e})
+	return nil
+}
+
+// SendUnicode types r regardless of the keyboard layout, each UTF-16 code
+// unit of r is pressed then released
+func (c *Client) SendUnicode(r rune) error {
+	if !utf8.ValidRune(r) {
+		return errors.New(fmt.Sprintf("invalid rune 0x%x", r))
+	}
+	if inputCapa, ok := c.ServerCapability(CAPSTYPE_INPUT).(*InputCapability); !ok || inputCapa.Flags&INPUT_FLAG_UNICODE == 0 {
+		return errors.New("server does not support unicode input")
+	}
+	units := []uint16{uint16(r)}
+	if r > 0xffff {
+		r1, r2 := utf16.EncodeRune(r)
+		units = []uint16{uint16(r1), uint16(r2)}
+	}
+	if c.fastPathInput() {
+		events := make([][]byte, 0, 2*len(units))
+		for _, u := range units {
+			events = append(events, fastPathUnicodeEvent(u, true), fastPathUnicodeEvent(u, false))
 		}
+		return c.sendFastPathInput(events...)
 	}
+	events := make([]InputEventsInterface, 0, 2*len(units))
+	for _, u := range units {
+		events = append(events, &UnicodeKeyEvent{Unicode: u}, &UnicodeKeyEvent{KeyboardFlags: KBDFLAGS_RELEASE, Unicode: u})
+	}
+	c.SendInputEvents(INPUT_EVENT_UNICODE, events)
+	return nil
+}
+
+// SendPointer sends a mouse event with PTRFLAGS_* flags
+func (c *Client) SendPointer(x, y uint16, flags uint16) error {
+	if c.fastPathInput() {
+		return c.sendFastPathInput(fastPathPointerEvent(x, y, flags))
+	}
+	e := &PointerEvent{PointerFlags: flags, XPos: x, YPos: y}
+	c.SendInputEvents(INPUT_EVENT_MOUSE, []InputEventsInterface{e})
+	return nil
+}
+
+// SendExtendedPointer presses or releases the extended button 1 or 2 at x, y,
+// which are the back and forward buttons of most mice
+func (c *Client) SendExtendedPointer(x, y uint16, button int, down bool) error {
+	var flags uint16
+	switch button {
+	case 1:
+		flags = PTRXFLAGS_BUTTON1
+	case 2:
+		flags = PTRXFLAGS_BUTTON2
+	default:
+		return errors.New(fmt.Sprintf("invalid extended button %d", button))
+	}
+	if down {
+		flags |= PTRXFLAGS_DOWN
+	}
+	if inputCapa, ok := c.ServerCapability(CAPSTYPE_INPUT).(*InputCapability); !ok || inputCapa.Flags&INPUT_FLAG_MOUSEX == 0 {
+		return errors.New("server does not support extended mouse buttons")
+	}
+	if c.fastPathInput() {
+		return c.sendFastPathInput(fastPathPointerXEvent(x, y, flags))
+	}
+	// TS_POINTERX_EVENT has the layout of TS_POINTER_EVENT
+	e := &PointerEvent{PointerFlags: flags, XPos: x, YPos: y}
+	c.SendInputEvents(INPUT_EVENT_MOUSEX, []InputEventsInterface{e})
+	return nil
+}
+
+// SendWheel scrolls by delta, positive up or right, the rotation is clamped
+// to the 9 bits two's complement of the pointer flags, 120 per notch
+func (c *Client) SendWheel(delta int16, horizontal bool) error {
+	flags := uint16(PTRFLAGS_WHEEL)
+	if horizontal {
+		if inputCapa, ok := c.ServerCapability(CAPSTYPE_INPUT).(*InputCapability); !ok || inputCapa.Flags&INPUT_FLAG_MOUSE_HWHEEL == 0 {
+			return errors.New("server does not support horizontal wheel")
+		}
+		flags = PTRFLAGS_HWHEEL
+	}
+	if delta > 0xff {
+		delta = 0xff
+	} else if delta < -0x100 {
+		delta = -0x100
+	}
+	return c.SendPointer(0, 0, flags|uint16(delta)&WheelRotationMask)
+}
+
+// SendRefreshRect asks the server to send again the areas of rects
+func (c *Client) SendRefreshRect(rects []Rect) error {
+	if len(rects) == 0 || len(rects) > 0xff {
+		return errors.New(fmt.Sprintf("invalid number of areas %d", len(rects)))
+	}
+	c.sendDataPDU(&RefreshRectDataPDU{AreasToRefresh: rects})
+	return nil
+}
+
+// SendSuppressOutput stops the display updates, or resumes them for rect
+func (c *Client) SendSuppressOutput(allow bool, rect Rect) error {
+	pdu := &SuppressOutputDataPDU{}
+	if allow {
+		pdu.DesktopRect = []Rect{rect}
+	}
+	c.sendDataPDU(pdu)
+	return nil
 }
 
 type InputEventsInterface interface {
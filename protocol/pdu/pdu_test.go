@@ -0,0 +1,658 @@
+package pdu
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lunixbochs/struc"
+	"github.com/tomatome/grdp/core"
+	"github.com/tomatome/grdp/emission"
+	"github.com/tomatome/grdp/protocol/codec/rfx"
+	"github.com/tomatome/grdp/protocol/t125/gcc"
+)
+
+func TestDefragment(t *testing.T) {
+	data, _ := hex.DecodeString(surfaceCommandsHex)
+	c := &Client{}
+	if _, err := c.defragment(&FastPathUpdatePDU{UpdateHeader: FASTPATH_FRAGMENT_LAST << 4, Fragment: data}); err == nil {
+		t.Error("last fragment without first accepted")
+	}
+
+	for i, part := range [][]byte{data[:5], data[5:9], data[9:]} {
+		frag := uint8(FASTPATH_FRAGMENT_NEXT)
+		if i == 0 {
+			frag = FASTPATH_FRAGMENT_FIRST
+		} else if i == 2 {
+			frag = FASTPATH_FRAGMENT_LAST
+		}
+		d, err := c.defragment(&FastPathUpdatePDU{UpdateHeader: frag<<4 | FASTPATH_UPDATETYPE_SURFCMDS, Fragment: part})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < 2 && d != nil {
+			t.Fatal("update returned before the last fragment")
+		}
+		if i == 2 && len(d.(*FastPathSurfaceCommandsPDU).Commands) != 1 {
+			t.Errorf("bad reassembled update %+v", d)
+		}
+	}
+}
+
+func TestDefragmentMaxSize(t *testing.T) {
+	c := &Client{PDULayer: NewPDULayer(&transportCapture{Emitter: *emission.NewEmitter()})}
+	c.SetMaxPDUSize(8)
+	var errs []error
+	c.On("error", func(err error) {
+		errs = append(errs, err)
+	})
+	part := []byte{1, 2, 3, 4, 5}
+	c.defragment(&FastPathUpdatePDU{UpdateHeader: FASTPATH_FRAGMENT_FIRST<<4 | FASTPATH_UPDATETYPE_SURFCMDS, Fragment: part})
+	if _, err := c.defragment(&FastPathUpdatePDU{UpdateHeader: FASTPATH_FRAGMENT_NEXT<<4 | FASTPATH_UPDATETYPE_SURFCMDS, Fragment: part}); err == nil {
+		t.Error("fragments above the maximum size accepted")
+	}
+	if c.fragment != nil || len(errs) != 1 {
+		t.Error("get", len(c.fragment), errs)
+	}
+}
+
+func TestFrameRectangles(t *testing.T) {
+	pixels := make([]byte, rfx.TILE_SIZE*rfx.TILE_SIZE*4)
+	for y := 0; y < rfx.TILE_SIZE; y++ {
+		pixels[y*rfx.TILE_SIZE*4] = byte(y)
+	}
+	f := &rfx.Frame{
+		Rects: []rfx.Rect{{X: 60, Y: 2, Width: 10, Height: 3}, {X: 200, Y: 0, Width: 8, Height: 8}},
+		Tiles: []rfx.Tile{{X: 64, Y: 0, Pixels: pixels}},
+	}
+	rects := frameRectangles(100, 50, f)
+	if len(rects) != 1 {
+		t.Fatalf("expect 1 rectangle, get %d", len(rects))
+	}
+	r := rects[0]
+	if r.DestLeft != 164 || r.DestTop != 52 || r.DestRight != 169 || r.DestBottom != 54 ||
+		r.Width != 6 || r.Height != 3 || r.BitsPerPixel != 32 || len(r.Pixels) != 6*3*4 {
+		t.Fatalf("bad rectangle %+v", r)
+	}
+	// rows bottom up
+	if r.Pixels[0] != 4 || r.Pixels[6*4] != 3 || r.Pixels[2*6*4] != 2 {
+		t.Errorf("bad rows %v", r.Pixels)
+	}
+}
+
+func TestEnableRemoteFX(t *testing.T) {
+	c := &Client{PDULayer: &PDULayer{clientCapabilities: map[CapsType]Capability{}}}
+	c.EnableRemoteFX()
+	buff := &bytes.Buffer{}
+	if err := struc.Pack(buff, c.clientCapabilities[CAPSETTYPE_BITMAP_CODECS]); err != nil {
+		t.Fatal(err)
+	}
+	b := buff.Bytes()
+	// count, guid, id, properties length and the 49 bytes caps container
+	if len(b) != 1+16+1+2+49 || b[0] != 1 || !bytes.Equal(b[1:17], CODEC_GUID_REMOTEFX[:]) ||
+		b[17] != CODEC_ID_REMOTEFX || b[18] != 49 || b[19] != 0 {
+		t.Errorf("bad bitmap codecs capability %x", b)
+	}
+	if c.clientCapabilities[CAPSETTYPE_SURFACE_COMMANDS] == nil || c.rfx == nil {
+		t.Error("surface commands not enabled")
+	}
+}
+
+func TestEmitNSCodecSurfaceBits(t *testing.T) {
+	c := &Client{PDULayer: &PDULayer{
+		Emitter:            *emission.NewEmitter(),
+		clientCapabilities: map[CapsType]Capability{},
+	}}
+	c.EnableRemoteFX()
+	c.EnableNSCodec()
+	codecs := c.clientCapabilities[CAPSETTYPE_BITMAP_CODECS].(*BitmapCodecsCapability).SupportedBitmapCodecs.Array
+	if len(codecs) != 2 || codecs[0].ID != CODEC_ID_REMOTEFX || codecs[1].ID != CODEC_ID_NSCODEC {
+		t.Fatalf("bad codecs %+v", codecs)
+	}
+
+	// 1x2 stream with raw planes, a black pixel above a white one
+	stream, _ := hex.DecodeString("02000000020000000200000000000000" + "01000000" + "00ff" + "0000" + "0000")
+	var rects []BitmapData
+	c.On("bitmap", func(r []BitmapData) {
+		rects = r
+	})
+	c.emitSurfaceBits([]SurfaceBits{
+		{DestLeft: 3, DestTop: 4, CodecId: CODEC_ID_NSCODEC, Width: 1, Height: 2, BitmapData: stream},
+		{CodecId: 0x7f, Width: 1, Height: 1},
+	})
+	if len(rects) != 1 {
+		t.Fatalf("expect 1 rectangle, get %+v", rects)
+	}
+	r := rects[0]
+	if r.DestLeft != 3 || r.DestBottom != 5 || r.BitsPerPixel != 32 ||
+		hex.EncodeToString(r.Pixels) != "ffffffff000000ff" {
+		t.Errorf("bad rectangle %+v", r)
+	}
+}
+
+type fastPathCapture struct {
+	lock    sync.Mutex
+	secFlag byte
+	data    []byte
+	sent    int
+}
+
+func (f *fastPathCapture) SendFastPath(secFlag byte, data []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.secFlag, f.data = secFlag, data
+	f.sent++
+	return len(data), nil
+}
+
+type transportCapture struct {
+	emission.Emitter
+	data   []byte
+	writes [][]byte
+}
+
+func (t *transportCapture) Read(b []byte) (int, error)    { return 0, nil }
+func (t *transportCapture) Close() error                  { return nil }
+func (t *transportCapture) SetReadTimeout(time.Duration)  {}
+func (t *transportCapture) SetWriteTimeout(time.Duration) {}
+func (t *transportCapture) Write(b []byte) (int, error) {
+	t.data = b
+	t.writes = append(t.writes, b)
+	return len(b), nil
+}
+
+func TestFastPathInput(t *testing.T) {
+	fp := &fastPathCapture{}
+	tr := &transportCapture{Emitter: *emission.NewEmitter()}
+	c := &Client{PDULayer: &PDULayer{
+		transport:          tr,
+		serverCapabilities: map[CapsType]Capability{CAPSTYPE_INPUT: &InputCapability{Flags: INPUT_FLAG_FASTPATH_INPUT}},
+	}}
+	c.SetFastPathSender(fp)
+
+	for _, e := range []struct {
+		send   func() error
+		expect string
+	}{
+		// extended up arrow press then release
+		{func() error { return c.SendScancode(0xe048, true) }, "010248"},
+		{func() error { return c.SendScancode(0xe048, false) }, "010348"},
+		// move to 0x102,0x304
+		{func() error { return c.SendPointer(0x102, 0x304, PTRFLAGS_MOVE) }, "0120000802010403"},
+	} {
+		if err := e.send(); err != nil {
+			t.Fatal(err)
+		}
+		if fp.secFlag != 0 || hex.EncodeToString(fp.data) != e.expect {
+			t.Errorf("get %x, expect %s", fp.data, e.expect)
+		}
+	}
+	if tr.data != nil {
+		t.Error("fast path input went through the slow path")
+	}
+	fastPath := 2 + len(fp.data)
+
+	// the server did not announce fast path input
+	c.serverCapabilities[CAPSTYPE_INPUT] = &InputCapability{Flags: INPUT_FLAG_SCANCODES}
+	fp.data = nil
+	if err := c.SendPointer(0x102, 0x304, PTRFLAGS_MOVE); err != nil {
+		t.Fatal(err)
+	}
+	if fp.data != nil || tr.data == nil {
+		t.Fatal("slow path input not used")
+	}
+	// MCS send data request, x224 data and tpkt headers
+	slowPath := 8 + 3 + 4 + len(tr.data)
+
+	// byte overhead per mouse move, the round trip latency scales with it
+	// on slow links and the fast path skips the share headers
+	t.Logf("mouse move: fast path %d bytes, slow path %d bytes", fastPath, slowPath)
+	if fastPath >= slowPath {
+		t.Errorf("fast path %d bytes not below slow path %d bytes", fastPath, slowPath)
+	}
+}
+
+func TestSendUnicode(t *testing.T) {
+	fp := &fastPathCapture{}
+	tr := &transportCapture{Emitter: *emission.NewEmitter()}
+	c := &Client{PDULayer: &PDULayer{
+		transport:          tr,
+		serverCapabilities: map[CapsType]Capability{CAPSTYPE_INPUT: &InputCapability{Flags: INPUT_FLAG_FASTPATH_INPUT | INPUT_FLAG_UNICODE}},
+	}}
+	c.SetFastPathSender(fp)
+
+	if err := c.SendUnicode('é'); err != nil || hex.EncodeToString(fp.data) != "0280e90081e900" {
+		t.Errorf("get %x, %v", fp.data, err)
+	}
+	// U+1F600 is the surrogate pair d83d de00
+	if err := c.SendUnicode(0x1f600); err != nil || hex.EncodeToString(fp.data) != "04803dd8813dd88000de8100de" {
+		t.Errorf("get %x, %v", fp.data, err)
+	}
+	if err := c.SendUnicode(0xd800); err == nil {
+		t.Error("expect error on lone surrogate")
+	}
+
+	c.serverCapabilities[CAPSTYPE_INPUT] = &InputCapability{Flags: INPUT_FLAG_UNICODE}
+	if err := c.SendUnicode('é'); err != nil || tr.data == nil {
+		t.Fatal("slow path input not used", err)
+	}
+	// two TS_UNICODE_KEYBOARD_EVENT after the share headers
+	if !bytes.HasSuffix(tr.data, []byte{0, 0, 0, 0, 5, 0, 0x00, 0x80, 0xe9, 0, 0, 0}) {
+		t.Errorf("bad slow path events %x", tr.data)
+	}
+
+	c.serverCapabilities[CAPSTYPE_INPUT] = &InputCapability{Flags: INPUT_FLAG_SCANCODES}
+	if err := c.SendUnicode('é'); err == nil {
+		t.Error("expect error without server support")
+	}
+}
+
+func TestSendWheel(t *testing.T) {
+	fp := &fastPathCapture{}
+	c := &Client{PDULayer: &PDULayer{
+		serverCapabilities: map[CapsType]Capability{CAPSTYPE_INPUT: &InputCapability{Flags: INPUT_FLAG_FASTPATH_INPUT}},
+	}}
+	c.SetFastPathSender(fp)
+
+	for _, e := range []struct {
+		delta  int16
+		expect uint16
+	}{
+		{120, PTRFLAGS_WHEEL | 120},
+		{-120, PTRFLAGS_WHEEL | PTRFLAGS_WHEEL_NEGATIVE | 0x88},
+		{1000, PTRFLAGS_WHEEL | 0xff},
+		{-1000, PTRFLAGS_WHEEL | PTRFLAGS_WHEEL_NEGATIVE},
+	} {
+		if err := c.SendWheel(e.delta, false); err != nil {
+			t.Fatal(err)
+		}
+		if flags := uint16(fp.data[2]) | uint16(fp.data[3])<<8; flags != e.expect {
+			t.Errorf("delta %d get flags 0x%x, expect 0x%x", e.delta, flags, e.expect)
+		}
+	}
+
+	if err := c.SendWheel(120, true); err == nil {
+		t.Error("expect error without horizontal wheel support")
+	}
+	c.serverCapabilities[CAPSTYPE_INPUT] = &InputCapability{Flags: INPUT_FLAG_FASTPATH_INPUT | INPUT_FLAG_MOUSE_HWHEEL}
+	if err := c.SendWheel(-120, true); err != nil || fp.data[3] != (PTRFLAGS_HWHEEL|PTRFLAGS_WHEEL_NEGATIVE)>>8 {
+		t.Errorf("get %x, %v", fp.data, err)
+	}
+}
+
+func TestSendExtendedPointer(t *testing.T) {
+	fp := &fastPathCapture{}
+	tr := &transportCapture{Emitter: *emission.NewEmitter()}
+	c := &Client{PDULayer: &PDULayer{
+		transport:          tr,
+		serverCapabilities: map[CapsType]Capability{CAPSTYPE_INPUT: &InputCapability{Flags: INPUT_FLAG_FASTPATH_INPUT | INPUT_FLAG_MOUSEX}},
+	}}
+	c.SetFastPathSender(fp)
+
+	// back button press at 0x102,0x304
+	if err := c.SendExtendedPointer(0x102, 0x304, 1, true); err != nil || hex.EncodeToString(fp.data) != "0140018002010403" {
+		t.Errorf("get %x, %v", fp.data, err)
+	}
+	if err := c.SendExtendedPointer(0, 0, 3, true); err == nil {
+		t.Error("expect error on button 3")
+	}
+
+	c.serverCapabilities[CAPSTYPE_INPUT] = &InputCapability{Flags: INPUT_FLAG_MOUSEX}
+	if err := c.SendExtendedPointer(0x102, 0x304, 2, false); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(tr.data, []byte{0x02, 0x80, 0x02, 0x00, 0x02, 0x01, 0x04, 0x03}) {
+		t.Errorf("bad slow path event %x", tr.data)
+	}
+
+	c.serverCapabilities[CAPSTYPE_INPUT] = &InputCapability{}
+	if err := c.SendExtendedPointer(0, 0, 1, true); err == nil {
+		t.Error("expect error without server support")
+	}
+}
+
+func TestInputBatch(t *testing.T) {
+	fp := &fastPathCapture{}
+	c := &Client{PDULayer: &PDULayer{
+		serverCapabilities: map[CapsType]Capability{CAPSTYPE_INPUT: &InputCapability{Flags: INPUT_FLAG_FASTPATH_INPUT}},
+	}}
+	c.SetFastPathSender(fp)
+
+	c.BeginInputBatch()
+	for i := 0; i < 300; i++ {
+		c.SendPointer(uint16(i), 0, PTRFLAGS_MOVE)
+	}
+	// a full PDU is sent before FlushInput
+	if fp.sent != 1 || fp.data[0] != 255 {
+		t.Fatalf("get %d PDUs of %d events", fp.sent, fp.data[0])
+	}
+	if err := c.FlushInput(); err != nil {
+		t.Fatal(err)
+	}
+	if fp.sent != 2 || fp.data[0] != 45 || len(fp.data) != 1+45*7 {
+		t.Fatalf("get %d PDUs of %d events", fp.sent, fp.data[0])
+	}
+	// the batch is over
+	c.SendScancode(0x1e, true)
+	if fp.sent != 3 || fp.data[0] != 1 {
+		t.Error("event queued after FlushInput")
+	}
+
+	c.SetInputFlushInterval(10 * time.Millisecond)
+	c.BeginInputBatch()
+	c.SendScancode(0x1e, true)
+	c.SendScancode(0x1e, false)
+	time.Sleep(100 * time.Millisecond)
+	fp.lock.Lock()
+	if fp.sent != 4 || fp.data[0] != 2 {
+		t.Errorf("get %d PDUs, events not flushed on the interval", fp.sent)
+	}
+	fp.lock.Unlock()
+	c.FlushInput()
+}
+
+func TestRecvFastPath(t *testing.T) {
+	c := &Client{PDULayer: &PDULayer{Emitter: *emission.NewEmitter()}}
+	var colors []uint32
+	c.On("palette", func(p []uint32) {
+		colors = p
+	})
+	// synchronize, an unsupported orders update, a compressed update,
+	// a pointer position and a single color palette
+	s, _ := hex.DecodeString("030000" + "0002000000" + "81200100ff" + "080400" + "0a001400" +
+		"020b00" + "02000000" + "01000000" + "102030")
+	c.RecvFastPath(0, s)
+	if len(colors) != 1 || colors[0] != 0x102030 {
+		t.Errorf("bad palette %x", colors)
+	}
+}
+
+func TestConfirmCapabilitiesRDP4(t *testing.T) {
+	c := &Client{PDULayer: NewPDULayer(&transportCapture{Emitter: *emission.NewEmitter()})}
+	c.EnableNSCodec()
+	all := len(c.confirmCapabilities())
+
+	c.SetServerCoreData(&gcc.ServerCoreData{RdpVersion: gcc.RDP_VERSION_4})
+	caps := c.confirmCapabilities()
+	for _, v := range caps {
+		if rdp5Capabilities[v.Type()] {
+			t.Errorf("capability 0x%04x sent to RDP 4 server", v.Type())
+		}
+	}
+	if len(caps) != all-4 {
+		t.Error("expect", all-4, "capabilities, get", len(caps))
+	}
+}
+
+func TestRecvDemandActivePDU(t *testing.T) {
+	c := &Client{PDULayer: NewPDULayer(&transportCapture{Emitter: *emission.NewEmitter()}), orders: newOrderDecoder()}
+	c.clientCoreData = gcc.NewClientCoreData()
+	demand := &DemandActivePDU{
+		SharedId:         0x103ea,
+		SourceDescriptor: []byte("RDP"),
+		CapabilitySets: []Capability{
+			&GeneralCapability{ProtocolVersion: 0x0200},
+			&BitmapCapability{PreferredBitsPerPixel: 16, DesktopWidth: 800, DesktopHeight: 600},
+			&InputCapability{Flags: INPUT_FLAG_SCANCODES},
+			&BitmapCacheHostSupportCapability{CacheVersion: BITMAPCACHE_REV2},
+		},
+	}
+	demand.LengthSourceDescriptor = uint16(len(demand.SourceDescriptor))
+	tr := c.transport.(*transportCapture)
+	c.recvDemandActivePDU(NewPDU(1002, demand).serialize())
+
+	if input, ok := c.ServerCapability(CAPSTYPE_INPUT).(*InputCapability); !ok || input.Flags != INPUT_FLAG_SCANCODES {
+		t.Errorf("bad server input capability %+v", c.ServerCapability(CAPSTYPE_INPUT))
+	}
+	if c.ServerCapability(CAPSTYPE_SOUND) != nil {
+		t.Error("unexpected server sound capability")
+	}
+	bitmap := c.clientCapabilities[CAPSTYPE_BITMAP].(*BitmapCapability)
+	if bitmap.DesktopWidth != 800 || bitmap.DesktopHeight != 600 {
+		t.Errorf("confirm active desktop %dx%d, expect the server one", bitmap.DesktopWidth, bitmap.DesktopHeight)
+	}
+
+	// the server hosts revision 2 bitmap caches
+	confirm, err := readPDU(bytes.NewReader(tr.writes[0]), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rev1, rev2 bool
+	for _, capa := range confirm.Message.(*ConfirmActivePDU).CapabilitySets {
+		switch v := capa.(type) {
+		case *BitmapCacheCapability:
+			rev1 = true
+		case *BitmapCacheRev2Capability:
+			rev2 = v.NumCellCaches == 3 && v.BitmapCache2CellInfo == 2048
+		}
+	}
+	if rev1 || !rev2 {
+		t.Error("expect a revision 2 bitmap cache", rev1, rev2)
+	}
+}
+
+func TestRecvErrorInfo(t *testing.T) {
+	c := &Client{PDULayer: NewPDULayer(&transportCapture{Emitter: *emission.NewEmitter()})}
+	var errs []error
+	c.On("error", func(err error) {
+		errs = append(errs, err)
+	})
+	for _, code := range []uint32{0, 0x5, 0xbeef} {
+		c.recvPDU(NewPDU(1002, NewDataPDU(&ErrorInfoDataPDU{ErrorInfo: code}, 0x103ea)).serialize())
+	}
+	if len(errs) != 2 {
+		t.Fatal("expect 2 errors, get", errs)
+	}
+	if errs[0] != ERRINFO_DISCONNECTED_BY_OTHERCONNECTION ||
+		errs[0].Error() != "another user connected to the session (errinfo 0x00000005)" {
+		t.Error("bad error", errs[0])
+	}
+	if errs[1].Error() != "unknown error info 0x0000beef" {
+		t.Error("bad error", errs[1])
+	}
+}
+
+func TestDisableOrders(t *testing.T) {
+	c := &Client{PDULayer: NewPDULayer(&transportCapture{Emitter: *emission.NewEmitter()})}
+	orderCapa := c.clientCapabilities[CAPSTYPE_ORDER].(*OrderCapability)
+	if orderCapa.OrderSupport[TS_NEG_MEMBLT_INDEX] == 0 {
+		t.Fatal("memblt not advertised")
+	}
+	c.DisableOrders()
+	if orderCapa.OrderSupport != [32]byte{} || orderCapa.OrderFlags&NEGOTIATEORDERSUPPORT == 0 {
+		t.Errorf("bad order capability %+v", orderCapa)
+	}
+}
+
+func TestSendRefreshRectAndSuppressOutput(t *testing.T) {
+	tr := &transportCapture{Emitter: *emission.NewEmitter()}
+	c := &Client{PDULayer: &PDULayer{transport: tr}}
+	// share control and share data headers
+	const headers = 6 + 12
+
+	if err := c.SendRefreshRect([]Rect{{0, 0, 99, 49}, {100, 50, 199, 99}}); err != nil {
+		t.Fatal(err)
+	}
+	if tr.data[14] != PDUTYPE2_REFRESH_RECT || hex.EncodeToString(tr.data[headers:]) != "02000000"+"000000006300310064003200c7006300" {
+		t.Errorf("bad refresh rect %x", tr.data)
+	}
+	if err := c.SendRefreshRect(nil); err == nil {
+		t.Error("expect error without area")
+	}
+
+	if err := c.SendSuppressOutput(false, Rect{}); err != nil {
+		t.Fatal(err)
+	}
+	if tr.data[14] != PDUTYPE2_SUPPRESS_OUTPUT || hex.EncodeToString(tr.data[headers:]) != "00000000" {
+		t.Errorf("bad suppress output %x", tr.data)
+	}
+	c.SendSuppressOutput(true, Rect{0, 0, 1279, 799})
+	if hex.EncodeToString(tr.data[headers:]) != "01000000"+"00000000ff041f03" {
+		t.Errorf("bad allow output %x", tr.data)
+	}
+}
+
+// dataPDU wraps the payload of type2 in the share data and control headers
+func dataPDU(type2 uint8, payload []byte) []byte {
+	buff := &bytes.Buffer{}
+	struc.Pack(buff, &ShareControlHeader{uint16(6 + 12 + len(payload)), PDUTYPE_DATAPDU, 1002})
+	struc.Pack(buff, NewShareDataHeader(len(payload), type2, 0x103ea))
+	buff.Write(payload)
+	return buff.Bytes()
+}
+
+func TestRecvSaveSessionInfo(t *testing.T) {
+	c := &Client{PDULayer: NewPDULayer(&transportCapture{Emitter: *emission.NewEmitter()})}
+	type logon struct {
+		id           uint32
+		domain, user string
+	}
+	var (
+		logons []logon
+		cookie []byte
+	)
+	c.On("logon", func(id uint32, domain, user string) {
+		logons = append(logons, logon{id, domain, user})
+	}).On("reconnect-cookie", func(id uint32, random []byte) {
+		cookie = random
+	})
+
+	// logon info version 2
+	v2 := &bytes.Buffer{}
+	core.WriteUInt32LE(INFOTYPE_LOGON_LONG, v2)
+	core.WriteUInt16LE(1, v2)
+	core.WriteUInt32LE(576, v2)
+	core.WriteUInt32LE(7, v2)
+	core.WriteUInt32LE(10, v2)
+	core.WriteUInt32LE(8, v2)
+	v2.Write(make([]byte, 558))
+	v2.Write(core.UnicodeEncode("CORP\x00"))
+	v2.Write(core.UnicodeEncode("bob\x00"))
+	c.recvPDU(dataPDU(PDUTYPE2_SAVE_SESSION_INFO, v2.Bytes()))
+
+	// logon info version 1
+	v1 := &bytes.Buffer{}
+	core.WriteUInt32LE(INFOTYPE_LOGON, v1)
+	core.WriteUInt32LE(4, v1)
+	v1.Write(append(core.UnicodeEncode("W"), make([]byte, 50)...))
+	core.WriteUInt32LE(8, v1)
+	v1.Write(append(core.UnicodeEncode("ann"), make([]byte, 506)...))
+	core.WriteUInt32LE(3, v1)
+	c.recvPDU(dataPDU(PDUTYPE2_SAVE_SESSION_INFO, v1.Bytes()))
+
+	// extended info with a reconnect cookie and logon errors
+	ext := &bytes.Buffer{}
+	core.WriteUInt32LE(INFOTYPE_LOGON_EXTENDED_INFO, ext)
+	core.WriteUInt16LE(6+32+12, ext)
+	core.WriteUInt32LE(LOGON_EX_AUTORECONNECTCOOKIE|LOGON_EX_LOGONERRORS, ext)
+	core.WriteUInt32LE(28, ext)
+	core.WriteUInt32LE(28, ext)
+	core.WriteUInt32LE(1, ext)
+	core.WriteUInt32LE(7, ext)
+	ext.Write(bytes.Repeat([]byte{0xab}, 16))
+	core.WriteUInt32LE(8, ext)
+	core.WriteUInt32LE(0xfffffffe, ext)
+	core.WriteUInt32LE(7, ext)
+	ext.Write(make([]byte, 570))
+	c.recvPDU(dataPDU(PDUTYPE2_SAVE_SESSION_INFO, ext.Bytes()))
+
+	if len(logons) != 2 || logons[0] != (logon{7, "CORP", "bob"}) || logons[1] != (logon{3, "W", "ann"}) {
+		t.Errorf("get logons %+v", logons)
+	}
+	if !bytes.Equal(cookie, bytes.Repeat([]byte{0xab}, 16)) {
+		t.Errorf("bad cookie %x", cookie)
+	}
+}
+
+func TestSkipUnknownPDU(t *testing.T) {
+	tr := &transportCapture{Emitter: *emission.NewEmitter()}
+	c := &Client{PDULayer: NewPDULayer(tr)}
+	var (
+		errs  []error
+		ready bool
+	)
+	c.On("error", func(err error) {
+		errs = append(errs, err)
+	})
+	c.On("ready", func() {
+		ready = true
+	})
+	// the connection sequence goes on past the unknown pdus
+	tr.Once("data", c.recvServerSynchronizePDU)
+	for _, d := range []DataPDUData{
+		NewSynchronizeDataPDU(1002),
+		&ControlDataPDU{Action: CTRLACTION_COOPERATE},
+		&ControlDataPDU{Action: CTRLACTION_GRANTED_CONTROL},
+		&FontMapDataPDU{},
+	} {
+		tr.Emit("data", dataPDU(PDUTYPE2_MONITOR_LAYOUT_PDU, []byte{0, 0, 0, 0}))
+		tr.Emit("data", NewPDU(1002, NewDataPDU(d, 0x103ea)).serialize())
+	}
+	if !ready || len(errs) != 0 {
+		t.Fatal("get", ready, errs)
+	}
+	// the unknown pdus of the session
+	c.recvPDU(dataPDU(0x7e, nil))
+	c.RecvFastPath(0, []byte{0x0d, 0x01, 0x00, 0xff})
+	if len(errs) != 0 {
+		t.Fatal("get", errs)
+	}
+
+	c.SetStrict(true)
+	c.recvPDU(dataPDU(0x7e, nil))
+	c.RecvFastPath(0, []byte{0x0d, 0x01, 0x00, 0xff})
+	var unknown *UnknownPDUError
+	if len(errs) != 2 || !errors.As(errs[0], &unknown) || unknown.Type != 0x7e || errs[1].Error() != "unknown fast path update type 0x0d" {
+		t.Error("get", errs)
+	}
+}
+
+func TestReactivation(t *testing.T) {
+	tr := &transportCapture{Emitter: *emission.NewEmitter()}
+	c := &Client{PDULayer: NewPDULayer(tr)}
+	ready := 0
+	c.On("ready", func() {
+		ready++
+	})
+	// the deactivation-reactivation sequence ends as the connection one
+	for i := 0; i < 2; i++ {
+		tr.Once("data", c.recvServerSynchronizePDU)
+		for _, d := range []DataPDUData{
+			NewSynchronizeDataPDU(1002),
+			&ControlDataPDU{Action: CTRLACTION_COOPERATE},
+			&ControlDataPDU{Action: CTRLACTION_GRANTED_CONTROL},
+			&FontMapDataPDU{},
+		} {
+			tr.Emit("data", NewPDU(1002, NewDataPDU(d, 0x103ea)).serialize())
+		}
+	}
+	if n := tr.GetListenerCount("data"); ready != 2 || n != 1 {
+		t.Error("get", ready, n)
+	}
+}
+
+func TestEnableBitmapCodecs(t *testing.T) {
+	c := &Client{PDULayer: &PDULayer{clientCapabilities: map[CapsType]Capability{}}}
+	c.EnableRemoteFX()
+	if err := c.EnableBitmapCodecs(CODEC_ID_NSCODEC, CODEC_ID_NSCODEC); err != nil {
+		t.Fatal(err)
+	}
+	codecs := c.clientCapabilities[CAPSETTYPE_BITMAP_CODECS].(*BitmapCodecsCapability).SupportedBitmapCodecs.Array
+	if len(codecs) != 1 || codecs[0].ID != CODEC_ID_NSCODEC || c.rfx != nil || !c.nscodec {
+		t.Errorf("bad codecs %+v", codecs)
+	}
+
+	// plain bitmaps
+	if err := c.EnableBitmapCodecs(); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.clientCapabilities) != 0 || c.nscodec {
+		t.Error("get", c.clientCapabilities)
+	}
+	if err := c.EnableBitmapCodecs(CODEC_ID_REMOTEFX, 2); err == nil || err.Error() != "unknown bitmap codec id 2" {
+		t.Error("get", err)
+	}
+}
@@ -0,0 +1,239 @@
+package pdu
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+
+	"github.com/tomatome/grdp/core"
+)
+
+/**
+ * @see MS-RDPBCGR 2.2.9.1.1.4 Server Pointer Update PDU (TS_POINTER_PDU)
+ */
+const (
+	TS_PTRMSGTYPE_SYSTEM   = 0x0001
+	TS_PTRMSGTYPE_POSITION = 0x0003
+	TS_PTRMSGTYPE_COLOR    = 0x0006
+	TS_PTRMSGTYPE_CACHED   = 0x0007
+	TS_PTRMSGTYPE_POINTER  = 0x0008
+)
+
+const (
+	SYSPTR_NULL    = 0x00000000
+	SYSPTR_DEFAULT = 0x00007F00
+)
+
+// color pointer cache size advertised in the pointer capability set
+const pointerCacheSize = 20
+
+// largest pointer side, large pointers included
+const maxPointerSize = 384
+
+/**
+ * Shape of the pointer, masks are bottom up with rows padded to 2 bytes,
+ * AndMask is 1 bpp and XorMask is XorBpp, see RGBA
+ * Hidden and Default are set for the system pointers without masks
+ * @see MS-RDPBCGR 2.2.9.1.1.4.4 Color Pointer Update (TS_COLORPOINTERATTRIBUTE)
+ */
+type PointerShape struct {
+	CacheIndex uint16
+	Hotspot    image.Point
+	Width      uint16
+	Height     uint16
+	XorBpp     uint16
+	AndMask    []byte
+	XorMask    []byte
+	Hidden     bool
+	Default    bool
+}
+
+// PointerUpdate is a pointer update of TS_PTRMSGTYPE_* MessageType
+type PointerUpdate struct {
+	MessageType uint16
+	// position update
+	X, Y uint16
+	// cached pointer update
+	CacheIndex uint16
+	// system, color and new pointer updates
+	Shape *PointerShape
+}
+
+// maskStride returns the bytes of a mask row
+func maskStride(width, bpp uint16) int {
+	return (int(width)*int(bpp) + 15) / 16 * 2
+}
+
+func readColorPointer(xorBpp uint16, r io.Reader) (*PointerShape, error) {
+	p := &PointerShape{XorBpp: xorBpp}
+	var x, y, lengthAndMask, lengthXorMask uint16
+	if err := readUint16s(r, &p.CacheIndex, &x, &y, &p.Width, &p.Height, &lengthAndMask, &lengthXorMask); err != nil {
+		return nil, err
+	}
+	p.Hotspot = image.Pt(int(x), int(y))
+	if p.Width > maxPointerSize || p.Height > maxPointerSize {
+		return nil, errors.New(fmt.Sprintf("invalid pointer size %dx%d", p.Width, p.Height))
+	}
+	if int(lengthXorMask) < maskStride(p.Width, xorBpp)*int(p.Height) {
+		return nil, errors.New(fmt.Sprintf("xor mask of %d bytes too short for %dx%d at %d bpp",
+			lengthXorMask, p.Width, p.Height, xorBpp))
+	}
+	// an empty and mask is allowed with an alpha channel
+	if lengthAndMask != 0 && int(lengthAndMask) < maskStride(p.Width, 1)*int(p.Height) {
+		return nil, errors.New(fmt.Sprintf("and mask of %d bytes too short for %dx%d", lengthAndMask, p.Width, p.Height))
+	}
+	var err error
+	if p.XorMask, err = core.ReadBytes(int(lengthXorMask), r); err != nil {
+		return nil, err
+	}
+	if p.AndMask, err = core.ReadBytes(int(lengthAndMask), r); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// readPointerUpdate reads the pointer attributes of messageType
+func readPointerUpdate(messageType uint16, r io.Reader) (*PointerUpdate, error) {
+	u := &PointerUpdate{MessageType: messageType}
+	var err error
+	switch messageType {
+	case TS_PTRMSGTYPE_SYSTEM:
+		b, err := core.ReadBytes(4, r)
+		if err != nil {
+			return nil, err
+		}
+		switch uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24 {
+		case SYSPTR_NULL:
+			u.Shape = &PointerShape{Hidden: true}
+		case SYSPTR_DEFAULT:
+			u.Shape = &PointerShape{Default: true}
+		default:
+			return nil, errors.New(fmt.Sprintf("unknown system pointer %x", b))
+		}
+	case TS_PTRMSGTYPE_POSITION:
+		err = readUint16s(r, &u.X, &u.Y)
+	case TS_PTRMSGTYPE_CACHED:
+		err = readUint16s(r, &u.CacheIndex)
+	case TS_PTRMSGTYPE_COLOR:
+		u.Shape, err = readColorPointer(24, r)
+	case TS_PTRMSGTYPE_POINTER:
+		// @see MS-RDPBCGR 2.2.9.1.1.4.5 New Pointer Update (TS_POINTERATTRIBUTE)
+		var xorBpp uint16
+		if err = readUint16s(r, &xorBpp); err != nil {
+			return nil, err
+		}
+		u.Shape, err = readColorPointer(xorBpp, r)
+	default:
+		return nil, errors.New(fmt.Sprintf("unknown pointer message type 0x%x", messageType))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+/**
+ * RGBA returns the Width*Height top down pixels of the pointer, screen
+ * pixels inverted by the masks are drawn black
+ * @see MS-RDPBCGR 2.2.9.1.1.4.4 Color Pointer Update (TS_COLORPOINTERATTRIBUTE)
+ */
+func (p *PointerShape) RGBA() ([]byte, error) {
+	switch p.XorBpp {
+	case 1, 16, 24, 32:
+	default:
+		return nil, errors.New(fmt.Sprintf("unsupported pointer bpp %d", p.XorBpp))
+	}
+	w, h := int(p.Width), int(p.Height)
+	xorStride, andStride := maskStride(p.Width, p.XorBpp), maskStride(p.Width, 1)
+	pixels := make([]byte, w*h*4)
+	for y := 0; y < h; y++ {
+		xorRow := p.XorMask[(h-1-y)*xorStride:]
+		for x := 0; x < w; x++ {
+			var r, g, b byte
+			a := byte(0xff)
+			switch p.XorBpp {
+			case 1:
+				if xorRow[x/8]&(0x80>>uint(x%8)) != 0 {
+					r, g, b = 0xff, 0xff, 0xff
+				}
+			case 16:
+				v := uint16(xorRow[x*2]) | uint16(xorRow[x*2+1])<<8
+				r, g, b = byte(v>>11)<<3, byte(v>>5)<<2, byte(v)<<3
+			case 24:
+				b, g, r = xorRow[x*3], xorRow[x*3+1], xorRow[x*3+2]
+			case 32:
+				b, g, r, a = xorRow[x*4], xorRow[x*4+1], xorRow[x*4+2], xorRow[x*4+3]
+			}
+			if len(p.AndMask) != 0 && p.AndMask[(h-1-y)*andStride+x/8]&(0x80>>uint(x%8)) != 0 {
+				if r|g|b == 0 {
+					// transparent
+					a = 0
+				} else {
+					// inverted
+					r, g, b, a = 0, 0, 0, 0xff
+				}
+			}
+			i := (y*w + x) * 4
+			pixels[i], pixels[i+1], pixels[i+2], pixels[i+3] = r, g, b, a
+		}
+	}
+	return pixels, nil
+}
+
+/**
+ * Slow path pointer update
+ * @see MS-RDPBCGR 2.2.9.1.1.4 Server Pointer Update PDU (TS_POINTER_PDU)
+ */
+type PointerPDU struct {
+	Pointer *PointerUpdate
+}
+
+func (p *PointerPDU) Unpack(r io.Reader) error {
+	var messageType, pad uint16
+	if err := readUint16s(r, &messageType, &pad); err != nil {
+		return err
+	}
+	var err error
+	p.Pointer, err = readPointerUpdate(messageType, r)
+	return err
+}
+
+func (*PointerPDU) Type2() uint8 {
+	return PDUTYPE2_POINTER
+}
+
+// message types of the fast path pointer updates
+var fastPathPointerTypes = map[uint8]uint16{
+	FASTPATH_UPDATETYPE_PTR_POSITION: TS_PTRMSGTYPE_POSITION,
+	FASTPATH_UPDATETYPE_COLOR:        TS_PTRMSGTYPE_COLOR,
+	FASTPATH_UPDATETYPE_CACHED:       TS_PTRMSGTYPE_CACHED,
+	FASTPATH_UPDATETYPE_POINTER:      TS_PTRMSGTYPE_POINTER,
+}
+
+/**
+ * Fast path pointer updates, the system pointers have no data
+ * @see MS-RDPBCGR 2.2.9.1.2.1.5 Fast-Path Pointer Position Update
+ */
+type FastPathPointerUpdatePDU struct {
+	Code    uint8
+	Pointer *PointerUpdate
+}
+
+func (f *FastPathPointerUpdatePDU) Unpack(r io.Reader) error {
+	switch f.Code {
+	case FASTPATH_UPDATETYPE_PTR_NULL:
+		f.Pointer = &PointerUpdate{MessageType: TS_PTRMSGTYPE_SYSTEM, Shape: &PointerShape{Hidden: true}}
+		return nil
+	case FASTPATH_UPDATETYPE_PTR_DEFAULT:
+		f.Pointer = &PointerUpdate{MessageType: TS_PTRMSGTYPE_SYSTEM, Shape: &PointerShape{Default: true}}
+		return nil
+	}
+	var err error
+	f.Pointer, err = readPointerUpdate(fastPathPointerTypes[f.Code], r)
+	return err
+}
+
+func (f *FastPathPointerUpdatePDU) FastPathUpdateType() uint8 {
+	return f.Code
+}
@@ -0,0 +1,75 @@
+package pdu
+
+import (
+	"bytes"
+	"encoding/hex"
+	"image"
+	"testing"
+
+	"github.com/tomatome/grdp/emission"
+)
+
+func TestRecvColorPointer(t *testing.T) {
+	c := &Client{PDULayer: &PDULayer{Emitter: *emission.NewEmitter()}}
+	var shapes []PointerShape
+	c.On("pointer", func(p PointerShape) {
+		shapes = append(shapes, p)
+	})
+	var x, y uint16
+	c.On("pointer-position", func(px, py uint16) {
+		x, y = px, py
+	})
+
+	// 2x2 color pointer in slot 1 with hotspot 1,0, bottom up rows of
+	// red and white then white and black, the right column masked
+	color := "0100" + "0100" + "0000" + "0200" + "0200" + "0400" + "0c00" +
+		"0000ff" + "ffffff" + "ffffff" + "000000" + "4000" + "4000"
+	s, _ := hex.DecodeString("091e00" + color + "0a02000100" + "080400" + "0a001400" + "050000")
+	c.RecvFastPath(0, s)
+
+	if len(shapes) != 3 {
+		t.Fatalf("get %d pointers, expect 3", len(shapes))
+	}
+	p := shapes[0]
+	if p.CacheIndex != 1 || p.Hotspot != image.Pt(1, 0) || p.Width != 2 || p.Height != 2 || p.XorBpp != 24 {
+		t.Fatalf("bad pointer %+v", p)
+	}
+	pixels, err := p.RGBA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// white and transparent, then red and the inverted pixel in black
+	if hex.EncodeToString(pixels) != "ffffffff"+"00000000"+"ff0000ff"+"000000ff" {
+		t.Errorf("get %x", pixels)
+	}
+	if !bytes.Equal(shapes[1].XorMask, p.XorMask) {
+		t.Error("cached pointer not replayed")
+	}
+	if !shapes[2].Hidden {
+		t.Error("null pointer not hidden")
+	}
+	if x != 10 || y != 20 {
+		t.Errorf("pointer at %d,%d", x, y)
+	}
+}
+
+func TestReadMonoPointer(t *testing.T) {
+	// new pointer of 1 bpp, 8x1 with white pixels 0 and 1, and mask on pixels 1 and 2
+	b, _ := hex.DecodeString("0800" + "0000" + "0100" + "0200" + "0000" + "0000" + "0800" + "0100" +
+		"0200" + "0200" + "c000" + "6000")
+	p := &PointerPDU{}
+	if err := p.Unpack(bytes.NewReader(b)); err != nil {
+		t.Fatal(err)
+	}
+	if p.Pointer.MessageType != TS_PTRMSGTYPE_POINTER || p.Pointer.Shape.CacheIndex != 2 {
+		t.Fatalf("bad pointer %+v", p.Pointer)
+	}
+	pixels, err := p.Pointer.Shape.RGBA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// white, inverted, transparent and black
+	if hex.EncodeToString(pixels[:16]) != "ffffffff"+"000000ff"+"00000000"+"000000ff" {
+		t.Errorf("get %x", pixels[:16])
+	}
+}
@@ -0,0 +1,509 @@
+package rdpdr
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/tomatome/grdp/core"
+	"github.com/tomatome/grdp/glog"
+)
+
+/**
+ * NTSTATUS values
+ * @see MS-ERREF 2.3.1 NTSTATUS Values
+ */
+const (
+	STATUS_SUCCESS               = 0x00000000
+	STATUS_NO_MORE_FILES         = 0x80000006
+	STATUS_UNSUCCESSFUL          = 0xC0000001
+	STATUS_INVALID_HANDLE        = 0xC0000008
+	STATUS_INVALID_PARAMETER     = 0xC000000D
+	STATUS_NO_SUCH_DEVICE        = 0xC000000E
+	STATUS_NO_SUCH_FILE          = 0xC000000F
+	STATUS_ACCESS_DENIED         = 0xC0000022
+	STATUS_OBJECT_NAME_INVALID   = 0xC0000033
+	STATUS_OBJECT_NAME_NOT_FOUND = 0xC0000034
+	STATUS_MEDIA_WRITE_PROTECTED = 0xC00000A2
+	STATUS_FILE_IS_A_DIRECTORY   = 0xC00000BA
+	STATUS_NOT_SUPPORTED         = 0xC00000BB
+	STATUS_NOT_A_DIRECTORY       = 0xC0000103
+)
+
+/**
+ * @see MS-RDPEFS 2.2.1.4 Device I/O Request (DR_DEVICE_IOREQUEST)
+ */
+const (
+	IRP_MJ_CREATE                   = 0x00000000
+	IRP_MJ_CLOSE                    = 0x00000002
+	IRP_MJ_READ                     = 0x00000003
+	IRP_MJ_WRITE                    = 0x00000004
+	IRP_MJ_QUERY_INFORMATION        = 0x00000005
+	IRP_MJ_SET_INFORMATION          = 0x00000006
+	IRP_MJ_QUERY_VOLUME_INFORMATION = 0x0000000A
+	IRP_MJ_SET_VOLUME_INFORMATION   = 0x0000000B
+	IRP_MJ_DIRECTORY_CONTROL        = 0x0000000C
+	IRP_MJ_DEVICE_CONTROL           = 0x0000000E
+	IRP_MJ_LOCK_CONTROL             = 0x00000011
+)
+
+const (
+	IRP_MN_QUERY_DIRECTORY         = 0x00000001
+	IRP_MN_NOTIFY_CHANGE_DIRECTORY = 0x00000002
+)
+
+// create dispositions and options
+// @see MS-SMB2 2.2.13 SMB2 CREATE Request
+const (
+	FILE_SUPERSEDE    = 0x00000000
+	FILE_OPEN         = 0x00000001
+	FILE_CREATE       = 0x00000002
+	FILE_OPEN_IF      = 0x00000003
+	FILE_OVERWRITE    = 0x00000004
+	FILE_OVERWRITE_IF = 0x00000005
+
+	FILE_DIRECTORY_FILE     = 0x00000001
+	FILE_NON_DIRECTORY_FILE = 0x00000040
+	FILE_DELETE_ON_CLOSE    = 0x00001000
+)
+
+// access mask bits changing a file
+const (
+	FILE_WRITE_DATA  = 0x00000002
+	FILE_APPEND_DATA = 0x00000004
+	DELETE           = 0x00010000
+	GENERIC_ALL      = 0x10000000
+	GENERIC_WRITE    = 0x40000000
+
+	writeAccess = FILE_WRITE_DATA | FILE_APPEND_DATA | DELETE | GENERIC_ALL | GENERIC_WRITE
+)
+
+// information of a create response
+const FILE_OPENED = 0x00000001
+
+const (
+	FILE_ATTRIBUTE_READONLY  = 0x00000001
+	FILE_ATTRIBUTE_DIRECTORY = 0x00000010
+)
+
+/**
+ * File and volume information classes
+ * @see MS-FSCC 2.4 File Information Classes
+ * @see MS-FSCC 2.5 File System Information Classes
+ */
+const (
+	FileDirectoryInformation     = 1
+	FileFullDirectoryInformation = 2
+	FileBothDirectoryInformation = 3
+	FileBasicInformation         = 4
+	FileStandardInformation      = 5
+	FileNamesInformation         = 12
+	FileAttributeTagInformation  = 35
+
+	FileFsVolumeInformation    = 1
+	FileFsSizeInformation      = 3
+	FileFsDeviceInformation    = 4
+	FileFsAttributeInformation = 5
+	FileFsFullSizeInformation  = 7
+)
+
+// volume attributes and device characteristics
+const (
+	FILE_CASE_PRESERVED_NAMES = 0x00000002
+	FILE_UNICODE_ON_DISK      = 0x00000004
+	FILE_READ_ONLY_VOLUME     = 0x00080000
+
+	FILE_DEVICE_DISK      = 0x00000007
+	FILE_READ_ONLY_DEVICE = 0x00000002
+)
+
+// allocation unit reported for the volume and file sizes
+const clusterSize = 4096
+
+// an opened file or directory
+type file struct {
+	path    string
+	info    fs.FileInfo
+	f       fs.File
+	entries []fs.FileInfo
+}
+
+// drive serves a read only fs.FS
+type drive struct {
+	id     uint32
+	name   string
+	fsys   fs.FS
+	files  map[uint32]*file
+	nextId uint32
+}
+
+func newDrive(id uint32, name string, fsys fs.FS) *drive {
+	return &drive{id: id, name: name, fsys: fsys, files: make(map[uint32]*file)}
+}
+
+// process returns the status and data of the completion, no reply for change notifications
+func (d *drive) process(req *ioRequest, r io.Reader) (uint32, []byte, bool) {
+	switch req.MajorFunction {
+	case IRP_MJ_CREATE:
+		status, data := d.create(r)
+		return status, data, true
+	case IRP_MJ_CLOSE:
+		if f, ok := d.files[req.FileId]; ok {
+			if f.f != nil {
+				f.f.Close()
+			}
+			delete(d.files, req.FileId)
+		}
+		return STATUS_SUCCESS, make([]byte, 4), true
+	case IRP_MJ_READ:
+		status, data := d.read(d.files[req.FileId], r)
+		return status, data, true
+	case IRP_MJ_QUERY_INFORMATION:
+		status, data := d.queryInformation(d.files[req.FileId], r)
+		return status, data, true
+	case IRP_MJ_QUERY_VOLUME_INFORMATION:
+		status, data := d.queryVolumeInformation(r)
+		return status, data, true
+	case IRP_MJ_DIRECTORY_CONTROL:
+		if req.MinorFunction == IRP_MN_NOTIFY_CHANGE_DIRECTORY {
+			// nothing changes on a read only drive
+			return 0, nil, false
+		}
+		status, data := d.queryDirectory(d.files[req.FileId], r)
+		return status, data, true
+	case IRP_MJ_WRITE, IRP_MJ_SET_INFORMATION, IRP_MJ_SET_VOLUME_INFORMATION:
+		return STATUS_MEDIA_WRITE_PROTECTED, make([]byte, 5), true
+	case IRP_MJ_DEVICE_CONTROL:
+		return STATUS_NOT_SUPPORTED, make([]byte, 4), true
+	}
+	glog.Debugf("rdpdr unsupported major function 0x%x", req.MajorFunction)
+	return STATUS_NOT_SUPPORTED, make([]byte, 5), true
+}
+
+// fsPath converts a windows path of the drive to an fs.FS path
+func fsPath(p string) (string, bool) {
+	p = strings.Trim(strings.Replace(p, "\\", "/", -1), "/")
+	if p == "" {
+		return ".", true
+	}
+	return p, fs.ValidPath(p)
+}
+
+func readPath(r io.Reader, ln uint32) (string, error) {
+	b, err := core.ReadBytes(int(ln), r)
+	if err != nil {
+		return "", err
+	}
+	u := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		v := uint16(b[i]) | uint16(b[i+1])<<8
+		if v == 0 {
+			break
+		}
+		u = append(u, v)
+	}
+	return string(utf16.Decode(u)), nil
+}
+
+/**
+ * @see MS-RDPEFS 2.2.1.4.1 Device Create Request (DR_CREATE_REQ)
+ * @see MS-RDPEFS 2.2.1.5.1 Device Create Response (DR_CREATE_RSP)
+ */
+func (d *drive) create(r io.Reader) (uint32, []byte) {
+	var access, attributes, shared, disposition, options, pathLength uint32
+	var allocation [2]uint32
+	if err := readUint32s(r, &access, &allocation[0], &allocation[1], &attributes, &shared,
+		&disposition, &options, &pathLength); err != nil {
+		return STATUS_INVALID_PARAMETER, make([]byte, 5)
+	}
+	name, err := readPath(r, pathLength)
+	if err != nil {
+		return STATUS_INVALID_PARAMETER, make([]byte, 5)
+	}
+	p, ok := fsPath(name)
+	if !ok {
+		return STATUS_OBJECT_NAME_INVALID, make([]byte, 5)
+	}
+	info, err := fs.Stat(d.fsys, p)
+	if err != nil {
+		return STATUS_OBJECT_NAME_NOT_FOUND, make([]byte, 5)
+	}
+	if access&writeAccess != 0 || options&FILE_DELETE_ON_CLOSE != 0 ||
+		(disposition != FILE_OPEN && disposition != FILE_OPEN_IF) {
+		return STATUS_ACCESS_DENIED, make([]byte, 5)
+	}
+	if info.IsDir() && options&FILE_NON_DIRECTORY_FILE != 0 {
+		return STATUS_FILE_IS_A_DIRECTORY, make([]byte, 5)
+	}
+	if !info.IsDir() && options&FILE_DIRECTORY_FILE != 0 {
+		return STATUS_NOT_A_DIRECTORY, make([]byte, 5)
+	}
+
+	f := &file{path: p, info: info}
+	if !info.IsDir() {
+		if f.f, err = d.fsys.Open(p); err != nil {
+			return STATUS_ACCESS_DENIED, make([]byte, 5)
+		}
+	}
+	d.nextId++
+	d.files[d.nextId] = f
+
+	buff := &bytes.Buffer{}
+	core.WriteUInt32LE(d.nextId, buff)
+	core.WriteUInt8(FILE_OPENED, buff)
+	return STATUS_SUCCESS, buff.Bytes()
+}
+
+/**
+ * @see MS-RDPEFS 2.2.1.4.3 Device Read Request (DR_READ_REQ)
+ * @see MS-RDPEFS 2.2.1.5.3 Device Read Response (DR_READ_RSP)
+ */
+func (d *drive) read(f *file, r io.Reader) (uint32, []byte) {
+	var length, offsetLow, offsetHigh uint32
+	if err := readUint32s(r, &length, &offsetLow, &offsetHigh); err != nil {
+		return STATUS_INVALID_PARAMETER, make([]byte, 4)
+	}
+	if f == nil {
+		return STATUS_INVALID_HANDLE, make([]byte, 4)
+	}
+	if f.f == nil {
+		return STATUS_FILE_IS_A_DIRECTORY, make([]byte, 4)
+	}
+	offset := int64(offsetHigh)<<32 | int64(offsetLow)
+	if size := f.info.Size(); offset >= size {
+		length = 0
+	} else if int64(length) > size-offset {
+		length = uint32(size - offset)
+	}
+	data := make([]byte, length)
+	var n int
+	var err error
+	switch rf := f.f.(type) {
+	case io.ReaderAt:
+		n, err = rf.ReadAt(data, offset)
+	case io.ReadSeeker:
+		if _, err = rf.Seek(offset, io.SeekStart); err == nil {
+			n, err = io.ReadFull(rf, data)
+		}
+	default:
+		return STATUS_NOT_SUPPORTED, make([]byte, 4)
+	}
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return STATUS_UNSUCCESSFUL, make([]byte, 4)
+	}
+	buff := &bytes.Buffer{}
+	core.WriteUInt32LE(uint32(n), buff)
+	core.WriteBytes(data[:n], buff)
+	return STATUS_SUCCESS, buff.Bytes()
+}
+
+// fileTime converts t to 100ns intervals since 1601
+func fileTime(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+	return uint64(t.UnixNano()/100) + 116444736000000000
+}
+
+func attributes(info fs.FileInfo) uint32 {
+	if info.IsDir() {
+		return FILE_ATTRIBUTE_DIRECTORY | FILE_ATTRIBUTE_READONLY
+	}
+	return FILE_ATTRIBUTE_READONLY
+}
+
+func allocationSize(size int64) uint64 {
+	return uint64((size + clusterSize - 1) / clusterSize * clusterSize)
+}
+
+// writeTimes writes creation, last access, last write and change times, all the modification time
+func writeTimes(info fs.FileInfo, buff *bytes.Buffer) {
+	t := fileTime(info.ModTime())
+	for i := 0; i < 4; i++ {
+		core.WriteUInt32LE(uint32(t), buff)
+		core.WriteUInt32LE(uint32(t>>32), buff)
+	}
+}
+
+func writeUint64(v uint64, buff *bytes.Buffer) {
+	core.WriteUInt32LE(uint32(v), buff)
+	core.WriteUInt32LE(uint32(v>>32), buff)
+}
+
+// withLength prefixes the information buffer with its length
+func withLength(info []byte) []byte {
+	buff := &bytes.Buffer{}
+	core.WriteUInt32LE(uint32(len(info)), buff)
+	core.WriteBytes(info, buff)
+	return buff.Bytes()
+}
+
+/**
+ * @see MS-RDPEFS 2.2.3.3.8 Server Drive Query Information Request (DR_DRIVE_QUERY_INFORMATION_REQ)
+ */
+func (d *drive) queryInformation(f *file, r io.Reader) (uint32, []byte) {
+	var class uint32
+	if err := readUint32s(r, &class); err != nil {
+		return STATUS_INVALID_PARAMETER, make([]byte, 4)
+	}
+	if f == nil {
+		return STATUS_INVALID_HANDLE, make([]byte, 4)
+	}
+	buff := &bytes.Buffer{}
+	switch class {
+	case FileBasicInformation:
+		writeTimes(f.info, buff)
+		core.WriteUInt32LE(attributes(f.info), buff)
+	case FileStandardInformation:
+		writeUint64(allocationSize(f.info.Size()), buff)
+		writeUint64(uint64(f.info.Size()), buff)
+		core.WriteUInt32LE(1, buff) // NumberOfLinks
+		core.WriteUInt8(0, buff)    // DeletePending
+		if f.info.IsDir() {
+			core.WriteUInt8(1, buff)
+		} else {
+			core.WriteUInt8(0, buff)
+		}
+	case FileAttributeTagInformation:
+		core.WriteUInt32LE(attributes(f.info), buff)
+		core.WriteUInt32LE(0, buff) // ReparseTag
+	default:
+		return STATUS_NOT_SUPPORTED, make([]byte, 4)
+	}
+	return STATUS_SUCCESS, withLength(buff.Bytes())
+}
+
+/**
+ * The size of an fs.FS is unknown, the volume is reported full
+ * @see MS-RDPEFS 2.2.3.3.6 Server Drive Query Volume Information Request
+ */
+func (d *drive) queryVolumeInformation(r io.Reader) (uint32, []byte) {
+	var class uint32
+	if err := readUint32s(r, &class); err != nil {
+		return STATUS_INVALID_PARAMETER, make([]byte, 4)
+	}
+	buff := &bytes.Buffer{}
+	switch class {
+	case FileFsVolumeInformation:
+		label := core.UnicodeEncode(d.name)
+		writeUint64(0, buff)           // VolumeCreationTime
+		core.WriteUInt32LE(d.id, buff) // VolumeSerialNumber
+		core.WriteUInt32LE(uint32(len(label)), buff)
+		core.WriteUInt8(0, buff) // SupportsObjects
+		core.WriteBytes(label, buff)
+	case FileFsSizeInformation:
+		writeUint64(0, buff) // TotalAllocationUnits
+		writeUint64(0, buff) // AvailableAllocationUnits
+		core.WriteUInt32LE(clusterSize/512, buff)
+		core.WriteUInt32LE(512, buff)
+	case FileFsFullSizeInformation:
+		writeUint64(0, buff)
+		writeUint64(0, buff)
+		writeUint64(0, buff)
+		core.WriteUInt32LE(clusterSize/512, buff)
+		core.WriteUInt32LE(512, buff)
+	case FileFsAttributeInformation:
+		name := core.UnicodeEncode("FAT32")
+		core.WriteUInt32LE(FILE_CASE_PRESERVED_NAMES|FILE_UNICODE_ON_DISK|FILE_READ_ONLY_VOLUME, buff)
+		core.WriteUInt32LE(255, buff) // MaximumComponentNameLength
+		core.WriteUInt32LE(uint32(len(name)), buff)
+		core.WriteBytes(name, buff)
+	case FileFsDeviceInformation:
+		core.WriteUInt32LE(FILE_DEVICE_DISK, buff)
+		core.WriteUInt32LE(FILE_READ_ONLY_DEVICE, buff)
+	default:
+		return STATUS_NOT_SUPPORTED, make([]byte, 4)
+	}
+	return STATUS_SUCCESS, withLength(buff.Bytes())
+}
+
+/**
+ * One entry is returned per request, the initial query gives the pattern
+ * @see MS-RDPEFS 2.2.3.3.10 Server Drive Query Directory Request (DR_DRIVE_QUERY_DIRECTORY_REQ)
+ * @see MS-RDPEFS 2.2.3.4.10 Client Drive Query Directory Response (DR_DRIVE_QUERY_DIRECTORY_RSP)
+ */
+func (d *drive) queryDirectory(f *file, r io.Reader) (uint32, []byte) {
+	var class, pathLength uint32
+	if err := readUint32s(r, &class); err != nil {
+		return STATUS_INVALID_PARAMETER, make([]byte, 5)
+	}
+	b, err := core.ReadBytes(1, r)
+	if err != nil {
+		return STATUS_INVALID_PARAMETER, make([]byte, 5)
+	}
+	initial := b[0] != 0
+	if err = readUint32s(r, &pathLength); err != nil {
+		return STATUS_INVALID_PARAMETER, make([]byte, 5)
+	}
+	if _, err = core.ReadBytes(23, r); err != nil {
+		return STATUS_INVALID_PARAMETER, make([]byte, 5)
+	}
+	if f == nil {
+		return STATUS_INVALID_HANDLE, make([]byte, 5)
+	}
+	if !f.info.IsDir() {
+		return STATUS_NOT_A_DIRECTORY, make([]byte, 5)
+	}
+
+	if initial {
+		name, err := readPath(r, pathLength)
+		if err != nil {
+			return STATUS_INVALID_PARAMETER, make([]byte, 5)
+		}
+		pattern := "*"
+		if i := strings.LastIndex(name, "\\"); i >= 0 {
+			pattern = name[i+1:]
+		}
+		entries, err := fs.ReadDir(d.fsys, f.path)
+		if err != nil {
+			return STATUS_NO_SUCH_FILE, make([]byte, 5)
+		}
+		f.entries = f.entries[:0]
+		for _, e := range entries {
+			if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(e.Name())); !ok {
+				continue
+			}
+			if info, err := e.Info(); err == nil {
+				f.entries = append(f.entries, info)
+			}
+		}
+		if len(f.entries) == 0 {
+			return STATUS_NO_SUCH_FILE, make([]byte, 5)
+		}
+	}
+	if len(f.entries) == 0 {
+		return STATUS_NO_MORE_FILES, make([]byte, 5)
+	}
+	info := f.entries[0]
+	f.entries = f.entries[1:]
+
+	name := core.UnicodeEncode(info.Name())
+	buff := &bytes.Buffer{}
+	core.WriteUInt32LE(0, buff) // NextEntryOffset
+	core.WriteUInt32LE(0, buff) // FileIndex
+	switch class {
+	case FileDirectoryInformation, FileFullDirectoryInformation, FileBothDirectoryInformation:
+		writeTimes(info, buff)
+		writeUint64(uint64(info.Size()), buff)
+		writeUint64(allocationSize(info.Size()), buff)
+		core.WriteUInt32LE(attributes(info), buff)
+		core.WriteUInt32LE(uint32(len(name)), buff)
+		if class != FileDirectoryInformation {
+			core.WriteUInt32LE(0, buff) // EaSize
+		}
+		if class == FileBothDirectoryInformation {
+			// ShortNameLength, Reserved and ShortName
+			core.WriteBytes(make([]byte, 26), buff)
+		}
+	case FileNamesInformation:
+		core.WriteUInt32LE(uint32(len(name)), buff)
+	default:
+		return STATUS_NOT_SUPPORTED, make([]byte, 5)
+	}
+	core.WriteBytes(name, buff)
+	return STATUS_SUCCESS, withLength(buff.Bytes())
+}
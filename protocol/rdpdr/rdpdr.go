@@ -0,0 +1,329 @@
+// Package rdpdr redirects read only drives over the rdpdr static virtual channel
+package rdpdr
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sync"
+
+	"github.com/tomatome/grdp/core"
+	"github.com/tomatome/grdp/glog"
+	"github.com/tomatome/grdp/plugin"
+)
+
+/**
+ * @see MS-RDPEFS 2.2.1.1 Shared Header (RDPDR_HEADER)
+ */
+const (
+	RDPDR_CTYP_CORE = 0x4472
+	RDPDR_CTYP_PRN  = 0x5052
+)
+
+const (
+	PAKID_CORE_SERVER_ANNOUNCE     = 0x496E
+	PAKID_CORE_CLIENTID_CONFIRM    = 0x4343
+	PAKID_CORE_CLIENT_NAME         = 0x434E
+	PAKID_CORE_DEVICELIST_ANNOUNCE = 0x4441
+	PAKID_CORE_DEVICE_REPLY        = 0x6472
+	PAKID_CORE_DEVICE_IOREQUEST    = 0x4952
+	PAKID_CORE_DEVICE_IOCOMPLETION = 0x4943
+	PAKID_CORE_SERVER_CAPABILITY   = 0x5350
+	PAKID_CORE_CLIENT_CAPABILITY   = 0x4350
+	PAKID_CORE_DEVICELIST_REMOVE   = 0x444D
+	PAKID_CORE_USER_LOGGEDON       = 0x554C
+)
+
+/**
+ * @see MS-RDPEFS 2.2.1.2 Capability Header (CAPABILITY_HEADER)
+ */
+const (
+	CAP_GENERAL_TYPE   = 0x0001
+	CAP_PRINTER_TYPE   = 0x0002
+	CAP_PORT_TYPE      = 0x0003
+	CAP_DRIVE_TYPE     = 0x0004
+	CAP_SMARTCARD_TYPE = 0x0005
+)
+
+const (
+	GENERAL_CAPABILITY_VERSION_02 = 0x00000002
+	DRIVE_CAPABILITY_VERSION_02   = 0x00000002
+)
+
+// extendedPDU of the general capability set
+const (
+	RDPDR_DEVICE_REMOVE_PDUS      = 0x00000001
+	RDPDR_CLIENT_DISPLAY_NAME_PDU = 0x00000002
+	RDPDR_USER_LOGGEDON_PDU       = 0x00000004
+)
+
+const (
+	RDPDR_DTYP_SERIAL     = 0x00000001
+	RDPDR_DTYP_PARALLEL   = 0x00000002
+	RDPDR_DTYP_PRINT      = 0x00000004
+	RDPDR_DTYP_FILESYSTEM = 0x00000008
+	RDPDR_DTYP_SMARTCARD  = 0x00000020
+)
+
+// highest protocol version implemented
+const (
+	versionMajor = 0x0001
+	versionMinor = 0x000C
+)
+
+// readUint32s reads little endian values
+func readUint32s(r io.Reader, values ...*uint32) error {
+	for _, v := range values {
+		b, err := core.ReadBytes(4, r)
+		if err != nil {
+			return err
+		}
+		*v = uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+	}
+	return nil
+}
+
+func header(packetId uint16, buff *bytes.Buffer) {
+	core.WriteUInt16LE(RDPDR_CTYP_CORE, buff)
+	core.WriteUInt16LE(packetId, buff)
+}
+
+/**
+ * Client of the rdpdr channel announcing file system devices
+ * @see MS-RDPEFS 1.3.1 Protocol Initialization
+ */
+type Client struct {
+	conn         *plugin.ChannelConn
+	computerName string
+
+	lock        sync.Mutex
+	drives      []*drive
+	clientId    uint32
+	serverMinor uint16
+}
+
+// New returns a client of an opened rdpdr channel stream, see Run
+func New(rw io.ReadWriteCloser, computerName string) *Client {
+	return &Client{
+		conn:         plugin.NewChannelConn(rw, 0),
+		computerName: computerName,
+	}
+}
+
+// AddDrive shares fsys as a read only drive shown as name, before Run
+func (c *Client) AddDrive(name string, fsys fs.FS) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.drives = append(c.drives, newDrive(uint32(len(c.drives)+1), name, fsys))
+}
+
+// Run processes the channel until it is closed
+func (c *Client) Run() error {
+	for {
+		msg, err := c.conn.ReadMessage()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = c.process(msg); err != nil {
+			glog.Warn("rdpdr:", err)
+		}
+	}
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Client) process(msg []byte) error {
+	if len(msg) < 4 {
+		return errors.New("message shorter than its header")
+	}
+	component := uint16(msg[0]) | uint16(msg[1])<<8
+	packetId := uint16(msg[2]) | uint16(msg[3])<<8
+	if component != RDPDR_CTYP_CORE {
+		return errors.New(fmt.Sprintf("unknown component 0x%x", component))
+	}
+	r := bytes.NewReader(msg[4:])
+	glog.Debugf("rdpdr packet 0x%x", packetId)
+	switch packetId {
+	case PAKID_CORE_SERVER_ANNOUNCE:
+		return c.recvServerAnnounce(r)
+	case PAKID_CORE_SERVER_CAPABILITY:
+		return c.sendCapabilities()
+	case PAKID_CORE_CLIENTID_CONFIRM:
+		// version 1.5 servers never send the logged on PDU
+		c.lock.Lock()
+		minor := c.serverMinor
+		c.lock.Unlock()
+		if minor == 0x0005 {
+			return c.sendDeviceList()
+		}
+		return nil
+	case PAKID_CORE_USER_LOGGEDON:
+		return c.sendDeviceList()
+	case PAKID_CORE_DEVICE_REPLY:
+		var deviceId, result uint32
+		if err := readUint32s(r, &deviceId, &result); err != nil {
+			return err
+		}
+		if result != STATUS_SUCCESS {
+			glog.Warn(fmt.Sprintf("rdpdr device %d refused 0x%x", deviceId, result))
+		}
+		return nil
+	case PAKID_CORE_DEVICE_IOREQUEST:
+		return c.recvIORequest(r)
+	}
+	return errors.New(fmt.Sprintf("unknown packet 0x%x", packetId))
+}
+
+/**
+ * Reply to the server announce then send the client name
+ * @see MS-RDPEFS 2.2.2.3 Client Announce Reply (DR_CORE_CLIENT_ANNOUNCE_RSP)
+ * @see MS-RDPEFS 2.2.2.4 Client Name Request (DR_CORE_CLIENT_NAME_REQ)
+ */
+func (c *Client) recvServerAnnounce(r io.Reader) error {
+	b, err := core.ReadBytes(4, r)
+	if err != nil {
+		return err
+	}
+	minor := uint16(b[2]) | uint16(b[3])<<8
+	if minor > versionMinor {
+		minor = versionMinor
+	}
+	var clientId uint32
+	if err = readUint32s(r, &clientId); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	c.clientId, c.serverMinor = clientId, minor
+	c.lock.Unlock()
+
+	buff := &bytes.Buffer{}
+	header(PAKID_CORE_CLIENTID_CONFIRM, buff)
+	core.WriteUInt16LE(versionMajor, buff)
+	core.WriteUInt16LE(minor, buff)
+	core.WriteUInt32LE(clientId, buff)
+	if err = c.conn.WriteMessage(buff.Bytes()); err != nil {
+		return err
+	}
+
+	name := core.UnicodeEncode(c.computerName + "\x00")
+	buff = &bytes.Buffer{}
+	header(PAKID_CORE_CLIENT_NAME, buff)
+	// unicode name, code page 0
+	core.WriteUInt32LE(1, buff)
+	core.WriteUInt32LE(0, buff)
+	core.WriteUInt32LE(uint32(len(name)), buff)
+	core.WriteBytes(name, buff)
+	return c.conn.WriteMessage(buff.Bytes())
+}
+
+/**
+ * @see MS-RDPEFS 2.2.2.8 Client Core Capability Response (DR_CORE_CAPABILITY_RSP)
+ */
+func (c *Client) sendCapabilities() error {
+	buff := &bytes.Buffer{}
+	header(PAKID_CORE_CLIENT_CAPABILITY, buff)
+	core.WriteUInt16LE(2, buff)
+	core.WriteUInt16LE(0, buff)
+
+	// GENERAL_CAPS_SET
+	core.WriteUInt16LE(CAP_GENERAL_TYPE, buff)
+	core.WriteUInt16LE(44, buff)
+	core.WriteUInt32LE(GENERAL_CAPABILITY_VERSION_02, buff)
+	core.WriteUInt32LE(0, buff) // osType
+	core.WriteUInt32LE(0, buff) // osVersion
+	core.WriteUInt16LE(versionMajor, buff)
+	core.WriteUInt16LE(versionMinor, buff)
+	core.WriteUInt32LE(0xffff, buff) // ioCode1, all the IRPs
+	core.WriteUInt32LE(0, buff)      // ioCode2
+	core.WriteUInt32LE(RDPDR_DEVICE_REMOVE_PDUS|RDPDR_CLIENT_DISPLAY_NAME_PDU|RDPDR_USER_LOGGEDON_PDU, buff)
+	core.WriteUInt32LE(0, buff) // extraFlags1
+	core.WriteUInt32LE(0, buff) // extraFlags2
+	core.WriteUInt32LE(0, buff) // SpecialTypeDeviceCap
+
+	// DRIVE_CAPS_SET
+	core.WriteUInt16LE(CAP_DRIVE_TYPE, buff)
+	core.WriteUInt16LE(8, buff)
+	core.WriteUInt32LE(DRIVE_CAPABILITY_VERSION_02, buff)
+	return c.conn.WriteMessage(buff.Bytes())
+}
+
+/**
+ * Drives are announced once the user is logged on, or on client id
+ * confirm for version 1.5 servers
+ * @see MS-RDPEFS 2.2.2.9 Client Device List Announce Request (DR_CORE_DEVICELIST_ANNOUNCE_REQ)
+ */
+func (c *Client) sendDeviceList() error {
+	c.lock.Lock()
+	drives := c.drives
+	c.lock.Unlock()
+	buff := &bytes.Buffer{}
+	header(PAKID_CORE_DEVICELIST_ANNOUNCE, buff)
+	core.WriteUInt32LE(uint32(len(drives)), buff)
+	for _, d := range drives {
+		core.WriteUInt32LE(RDPDR_DTYP_FILESYSTEM, buff)
+		core.WriteUInt32LE(d.id, buff)
+		// PreferredDosName, 7 ascii characters and a null
+		dosName := make([]byte, 8)
+		copy(dosName[:7], d.name)
+		core.WriteBytes(dosName, buff)
+		// display name
+		name := core.UnicodeEncode(d.name + "\x00")
+		core.WriteUInt32LE(uint32(len(name)), buff)
+		core.WriteBytes(name, buff)
+	}
+	return c.conn.WriteMessage(buff.Bytes())
+}
+
+/**
+ * @see MS-RDPEFS 2.2.1.4 Device I/O Request (DR_DEVICE_IOREQUEST)
+ */
+type ioRequest struct {
+	DeviceId      uint32
+	FileId        uint32
+	CompletionId  uint32
+	MajorFunction uint32
+	MinorFunction uint32
+}
+
+func (c *Client) recvIORequest(r io.Reader) error {
+	req := &ioRequest{}
+	if err := readUint32s(r, &req.DeviceId, &req.FileId, &req.CompletionId, &req.MajorFunction, &req.MinorFunction); err != nil {
+		return err
+	}
+	var d *drive
+	c.lock.Lock()
+	for _, v := range c.drives {
+		if v.id == req.DeviceId {
+			d = v
+		}
+	}
+	c.lock.Unlock()
+	if d == nil {
+		return c.sendIOCompletion(req, STATUS_NO_SUCH_DEVICE, make([]byte, 4))
+	}
+	status, data, reply := d.process(req, r)
+	if !reply {
+		return nil
+	}
+	return c.sendIOCompletion(req, status, data)
+}
+
+/**
+ * @see MS-RDPEFS 2.2.1.5 Device I/O Response (DR_DEVICE_IOCOMPLETION)
+ */
+func (c *Client) sendIOCompletion(req *ioRequest, status uint32, data []byte) error {
+	buff := &bytes.Buffer{}
+	header(PAKID_CORE_DEVICE_IOCOMPLETION, buff)
+	core.WriteUInt32LE(req.DeviceId, buff)
+	core.WriteUInt32LE(req.CompletionId, buff)
+	core.WriteUInt32LE(status, buff)
+	core.WriteBytes(data, buff)
+	return c.conn.WriteMessage(buff.Bytes())
+}
@@ -0,0 +1,181 @@
+package rdpdr
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/tomatome/grdp/core"
+	"github.com/tomatome/grdp/glog"
+	"github.com/tomatome/grdp/plugin"
+)
+
+func init() {
+	glog.SetLevel(glog.NONE)
+}
+
+func expect(t *testing.T, server *plugin.ChannelConn, msg string) {
+	t.Helper()
+	b, err := server.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(b) != msg {
+		t.Fatalf("get %x, expect %s", b, msg)
+	}
+}
+
+func send(t *testing.T, server *plugin.ChannelConn, packetId uint16, body []byte) {
+	t.Helper()
+	buff := &bytes.Buffer{}
+	header(packetId, buff)
+	buff.Write(body)
+	if err := server.WriteMessage(buff.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// request sends an I/O request to device 1 and returns the status and data of its completion
+func request(t *testing.T, server *plugin.ChannelConn, fileId, major, minor uint32, body []byte) (uint32, []byte) {
+	t.Helper()
+	buff := &bytes.Buffer{}
+	for _, v := range []uint32{1, fileId, 9, major, minor} {
+		core.WriteUInt32LE(v, buff)
+	}
+	buff.Write(body)
+	send(t, server, PAKID_CORE_DEVICE_IOREQUEST, buff.Bytes())
+
+	b, err := server.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var deviceId, completionId, status uint32
+	r := bytes.NewReader(b[4:])
+	if err = readUint32s(r, &deviceId, &completionId, &status); err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(b[:4]) != "72444349" || deviceId != 1 || completionId != 9 {
+		t.Fatalf("invalid completion %x", b)
+	}
+	return status, b[16:]
+}
+
+func createRequest(access, options uint32, name string) []byte {
+	p := core.UnicodeEncode(name + "\x00")
+	buff := &bytes.Buffer{}
+	for _, v := range []uint32{access, 0, 0, 0, 0, FILE_OPEN, options, uint32(len(p))} {
+		core.WriteUInt32LE(v, buff)
+	}
+	buff.Write(p)
+	return buff.Bytes()
+}
+
+func TestDrive(t *testing.T) {
+	client, conn := net.Pipe()
+	defer conn.Close()
+	server := plugin.NewChannelConn(conn, 0)
+	c := New(client, "pc")
+	c.AddDrive("share", fstest.MapFS{
+		"docs/a.txt": {Data: []byte("hello")},
+		"docs/b.txt": {Data: []byte("world")},
+	})
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Run()
+	}()
+
+	send(t, server, PAKID_CORE_SERVER_ANNOUNCE, []byte{1, 0, 0x0d, 0, 7, 0, 0, 0})
+	expect(t, server, "72444343"+"01000c00"+"07000000")
+	expect(t, server, "72444e43"+"01000000"+"00000000"+"06000000"+"700063000000")
+	send(t, server, PAKID_CORE_SERVER_CAPABILITY, []byte{0, 0, 0, 0})
+	b, err := server.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != 60 || hex.EncodeToString(b[:8]) != "7244504302000000" {
+		t.Fatalf("invalid capabilities %x", b)
+	}
+	send(t, server, PAKID_CORE_USER_LOGGEDON, nil)
+	expect(t, server, "72444144"+"01000000"+"08000000"+"01000000"+"7368617265000000"+
+		"0c000000"+hex.EncodeToString(core.UnicodeEncode("share\x00")))
+
+	status, data := request(t, server, 0, IRP_MJ_CREATE, 0, createRequest(0x80000000, FILE_NON_DIRECTORY_FILE, "\\docs\\a.txt"))
+	if status != STATUS_SUCCESS || hex.EncodeToString(data) != "0100000001" {
+		t.Fatalf("create status 0x%x data %x", status, data)
+	}
+	read := []byte{100, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0}
+	status, data = request(t, server, 1, IRP_MJ_READ, 0, append(read, make([]byte, 20)...))
+	if status != STATUS_SUCCESS || hex.EncodeToString(data) != "03000000"+hex.EncodeToString([]byte("llo")) {
+		t.Fatalf("read status 0x%x data %x", status, data)
+	}
+	status, data = request(t, server, 1, IRP_MJ_QUERY_INFORMATION, 0, []byte{FileStandardInformation, 0, 0, 0, 0, 0, 0, 0})
+	if status != STATUS_SUCCESS || hex.EncodeToString(data) != "16000000"+"0010000000000000"+"0500000000000000"+"01000000"+"0000" {
+		t.Fatalf("query information status 0x%x data %x", status, data)
+	}
+	status, _ = request(t, server, 1, IRP_MJ_WRITE, 0, make([]byte, 32))
+	if status != STATUS_MEDIA_WRITE_PROTECTED {
+		t.Fatalf("write status 0x%x", status)
+	}
+	status, data = request(t, server, 1, IRP_MJ_CLOSE, 0, make([]byte, 32))
+	if status != STATUS_SUCCESS || len(data) != 4 {
+		t.Fatalf("close status 0x%x data %x", status, data)
+	}
+	status, _ = request(t, server, 1, IRP_MJ_READ, 0, append(read, make([]byte, 20)...))
+	if status != STATUS_INVALID_HANDLE {
+		t.Fatalf("read of closed file status 0x%x", status)
+	}
+
+	// write access and missing files are refused
+	status, _ = request(t, server, 0, IRP_MJ_CREATE, 0, createRequest(GENERIC_WRITE, 0, "\\docs\\a.txt"))
+	if status != STATUS_ACCESS_DENIED {
+		t.Fatalf("create for write status 0x%x", status)
+	}
+	status, _ = request(t, server, 0, IRP_MJ_CREATE, 0, createRequest(0x80000000, 0, "\\docs\\c.txt"))
+	if status != STATUS_OBJECT_NAME_NOT_FOUND {
+		t.Fatalf("create of missing file status 0x%x", status)
+	}
+
+	status, data = request(t, server, 0, IRP_MJ_CREATE, 0, createRequest(0x80000000, FILE_DIRECTORY_FILE, "\\docs"))
+	if status != STATUS_SUCCESS || hex.EncodeToString(data) != "0200000001" {
+		t.Fatalf("create directory status 0x%x data %x", status, data)
+	}
+	pattern := core.UnicodeEncode("\\docs\\*.txt\x00")
+	query := func(initial byte) (uint32, []byte) {
+		buff := &bytes.Buffer{}
+		core.WriteUInt32LE(FileNamesInformation, buff)
+		core.WriteUInt8(initial, buff)
+		if initial == 0 {
+			core.WriteUInt32LE(0, buff)
+			buff.Write(make([]byte, 23))
+		} else {
+			core.WriteUInt32LE(uint32(len(pattern)), buff)
+			buff.Write(make([]byte, 23))
+			buff.Write(pattern)
+		}
+		return request(t, server, 2, IRP_MJ_DIRECTORY_CONTROL, IRP_MN_QUERY_DIRECTORY, buff.Bytes())
+	}
+	for i, name := range []string{"a.txt", "b.txt"} {
+		status, data = query(byte(1 - i))
+		n := core.UnicodeEncode(name)
+		if status != STATUS_SUCCESS || hex.EncodeToString(data) != "16000000"+"0000000000000000"+"0a000000"+hex.EncodeToString(n) {
+			t.Fatalf("query directory %d status 0x%x data %x", i, status, data)
+		}
+	}
+	status, data = query(0)
+	if status != STATUS_NO_MORE_FILES || len(data) != 5 {
+		t.Fatalf("end of directory status 0x%x data %x", status, data)
+	}
+
+	conn.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("run not stopped by close")
+	}
+}
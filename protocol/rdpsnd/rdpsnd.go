@@ -0,0 +1,315 @@
+// Package rdpsnd receives the audio output of the server over the rdpsnd
+// static virtual channel
+package rdpsnd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/tomatome/grdp/core"
+	"github.com/tomatome/grdp/glog"
+	"github.com/tomatome/grdp/plugin"
+)
+
+/**
+ * @see MS-RDPEA 2.2.1 RDPSND PDU Header (SNDPROLOG)
+ */
+const (
+	SNDC_CLOSE       = 0x01
+	SNDC_WAVE        = 0x02
+	SNDC_SETVOLUME   = 0x03
+	SNDC_SETPITCH    = 0x04
+	SNDC_WAVECONFIRM = 0x05
+	SNDC_TRAINING    = 0x06
+	SNDC_FORMATS     = 0x07
+	SNDC_CRYPTKEY    = 0x08
+	SNDC_WAVEENCRYPT = 0x09
+	SNDC_UDPWAVE     = 0x0A
+	SNDC_UDPWAVELAST = 0x0B
+	SNDC_QUALITYMODE = 0x0C
+	SNDC_WAVE2       = 0x0D
+)
+
+/**
+ * @see MS-RDPEA 2.2.2.2 Client Audio Formats and Version PDU (CLIENT_AUDIO_VERSION_AND_FORMATS)
+ */
+const (
+	TSSNDCAPS_ALIVE  = 0x00000001
+	TSSNDCAPS_VOLUME = 0x00000002
+	TSSNDCAPS_PITCH  = 0x00000004
+)
+
+const HIGH_QUALITY = 0x0002
+
+// highest protocol version implemented, wave2 PDUs come from version 8
+const version = 0x0008
+
+// WAVE_FORMAT_PCM is the only format tag decoded
+// @see RFC 2361 Appendix A
+const WAVE_FORMAT_PCM = 0x0001
+
+/**
+ * @see MS-RDPEA 2.2.2.1.1 Audio Format (AUDIO_FORMAT)
+ */
+type AudioFormat struct {
+	FormatTag      uint16
+	Channels       uint16
+	SamplesPerSec  uint32
+	AvgBytesPerSec uint32
+	BlockAlign     uint16
+	BitsPerSample  uint16
+	Data           []byte
+}
+
+func readFormat(r io.Reader) (*AudioFormat, error) {
+	b, err := core.ReadBytes(18, r)
+	if err != nil {
+		return nil, err
+	}
+	f := &AudioFormat{
+		FormatTag:      uint16(b[0]) | uint16(b[1])<<8,
+		Channels:       uint16(b[2]) | uint16(b[3])<<8,
+		SamplesPerSec:  uint32(b[4]) | uint32(b[5])<<8 | uint32(b[6])<<16 | uint32(b[7])<<24,
+		AvgBytesPerSec: uint32(b[8]) | uint32(b[9])<<8 | uint32(b[10])<<16 | uint32(b[11])<<24,
+		BlockAlign:     uint16(b[12]) | uint16(b[13])<<8,
+		BitsPerSample:  uint16(b[14]) | uint16(b[15])<<8,
+	}
+	if f.Data, err = core.ReadBytes(int(b[16])|int(b[17])<<8, r); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *AudioFormat) Serialize() []byte {
+	buff := &bytes.Buffer{}
+	core.WriteUInt16LE(f.FormatTag, buff)
+	core.WriteUInt16LE(f.Channels, buff)
+	core.WriteUInt32LE(f.SamplesPerSec, buff)
+	core.WriteUInt32LE(f.AvgBytesPerSec, buff)
+	core.WriteUInt16LE(f.BlockAlign, buff)
+	core.WriteUInt16LE(f.BitsPerSample, buff)
+	core.WriteUInt16LE(uint16(len(f.Data)), buff)
+	core.WriteBytes(f.Data, buff)
+	return buff.Bytes()
+}
+
+func pdu(msgType uint8, body []byte) []byte {
+	buff := &bytes.Buffer{}
+	core.WriteUInt8(msgType, buff)
+	core.WriteUInt8(0, buff)
+	core.WriteUInt16LE(uint16(len(body)), buff)
+	core.WriteBytes(body, buff)
+	return buff.Bytes()
+}
+
+// wave info waiting for its wave PDU
+type wave struct {
+	timeStamp uint16
+	formatNo  uint16
+	blockNo   uint8
+	data      []byte
+	size      int
+	received  time.Time
+}
+
+/**
+ * Client of the audio output channel, only formats of WAVE_FORMAT_PCM are
+ * negotiated so waves are delivered as they come
+ * @see MS-RDPEA 1.3.2.1 Initialization Sequence
+ */
+type Client struct {
+	conn *plugin.ChannelConn
+
+	lock    sync.Mutex
+	formats []AudioFormat
+	pending *wave
+	onAudio func(AudioFormat, []byte)
+}
+
+// New returns a client of an opened rdpsnd channel stream, see Run
+func New(rw io.ReadWriteCloser) *Client {
+	return &Client{
+		conn: plugin.NewChannelConn(rw, plugin.CHANNEL_OPTION_SHOW_PROTOCOL),
+	}
+}
+
+// OnAudio sets the callback receiving the PCM samples played on the server,
+// it runs on the channel goroutine and delays the wave confirm
+func (c *Client) OnAudio(f func(format AudioFormat, pcm []byte)) {
+	c.lock.Lock()
+	c.onAudio = f
+	c.lock.Unlock()
+}
+
+// Run processes the channel until it is closed
+func (c *Client) Run() error {
+	for {
+		msg, err := c.conn.ReadMessage()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = c.process(msg); err != nil {
+			glog.Warn("rdpsnd:", err)
+		}
+	}
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Client) process(msg []byte) error {
+	c.lock.Lock()
+	w := c.pending
+	c.pending = nil
+	c.lock.Unlock()
+	if w != nil {
+		// the wave PDU, its first 4 bytes are in the wave info
+		if len(msg) < 4 || len(msg) != w.size-len(w.data)+4 {
+			return errors.New(fmt.Sprintf("wave of %d bytes, expect %d", len(msg), w.size-len(w.data)+4))
+		}
+		w.data = append(w.data, msg[4:]...)
+		return c.play(w)
+	}
+
+	if len(msg) < 4 {
+		return errors.New("message shorter than its header")
+	}
+	msgType := msg[0]
+	bodySize := int(msg[2]) | int(msg[3])<<8
+	r := bytes.NewReader(msg[4:])
+	glog.Debugf("rdpsnd message 0x%x size %d", msgType, bodySize)
+	switch msgType {
+	case SNDC_FORMATS:
+		return c.recvFormats(r)
+	case SNDC_TRAINING:
+		b, err := core.ReadBytes(4, r)
+		if err != nil {
+			return err
+		}
+		// confirm with the same time stamp and pack size
+		return c.conn.WriteMessage(pdu(SNDC_TRAINING, b))
+	case SNDC_WAVE:
+		b, err := core.ReadBytes(12, r)
+		if err != nil {
+			return err
+		}
+		if bodySize < 12 {
+			return errors.New(fmt.Sprintf("invalid wave size %d", bodySize))
+		}
+		c.lock.Lock()
+		c.pending = &wave{
+			timeStamp: uint16(b[0]) | uint16(b[1])<<8,
+			formatNo:  uint16(b[2]) | uint16(b[3])<<8,
+			blockNo:   b[4],
+			data:      append([]byte{}, b[8:12]...),
+			size:      bodySize - 8,
+			received:  time.Now(),
+		}
+		c.lock.Unlock()
+	case SNDC_WAVE2:
+		b, err := core.ReadBytes(12, r)
+		if err != nil {
+			return err
+		}
+		return c.play(&wave{
+			timeStamp: uint16(b[0]) | uint16(b[1])<<8,
+			formatNo:  uint16(b[2]) | uint16(b[3])<<8,
+			blockNo:   b[4],
+			data:      msg[16:],
+			received:  time.Now(),
+		})
+	case SNDC_CLOSE, SNDC_SETVOLUME, SNDC_SETPITCH:
+	default:
+		return errors.New(fmt.Sprintf("unknown message 0x%x", msgType))
+	}
+	return nil
+}
+
+/**
+ * Keep the PCM formats of the server and send them back, the server
+ * then refers to formats by their index in the client list
+ * @see MS-RDPEA 2.2.2.1 Server Audio Formats and Version PDU (SERVER_AUDIO_VERSION_AND_FORMATS)
+ */
+func (c *Client) recvFormats(r io.Reader) error {
+	b, err := core.ReadBytes(20, r)
+	if err != nil {
+		return err
+	}
+	count := int(b[14]) | int(b[15])<<8
+	serverVersion := uint16(b[17]) | uint16(b[18])<<8
+	var formats []AudioFormat
+	for i := 0; i < count; i++ {
+		f, err := readFormat(r)
+		if err != nil {
+			return err
+		}
+		if f.FormatTag == WAVE_FORMAT_PCM {
+			formats = append(formats, *f)
+		}
+	}
+	if len(formats) == 0 {
+		glog.Warn("rdpsnd: no PCM format offered by the server")
+	}
+	c.lock.Lock()
+	c.formats = formats
+	c.lock.Unlock()
+
+	buff := &bytes.Buffer{}
+	core.WriteUInt32LE(TSSNDCAPS_ALIVE, buff)
+	core.WriteUInt32LE(0, buff) // dwVolume
+	core.WriteUInt32LE(0, buff) // dwPitch
+	core.WriteUInt16LE(0, buff) // wDGramPort, no UDP
+	core.WriteUInt16LE(uint16(len(formats)), buff)
+	core.WriteUInt8(0, buff) // cLastBlockConfirmed
+	core.WriteUInt16LE(version, buff)
+	core.WriteUInt8(0, buff)
+	for i := range formats {
+		core.WriteBytes(formats[i].Serialize(), buff)
+	}
+	if err = c.conn.WriteMessage(pdu(SNDC_FORMATS, buff.Bytes())); err != nil {
+		return err
+	}
+	if serverVersion < 6 {
+		return nil
+	}
+	// @see MS-RDPEA 2.2.2.3 Quality Mode PDU
+	buff = &bytes.Buffer{}
+	core.WriteUInt16LE(HIGH_QUALITY, buff)
+	core.WriteUInt16LE(0, buff)
+	return c.conn.WriteMessage(pdu(SNDC_QUALITYMODE, buff.Bytes()))
+}
+
+/**
+ * Deliver w then confirm it, the server paces the stream on the time
+ * stamp confirmed so it is moved by the time spent on the wave
+ * @see MS-RDPEA 2.2.3.8 Wave Confirm PDU (SNDWAV_CONFIRM)
+ */
+func (c *Client) play(w *wave) error {
+	c.lock.Lock()
+	f := c.onAudio
+	var format *AudioFormat
+	if int(w.formatNo) < len(c.formats) {
+		format = &c.formats[w.formatNo]
+	}
+	c.lock.Unlock()
+	if format == nil {
+		glog.Warn(fmt.Sprintf("rdpsnd: wave of unknown format %d", w.formatNo))
+	} else if f != nil {
+		f(*format, w.data)
+	}
+
+	buff := &bytes.Buffer{}
+	elapsed := uint16(time.Since(w.received) / time.Millisecond)
+	core.WriteUInt16LE(w.timeStamp+elapsed, buff)
+	core.WriteUInt8(w.blockNo, buff)
+	core.WriteUInt8(0, buff)
+	return c.conn.WriteMessage(pdu(SNDC_WAVECONFIRM, buff.Bytes()))
+}
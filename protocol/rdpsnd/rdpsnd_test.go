@@ -0,0 +1,126 @@
+package rdpsnd
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tomatome/grdp/core"
+	"github.com/tomatome/grdp/glog"
+	"github.com/tomatome/grdp/plugin"
+)
+
+func init() {
+	glog.SetLevel(glog.NONE)
+}
+
+func expect(t *testing.T, server *plugin.ChannelConn, msg string) {
+	t.Helper()
+	b, err := server.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(b) != msg {
+		t.Fatalf("get %x, expect %s", b, msg)
+	}
+}
+
+func expectConfirm(t *testing.T, server *plugin.ChannelConn, timeStamp uint16, blockNo uint8) {
+	t.Helper()
+	b, err := server.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != 8 || hex.EncodeToString(b[:4]) != "05000400" || b[6] != blockNo {
+		t.Fatalf("invalid wave confirm %x", b)
+	}
+	// moved by the time spent in the callback only
+	if ts := uint16(b[4]) | uint16(b[5])<<8; ts < timeStamp || ts > timeStamp+1000 {
+		t.Errorf("confirmed time stamp %d, wave at %d", ts, timeStamp)
+	}
+}
+
+type audio struct {
+	format AudioFormat
+	pcm    []byte
+}
+
+func TestAudio(t *testing.T) {
+	client, conn := net.Pipe()
+	defer conn.Close()
+	server := plugin.NewChannelConn(conn, plugin.CHANNEL_OPTION_SHOW_PROTOCOL)
+	c := New(client)
+	played := make(chan audio, 1)
+	c.OnAudio(func(format AudioFormat, pcm []byte) {
+		played <- audio{format, pcm}
+	})
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Run()
+	}()
+
+	pcm := AudioFormat{FormatTag: WAVE_FORMAT_PCM, Channels: 2, SamplesPerSec: 44100,
+		AvgBytesPerSec: 176400, BlockAlign: 4, BitsPerSample: 16}
+	adpcm := AudioFormat{FormatTag: 0x0002, Channels: 2, SamplesPerSec: 22050,
+		AvgBytesPerSec: 22311, BlockAlign: 1024, BitsPerSample: 4, Data: []byte{0xf4, 0x07}}
+	buff := &bytes.Buffer{}
+	buff.Write(make([]byte, 14))
+	core.WriteUInt16LE(2, buff)
+	core.WriteUInt8(0, buff)
+	core.WriteUInt16LE(8, buff)
+	core.WriteUInt8(0, buff)
+	buff.Write(adpcm.Serialize())
+	buff.Write(pcm.Serialize())
+	server.WriteMessage(pdu(SNDC_FORMATS, buff.Bytes()))
+
+	// the ADPCM format is dropped, the PCM one is format 0
+	expect(t, server, "07002600"+"01000000"+"00000000"+"00000000"+"0000"+"0100"+"00"+"0800"+"00"+
+		hex.EncodeToString(pcm.Serialize()))
+	expect(t, server, "0c000400"+"0200"+"0000")
+
+	server.WriteMessage(pdu(SNDC_TRAINING, []byte{0x10, 0x27, 0x00, 0x04}))
+	expect(t, server, "06000400"+"10270004")
+
+	// wave info then wave PDU
+	samples := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	info := []byte{100, 0, 0, 0, 3, 0, 0, 0}
+	info = append(info, samples[:4]...)
+	msg := pdu(SNDC_WAVE, info)
+	msg[2] = byte(len(info) + len(samples) - 4)
+	server.WriteMessage(msg)
+	server.WriteMessage(append([]byte{0, 0, 0, 0}, samples[4:]...))
+	select {
+	case a := <-played:
+		if a.format.SamplesPerSec != 44100 || !bytes.Equal(a.pcm, samples) {
+			t.Errorf("played %v %v", a.format, a.pcm)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no audio")
+	}
+	expectConfirm(t, server, 100, 3)
+
+	// wave2 carries the samples in one PDU
+	wave2 := []byte{200, 0, 0, 0, 4, 0, 0, 0, 0, 0, 0, 0}
+	server.WriteMessage(pdu(SNDC_WAVE2, append(wave2, samples...)))
+	select {
+	case a := <-played:
+		if !bytes.Equal(a.pcm, samples) {
+			t.Errorf("played %v", a.pcm)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no audio")
+	}
+	expectConfirm(t, server, 200, 4)
+
+	conn.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("run not stopped by close")
+	}
+}
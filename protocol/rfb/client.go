@@ -0,0 +1,621 @@
+package rfb
+
+import (
+	"bytes"
+	"crypto/des"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tomatome/grdp/core"
+	"github.com/tomatome/grdp/emission"
+	"github.com/tomatome/grdp/glog"
+	"github.com/tomatome/grdp/protocol/pdu"
+)
+
+/**
+ * @see RFC 6143 7.5 Client-to-Server Messages
+ */
+const (
+	SET_PIXEL_FORMAT           = 0
+	SET_ENCODINGS              = 2
+	FRAMEBUFFER_UPDATE_REQUEST = 3
+	KEY_EVENT                  = 4
+	POINTER_EVENT              = 5
+	CLIENT_CUT_TEXT            = 6
+)
+
+/**
+ * @see RFC 6143 7.6 Server-to-Client Messages
+ */
+const (
+	FRAMEBUFFER_UPDATE     = 0
+	SET_COLOUR_MAP_ENTRIES = 1
+	BELL                   = 2
+	SERVER_CUT_TEXT        = 3
+)
+
+/**
+ * @see RFC 6143 7.7 Encodings
+ */
+const (
+	ENCODING_RAW      int32 = 0
+	ENCODING_COPYRECT int32 = 1
+	ENCODING_HEXTILE  int32 = 5
+	ENCODING_CURSOR   int32 = -239
+)
+
+// hextile subencoding mask
+// @see RFC 6143 7.7.4 Hextile Encoding
+const (
+	HEXTILE_RAW                  = 0x01
+	HEXTILE_BACKGROUND_SPECIFIED = 0x02
+	HEXTILE_FOREGROUND_SPECIFIED = 0x04
+	HEXTILE_ANY_SUBRECTS         = 0x08
+	HEXTILE_SUBRECTS_COLOURED    = 0x10
+)
+
+// bytes per pixel of the requested pixel format
+const bytesPerPixel = 4
+
+// clientPixelFormat is 32 bpp little endian BGRX, the layout of the 32 bpp
+// pdu.BitmapData of the RDP client
+func clientPixelFormat() []byte {
+	buff := &bytes.Buffer{}
+	core.WriteUInt8(32, buff) // bits-per-pixel
+	core.WriteUInt8(24, buff) // depth
+	core.WriteUInt8(0, buff)  // big-endian-flag
+	core.WriteUInt8(1, buff)  // true-colour-flag
+	core.WriteUInt16BE(255, buff)
+	core.WriteUInt16BE(255, buff)
+	core.WriteUInt16BE(255, buff)
+	core.WriteUInt8(16, buff)
+	core.WriteUInt8(8, buff)
+	core.WriteUInt8(0, buff)
+	core.WriteBytes(make([]byte, 3), buff)
+	return buff.Bytes()
+}
+
+/**
+ * VNC client with the events of the RDP client, after Connect it emits
+ * "bitmap" []pdu.BitmapData 32 bpp bottom up rectangles
+ * "pointer" pdu.PointerShape of the cursor pseudo encoding
+ * "error" error and "close"
+ */
+type VNCClient struct {
+	emission.Emitter
+	addr     string
+	password string
+	timeout  time.Duration
+
+	conn      net.Conn
+	writeLock sync.Mutex
+	Name      string
+	Width     uint16
+	Height    uint16
+	// top down BGRX pixels, source of the copy rects
+	framebuffer []byte
+}
+
+// NewVNCClient returns a client of addr, an empty password for the None security type
+func NewVNCClient(addr string, password string) *VNCClient {
+	return &VNCClient{
+		Emitter:  *emission.NewEmitter(),
+		addr:     addr,
+		password: password,
+		timeout:  10 * time.Second,
+	}
+}
+
+// Connect runs the handshake and returns once the first update is requested
+func (c *VNCClient) Connect() error {
+	addr, err := core.HostPort(c.addr, "5900")
+	if err != nil {
+		return errors.New(fmt.Sprintf("dial: %v", err))
+	}
+	conn, err := net.DialTimeout("tcp", addr, c.timeout)
+	if err != nil {
+		return errors.New(fmt.Sprintf("dial: %v", err))
+	}
+	c.conn = conn
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	if err = c.handshake(); err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	go c.run()
+	return nil
+}
+
+func (c *VNCClient) write(b []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if c.conn == nil {
+		return errors.New("not connected")
+	}
+	_, err := c.conn.Write(b)
+	return err
+}
+
+func readUint32BE(r io.Reader) (uint32, error) {
+	b, err := core.ReadBytes(4, r)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3]), nil
+}
+
+func readUint16sBE(r io.Reader, values ...*uint16) error {
+	for _, v := range values {
+		b, err := core.ReadBytes(2, r)
+		if err != nil {
+			return err
+		}
+		*v = uint16(b[0])<<8 | uint16(b[1])
+	}
+	return nil
+}
+
+// readReason reads the string of a failure
+func readReason(r io.Reader) string {
+	n, err := readUint32BE(r)
+	if err != nil {
+		return err.Error()
+	}
+	b, err := core.ReadBytes(int(n), r)
+	if err != nil {
+		return err.Error()
+	}
+	return string(b)
+}
+
+/**
+ * @see RFC 6143 7.1 Handshake Messages
+ * @see RFC 6143 7.3 Initialization Messages
+ */
+func (c *VNCClient) handshake() error {
+	b, err := core.ReadBytes(12, c.conn)
+	if err != nil {
+		return err
+	}
+	var major, minor int
+	if _, err = fmt.Sscanf(string(b), "RFB %03d.%03d\n", &major, &minor); err != nil || major != 3 {
+		return errors.New(fmt.Sprintf("invalid protocol version %q", b))
+	}
+	version := RFB003008
+	switch {
+	case minor < 7:
+		version = RFB003003
+	case minor == 7:
+		version = RFB003007
+	}
+	if err = c.write([]byte(version)); err != nil {
+		return err
+	}
+
+	var secType uint8
+	if version == RFB003003 {
+		t, err := readUint32BE(c.conn)
+		if err != nil {
+			return err
+		}
+		if t == uint32(SEC_INVALID) {
+			return errors.New("connection failed: " + readReason(c.conn))
+		}
+		secType = uint8(t)
+	} else {
+		b, err = core.ReadBytes(1, c.conn)
+		if err != nil {
+			return err
+		}
+		if b[0] == 0 {
+			return errors.New("connection failed: " + readReason(c.conn))
+		}
+		types, err := core.ReadBytes(int(b[0]), c.conn)
+		if err != nil {
+			return err
+		}
+		secType = SEC_INVALID
+		for _, t := range types {
+			if t == SEC_VNC && (c.password != "" || secType == SEC_INVALID) {
+				secType = t
+			} else if t == SEC_NONE && (c.password == "" || secType == SEC_INVALID) {
+				secType = t
+			}
+		}
+		if secType == SEC_INVALID {
+			return errors.New(fmt.Sprintf("no supported security type in %v", types))
+		}
+		if err = c.write([]byte{secType}); err != nil {
+			return err
+		}
+	}
+
+	switch secType {
+	case SEC_VNC:
+		if err = c.authenticate(); err != nil {
+			return err
+		}
+	case SEC_NONE:
+	default:
+		return errors.New(fmt.Sprintf("unsupported security type %d", secType))
+	}
+	// the result of None is only sent from version 3.8
+	if secType == SEC_VNC || version == RFB003008 {
+		result, err := readUint32BE(c.conn)
+		if err != nil {
+			return err
+		}
+		if result != 0 {
+			if version == RFB003008 {
+				return errors.New("authentication failed: " + readReason(c.conn))
+			}
+			return errors.New("authentication failed")
+		}
+	}
+
+	// shared ClientInit
+	if err = c.write([]byte{1}); err != nil {
+		return err
+	}
+	if err = readUint16sBE(c.conn, &c.Width, &c.Height); err != nil {
+		return err
+	}
+	if _, err = core.ReadBytes(16, c.conn); err != nil {
+		return err
+	}
+	c.Name = readReason(c.conn)
+	c.framebuffer = make([]byte, int(c.Width)*int(c.Height)*bytesPerPixel)
+	glog.Info("vnc desktop", c.Name, c.Width, c.Height)
+
+	buff := &bytes.Buffer{}
+	core.WriteUInt8(SET_PIXEL_FORMAT, buff)
+	core.WriteBytes(make([]byte, 3), buff)
+	core.WriteBytes(clientPixelFormat(), buff)
+	encodings := []int32{ENCODING_HEXTILE, ENCODING_COPYRECT, ENCODING_RAW, ENCODING_CURSOR}
+	core.WriteUInt8(SET_ENCODINGS, buff)
+	core.WriteUInt8(0, buff)
+	core.WriteUInt16BE(uint16(len(encodings)), buff)
+	for _, e := range encodings {
+		core.WriteUInt32BE(uint32(e), buff)
+	}
+	if err = c.write(buff.Bytes()); err != nil {
+		return err
+	}
+	return c.RequestUpdate(false)
+}
+
+/**
+ * DES of the challenge keyed by the password, bits of each key byte mirrored
+ * @see RFC 6143 7.2.2 VNC Authentication
+ */
+func (c *VNCClient) authenticate() error {
+	challenge, err := core.ReadBytes(16, c.conn)
+	if err != nil {
+		return err
+	}
+	bk, err := des.NewCipher(fixDesKey([]byte(c.password)))
+	if err != nil {
+		return err
+	}
+	response := make([]byte, 16)
+	bk.Encrypt(response, challenge)
+	bk.Encrypt(response[8:], challenge[8:])
+	return c.write(response)
+}
+
+// RequestUpdate asks for the whole desktop, or its changes when incremental
+// @see RFC 6143 7.5.3 FramebufferUpdateRequest
+func (c *VNCClient) RequestUpdate(incremental bool) error {
+	buff := &bytes.Buffer{}
+	core.WriteUInt8(FRAMEBUFFER_UPDATE_REQUEST, buff)
+	if incremental {
+		core.WriteUInt8(1, buff)
+	} else {
+		core.WriteUInt8(0, buff)
+	}
+	core.WriteUInt16BE(0, buff)
+	core.WriteUInt16BE(0, buff)
+	core.WriteUInt16BE(c.Width, buff)
+	core.WriteUInt16BE(c.Height, buff)
+	return c.write(buff.Bytes())
+}
+
+// SendKey sends a key press or release of an X keysym
+func (c *VNCClient) SendKey(keysym uint32, down bool) error {
+	buff := &bytes.Buffer{}
+	core.WriteUInt8(KEY_EVENT, buff)
+	if down {
+		core.WriteUInt8(1, buff)
+	} else {
+		core.WriteUInt8(0, buff)
+	}
+	core.WriteUInt16BE(0, buff)
+	core.WriteUInt32BE(keysym, buff)
+	return c.write(buff.Bytes())
+}
+
+// SendPointer sends the pointer position with the pressed buttons, bit 0 is the left one
+func (c *VNCClient) SendPointer(x, y uint16, buttons uint8) error {
+	buff := &bytes.Buffer{}
+	core.WriteUInt8(POINTER_EVENT, buff)
+	core.WriteUInt8(buttons, buff)
+	core.WriteUInt16BE(x, buff)
+	core.WriteUInt16BE(y, buff)
+	return c.write(buff.Bytes())
+}
+
+func (c *VNCClient) Close() error {
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+func (c *VNCClient) run() {
+	for {
+		err := c.recvMessage()
+		if err == io.EOF {
+			c.Emit("close")
+			return
+		}
+		if err != nil {
+			c.Emit("error", err)
+			c.conn.Close()
+			return
+		}
+	}
+}
+
+func (c *VNCClient) recvMessage() error {
+	b, err := core.ReadBytes(1, c.conn)
+	if err != nil {
+		return err
+	}
+	switch b[0] {
+	case FRAMEBUFFER_UPDATE:
+		return c.recvFramebufferUpdate()
+	case SET_COLOUR_MAP_ENTRIES:
+		// unused with a true colour pixel format
+		b, err = core.ReadBytes(5, c.conn)
+		if err != nil {
+			return err
+		}
+		_, err = core.ReadBytes((int(b[3])<<8|int(b[4]))*6, c.conn)
+		return err
+	case BELL:
+		return nil
+	case SERVER_CUT_TEXT:
+		if _, err = core.ReadBytes(3, c.conn); err != nil {
+			return err
+		}
+		readReason(c.conn)
+		return nil
+	}
+	return errors.New(fmt.Sprintf("unknown message type %d", b[0]))
+}
+
+/**
+ * @see RFC 6143 7.6.1 FramebufferUpdate
+ */
+func (c *VNCClient) recvFramebufferUpdate() error {
+	b, err := core.ReadBytes(3, c.conn)
+	if err != nil {
+		return err
+	}
+	count := int(b[1])<<8 | int(b[2])
+	var rectangles []pdu.BitmapData
+	for i := 0; i < count; i++ {
+		var x, y, w, h uint16
+		if err = readUint16sBE(c.conn, &x, &y, &w, &h); err != nil {
+			return err
+		}
+		e, err := readUint32BE(c.conn)
+		if err != nil {
+			return err
+		}
+		rect := image.Rect(int(x), int(y), int(x)+int(w), int(y)+int(h))
+		encoding := int32(e)
+		if encoding == ENCODING_CURSOR {
+			if err = c.recvCursor(rect); err != nil {
+				return err
+			}
+			continue
+		}
+		if !rect.In(image.Rect(0, 0, int(c.Width), int(c.Height))) {
+			return errors.New(fmt.Sprintf("rectangle %v out of the desktop", rect))
+		}
+		switch encoding {
+		case ENCODING_RAW:
+			err = c.recvRaw(rect)
+		case ENCODING_COPYRECT:
+			err = c.recvCopyRect(rect)
+		case ENCODING_HEXTILE:
+			err = c.recvHextile(rect)
+		default:
+			err = errors.New(fmt.Sprintf("unsupported encoding %d", encoding))
+		}
+		if err != nil {
+			return err
+		}
+		if !rect.Empty() {
+			rectangles = append(rectangles, c.bitmap(rect))
+		}
+	}
+	if len(rectangles) > 0 {
+		c.Emit("bitmap", rectangles)
+	}
+	return c.RequestUpdate(true)
+}
+
+// bitmap returns rect of the framebuffer as a bottom up rectangle
+func (c *VNCClient) bitmap(rect image.Rectangle) pdu.BitmapData {
+	stride := rect.Dx() * bytesPerPixel
+	pixels := make([]byte, 0, stride*rect.Dy())
+	for y := rect.Max.Y - 1; y >= rect.Min.Y; y-- {
+		i := c.offset(rect.Min.X, y)
+		pixels = append(pixels, c.framebuffer[i:i+stride]...)
+	}
+	return pdu.BitmapData{
+		DestLeft:         uint16(rect.Min.X),
+		DestTop:          uint16(rect.Min.Y),
+		DestRight:        uint16(rect.Max.X - 1),
+		DestBottom:       uint16(rect.Max.Y - 1),
+		Width:            uint16(rect.Dx()),
+		Height:           uint16(rect.Dy()),
+		BitsPerPixel:     32,
+		BitmapDataStream: pixels,
+		Pixels:           pixels,
+	}
+}
+
+func (c *VNCClient) offset(x, y int) int {
+	return (y*int(c.Width) + x) * bytesPerPixel
+}
+
+func (c *VNCClient) fill(rect image.Rectangle, pixel []byte) {
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for i := c.offset(rect.Min.X, y); i < c.offset(rect.Max.X, y); i += bytesPerPixel {
+			copy(c.framebuffer[i:], pixel)
+		}
+	}
+}
+
+// recvRaw reads the raw pixels of rect into the framebuffer
+func (c *VNCClient) recvRaw(rect image.Rectangle) error {
+	stride := rect.Dx() * bytesPerPixel
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		i := c.offset(rect.Min.X, y)
+		if _, err := io.ReadFull(c.conn, c.framebuffer[i:i+stride]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// @see RFC 6143 7.7.2 CopyRect Encoding
+func (c *VNCClient) recvCopyRect(rect image.Rectangle) error {
+	var srcX, srcY uint16
+	if err := readUint16sBE(c.conn, &srcX, &srcY); err != nil {
+		return err
+	}
+	src := rect.Sub(rect.Min).Add(image.Pt(int(srcX), int(srcY)))
+	if !src.In(image.Rect(0, 0, int(c.Width), int(c.Height))) {
+		return errors.New(fmt.Sprintf("copy rect source %v out of the desktop", src))
+	}
+	stride := rect.Dx() * bytesPerPixel
+	rows := make([]byte, stride*rect.Dy())
+	for y := 0; y < rect.Dy(); y++ {
+		i := c.offset(src.Min.X, src.Min.Y+y)
+		copy(rows[y*stride:], c.framebuffer[i:i+stride])
+	}
+	for y := 0; y < rect.Dy(); y++ {
+		copy(c.framebuffer[c.offset(rect.Min.X, rect.Min.Y+y):], rows[y*stride:(y+1)*stride])
+	}
+	return nil
+}
+
+// @see RFC 6143 7.7.4 Hextile Encoding
+func (c *VNCClient) recvHextile(rect image.Rectangle) error {
+	background := make([]byte, bytesPerPixel)
+	foreground := make([]byte, bytesPerPixel)
+	for ty := rect.Min.Y; ty < rect.Max.Y; ty += 16 {
+		for tx := rect.Min.X; tx < rect.Max.X; tx += 16 {
+			tile := image.Rect(tx, ty, tx+16, ty+16).Intersect(rect)
+			b, err := core.ReadBytes(1, c.conn)
+			if err != nil {
+				return err
+			}
+			mask := b[0]
+			if mask&HEXTILE_RAW != 0 {
+				if err = c.recvRaw(tile); err != nil {
+					return err
+				}
+				continue
+			}
+			if mask&HEXTILE_BACKGROUND_SPECIFIED != 0 {
+				if _, err = io.ReadFull(c.conn, background); err != nil {
+					return err
+				}
+			}
+			c.fill(tile, background)
+			if mask&HEXTILE_FOREGROUND_SPECIFIED != 0 {
+				if _, err = io.ReadFull(c.conn, foreground); err != nil {
+					return err
+				}
+			}
+			if mask&HEXTILE_ANY_SUBRECTS == 0 {
+				continue
+			}
+			b, err = core.ReadBytes(1, c.conn)
+			if err != nil {
+				return err
+			}
+			for n := int(b[0]); n > 0; n-- {
+				color := foreground
+				if mask&HEXTILE_SUBRECTS_COLOURED != 0 {
+					color = make([]byte, bytesPerPixel)
+					if _, err = io.ReadFull(c.conn, color); err != nil {
+						return err
+					}
+				}
+				b, err = core.ReadBytes(2, c.conn)
+				if err != nil {
+					return err
+				}
+				x, y := tile.Min.X+int(b[0]>>4), tile.Min.Y+int(b[0]&0xf)
+				sub := image.Rect(x, y, x+int(b[1]>>4)+1, y+int(b[1]&0xf)+1)
+				c.fill(sub.Intersect(tile), color)
+			}
+		}
+	}
+	return nil
+}
+
+/**
+ * Cursor pseudo encoding, the shape at hotspot rect.Min as a 32 bpp pointer
+ * whose and mask hides the pixels outside of the bitmask
+ * @see RFC 6143 7.8.1 Cursor Pseudo-Encoding
+ */
+func (c *VNCClient) recvCursor(rect image.Rectangle) error {
+	w, h := rect.Dx(), rect.Dy()
+	pixels, err := core.ReadBytes(w*h*bytesPerPixel, c.conn)
+	if err != nil {
+		return err
+	}
+	maskStride := (w + 7) / 8
+	bitmask, err := core.ReadBytes(maskStride*h, c.conn)
+	if err != nil {
+		return err
+	}
+	andStride := (w + 15) / 16 * 2
+	shape := pdu.PointerShape{
+		Hotspot: rect.Min,
+		Width:   uint16(w),
+		Height:  uint16(h),
+		XorBpp:  32,
+		XorMask: make([]byte, 0, len(pixels)),
+		AndMask: make([]byte, andStride*h),
+	}
+	for y := h - 1; y >= 0; y-- {
+		row := pixels[y*w*bytesPerPixel : (y+1)*w*bytesPerPixel]
+		for x := 0; x < w; x++ {
+			p := row[x*bytesPerPixel : (x+1)*bytesPerPixel]
+			if bitmask[y*maskStride+x/8]&(0x80>>uint(x%8)) == 0 {
+				// transparent, black under the and mask
+				shape.AndMask[(h-1-y)*andStride+x/8] |= 0x80 >> uint(x%8)
+				p = []byte{0, 0, 0, 0}
+			} else {
+				p = []byte{p[0], p[1], p[2], 0xff}
+			}
+			shape.XorMask = append(shape.XorMask, p...)
+		}
+	}
+	c.Emit("pointer", shape)
+	return nil
+}
@@ -0,0 +1,156 @@
+package rfb
+
+import (
+	"bytes"
+	"crypto/des"
+	"encoding/hex"
+	"image"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tomatome/grdp/glog"
+	"github.com/tomatome/grdp/protocol/pdu"
+)
+
+func init() {
+	glog.SetLevel(glog.NONE)
+}
+
+func expect(t *testing.T, conn net.Conn, s string) {
+	want, _ := hex.DecodeString(s)
+	b := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, want) {
+		t.Fatalf("get %x, expect %s", b, s)
+	}
+}
+
+func send(conn net.Conn, s string) {
+	b, _ := hex.DecodeString(s)
+	conn.Write(b)
+}
+
+// fakeServer runs a 4x2 desktop asking for the password "secret"
+func fakeServer(t *testing.T, l net.Listener) {
+	conn, err := l.Accept()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte(RFB003008))
+	expect(t, conn, hex.EncodeToString([]byte(RFB003008)))
+	send(conn, "020102")
+	expect(t, conn, "02")
+
+	challenge := bytes.Repeat([]byte{0x5a}, 16)
+	conn.Write(challenge)
+	bk, _ := des.NewCipher(fixDesKey([]byte("secret")))
+	response := make([]byte, 16)
+	bk.Encrypt(response, challenge)
+	bk.Encrypt(response[8:], challenge[8:])
+	expect(t, conn, hex.EncodeToString(response))
+	send(conn, "00000000")
+
+	expect(t, conn, "01")
+	send(conn, "00040002"+"2018000100ff00ff00ff100800000000"+"00000004"+hex.EncodeToString([]byte("test")))
+	expect(t, conn, "00000000"+"2018000100ff00ff00ff100800000000")
+	expect(t, conn, "02000004"+"00000005"+"00000001"+"00000000"+"ffffff11")
+	expect(t, conn, "03000000000000040002")
+
+	send(conn, "00000004"+
+		// raw 0,0 2x1
+		"0000000000020001"+"00000000"+"01010100"+"02020200"+
+		// hextile 0,1 4x1, background and foreground, one subrect at 3,0
+		"0000000100040001"+"00000005"+"0e"+"03030300"+"04040400"+"01"+"3000"+
+		// copy of 0,0 to 2,0
+		"0002000000020001"+"00000001"+"00000000"+
+		// cursor with hotspot 1,1, 2x1 with only the left pixel shown
+		"0001000100020001"+"ffffff11"+"0a0b0c00"+"0d0e0f00"+"80")
+	expect(t, conn, "03010000000000040002")
+}
+
+func TestVNCClient(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go fakeServer(t, l)
+
+	c := NewVNCClient(l.Addr().String(), "secret")
+	bitmaps := make(chan []pdu.BitmapData, 1)
+	pointers := make(chan pdu.PointerShape, 1)
+	closed := make(chan struct{})
+	c.On("bitmap", func(rectangles []pdu.BitmapData) {
+		bitmaps <- rectangles
+	})
+	c.On("pointer", func(p pdu.PointerShape) {
+		pointers <- p
+	})
+	c.On("error", func(e error) {
+		t.Error(e)
+	})
+	c.On("close", func() {
+		close(closed)
+	})
+	if err = c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.Name != "test" || c.Width != 4 || c.Height != 2 {
+		t.Fatalf("bad desktop %q %dx%d", c.Name, c.Width, c.Height)
+	}
+
+	var p pdu.PointerShape
+	select {
+	case p = <-pointers:
+	case <-time.After(time.Second):
+		t.Fatal("no pointer")
+	}
+	if p.Hotspot != image.Pt(1, 1) || p.Width != 2 || p.Height != 1 || p.XorBpp != 32 {
+		t.Fatalf("bad pointer %+v", p)
+	}
+	pixels, err := p.RGBA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(pixels) != "0c0b0aff"+"00000000" {
+		t.Errorf("get pointer %x", pixels)
+	}
+
+	var rectangles []pdu.BitmapData
+	select {
+	case rectangles = <-bitmaps:
+	case <-time.After(time.Second):
+		t.Fatal("no bitmap")
+	}
+	if len(rectangles) != 3 {
+		t.Fatalf("get %d rectangles, expect 3", len(rectangles))
+	}
+	expects := []struct {
+		left, top, right, bottom uint16
+		pixels                   string
+	}{
+		{0, 0, 1, 0, "01010100" + "02020200"},
+		{0, 1, 3, 1, "03030300" + "03030300" + "03030300" + "04040400"},
+		{2, 0, 3, 0, "01010100" + "02020200"},
+	}
+	for i, e := range expects {
+		r := rectangles[i]
+		if r.DestLeft != e.left || r.DestTop != e.top || r.DestRight != e.right || r.DestBottom != e.bottom ||
+			r.BitsPerPixel != 32 || hex.EncodeToString(r.Pixels) != e.pixels {
+			t.Errorf("rectangle %d is %d,%d,%d,%d %x", i, r.DestLeft, r.DestTop, r.DestRight, r.DestBottom, r.Pixels)
+		}
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Error("no close")
+	}
+}
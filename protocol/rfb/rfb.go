@@ -9,6 +9,7 @@ import (
 	"io"
 	"log"
 	"net"
+	"time"
 
 	"github.com/lunixbochs/struc"
 
@@ -38,6 +39,9 @@ type RFBConn struct {
 	s       *ServerInit
 	NbRect  uint16
 	BitRect *BitRect
+
+	readTimeout  time.Duration
+	writeTimeout time.Duration
 }
 
 func NewRFBConn(s net.Conn) *RFBConn {
@@ -51,10 +55,20 @@ func NewRFBConn(s net.Conn) *RFBConn {
 	return fc
 }
 func (fc *RFBConn) Read(b []byte) (n int, err error) {
+	if fc.readTimeout > 0 {
+		if err = fc.Conn.SetReadDeadline(time.Now().Add(fc.readTimeout)); err != nil {
+			return 0, err
+		}
+	}
 	return fc.Conn.Read(b)
 }
 
 func (fc *RFBConn) Write(data []byte) (n int, err error) {
+	if fc.writeTimeout > 0 {
+		if err = fc.Conn.SetWriteDeadline(time.Now().Add(fc.writeTimeout)); err != nil {
+			return 0, err
+		}
+	}
 	buff := &bytes.Buffer{}
 	buff.Write(data)
 	return fc.Conn.Write(buff.Bytes())
@@ -62,6 +76,25 @@ func (fc *RFBConn) Write(data []byte) (n int, err error) {
 func (fc *RFBConn) Close() error {
 	return fc.Conn.Close()
 }
+
+func (fc *RFBConn) SetReadTimeout(d time.Duration) {
+	fc.readTimeout = d
+	deadline := time.Time{}
+	if d > 0 {
+		deadline = time.Now().Add(d)
+	}
+	fc.Conn.SetReadDeadline(deadline)
+}
+
+func (fc *RFBConn) SetWriteTimeout(d time.Duration) {
+	fc.writeTimeout = d
+	deadline := time.Time{}
+	if d > 0 {
+		deadline = time.Now().Add(d)
+	}
+	fc.Conn.SetWriteDeadline(deadline)
+}
+
 func (fc *RFBConn) recvProtocolVersion(s []byte, err error) {
 	version := string(s)
 	glog.Debug("RFBConn recvProtocolVersion", version, err)
@@ -260,7 +293,7 @@ func (fc *RFBConn) recvServerOrder(s []byte, err error) {
 	case 3:
 		core.StartReadBytes(7, fc, fc.recvServerCutTextHeader)
 	default:
-		glog.Errorf("Unknown message type %s", packetType)
+		glog.Errorf("Unknown message type %d", packetType)
 	}
 
 }
@@ -406,7 +439,7 @@ func NewRFB(t core.Transport) *RFB {
 }
 
 func (fb *RFB) recvProtocolVersion(version string) {
-	if version != RFB003003 || version != RFB003007 || version != RFB003008 {
+	if version != RFB003003 && version != RFB003007 && version != RFB003008 {
 		version = RFB003008
 	}
 	glog.Infof("version:%s", version)
@@ -0,0 +1,101 @@
+package sec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/tomatome/grdp/core"
+	"github.com/tomatome/grdp/glog"
+)
+
+/**
+ * header types and request types of the network auto-detect PDUs
+ * @see MS-RDPBCGR 2.2.14.1 Network Auto-Detect Request PDU
+ */
+const (
+	TYPE_ID_AUTODETECT_REQUEST  = 0x00
+	TYPE_ID_AUTODETECT_RESPONSE = 0x01
+)
+
+const (
+	RDP_RTT_REQUEST_TYPE_CONTINUOUS       = 0x0001
+	RDP_RTT_REQUEST_TYPE_CONNECTTIME      = 0x1001
+	RDP_BW_START_REQUEST_TYPE_CONTINUOUS  = 0x0014
+	RDP_BW_START_REQUEST_TYPE_TUNNEL      = 0x0114
+	RDP_BW_START_REQUEST_TYPE_CONNECTTIME = 0x1014
+	RDP_BW_PAYLOAD_REQUEST_TYPE           = 0x0002
+	RDP_BW_STOP_REQUEST_TYPE_CONNECTTIME  = 0x002B
+	RDP_BW_STOP_REQUEST_TYPE_CONTINUOUS   = 0x0429
+	RDP_BW_STOP_REQUEST_TYPE_TUNNEL       = 0x0629
+)
+
+/**
+ * @see MS-RDPBCGR 2.2.14.2 Network Auto-Detect Response PDU
+ */
+const (
+	RDP_RTT_RESPONSE_TYPE               = 0x0000
+	RDP_BW_RESULTS_RESPONSE_CONNECTTIME = 0x0003
+	RDP_BW_RESULTS_RESPONSE_CONTINUOUS  = 0x000B
+)
+
+// autoDetector measures the bandwidth between the start and stop requests
+// of the server
+type autoDetector struct {
+	// zero when no measure runs
+	start time.Time
+	bytes uint32
+}
+
+// received counts the n bytes of a packet for the running measure
+func (a *autoDetector) received(n int) {
+	if !a.start.IsZero() {
+		a.bytes += uint32(n)
+	}
+}
+
+// request handles the auto-detect request b, without its security header,
+// and returns the response to send if any
+func (a *autoDetector) request(b []byte) ([]byte, error) {
+	if len(b) < 6 || b[1] != TYPE_ID_AUTODETECT_REQUEST || int(b[0]) > len(b) {
+		return nil, errors.New(fmt.Sprintf("bad auto-detect request %x", b))
+	}
+	seq := binary.LittleEndian.Uint16(b[2:])
+	requestType := binary.LittleEndian.Uint16(b[4:])
+	glog.Debugf("sec auto-detect request 0x%04x", requestType)
+	switch requestType {
+	case RDP_RTT_REQUEST_TYPE_CONTINUOUS, RDP_RTT_REQUEST_TYPE_CONNECTTIME:
+		return autoDetectResponse(seq, RDP_RTT_RESPONSE_TYPE, nil), nil
+	case RDP_BW_START_REQUEST_TYPE_CONTINUOUS, RDP_BW_START_REQUEST_TYPE_TUNNEL, RDP_BW_START_REQUEST_TYPE_CONNECTTIME:
+		a.start, a.bytes = time.Now(), 0
+	case RDP_BW_STOP_REQUEST_TYPE_CONNECTTIME, RDP_BW_STOP_REQUEST_TYPE_CONTINUOUS, RDP_BW_STOP_REQUEST_TYPE_TUNNEL:
+		if a.start.IsZero() {
+			return nil, errors.New("auto-detect bandwidth stop without start")
+		}
+		var responseType uint16 = RDP_BW_RESULTS_RESPONSE_CONTINUOUS
+		if requestType == RDP_BW_STOP_REQUEST_TYPE_CONNECTTIME {
+			responseType = RDP_BW_RESULTS_RESPONSE_CONNECTTIME
+		}
+		results := &bytes.Buffer{}
+		core.WriteUInt32LE(uint32(time.Since(a.start)/time.Millisecond), results)
+		core.WriteUInt32LE(a.bytes, results)
+		a.start = time.Time{}
+		return autoDetectResponse(seq, responseType, results.Bytes()), nil
+	}
+	// bandwidth payloads are only counted, network characteristics results
+	// need no response
+	return nil, nil
+}
+
+// autoDetectResponse returns the response of responseType to the request seq
+func autoDetectResponse(seq, responseType uint16, data []byte) []byte {
+	buff := &bytes.Buffer{}
+	core.WriteUInt8(uint8(6+len(data)), buff)
+	core.WriteUInt8(TYPE_ID_AUTODETECT_RESPONSE, buff)
+	core.WriteUInt16LE(seq, buff)
+	core.WriteUInt16LE(responseType, buff)
+	core.WriteBytes(data, buff)
+	return buff.Bytes()
+}
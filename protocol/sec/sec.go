@@ -5,10 +5,15 @@ import (
 	"crypto/md5"
 	"crypto/rc4"
 	"crypto/sha1"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"math/big"
+	"net"
+	"strings"
+	"time"
 	"unicode/utf16"
 
 	"github.com/lunixbochs/struc"
@@ -66,8 +71,20 @@ const (
 	INFO_AUDIOCAPTURE                  = 0x00200000
 	INFO_VIDEO_DISABLE                 = 0x00400000
 	INFO_CompressionTypeMask           = 0x00001E00
+	// PACKET_COMPR_TYPE_64K in INFO_CompressionTypeMask
+	INFO_COMPRESSION_TYPE_64K = 0x00000200
 )
 
+// InfoFlags are the flags of the client info packet
+type InfoFlags uint32
+
+// DefaultInfoFlags are sent unless SendClientInfo is given other flags
+const DefaultInfoFlags = InfoFlags(INFO_MOUSE | INFO_UNICODE | INFO_LOGONNOTIFY | INFO_LOGONERRORS | INFO_DISABLECTRLALTDEL | INFO_ENABLEWINDOWSKEY | INFO_AUTOLOGON)
+
+// CompressionInfoFlags advertise the MPPC bulk compression with a 64K
+// history, the RDP 6.0 and 6.1 types are not supported
+const CompressionInfoFlags = InfoFlags(INFO_COMPRESSION | INFO_COMPRESSION_TYPE_64K)
+
 const (
 	AF_INET  uint16 = 0x00002
 	AF_INET6        = 0x0017
@@ -89,22 +106,43 @@ const (
 	FASTPATH_OUTPUT_ENCRYPTED       = 0x2
 )
 
+const (
+	FASTPATH_INPUT_SECURE_CHECKSUM = 0x1
+	FASTPATH_INPUT_ENCRYPTED       = 0x2
+)
+
+/**
+ * ARC_CS_PRIVATE_PACKET
+ * @see MS-RDPBCGR 2.2.11.1.2.1 Client Auto-Reconnect Packet
+ */
 type ClientAutoReconnect struct {
 	CbAutoReconnectLen uint16
 	CbLen              uint32
 	Version            uint32
 	LogonId            uint32
 	SecVerifier        []byte
+	// ArcRandomBits of the server ARC_SC_PRIVATE_PACKET
+	arcRandomBits []byte
 }
 
+// NewClientAutoReconnect builds the client cookie from the logon id and random
+// received in the server auto-reconnect cookie
 func NewClientAutoReconnect(id uint32, random []byte) *ClientAutoReconnect {
-	return &ClientAutoReconnect{
+	a := &ClientAutoReconnect{
 		CbAutoReconnectLen: 28,
 		CbLen:              28,
 		Version:            1,
 		LogonId:            id,
-		SecVerifier:        nla.HMAC_MD5(random, random),
+		arcRandomBits:      random,
 	}
+	// client random is all zero with enhanced security
+	a.setClientRandom(make([]byte, 32))
+	return a
+}
+
+// SecVerifier is HMAC_MD5(ArcRandomBits, ClientRandom)
+func (a *ClientAutoReconnect) setClientRandom(clientRandom []byte) {
+	a.SecVerifier = nla.HMAC_MD5(a.arcRandomBits, clientRandom)
 }
 
 type RDPExtendedInfo struct {
@@ -124,12 +162,51 @@ func NewExtendedInfo(auto *ClientAutoReconnect) *RDPExtendedInfo {
 		ClientAddressFamily: AF_INET,
 		ClientAddress:       []byte{0, 0},
 		ClientDir:           []byte{0, 0},
-		ClientTimeZone:      make([]byte, 172),
+		ClientTimeZone:      timeZoneInfo(time.Now()),
 		ClientSessionId:     0,
 		AutoReconnect:       auto,
 	}
 }
 
+// unicode encodes s as a null terminated UTF-16LE string
+func unicode(s string) []byte {
+	buff := &bytes.Buffer{}
+	for _, ch := range utf16.Encode([]rune(s)) {
+		core.WriteUInt16LE(ch, buff)
+	}
+	core.WriteUInt16LE(0, buff)
+	return buff.Bytes()
+}
+
+/**
+ * TS_TIME_ZONE_INFORMATION of the zone of t, without daylight transitions
+ * @see https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-rdpbcgr/526ed635-d7a9-4d3c-bbe1-4e3fb17585f4
+ */
+func timeZoneInfo(t time.Time) []byte {
+	name, offset := t.Zone()
+	zoneName := make([]byte, 64)
+	copy(zoneName[:62], unicode(name))
+
+	buff := &bytes.Buffer{}
+	core.WriteUInt32LE(uint32(int32(-offset/60)), buff)
+	core.WriteBytes(zoneName, buff)
+	core.WriteBytes(make([]byte, 16), buff)
+	core.WriteUInt32LE(0, buff)
+	core.WriteBytes(zoneName, buff)
+	core.WriteBytes(make([]byte, 16), buff)
+	core.WriteUInt32LE(0, buff)
+	return buff.Bytes()
+}
+
+// SetClientAddress sets the address reported to the server
+func (o *RDPExtendedInfo) SetClientAddress(ip net.IP) {
+	o.ClientAddressFamily = AF_INET
+	if ip.To4() == nil {
+		o.ClientAddressFamily = AF_INET6
+	}
+	o.ClientAddress = unicode(ip.String())
+}
+
 func (o *RDPExtendedInfo) Serialize() []byte {
 	buff := &bytes.Buffer{}
 	core.WriteUInt16LE(o.ClientAddressFamily, buff)
@@ -171,7 +248,7 @@ type RDPInfo struct {
 func NewRDPInfo() *RDPInfo {
 	info := &RDPInfo{
 		//Flag: INFO_MOUSE | INFO_UNICODE | INFO_LOGONNOTIFY | INFO_LOGONERRORS | INFO_DISABLECTRLALTDEL | INFO_ENABLEWINDOWSKEY | INFO_FORCE_ENCRYPTED_CS_PDU,
-		Flag:           INFO_MOUSE | INFO_UNICODE | INFO_LOGONNOTIFY | INFO_LOGONERRORS | INFO_DISABLECTRLALTDEL | INFO_ENABLEWINDOWSKEY | INFO_AUTOLOGON,
+		Flag:           uint32(DefaultInfoFlags),
 		Domain:         []byte{0, 0},
 		UserName:       []byte{0, 0},
 		Password:       []byte{0, 0},
@@ -218,6 +295,26 @@ func readSecurityHeader(r io.Reader) *SecurityHeader {
 	return s
 }
 
+// HeartbeatPDU is sent by the server to keep an idle session alive
+type HeartbeatPDU struct {
+	Reserved uint8
+	// seconds between two heartbeats
+	Period uint8
+	// missed heartbeats before warning the user
+	Count1 uint8
+	// missed heartbeats before reconnecting
+	Count2 uint8
+}
+
+// readHeartbeat reads b as a heartbeat PDU, the basic security header
+// is present even without standard RDP security
+func readHeartbeat(b []byte) (*HeartbeatPDU, bool) {
+	if len(b) != 8 || binary.LittleEndian.Uint16(b)&HEARTBEAT == 0 {
+		return nil, false
+	}
+	return &HeartbeatPDU{b[4], b[5], b[6], b[7]}, true
+}
+
 type SEC struct {
 	emission.Emitter
 	transport   core.Transport
@@ -229,12 +326,16 @@ type SEC struct {
 	enableEncryption bool
 	//Enable Secure Mac generation
 	enableSecureCheckSum bool
-	//counter before update
+	//packets encrypted and decrypted, the keys are updated every 4096
 	nbEncryptedPacket int
 	nbDecryptedPacket int
 
+	//initialise decrypt and encrypt keys
+	initialDecrytKey  []byte
+	initialEncryptKey []byte
 	currentDecrytKey  []byte
 	currentEncryptKey []byte
+	encryptionMethod  uint32
 
 	//current rc4 tab
 	decryptRc4 *rc4.Cipher
@@ -259,6 +360,9 @@ func NewSEC(t core.Transport) *SEC {
 		nil,
 		nil,
 		nil,
+		0,
+		nil,
+		nil,
 		nil,
 	}
 
@@ -287,8 +391,22 @@ func (s *SEC) Close() error {
 	return s.transport.Close()
 }
 
+func (s *SEC) SetReadTimeout(d time.Duration) {
+	if t, ok := s.transport.(core.TimeoutSetter); ok {
+		t.SetReadTimeout(d)
+	}
+}
+
+func (s *SEC) SetWriteTimeout(d time.Duration) {
+	if t, ok := s.transport.(core.TimeoutSetter); ok {
+		t.SetWriteTimeout(d)
+	}
+}
+
 func (s *SEC) sendFlagged(flag uint16, data []byte) (n int, err error) {
-	glog.Debug("sendFlagged:", hex.EncodeToString(data))
+	if glog.Enabled(glog.DEBUG) {
+		glog.Debug("sendFlagged:", hex.EncodeToString(data))
+	}
 	b := s.encryt(flag, data)
 	return s.transport.Write(b)
 }
@@ -300,6 +418,18 @@ func (s *SEC) sendFlagged(flag uint16, data []byte) (n int, err error) {
 @return: {str} signature
 */
 func macData(macSaltKey, data []byte) []byte {
+	return signature(macSaltKey, data, nil)
+}
+
+// saltedMacData signs data with the number of packets encrypted before it
+// @see MS-RDPBCGR 5.3.6.1.1 Salted MAC Generation
+func saltedMacData(macSaltKey, data []byte, count int) []byte {
+	b := &bytes.Buffer{}
+	core.WriteUInt32LE(uint32(count), b)
+	return signature(macSaltKey, data, b.Bytes())
+}
+
+func signature(macSaltKey, data, salt []byte) []byte {
 	sha1Digest := sha1.New()
 	md5Digest := md5.New()
 
@@ -313,6 +443,7 @@ func macData(macSaltKey, data []byte) []byte {
 
 	sha1Digest.Write(b.Bytes())
 	sha1Digest.Write(data)
+	sha1Digest.Write(salt)
 
 	sha1Sig := sha1Digest.Sum(nil)
 
@@ -325,45 +456,93 @@ func macData(macSaltKey, data []byte) []byte {
 
 	return md5Digest.Sum(nil)
 }
-func (s *SEC) readEncryptedPayload(data []byte, checkSum bool) []byte {
-	r := bytes.NewReader(data)
-	sign, _ := core.ReadBytes(8, r)
-	glog.Debug("read sign:", sign)
-	encryptedPayload, _ := core.ReadBytes(r.Len(), r)
+
+// updateKey returns the key of the next 4096 packets
+// @see MS-RDPBCGR 5.3.7 Session Key Updates
+func updateKey(initialKey, currentKey []byte, method uint32) []byte {
+	sha1Digest := sha1.New()
+	sha1Digest.Write(initialKey)
+	sha1Digest.Write(bytes.Repeat([]byte{0x36}, 40))
+	sha1Digest.Write(currentKey)
+
+	md5Digest := md5.New()
+	md5Digest.Write(initialKey)
+	md5Digest.Write(bytes.Repeat([]byte{0x5c}, 48))
+	md5Digest.Write(sha1Digest.Sum(nil))
+	tempKey := md5Digest.Sum(nil)[:len(initialKey)]
+
+	rc, _ := rc4.NewCipher(tempKey)
+	key := make([]byte, len(tempKey))
+	rc.XORKeyStream(key, tempKey)
+	switch method {
+	case gcc.ENCRYPTION_FLAG_40BIT:
+		return gen40bits(key)
+	case gcc.ENCRYPTION_FLAG_56BIT:
+		return gen56bits(key)
+	}
+	return key
+}
+
+// readEncryptedPayload decrypts data and checks its signature, the server
+// signing with salted MACs turns them on for the client too
+func (s *SEC) readEncryptedPayload(data []byte, checkSum bool) ([]byte, error) {
+	if len(data) < 8 {
+		return nil, errors.New("sec: encrypted payload shorter than its signature")
+	}
+	sign, encryptedPayload := data[:8], data[8:]
+	if s.nbDecryptedPacket > 0 && s.nbDecryptedPacket%4096 == 0 {
+		s.currentDecrytKey = updateKey(s.initialDecrytKey, s.currentDecrytKey, s.encryptionMethod)
+		s.decryptRc4 = nil
+	}
 	if s.decryptRc4 == nil {
 		s.decryptRc4, _ = rc4.NewCipher(s.currentDecrytKey)
 	}
-	s.nbDecryptedPacket++
-	glog.Debug("nbDecryptedPacket:", s.nbDecryptedPacket)
 	plaintext := make([]byte, len(encryptedPayload))
 	s.decryptRc4.XORKeyStream(plaintext, encryptedPayload)
 
-	return plaintext
-
+	var mac []byte
+	if checkSum {
+		s.enableSecureCheckSum = true
+		mac = saltedMacData(s.macKey, plaintext, s.nbDecryptedPacket)
+	} else {
+		mac = macData(s.macKey, plaintext)
+	}
+	s.nbDecryptedPacket++
+	glog.Debug("nbDecryptedPacket:", s.nbDecryptedPacket)
+	if !bytes.Equal(mac[:8], sign) {
+		return nil, errors.New("sec: invalid MAC signature")
+	}
+	return plaintext, nil
 }
-func (s *SEC) writeEncryptedPayload(data []byte, checkSum bool) []byte {
-	if s.nbEncryptedPacket == 4096 {
 
+// writeEncryptedPayload encrypts data after its signature, updating the
+// key every 4096 packets
+func (s *SEC) writeEncryptedPayload(data []byte, checkSum bool) []byte {
+	if s.nbEncryptedPacket > 0 && s.nbEncryptedPacket%4096 == 0 {
+		s.currentEncryptKey = updateKey(s.initialEncryptKey, s.currentEncryptKey, s.encryptionMethod)
+		s.encryptRc4 = nil
+	}
+	if s.encryptRc4 == nil {
+		s.encryptRc4, _ = rc4.NewCipher(s.currentEncryptKey)
 	}
 
+	var sign []byte
 	if checkSum {
-		return []byte{}
+		sign = saltedMacData(s.macKey, data, s.nbEncryptedPacket)[:8]
+	} else {
+		sign = macData(s.macKey, data)[:8]
 	}
-
 	s.nbEncryptedPacket++
 	glog.Debug("nbEncryptedPacket:", s.nbEncryptedPacket)
-	b := &bytes.Buffer{}
-
-	sign := macData(s.macKey, data)[:8]
-	if s.encryptRc4 == nil {
-		s.encryptRc4, _ = rc4.NewCipher(s.currentEncryptKey)
-	}
 
-	plaintext := make([]byte, len(data))
-	s.encryptRc4.XORKeyStream(plaintext, data)
+	b := &bytes.Buffer{}
+	ciphertext := make([]byte, len(data))
+	s.encryptRc4.XORKeyStream(ciphertext, data)
 	b.Write(sign)
-	b.Write(plaintext)
-	glog.Debug("sign:", hex.EncodeToString(sign), "plaintext:", hex.EncodeToString(plaintext))
+	b.Write(ciphertext)
+	if glog.Enabled(glog.DEBUG) {
+		glog.Debug("sign:", hex.EncodeToString(sign), "ciphertext:", hex.EncodeToString(ciphertext))
+	}
 	return b.Bytes()
 }
 
@@ -391,9 +570,9 @@ func (s *SEC) encrytData(b []byte) []byte {
 	return s.encryt(flag, b)
 }
 
-func (s *SEC) decrytData(b []byte) []byte {
+func (s *SEC) decrytData(b []byte) ([]byte, error) {
 	if !s.enableEncryption {
-		return b
+		return b, nil
 	}
 
 	r := bytes.NewReader(b)
@@ -401,21 +580,26 @@ func (s *SEC) decrytData(b []byte) []byte {
 	_, _ = core.ReadUint16LE(r) //securityFlagHi
 	data, _ := core.ReadBytes(r.Len(), r)
 	if securityFlag&ENCRYPT != 0 {
-		data = s.readEncryptedPayload(data, securityFlag&SECURE_CHECKSUM != 0)
+		return s.readEncryptedPayload(data, securityFlag&SECURE_CHECKSUM != 0)
 	}
-	return data
+	return data, nil
 }
 
 type Client struct {
 	*SEC
 	userId    uint16
 	channelId uint16
-	//initialise decrypt and encrypt keys
-	initialDecrytKey  []byte
-	initialEncryptKey []byte
+	// keys of the licensing exchange, apart from the session keys
+	licenseMacKey []byte
+	licenseKey    []byte
+	// last licensing message, resent on request
+	licenseMessage []byte
 
 	fastPathListener core.FastPathListener
+	fastPathSender   core.FastPathSender
 	channelSender    core.ChannelSender
+
+	autoDetect autoDetector
 }
 
 func NewClient(t core.Transport) *Client {
@@ -432,39 +616,54 @@ func (c *Client) SetClientAutoReconnect(id uint32, random []byte) {
 }
 
 func (c *Client) SetAlternateShell(shell string) {
-	buff := &bytes.Buffer{}
-	for _, ch := range utf16.Encode([]rune(shell)) {
-		core.WriteUInt16LE(ch, buff)
-	}
-	core.WriteUInt16LE(0, buff)
-	c.info.AlternateShell = buff.Bytes()
+	c.info.AlternateShell = unicode(shell)
 }
 
 func (c *Client) SetUser(user string) {
-	buff := &bytes.Buffer{}
-	for _, ch := range utf16.Encode([]rune(user)) {
-		core.WriteUInt16LE(ch, buff)
-	}
-	core.WriteUInt16LE(0, buff)
-	c.info.UserName = buff.Bytes()
+	c.info.UserName = unicode(user)
 }
 
 func (c *Client) SetPwd(pwd string) {
-	buff := &bytes.Buffer{}
-	for _, ch := range utf16.Encode([]rune(pwd)) {
-		core.WriteUInt16LE(ch, buff)
-	}
-	core.WriteUInt16LE(0, buff)
-	c.info.Password = buff.Bytes()
+	c.info.Password = unicode(pwd)
 }
 
 func (c *Client) SetDomain(domain string) {
-	buff := &bytes.Buffer{}
-	for _, ch := range utf16.Encode([]rune(domain)) {
-		core.WriteUInt16LE(ch, buff)
+	c.info.Domain = unicode(domain)
+}
+
+func (c *Client) SetWorkingDir(dir string) {
+	c.info.WorkingDir = unicode(dir)
+}
+
+// SetClientAddress sets the client address of the extended info
+func (c *Client) SetClientAddress(ip net.IP) {
+	c.info.ExtendedInfo.SetClientAddress(ip)
+}
+
+/**
+ * SendClientInfo sets the logon fields of the client info packet.
+ * INFO_UNICODE is always set as the strings are sent in UTF-16,
+ * INFO_AUTOLOGON is added with a password so the server skips the
+ * logon screen. The packet goes out when the layer connects, or right
+ * away if it already has.
+ */
+func (c *Client) SendClientInfo(domain, user, pass, shell, workdir string, flags InfoFlags) {
+	if flags == 0 {
+		flags = DefaultInfoFlags
+	}
+	flags |= INFO_UNICODE
+	if pass != "" {
+		flags |= INFO_AUTOLOGON
+	}
+	c.info.Flag = uint32(flags)
+	c.SetDomain(domain)
+	c.SetUser(user)
+	c.SetPwd(pass)
+	c.SetAlternateShell(shell)
+	c.SetWorkingDir(workdir)
+	if c.clientData != nil {
+		c.sendInfoPkt()
 	}
-	core.WriteUInt16LE(0, buff)
-	c.info.Domain = buff.Bytes()
 }
 
 func (c *Client) connect(clientData []interface{}, serverData []interface{}, userId uint16, channels []t125.MCSChannelInfo) {
@@ -515,26 +714,28 @@ func (c *Client) ServerSecurityData() *gcc.ServerSecurityData {
 @return: {str} 40 bits data
 @see: http://msdn.microsoft.com/en-us/library/cc240785.aspx
 */
-//func gen40bits(data string)string{
-//    return "\xd1\x26\x9e" + data[:8][-5:]
-//}
+func gen40bits(data []byte) []byte {
+	return append([]byte{0xd1, 0x26, 0x9e}, data[3:8]...)
+}
+
 /*
 @summary: generate 56 bits data from 128 bits data
 @param data: {str} 128 bits data
 @return: {str} 56 bits data
 @see: http://msdn.microsoft.com/en-us/library/cc240785.aspx
 */
-//func gen56bits(data string) string{
-//   return "\xd1" + data[:8][-7:]
-//}
+func gen56bits(data []byte) []byte {
+	return append([]byte{0xd1}, data[1:8]...)
+}
+
 /*
- @summary: Generate particular signature from combination of sha1 and md5
- @see: http://msdn.microsoft.com/en-us/library/cc241992.aspx
- @param inputData: strange input (see doc)
- @param salt: salt for context call
- @param salt1: another salt (ex : client random)
- @param salt2: another another salt (ex: server random)
- @return : MD5(Salt + SHA1(Input + Salt + Salt1 + Salt2))
+@summary: Generate particular signature from combination of sha1 and md5
+@see: http://msdn.microsoft.com/en-us/library/cc241992.aspx
+@param inputData: strange input (see doc)
+@param salt: salt for context call
+@param salt1: another salt (ex : client random)
+@param salt2: another another salt (ex: server random)
+@return : MD5(Salt + SHA1(Input + Salt + Salt1 + Salt2))
 */
 func saltedHash(inputData, salt, salt1, salt2 []byte) []byte {
 	sha1Digest := sha1.New()
@@ -624,12 +825,11 @@ func generateKeys(clientRandom, serverRandom []byte, method uint32) ([]byte, []b
 	glog.Debug("SecondKey128:", hex.EncodeToString(initialSecondKey128))
 	//generate valid key
 	if method == gcc.ENCRYPTION_FLAG_40BIT {
-		//return gen40bits(macKey128), gen40bits(initialFirstKey128), gen40bits(initialSecondKey128)
+		return gen40bits(macKey128), gen40bits(initialFirstKey128), gen40bits(initialSecondKey128)
 	} else if method == gcc.ENCRYPTION_FLAG_56BIT {
-		//return gen56bits(macKey128), gen56bits(initialFirstKey128), gen56bits(initialSecondKey128)
-	} //else if method == gcc.ENCRYPTION_FLAG_128BIT{
+		return gen56bits(macKey128), gen56bits(initialFirstKey128), gen56bits(initialSecondKey128)
+	}
 	return macKey128, initialFirstKey128, initialSecondKey128
-	//}
 }
 
 type ClientSecurityExchangePDU struct {
@@ -651,12 +851,16 @@ func (c *Client) sendClientRandom() {
 
 	clientRandom := core.Random(32)
 	glog.Info("clientRandom:", hex.EncodeToString(clientRandom))
+	if c.info.ExtendedInfo.AutoReconnect != nil {
+		c.info.ExtendedInfo.AutoReconnect.setClientRandom(clientRandom)
+	}
 
 	serverRandom := c.ServerSecurityData().ServerRandom
 	glog.Info("ServerRandom:", hex.EncodeToString(serverRandom))
 
+	c.encryptionMethod = c.ServerSecurityData().EncryptionMethod
 	c.macKey, c.initialDecrytKey, c.initialEncryptKey = generateKeys(clientRandom,
-		serverRandom, c.ServerSecurityData().EncryptionMethod)
+		serverRandom, c.encryptionMethod)
 
 	//initialize keys
 	c.currentDecrytKey = c.initialDecrytKey
@@ -668,22 +872,9 @@ func (c *Client) sendClientRandom() {
 	}
 
 	ePublicKey, mPublicKey := c.ServerSecurityData().ServerCertificate.CertData.GetPublicKey()
-	b := new(big.Int).SetBytes(core.Reverse(mPublicKey))
-	e := new(big.Int).SetInt64(int64(ePublicKey))
-	d := new(big.Int).SetBytes(core.Reverse(clientRandom))
-	r := new(big.Int).Exp(d, e, b)
-	var ret []byte
-	if len(b.Bytes()) > 0 && len(r.Bytes()) > len(b.Bytes()) {
-		ret = r.Bytes()[:len(b.Bytes())]
-	} else {
-		ln := len(r.Bytes())
-		if ln < 1 {
-			ln = 1
-		}
-		ret = r.Bytes()[:ln]
-	}
+	ret := rsaEncrypt(clientRandom, ePublicKey, mPublicKey)
 	message := ClientSecurityExchangePDU{}
-	message.EncryptedClientRandom = core.Reverse(ret)
+	message.EncryptedClientRandom = ret
 	message.Length = uint32(len(message.EncryptedClientRandom) + 8)
 	message.Padding = make([]byte, 8)
 
@@ -698,7 +889,7 @@ func (c *Client) sendInfoPkt() {
 	}
 
 	glog.Debug("RdpVersion:", c.ClientCoreData().RdpVersion, ":", gcc.RDP_VERSION_5_PLUS)
-	c.sendFlagged(secFlag, c.info.Serialize(c.ClientCoreData().RdpVersion == gcc.RDP_VERSION_5_PLUS))
+	c.sendFlagged(secFlag, c.info.Serialize(c.ClientCoreData().RdpVersion >= gcc.RDP_VERSION_5_PLUS))
 }
 
 func (c *Client) recvLicenceInfo(channel string, s []byte) {
@@ -710,57 +901,103 @@ func (c *Client) recvLicenceInfo(channel string, s []byte) {
 		return
 	}
 
+	var err error
 	p := lic.ReadLicensePacket(r)
 	switch p.BMsgtype {
-	case lic.NEW_LICENSE:
+	case lic.NEW_LICENSE, lic.UPGRADE_LICENSE:
 		glog.Info("sec NEW_LICENSE")
 		c.Emit("success")
 		goto connect
 	case lic.ERROR_ALERT:
 		message := p.LicensingMessage.(*lic.ErrorMessage)
 		glog.Info("sec ERROR_ALERT and ErrorCode:", message.DwErrorCode)
-		if message.DwErrorCode == lic.STATUS_VALID_CLIENT && message.DwStateTransaction == lic.ST_NO_TRANSITION {
+		switch message.DwStateTransaction {
+		case lic.ST_NO_TRANSITION:
+			// STATUS_VALID_CLIENT, or a server going on without license
 			goto connect
+		case lic.ST_TOTAL_ABORT:
+			c.Emit("error", errors.New(fmt.Sprintf("license error 0x%x", message.DwErrorCode)))
+			return
+		case lic.ST_RESEND_LAST_MESSAGE:
+			if c.licenseMessage != nil {
+				c.sendFlagged(LICENSE_PKT, c.licenseMessage)
+			}
 		}
 		goto retry
 	case lic.LICENSE_REQUEST:
 		glog.Info("sec LICENSE_REQUEST")
-		c.sendClientNewLicenseRequest(p.LicensingMessage.([]byte))
-		goto retry
+		err = c.sendClientNewLicenseRequest(p.LicensingMessage.([]byte))
 	case lic.PLATFORM_CHALLENGE:
 		glog.Info("sec PLATFORM_CHALLENGE")
-		c.sendClientChallengeResponse(p.LicensingMessage.([]byte))
-		goto retry
+		err = c.sendClientChallengeResponse(p.LicensingMessage.([]byte))
 	default:
 		glog.Error("Not a valid license packet")
 		c.Emit("error", errors.New("Not a valid license packet"))
 		return
 	}
+	if err != nil {
+		c.Emit("error", err)
+		return
+	}
+
+retry:
+	c.transport.Once("sec", c.recvLicenceInfo)
+	return
 
 connect:
 	c.transport.On("sec", c.recvData)
 	c.Emit("connect", c.clientData[0].(*gcc.ClientCoreData), c.userId, c.channelId)
-	return
+}
 
-retry:
-	c.transport.Once("sec", c.recvLicenceInfo)
-	return
+// sendLicense sends the licensing message of msgType, kept to resend it
+func (c *Client) sendLicense(msgType uint8, message interface{}) {
+	buff := &bytes.Buffer{}
+	struc.Pack(buff, message)
+	c.licenseMessage = lic.WriteLicensePacket(msgType, buff.Bytes())
+	c.sendFlagged(LICENSE_PKT, c.licenseMessage)
+}
+
+// rsaEncrypt encrypts the little endian data with the little endian modulus,
+// the result has the size of the modulus
+func rsaEncrypt(data []byte, e uint32, modulus []byte) []byte {
+	m := new(big.Int).SetBytes(reversed(modulus))
+	d := new(big.Int).SetBytes(reversed(data))
+	r := new(big.Int).Exp(d, big.NewInt(int64(e)), m)
+	b := make([]byte, len(modulus))
+	r.FillBytes(b)
+	return core.Reverse(b)
 }
 
-func (c *Client) sendClientNewLicenseRequest(data []byte) {
+// reversed returns a reversed copy, core.Reverse works in place
+func reversed(b []byte) []byte {
+	return core.Reverse(append([]byte{}, b...))
+}
+
+// ansi returns the null terminated UTF-16LE s as a null terminated string
+func ansi(s []byte) []byte {
+	return append([]byte(strings.TrimRight(core.UnicodeDecode(s), "\x00")), 0)
+}
+
+/**
+ * sendClientNewLicenseRequest answers the license request with the
+ * pre-master secret encrypted with the server public key
+ * @see MS-RDPELE 2.2.2.2 Client New License Request
+ */
+func (c *Client) sendClientNewLicenseRequest(data []byte) error {
 	var req lic.ServerLicenseRequest
-	struc.Unpack(bytes.NewReader(data), &req)
+	if err := struc.Unpack(bytes.NewReader(data), &req); err != nil {
+		return errors.New(fmt.Sprintf("license request: %v", err))
+	}
 
 	var sc gcc.ServerCertificate
 	if c.ServerSecurityData().ServerCertificate.DwVersion != 0 {
 		sc = c.ServerSecurityData().ServerCertificate
-	} else {
-		rd := bytes.NewReader(req.ServerCertificate.BlobData)
-		err := sc.Unpack(rd)
-		if err != nil {
-			glog.Error(err)
-			return
-		}
+	} else if err := sc.Unpack(bytes.NewReader(req.ServerCertificate.BlobData)); err != nil {
+		return errors.New(fmt.Sprintf("license server certificate: %v", err))
+	}
+	ePublicKey, mPublicKey := sc.CertData.GetPublicKey()
+	if len(mPublicKey) == 0 {
+		return errors.New("license server certificate without public key")
 	}
 
 	serverRandom := req.ServerRandom
@@ -768,119 +1005,172 @@ func (c *Client) sendClientNewLicenseRequest(data []byte) {
 	preMasterSecret := core.Random(48)
 	masSecret := masterSecret(preMasterSecret, clientRandom, serverRandom)
 	sessionKeyBlob := masterSecret(masSecret, serverRandom, clientRandom)
-	c.macKey = sessionKeyBlob[:16]
-	c.initialDecrytKey = finalHash(sessionKeyBlob[16:32], clientRandom, serverRandom)
-
-	//format message
-	message := &lic.ClientNewLicenseRequest{}
-	message.ClientRandom = clientRandom
-
-	buff := &bytes.Buffer{}
-
-	ePublicKey, mPublicKey := sc.CertData.GetPublicKey()
-	b := new(big.Int).SetBytes(core.Reverse(mPublicKey))
-	e := new(big.Int).SetInt64(int64(ePublicKey))
-	d := new(big.Int).SetBytes(core.Reverse(clientRandom))
-	r := new(big.Int).Exp(d, e, b)
-	var ret []byte
-	if len(b.Bytes()) > 0 {
-		ret = r.Bytes()[:len(b.Bytes())]
-	} else {
-		ln := len(r.Bytes())
-		if ln < 1 {
-			ln = 1
-		}
-		ret = r.Bytes()[:ln]
+	c.licenseMacKey = sessionKeyBlob[:16]
+	c.licenseKey = finalHash(sessionKeyBlob[16:32], clientRandom, serverRandom)
+
+	message := &lic.ClientNewLicenseRequest{
+		PreferredKeyExchangeAlg:  lic.KEY_EXCHANGE_ALG_RSA,
+		PlatformId:               lic.CLIENT_OS_ID_WINNT_POST_52 | lic.CLIENT_IMAGE_ID_MICROSOFT,
+		ClientRandom:             clientRandom,
+		EncryptedPreMasterSecret: *lic.NewLicenseBinaryBlob(lic.BB_RANDOM_BLOB, append(rsaEncrypt(preMasterSecret, ePublicKey, mPublicKey), make([]byte, 8)...)),
+		ClientUserName:           *lic.NewLicenseBinaryBlob(lic.BB_CLIENT_USER_NAME_BLOB, ansi(c.info.UserName)),
+		ClientMachineName:        *lic.NewLicenseBinaryBlob(lic.BB_CLIENT_MACHINE_NAME_BLOB, ansi(c.ClientCoreData().ClientName[:])),
 	}
-	buff.Write(core.Reverse(ret))
-	buff.Write([]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
-	message.EncryptedPreMasterSecret.BlobData = buff.Bytes()
-
-	buff.Reset()
-	buff.Write(c.ClientCoreData().ClientName[:])
-	buff.Write([]byte{0x00})
-	message.ClientMachineName.BlobData = buff.Bytes()
-
-	buff.Reset()
-	buff.Write(c.info.UserName)
-	buff.Write([]byte{0x00})
-	message.ClientUserName.BlobData = buff.Bytes()
-
-	buff.Reset()
-	struc.Pack(buff, message)
-
-	c.sendFlagged(LICENSE_PKT, b.Bytes())
-
+	c.sendLicense(lic.NEW_LICENSE_REQUEST, message)
+	return nil
 }
 
-func (c *Client) sendClientChallengeResponse(data []byte) {
+/**
+ * sendClientChallengeResponse returns the platform challenge with the
+ * encrypted hardware id, signed with the decrypted challenge
+ * @see MS-RDPELE 2.2.2.5 Client Platform Challenge Response
+ */
+func (c *Client) sendClientChallengeResponse(data []byte) error {
+	if c.licenseKey == nil {
+		return errors.New("platform challenge before license request")
+	}
 	var pc lic.ServerPlatformChallenge
-	struc.Unpack(bytes.NewReader(data), &pc)
+	if err := struc.Unpack(bytes.NewReader(data), &pc); err != nil {
+		return errors.New(fmt.Sprintf("platform challenge: %v", err))
+	}
 
+	// the challenge should be TEST in unicode
 	serverEncryptedChallenge := pc.EncryptedPlatformChallenge.BlobData
-	//decrypt server challenge
-	//it should be TEST word in unicode format
-	rc, _ := rc4.NewCipher(c.initialDecrytKey)
-	serverChallenge := make([]byte, 20)
+	serverChallenge := make([]byte, len(serverEncryptedChallenge))
+	rc, _ := rc4.NewCipher(c.licenseKey)
 	rc.XORKeyStream(serverChallenge, serverEncryptedChallenge)
-	//if serverChallenge != "T\x00E\x00S\x00T\x00\x00\x00":
-	//raise InvalidExpectedDataException("bad license server challenge")
 
-	//generate hwid
-	b := &bytes.Buffer{}
-	b.Write(c.ClientCoreData().ClientName[:])
-	b.Write(c.info.UserName)
-	for i := 0; i < 2; i++ {
-		b.Write([]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+	hwid := &bytes.Buffer{}
+	core.WriteUInt32LE(lic.CLIENT_OS_ID_WINNT_POST_52|lic.CLIENT_IMAGE_ID_MICROSOFT, hwid)
+	sum := md5.Sum(append(append([]byte{}, c.ClientCoreData().ClientName[:]...), c.info.UserName...))
+	hwid.Write(sum[:])
+	encryptedHWID := make([]byte, hwid.Len())
+	rc, _ = rc4.NewCipher(c.licenseKey)
+	rc.XORKeyStream(encryptedHWID, hwid.Bytes())
+
+	message := &lic.ClientPLatformChallengeResponse{
+		EncryptedPlatformChallengeResponse: *lic.NewLicenseBinaryBlob(lic.BB_ENCRYPTED_DATA_BLOB, serverEncryptedChallenge),
+		EncryptedHWID:                      *lic.NewLicenseBinaryBlob(lic.BB_ENCRYPTED_DATA_BLOB, encryptedHWID),
+		MACData:                            macData(c.licenseMacKey, append(serverChallenge, hwid.Bytes()...))[:16],
 	}
-	hwid := b.Bytes()[:20]
-
-	encryptedHWID := make([]byte, 20)
-	rc.XORKeyStream(encryptedHWID, hwid)
-
-	b.Reset()
-	b.Write(serverChallenge)
-	b.Write(hwid)
-
-	message := &lic.ClientPLatformChallengeResponse{}
-	message.EncryptedPlatformChallengeResponse.BlobData = serverEncryptedChallenge
-	message.EncryptedHWID.BlobData = encryptedHWID
-	message.MACData = macData(c.macKey, b.Bytes())[:16]
-
-	b.Reset()
-	struc.Pack(b, message)
-	c.sendFlagged(LICENSE_PKT, b.Bytes())
+	c.sendLicense(lic.PLATFORM_CHALLENGE_RESPONSE, message)
+	return nil
 }
 
 func (c *Client) recvData(channel string, s []byte) {
-	glog.Debug("sec recvData", hex.EncodeToString(s))
-	glog.Debug(channel, len(s), ":", s)
-	data := c.decrytData(s)
+	if glog.Enabled(glog.DEBUG) {
+		glog.Debug("sec recvData", hex.EncodeToString(s))
+		glog.Debug(channel, len(s), ":", s)
+	}
+	c.autoDetect.received(len(s))
+	if c.ClientCoreData().EarlyCapabilityFlags&gcc.RNS_UD_CS_SUPPORT_HEARTBEAT_PDU != 0 {
+		if h, ok := readHeartbeat(s); ok {
+			glog.Debugf("sec heartbeat period %ds", h.Period)
+			c.Emit("heartbeat", h)
+			return
+		}
+	}
+	if channel == t125.MESSAGE_CHANNEL_NAME {
+		c.recvMessageChannel(s)
+		return
+	}
+	data, err := c.decrytData(s)
+	if err != nil {
+		c.Emit("error", err)
+		return
+	}
 	if channel != t125.GLOBAL_CHANNEL_NAME {
 		c.Emit("channel", channel, data)
 		return
 	}
 	c.Emit("data", data)
 }
+
+// recvMessageChannel answers the auto-detect requests of the message
+// channel, its PDUs always start with a security header
+func (c *Client) recvMessageChannel(s []byte) {
+	if len(s) < 4 {
+		c.Emit("error", errors.New("sec: short message channel pdu"))
+		return
+	}
+	flag := binary.LittleEndian.Uint16(s)
+	data := s[4:]
+	if c.enableEncryption && flag&ENCRYPT != 0 {
+		var err error
+		if data, err = c.readEncryptedPayload(data, flag&SECURE_CHECKSUM != 0); err != nil {
+			c.Emit("error", err)
+			return
+		}
+	}
+	if flag&AUTODETECT_REQ == 0 {
+		glog.Debugf("sec skip message channel pdu 0x%04x", flag)
+		return
+	}
+	response, err := c.autoDetect.request(data)
+	if err != nil {
+		c.Emit("error", err)
+		return
+	}
+	if response == nil {
+		return
+	}
+	flag = AUTODETECT_RSP
+	if c.enableEncryption {
+		flag |= ENCRYPT
+		if c.enableSecureCheckSum {
+			flag |= SECURE_CHECKSUM
+		}
+	}
+	if _, err = c.channelSender.SendToChannel(t125.MESSAGE_CHANNEL_NAME, c.encryt(flag, response)); err != nil {
+		c.Emit("error", err)
+	}
+}
+
 func (c *Client) SetFastPathListener(f core.FastPathListener) {
 	c.fastPathListener = f
 }
 
 func (c *Client) RecvFastPath(secFlag byte, s []byte) {
+	c.autoDetect.received(len(s))
 	data := s
 	if c.enableEncryption && secFlag&FASTPATH_OUTPUT_ENCRYPTED != 0 {
-		data = c.readEncryptedPayload(s, secFlag&FASTPATH_OUTPUT_SECURE_CHECKSUM != 0)
+		var err error
+		if data, err = c.readEncryptedPayload(s, secFlag&FASTPATH_OUTPUT_SECURE_CHECKSUM != 0); err != nil {
+			c.Emit("error", err)
+			return
+		}
 	}
 	c.fastPathListener.RecvFastPath(secFlag, data)
 }
 
+func (c *Client) SetFastPathSender(f core.FastPathSender) {
+	c.fastPathSender = f
+}
+
+// SendFastPath encrypts the fast path input data when the session is encrypted
+func (c *Client) SendFastPath(secFlag byte, data []byte) (int, error) {
+	if c.fastPathSender == nil {
+		return 0, errors.New("sec: no fast path sender")
+	}
+	if c.enableEncryption {
+		secFlag |= FASTPATH_INPUT_ENCRYPTED
+		if c.enableSecureCheckSum {
+			secFlag |= FASTPATH_INPUT_SECURE_CHECKSUM
+		}
+		data = c.writeEncryptedPayload(data, c.enableSecureCheckSum)
+	}
+	return c.fastPathSender.SendFastPath(secFlag, data)
+}
+
 func (c *Client) SetChannelSender(f core.ChannelSender) {
 	c.channelSender = f
 }
 
 func (c *Client) SendToChannel(channel string, b []byte) (int, error) {
 	if !c.enableEncryption {
-		glog.Debug("Sec Client write", hex.EncodeToString(b))
+		if glog.Enabled(glog.DEBUG) {
+			glog.Debug("Sec Client write", hex.EncodeToString(b))
+		}
 		return c.channelSender.SendToChannel(channel, b)
 	}
 	var flag uint16 = ENCRYPT
@@ -893,6 +1183,8 @@ func (c *Client) SendToChannel(channel string, b []byte) (int, error) {
 	core.WriteUInt16LE(flag, buff)
 	core.WriteUInt16LE(0, buff)
 	core.WriteBytes(data, buff)
-	glog.Debug("Sec Client write", channel, hex.EncodeToString(buff.Bytes()))
+	if glog.Enabled(glog.DEBUG) {
+		glog.Debug("Sec Client write", channel, hex.EncodeToString(buff.Bytes()))
+	}
 	return c.channelSender.SendToChannel(channel, buff.Bytes())
 }
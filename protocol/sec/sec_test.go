@@ -0,0 +1,355 @@
+package sec
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/rsa"
+	"encoding/binary"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lunixbochs/struc"
+	"github.com/tomatome/grdp/core"
+	"github.com/tomatome/grdp/emission"
+	"github.com/tomatome/grdp/glog"
+	"github.com/tomatome/grdp/protocol/lic"
+	"github.com/tomatome/grdp/protocol/t125"
+	"github.com/tomatome/grdp/protocol/t125/gcc"
+)
+
+func init() {
+	glog.SetLevel(glog.NONE)
+}
+
+func TestGenerateKeys(t *testing.T) {
+	clientRandom := bytes.Repeat([]byte{0x11}, 32)
+	serverRandom := bytes.Repeat([]byte{0x22}, 32)
+
+	mac, decrypt, encrypt := generateKeys(clientRandom, serverRandom, gcc.ENCRYPTION_FLAG_128BIT)
+	if len(mac) != 16 || len(decrypt) != 16 || len(encrypt) != 16 {
+		t.Fatal("expect 128 bits keys", len(mac), len(decrypt), len(encrypt))
+	}
+	if bytes.Equal(decrypt, encrypt) {
+		t.Error("decrypt and encrypt keys are the same")
+	}
+
+	mac40, decrypt40, encrypt40 := generateKeys(clientRandom, serverRandom, gcc.ENCRYPTION_FLAG_40BIT)
+	for i, k := range [][]byte{mac40, decrypt40, encrypt40} {
+		full := [][]byte{mac, decrypt, encrypt}[i]
+		if len(k) != 8 || !bytes.Equal(k[:3], []byte{0xd1, 0x26, 0x9e}) || !bytes.Equal(k[3:], full[3:8]) {
+			t.Errorf("bad 40 bits key %x from %x", k, full)
+		}
+	}
+
+	mac56, _, _ := generateKeys(clientRandom, serverRandom, gcc.ENCRYPTION_FLAG_56BIT)
+	if len(mac56) != 8 || mac56[0] != 0xd1 || !bytes.Equal(mac56[1:], mac[1:8]) {
+		t.Errorf("bad 56 bits key %x", mac56)
+	}
+}
+
+func TestSendClientInfo(t *testing.T) {
+	c := &Client{SEC: &SEC{info: NewRDPInfo()}}
+	c.SendClientInfo("CORP", "bob", "pässword", "", `C:\`, InfoFlags(INFO_MOUSE))
+	c.SetClientAddress(net.ParseIP("::1"))
+
+	b := c.info.Serialize(true)
+	flag := binary.LittleEndian.Uint32(b[4:])
+	if flag != INFO_MOUSE|INFO_UNICODE|INFO_AUTOLOGON {
+		t.Errorf("bad flags %x", flag)
+	}
+	// lengths exclude the null terminator
+	for i, n := range []uint16{8, 6, 16, 0, 6} {
+		if l := binary.LittleEndian.Uint16(b[8+2*i:]); l != n {
+			t.Errorf("field %d has length %d, expect %d", i, l, n)
+		}
+	}
+	if !bytes.Equal(c.info.UserName, []byte{'b', 0, 'o', 0, 'b', 0, 0, 0}) {
+		t.Errorf("bad user %x", c.info.UserName)
+	}
+
+	ext := b[18+10+8+18+2+8:]
+	if family := binary.LittleEndian.Uint16(ext); family != AF_INET6 {
+		t.Error("bad address family", family)
+	}
+	if l := binary.LittleEndian.Uint16(ext[2:]); l != 8 {
+		t.Error("bad address length", l)
+	}
+	if len(c.info.ExtendedInfo.ClientTimeZone) != 172 {
+		t.Error("bad time zone length", len(c.info.ExtendedInfo.ClientTimeZone))
+	}
+
+	c.SendClientInfo("", "guest", "", "", "", 0)
+	if c.info.Flag&INFO_AUTOLOGON == 0 || c.info.Flag&INFO_COMPRESSION != 0 || c.info.Flag != uint32(DefaultInfoFlags) {
+		t.Errorf("expect default flags, get %x", c.info.Flag)
+	}
+}
+
+func TestTimeZoneInfo(t *testing.T) {
+	tz := timeZoneInfo(time.Date(2020, 1, 1, 0, 0, 0, 0, time.FixedZone("CET", 3600)))
+	if len(tz) != 172 {
+		t.Fatal("bad length", len(tz))
+	}
+	if bias := int32(binary.LittleEndian.Uint32(tz)); bias != -60 {
+		t.Error("bad bias", bias)
+	}
+	if !bytes.Equal(tz[4:10], []byte{'C', 0, 'E', 0, 'T', 0}) {
+		t.Errorf("bad name %x", tz[4:10])
+	}
+}
+
+func TestRecvHeartbeat(t *testing.T) {
+	c := &Client{SEC: &SEC{Emitter: *emission.NewEmitter()}}
+	c.clientData = []interface{}{gcc.NewClientCoreData()}
+	var (
+		heartbeat *HeartbeatPDU
+		data      [][]byte
+	)
+	c.On("heartbeat", func(h *HeartbeatPDU) {
+		heartbeat = h
+	}).On("data", func(b []byte) {
+		data = append(data, b)
+	}).On("error", func(err error) {
+		t.Error("unexpected error", err)
+	})
+
+	c.recvData(t125.GLOBAL_CHANNEL_NAME, []byte{0x00, 0x40, 0x00, 0x00, 0x00, 30, 2, 5})
+	if heartbeat == nil || *heartbeat != (HeartbeatPDU{0, 30, 2, 5}) {
+		t.Errorf("bad heartbeat %+v", heartbeat)
+	}
+	// the session goes on after the heartbeat
+	pdu := []byte{0x08, 0x00, 0x17, 0x00, 0xea, 0x03, 0x01, 0x00}
+	c.recvData(t125.GLOBAL_CHANNEL_NAME, pdu)
+	if len(data) != 1 || !bytes.Equal(data[0], pdu) {
+		t.Errorf("get data %x", data)
+	}
+
+	// heartbeats are only expected when the client supports them
+	heartbeat = nil
+	c.ClientCoreData().EarlyCapabilityFlags &^= gcc.RNS_UD_CS_SUPPORT_HEARTBEAT_PDU
+	c.recvData(t125.GLOBAL_CHANNEL_NAME, []byte{0x00, 0x40, 0x00, 0x00, 0x00, 30, 2, 5})
+	if heartbeat != nil || len(data) != 2 {
+		t.Error("heartbeat without support", heartbeat, len(data))
+	}
+}
+
+type channelCapture struct {
+	channels []string
+	writes   [][]byte
+}
+
+func (c *channelCapture) SendToChannel(channel string, b []byte) (int, error) {
+	c.channels = append(c.channels, channel)
+	c.writes = append(c.writes, b)
+	return len(b), nil
+}
+
+func TestRecvAutoDetect(t *testing.T) {
+	c := &Client{SEC: &SEC{Emitter: *emission.NewEmitter()}}
+	c.clientData = []interface{}{gcc.NewClientCoreData()}
+	sender := &channelCapture{}
+	c.SetChannelSender(sender)
+	c.On("error", func(err error) {
+		t.Error("unexpected error", err)
+	})
+	header := []byte{AUTODETECT_REQ & 0xff, AUTODETECT_REQ >> 8, 0, 0}
+
+	// rtt measure request of sequence 7
+	c.recvData(t125.MESSAGE_CHANNEL_NAME, append(header, 0x06, 0x00, 0x07, 0x00, 0x01, 0x10))
+	if len(sender.writes) != 1 || sender.channels[0] != t125.MESSAGE_CHANNEL_NAME ||
+		!bytes.Equal(sender.writes[0], []byte{0x00, 0x20, 0, 0, 0x06, 0x01, 0x07, 0x00, 0x00, 0x00}) {
+		t.Fatalf("bad rtt response %x", sender.writes)
+	}
+
+	// connect-time bandwidth measure of a 10 bytes payload
+	c.recvData(t125.MESSAGE_CHANNEL_NAME, append(header, 0x06, 0x00, 0x08, 0x00, 0x14, 0x10))
+	c.recvData(t125.MESSAGE_CHANNEL_NAME, append(header, 0x08, 0x00, 0x09, 0x00, 0x02, 0x00, 0x0a, 0x00, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0))
+	c.recvData(t125.MESSAGE_CHANNEL_NAME, append(header, 0x08, 0x00, 0x0a, 0x00, 0x2b, 0x00, 0x00, 0x00))
+	if len(sender.writes) != 2 {
+		t.Fatal("expect bandwidth results, get", len(sender.writes))
+	}
+	results := sender.writes[1]
+	if len(results) != 18 || !bytes.Equal(results[:10], []byte{0x00, 0x20, 0, 0, 0x0e, 0x01, 0x0a, 0x00, 0x03, 0x00}) ||
+		binary.LittleEndian.Uint32(results[14:]) != 22+12 {
+		t.Errorf("bad bandwidth results %x", results)
+	}
+}
+
+type transportCapture struct {
+	emission.Emitter
+	writes [][]byte
+}
+
+func (t *transportCapture) Read(b []byte) (int, error)    { return 0, nil }
+func (t *transportCapture) Close() error                  { return nil }
+func (t *transportCapture) SetReadTimeout(time.Duration)  {}
+func (t *transportCapture) SetWriteTimeout(time.Duration) {}
+func (t *transportCapture) Write(b []byte) (int, error) {
+	t.writes = append(t.writes, b)
+	return len(b), nil
+}
+
+// licenseClient returns a client whose server certificate has the public key of k
+func licenseClient(k *rsa.PrivateKey) (*Client, *transportCapture) {
+	tr := &transportCapture{Emitter: *emission.NewEmitter()}
+	c := &Client{SEC: NewSEC(tr)}
+	c.SetUser("bob")
+	server := gcc.NewServerSecurityData()
+	server.ServerCertificate = gcc.ServerCertificate{DwVersion: 1, CertData: &gcc.ProprietaryServerCertificate{
+		PublicKeyBlob: gcc.RSAPublicKey{PubExp: uint32(k.E), Modulus: reversed(k.N.Bytes())},
+	}}
+	c.clientData = []interface{}{gcc.NewClientCoreData()}
+	c.serverData = []interface{}{gcc.NewServerCoreData(), server}
+	return c, tr
+}
+
+// licensePacket wraps the licensing message in a security header
+func licensePacket(msgType uint8, message interface{}) []byte {
+	buff := &bytes.Buffer{}
+	struc.Pack(buff, message)
+	return append([]byte{LICENSE_PKT & 0xff, LICENSE_PKT >> 8, 0, 0}, lic.WriteLicensePacket(msgType, buff.Bytes())...)
+}
+
+// errorAlert returns a license error message without blob
+func errorAlert(code, state uint32) []byte {
+	buff := &bytes.Buffer{}
+	core.WriteUInt32LE(code, buff)
+	core.WriteUInt32LE(state, buff)
+	core.WriteUInt16LE(lic.BB_ERROR_BLOB, buff)
+	core.WriteUInt16LE(0, buff)
+	return append([]byte{LICENSE_PKT & 0xff, LICENSE_PKT >> 8, 0, 0}, lic.WriteLicensePacket(lic.ERROR_ALERT, buff.Bytes())...)
+}
+
+func TestLicensing(t *testing.T) {
+	k, err := rsa.GenerateKey(rand.Reader, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, tr := licenseClient(k)
+	connected := false
+	c.On("connect", func(*gcc.ClientCoreData, uint16, uint16) {
+		connected = true
+	})
+
+	serverRandom := bytes.Repeat([]byte{0x5a}, 32)
+	c.recvLicenceInfo(t125.GLOBAL_CHANNEL_NAME, licensePacket(lic.LICENSE_REQUEST, &lic.ServerLicenseRequest{
+		ServerRandom: serverRandom,
+		ProductInfo:  lic.ProductInformation{CbCompanyName: 2, PbCompanyName: []byte{'M', 0}, CbProductId: 2, PbProductId: []byte{'A', 0}},
+	}))
+	if len(tr.writes) != 1 {
+		t.Fatal("expect a new license request")
+	}
+	w := tr.writes[0]
+	if w[4] != lic.NEW_LICENSE_REQUEST || int(binary.LittleEndian.Uint16(w[6:])) != len(w)-4 {
+		t.Fatalf("bad preamble %x", w[:8])
+	}
+	var req lic.ClientNewLicenseRequest
+	if err := struc.Unpack(bytes.NewReader(w[8:]), &req); err != nil {
+		t.Fatal(err)
+	}
+	if req.EncryptedPreMasterSecret.WBlobType != lic.BB_RANDOM_BLOB || len(req.EncryptedPreMasterSecret.BlobData) != 64+8 {
+		t.Fatalf("bad encrypted pre-master secret %+v", req.EncryptedPreMasterSecret)
+	}
+	// the server decrypts the pre-master secret and derives the same keys
+	m := new(big.Int).SetBytes(reversed(req.EncryptedPreMasterSecret.BlobData[:64]))
+	preMasterSecret := reversed(new(big.Int).Exp(m, k.D, k.N).Bytes())
+	sessionKeyBlob := masterSecret(masterSecret(preMasterSecret, req.ClientRandom, serverRandom), serverRandom, req.ClientRandom)
+	if !bytes.Equal(c.licenseKey, finalHash(sessionKeyBlob[16:32], req.ClientRandom, serverRandom)) {
+		t.Error("license key mismatch")
+	}
+	if !bytes.Equal(req.ClientUserName.BlobData, []byte("bob\x00")) {
+		t.Errorf("bad user name %q", req.ClientUserName.BlobData)
+	}
+
+	// platform challenge of "TEST"
+	challenge := []byte{'T', 0, 'E', 0, 'S', 0, 'T', 0, 0, 0}
+	encrypted := make([]byte, len(challenge))
+	rc, _ := rc4.NewCipher(c.licenseKey)
+	rc.XORKeyStream(encrypted, challenge)
+	c.recvLicenceInfo(t125.GLOBAL_CHANNEL_NAME, licensePacket(lic.PLATFORM_CHALLENGE, &lic.ServerPlatformChallenge{
+		EncryptedPlatformChallenge: *lic.NewLicenseBinaryBlob(lic.BB_ANY_BLOB, encrypted),
+	}))
+	w = tr.writes[1]
+	var resp lic.ClientPLatformChallengeResponse
+	if w[4] != lic.PLATFORM_CHALLENGE_RESPONSE || struc.Unpack(bytes.NewReader(w[8:]), &resp) != nil {
+		t.Fatalf("bad challenge response %x", w)
+	}
+	hwid := make([]byte, len(resp.EncryptedHWID.BlobData))
+	rc, _ = rc4.NewCipher(c.licenseKey)
+	rc.XORKeyStream(hwid, resp.EncryptedHWID.BlobData)
+	if !bytes.Equal(resp.MACData, macData(c.licenseMacKey, append(challenge, hwid...))[:16]) {
+		t.Error("bad challenge response MAC")
+	}
+
+	// resend then the valid client shortcut
+	c.recvLicenceInfo(t125.GLOBAL_CHANNEL_NAME, errorAlert(lic.ERR_INVALID_MAC, lic.ST_RESEND_LAST_MESSAGE))
+	if len(tr.writes) != 3 || !bytes.Equal(tr.writes[2], tr.writes[1]) {
+		t.Error("last message not resent")
+	}
+	if connected {
+		t.Fatal("connected before the end of licensing")
+	}
+	c.recvLicenceInfo(t125.GLOBAL_CHANNEL_NAME, errorAlert(lic.STATUS_VALID_CLIENT, lic.ST_NO_TRANSITION))
+	if !connected {
+		t.Error("not connected on valid client")
+	}
+}
+
+func TestLicensingAbort(t *testing.T) {
+	k, _ := rsa.GenerateKey(rand.Reader, 512)
+	c, _ := licenseClient(k)
+	var err error
+	c.On("error", func(e error) {
+		err = e
+	})
+	c.recvLicenceInfo(t125.GLOBAL_CHANNEL_NAME, errorAlert(lic.ERR_INVALID_CLIENT, lic.ST_TOTAL_ABORT))
+	if err == nil || err.Error() != "license error 0x8" {
+		t.Error("expect license error, get", err)
+	}
+}
+
+// rc4Pair returns a client SEC and the SEC of its server peer
+func rc4Pair(method uint32) (*SEC, *SEC) {
+	mac, decrypt, encrypt := generateKeys(bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32), method)
+	c := &SEC{macKey: mac, initialDecrytKey: decrypt, initialEncryptKey: encrypt, encryptionMethod: method}
+	c.currentDecrytKey, c.currentEncryptKey = decrypt, encrypt
+	s := &SEC{macKey: mac, initialDecrytKey: encrypt, initialEncryptKey: decrypt, encryptionMethod: method}
+	s.currentDecrytKey, s.currentEncryptKey = encrypt, decrypt
+	return c, s
+}
+
+func TestEncryptedPayload(t *testing.T) {
+	for _, method := range []uint32{gcc.ENCRYPTION_FLAG_40BIT, gcc.ENCRYPTION_FLAG_128BIT} {
+		c, s := rc4Pair(method)
+		// past the first key update, with and without salted MACs
+		for i := 0; i < 4100; i++ {
+			data := []byte{byte(i), byte(i >> 8), 0x42}
+			salted := i%2 == 1
+			b, err := s.readEncryptedPayload(c.writeEncryptedPayload(data, salted), salted)
+			if err != nil || !bytes.Equal(b, data) {
+				t.Fatalf("packet %d: get %x, %v", i, b, err)
+			}
+		}
+		if bytes.Equal(c.currentEncryptKey, c.initialEncryptKey) || !bytes.Equal(c.currentEncryptKey, s.currentDecrytKey) {
+			t.Error("key not updated")
+		}
+		if method == gcc.ENCRYPTION_FLAG_40BIT && !bytes.Equal(c.currentEncryptKey[:3], []byte{0xd1, 0x26, 0x9e}) {
+			t.Errorf("bad 40 bits updated key %x", c.currentEncryptKey)
+		}
+		if !s.enableSecureCheckSum {
+			t.Error("salted MAC not enabled by the peer")
+		}
+	}
+
+	c, s := rc4Pair(gcc.ENCRYPTION_FLAG_128BIT)
+	b := c.writeEncryptedPayload([]byte("data"), false)
+	b[len(b)-1] ^= 1
+	if _, err := s.readEncryptedPayload(b, false); err == nil {
+		t.Error("expect MAC error on altered payload")
+	}
+	if _, err := s.readEncryptedPayload(b[:4], false); err == nil {
+		t.Error("expect error on truncated payload")
+	}
+}
@@ -1,6 +1,7 @@
 package ber
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -55,6 +56,12 @@ func ReadEnumerated(r io.Reader) (uint8, error) {
 	return core.ReadUInt8(r)
 }
 
+func WriteEnumerated(enumerated uint8, w io.Writer) {
+	WriteUniversalTag(TAG_ENUMERATED, false, w)
+	WriteLength(1, w)
+	core.WriteUInt8(enumerated, w)
+}
+
 func ReadUniversalTag(tag uint8, pc bool, r io.Reader) bool {
 	bb, _ := core.ReadUInt8(r)
 	return bb == (CLASS_UNIV|berPC(pc))|(TAG_MASK&tag)
@@ -66,7 +73,10 @@ func WriteUniversalTag(tag uint8, pc bool, w io.Writer) {
 
 func ReadLength(r io.Reader) (int, error) {
 	ret := 0
-	size, _ := core.ReadUInt8(r)
+	size, err := core.ReadUInt8(r)
+	if err != nil {
+		return 0, err
+	}
 	if size&0x80 > 0 {
 		size = size &^ 0x80
 		if size == 1 {
@@ -103,24 +113,22 @@ func ReadInteger(r io.Reader) (int, error) {
 	if !ReadUniversalTag(TAG_INTEGER, false, r) {
 		return 0, errors.New("Bad integer tag")
 	}
-	size, _ := ReadLength(r)
-	switch size {
-	case 1:
-		num, _ := core.ReadUInt8(r)
-		return int(num), nil
-	case 2:
-		num, _ := core.ReadUint16BE(r)
-		return int(num), nil
-	case 3:
-		integer1, _ := core.ReadUInt8(r)
-		integer2, _ := core.ReadUint16BE(r)
-		return int(integer2) + int(integer1<<16), nil
-	case 4:
-		num, _ := core.ReadUInt32BE(r)
-		return int(num), nil
-	default:
+	size, err := ReadLength(r)
+	if err != nil {
+		return 0, err
+	}
+	if size < 1 || size > 4 {
 		return 0, errors.New("wrong size")
 	}
+	b, err := core.ReadBytes(size, r)
+	if err != nil {
+		return 0, err
+	}
+	num := 0
+	for _, v := range b {
+		num = num<<8 | int(v)
+	}
+	return num, nil
 }
 
 func WriteInteger(n int, w io.Writer) {
@@ -143,6 +151,35 @@ func WriteOctetstring(str string, w io.Writer) {
 	core.WriteBytes([]byte(str), w)
 }
 
+func ReadOctetstring(r io.Reader) ([]byte, error) {
+	if !ReadUniversalTag(TAG_OCTET_STRING, false, r) {
+		return nil, errors.New("invalid ber tag")
+	}
+	size, err := ReadLength(r)
+	if err != nil {
+		return nil, err
+	}
+	return core.ReadBytes(size, r)
+}
+
+func ReadBoolean(r io.Reader) (bool, error) {
+	if !ReadUniversalTag(TAG_BOOLEAN, false, r) {
+		return false, errors.New("invalid ber tag")
+	}
+	size, err := ReadLength(r)
+	if err != nil {
+		return false, err
+	}
+	if size != 1 {
+		return false, errors.New(fmt.Sprintf("boolean size is wrong, get %v, expect 1", size))
+	}
+	b, err := core.ReadUInt8(r)
+	if err != nil {
+		return false, err
+	}
+	return b != 0, nil
+}
+
 func WriteBoolean(b bool, w io.Writer) {
 	bb := uint8(0)
 	if b {
@@ -153,13 +190,22 @@ func WriteBoolean(b bool, w io.Writer) {
 	core.WriteUInt8(bb, w)
 }
 
+// ReadApplicationTag returns the content length of the application tag.
+// When r knows its remaining size (bytes.Reader, bytes.Buffer...) the
+// length is checked against it.
 func ReadApplicationTag(tag uint8, r io.Reader) (int, error) {
-	bb, _ := core.ReadUInt8(r)
+	bb, err := core.ReadUInt8(r)
+	if err != nil {
+		return 0, err
+	}
 	if tag > 30 {
 		if bb != (CLASS_APPL|PC_CONSTRUCT)|TAG_MASK {
 			return 0, errors.New("ReadApplicationTag invalid data")
 		}
-		bb, _ := core.ReadUInt8(r)
+		bb, err := core.ReadUInt8(r)
+		if err != nil {
+			return 0, err
+		}
 		if bb != tag {
 			return 0, errors.New("ReadApplicationTag bad tag")
 		}
@@ -168,7 +214,14 @@ func ReadApplicationTag(tag uint8, r io.Reader) (int, error) {
 			return 0, errors.New("ReadApplicationTag invalid data2")
 		}
 	}
-	return ReadLength(r)
+	size, err := ReadLength(r)
+	if err != nil {
+		return 0, err
+	}
+	if l, ok := r.(interface{ Len() int }); ok && size > l.Len() {
+		return 0, errors.New(fmt.Sprintf("ReadApplicationTag length %d exceeds remaining %d bytes", size, l.Len()))
+	}
+	return size, nil
 }
 
 func WriteApplicationTag(tag uint8, size int, w io.Writer) {
@@ -182,6 +235,60 @@ func WriteApplicationTag(tag uint8, size int, w io.Writer) {
 	}
 }
 
+/**
+ * @see http://www.itu.int/rec/T-REC-T.125-199802-I/en page 25
+ */
+type DomainParameters struct {
+	MaxChannelIds   int
+	MaxUserIds      int
+	MaxTokenIds     int
+	NumPriorities   int
+	MinThoughput    int
+	MaxHeight       int
+	MaxMCSPDUsize   int
+	ProtocolVersion int
+}
+
+func (d *DomainParameters) BER() []byte {
+	buff := &bytes.Buffer{}
+	WriteInteger(d.MaxChannelIds, buff)
+	WriteInteger(d.MaxUserIds, buff)
+	WriteInteger(d.MaxTokenIds, buff)
+	WriteInteger(d.NumPriorities, buff)
+	WriteInteger(d.MinThoughput, buff)
+	WriteInteger(d.MaxHeight, buff)
+	WriteInteger(d.MaxMCSPDUsize, buff)
+	WriteInteger(d.ProtocolVersion, buff)
+	return buff.Bytes()
+}
+
+func ReadDomainParameters(r io.Reader) (*DomainParameters, error) {
+	if !ReadUniversalTag(TAG_SEQUENCE, true, r) {
+		return nil, errors.New("bad BER tags")
+	}
+	size, err := ReadLength(r)
+	if err != nil {
+		return nil, err
+	}
+	data, err := core.ReadBytes(size, r)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("domain parameters truncated: %v", err))
+	}
+
+	d := &DomainParameters{}
+	sr := bytes.NewReader(data)
+	for _, v := range []*int{&d.MaxChannelIds, &d.MaxUserIds, &d.MaxTokenIds,
+		&d.NumPriorities, &d.MinThoughput, &d.MaxHeight, &d.MaxMCSPDUsize,
+		&d.ProtocolVersion} {
+		n, err := ReadInteger(sr)
+		if err != nil {
+			return nil, err
+		}
+		*v = n
+	}
+	return d, nil
+}
+
 func WriteEncodedDomainParams(data []byte, w io.Writer) {
 	WriteUniversalTag(TAG_SEQUENCE, true, w)
 	WriteLength(len(data), w)
@@ -0,0 +1,66 @@
+package ber_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/tomatome/grdp/protocol/t125/ber"
+)
+
+func encodedDomainParameters(d *ber.DomainParameters) []byte {
+	buff := &bytes.Buffer{}
+	ber.WriteEncodedDomainParams(d.BER(), buff)
+	return buff.Bytes()
+}
+
+func TestReadDomainParameters(t *testing.T) {
+	d := &ber.DomainParameters{
+		MaxChannelIds:   34,
+		MaxUserIds:      2,
+		NumPriorities:   1,
+		MaxHeight:       1,
+		MaxMCSPDUsize:   0xfff8,
+		ProtocolVersion: 2,
+	}
+	r, err := ber.ReadDomainParameters(bytes.NewReader(encodedDomainParameters(d)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *r != *d {
+		t.Errorf("%+v not equals to %+v", *r, *d)
+	}
+}
+
+func TestReadDomainParametersTruncated(t *testing.T) {
+	data := encodedDomainParameters(&ber.DomainParameters{
+		MaxChannelIds: 0xffff,
+		MaxUserIds:    0xfc17,
+		MaxMCSPDUsize: 0xffff,
+	})
+	for i := 0; i < len(data); i++ {
+		if _, err := ber.ReadDomainParameters(bytes.NewReader(data[:i])); err == nil {
+			t.Error("expect error on", i, "bytes")
+		}
+	}
+}
+
+func TestReadApplicationTag(t *testing.T) {
+	buff := &bytes.Buffer{}
+	ber.WriteApplicationTag(0x66, 3, buff)
+	buff.Write([]byte{1, 2, 3})
+	size, err := ber.ReadApplicationTag(0x66, bytes.NewReader(buff.Bytes()))
+	if err != nil || size != 3 {
+		t.Error("get", size, err)
+	}
+
+	// declared length larger than the data
+	if _, err := ber.ReadApplicationTag(0x66, bytes.NewReader(buff.Bytes()[:5])); err == nil {
+		t.Error("expect error on truncated content")
+	}
+	if _, err := ber.ReadApplicationTag(0x65, bytes.NewReader(buff.Bytes())); err == nil {
+		t.Error("expect error on bad tag")
+	}
+	if _, err := ber.ReadApplicationTag(0x66, bytes.NewReader(nil)); err == nil {
+		t.Error("expect error on empty data")
+	}
+}
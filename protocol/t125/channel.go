@@ -0,0 +1,102 @@
+package t125
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// channelStream buffers the data received on one MCS channel
+type channelStream struct {
+	mcs    *MCS
+	id     MCSChannel
+	lock   sync.Mutex
+	cond   *sync.Cond
+	buff   bytes.Buffer
+	closed bool
+}
+
+/**
+ * Channel returns a stream over an MCS channel, reads block until data is
+ * received and return io.EOF once the MCS layer or the stream is closed,
+ * each write is sent in one data PDU
+ */
+func (m *MCS) Channel(id MCSChannel) io.ReadWriteCloser {
+	m.streamsLock.Lock()
+	defer m.streamsLock.Unlock()
+	if s, ok := m.streams[id]; ok {
+		return s
+	}
+	s := &channelStream{mcs: m, id: id}
+	s.cond = sync.NewCond(&s.lock)
+	m.streams[id] = s
+	return s
+}
+
+func (m *MCS) pushStream(id MCSChannel, data []byte) {
+	m.streamsLock.Lock()
+	s, ok := m.streams[id]
+	m.streamsLock.Unlock()
+	if !ok {
+		return
+	}
+	s.lock.Lock()
+	if !s.closed {
+		s.buff.Write(data)
+		s.cond.Broadcast()
+	}
+	s.lock.Unlock()
+}
+
+func (m *MCS) closeStreams() {
+	m.streamsLock.Lock()
+	streams := m.streams
+	m.streams = map[MCSChannel]*channelStream{}
+	m.streamsLock.Unlock()
+	for _, s := range streams {
+		s.close()
+	}
+}
+
+func (s *channelStream) Read(b []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for s.buff.Len() == 0 && !s.closed {
+		s.cond.Wait()
+	}
+	if s.buff.Len() == 0 {
+		return 0, io.EOF
+	}
+	return s.buff.Read(b)
+}
+
+func (s *channelStream) Write(b []byte) (int, error) {
+	s.lock.Lock()
+	closed := s.closed
+	s.lock.Unlock()
+	if closed {
+		return 0, io.ErrClosedPipe
+	}
+	if err := s.mcs.Send(s.id, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close stops buffering the channel, pending data can still be read
+func (s *channelStream) Close() error {
+	s.mcs.streamsLock.Lock()
+	if s.mcs.streams[s.id] == s {
+		delete(s.mcs.streams, s.id)
+	}
+	s.mcs.streamsLock.Unlock()
+	s.close()
+	return nil
+}
+
+func (s *channelStream) close() {
+	s.lock.Lock()
+	s.closed = true
+	s.cond.Broadcast()
+	s.lock.Unlock()
+}
@@ -2,9 +2,15 @@ package gcc
 
 import (
 	"bytes"
+	"crypto/md5"
+	"encoding/asn1"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"math/big"
 	"os"
+	"unicode/utf16"
 
 	"github.com/tomatome/grdp/plugin"
 
@@ -26,9 +32,11 @@ type Message uint16
 
 const (
 	//server -> client
-	SC_CORE     Message = 0x0C01
-	SC_SECURITY         = 0x0C02
-	SC_NET              = 0x0C03
+	SC_CORE           Message = 0x0C01
+	SC_SECURITY               = 0x0C02
+	SC_NET                    = 0x0C03
+	SC_MCS_MSGCHANNEL         = 0x0C04
+	SC_MULTITRANSPORT         = 0x0C08
 	//client -> server
 	CS_CORE     = 0xC001
 	CS_SECURITY = 0xC002
@@ -37,6 +45,12 @@ const (
 	CS_MONITOR  = 0xC005
 )
 
+// CS_MCS_MSGCHANNEL asks for the MCS message channel
+const CS_MCS_MSGCHANNEL = 0xC006
+
+// CS_MONITOR_EX carries the attributes of the monitors of CS_MONITOR
+const CS_MONITOR_EX = 0xC008
+
 /**
  * @see http://msdn.microsoft.com/en-us/library/cc240510.aspx
  */
@@ -93,6 +107,17 @@ const (
 	RNS_UD_CS_SUPPORT_HEARTBEAT_PDU             = 0x0400
 )
 
+/**
+ * earlyCapabilityFlags of the server core data
+ * @see MS-RDPBCGR 2.2.1.4.2 Server Core Data (TS_UD_SC_CORE)
+ */
+const (
+	RNS_UD_SC_EDGE_ACTIONS_SUPPORTED_V1  uint32 = 0x00000001
+	RNS_UD_SC_DYNAMIC_DST_SUPPORTED             = 0x00000002
+	RNS_UD_SC_EDGE_ACTIONS_SUPPORTED_V2         = 0x00000004
+	RNS_UD_SC_SKIP_CHANNELJOIN_SUPPORTED        = 0x00000008
+)
+
 /**
  * @see http://msdn.microsoft.com/en-us/library/cc240510.aspx
  */
@@ -116,6 +141,7 @@ type VERSION uint32
 const (
 	RDP_VERSION_4      VERSION = 0x00080001
 	RDP_VERSION_5_PLUS         = 0x00080004
+	RDP_VERSION_10_0           = 0x00080005
 )
 
 type Sequence uint16
@@ -208,6 +234,7 @@ const (
 	KOREAN                             = 0x00000412
 	DUTCH                              = 0x00000413
 	NORWEGIAN                          = 0x00000414
+	UNITED_KINGDOM                     = 0x00000809
 )
 
 /**
@@ -252,14 +279,109 @@ type ClientCoreData struct {
 
 func NewClientCoreData() *ClientCoreData {
 	name, _ := os.Hostname()
-	var ClientName [32]byte
-	copy(ClientName[:], core.UnicodeEncode(name)[:])
-	return &ClientCoreData{
+	data := &ClientCoreData{
 		RDP_VERSION_5_PLUS, 1280, 800, RNS_UD_COLOR_8BPP,
-		RNS_UD_SAS_DEL, US, 3790, ClientName, KT_IBM_101_102_KEYS,
+		RNS_UD_SAS_DEL, US, 3790, [32]byte{}, KT_IBM_101_102_KEYS,
 		0, 12, [64]byte{}, RNS_UD_COLOR_8BPP, 1, 0, HIGH_COLOR_24BPP,
 		RNS_UD_15BPP_SUPPORT | RNS_UD_16BPP_SUPPORT | RNS_UD_24BPP_SUPPORT | RNS_UD_32BPP_SUPPORT,
-		RNS_UD_CS_SUPPORT_ERRINFO_PDU, [64]byte{}, 0, 0, 0}
+		RNS_UD_CS_SUPPORT_ERRINFO_PDU | RNS_UD_CS_SUPPORT_HEARTBEAT_PDU, [64]byte{}, 0, 0, 0}
+	data.SetClientName(name)
+	return data
+}
+
+// fixedUnicode copies s as null terminated UTF-16LE to b, truncating s
+// without splitting a surrogate pair
+func fixedUnicode(b []byte, s string) {
+	u := utf16.Encode([]rune(s))
+	if max := len(b)/2 - 1; len(u) > max {
+		u = u[:max]
+		// high surrogate
+		if c := u[max-1]; c >= 0xd800 && c < 0xdc00 {
+			u = u[:max-1]
+		}
+	}
+	for i := range b {
+		b[i] = 0
+	}
+	for i, c := range u {
+		b[2*i], b[2*i+1] = byte(c), byte(c>>8)
+	}
+}
+
+// SetClientName sets the client name, truncated to 15 characters
+func (data *ClientCoreData) SetClientName(name string) {
+	fixedUnicode(data.ClientName[:], name)
+}
+
+// SetClientBuild sets the build number of the client
+func (data *ClientCoreData) SetClientBuild(build uint32) {
+	data.ClientBuild = build
+}
+
+// SetClientProductId sets the digital product id, truncated to 31 characters
+func (data *ClientCoreData) SetClientProductId(id string) {
+	fixedUnicode(data.ClientDigProductId[:], id)
+}
+
+// SetConnectionType advertises the connection type t, the server tunes
+// the compression and the visual effects for it. CONNECTION_TYPE_AUTODETECT
+// also advertises RNS_UD_CS_SUPPORT_NETCHAR_AUTODETECT, the server then
+// measures the connection on the MCS message channel
+func (data *ClientCoreData) SetConnectionType(t ConnectionType) error {
+	if t < CONNECTION_TYPE_MODEM || t > CONNECTION_TYPE_AUTODETECT {
+		return errors.New(fmt.Sprintf("invalid connection type %d", t))
+	}
+	data.ConnectionType = uint8(t)
+	data.EarlyCapabilityFlags |= RNS_UD_CS_VALID_CONNECTION_TYPE
+	data.EarlyCapabilityFlags &^= RNS_UD_CS_SUPPORT_NETCHAR_AUTODETECT
+	if t == CONNECTION_TYPE_AUTODETECT {
+		data.EarlyCapabilityFlags |= RNS_UD_CS_SUPPORT_NETCHAR_AUTODETECT
+	}
+	return nil
+}
+
+// SetDesktop sets the requested desktop size
+func (data *ClientCoreData) SetDesktop(width, height uint16) error {
+	if width < 200 || width > 8192 || height < 200 || height > 8192 {
+		return errors.New(fmt.Sprintf("invalid desktop size %dx%d", width, height))
+	}
+	if width%4 != 0 {
+		return errors.New(fmt.Sprintf("desktop width %d is not a multiple of 4", width))
+	}
+	data.DesktopWidth = width
+	data.DesktopHeight = height
+	return nil
+}
+
+// SetColorDepth sets the requested color depth, bpp is one of 8, 15, 16, 24, 32
+func (data *ClientCoreData) SetColorDepth(bpp uint16) error {
+	data.EarlyCapabilityFlags &^= RNS_UD_CS_WANT_32BPP_SESSION
+	switch bpp {
+	case 8:
+		data.PostBeta2ColorDepth = RNS_UD_COLOR_8BPP
+		data.HighColorDepth = HIGH_COLOR_8BPP
+	case 15:
+		data.PostBeta2ColorDepth = RNS_UD_COLOR_16BPP_555
+		data.HighColorDepth = HIGH_COLOR_15BPP
+		data.SupportedColorDepths |= RNS_UD_15BPP_SUPPORT
+	case 16:
+		data.PostBeta2ColorDepth = RNS_UD_COLOR_16BPP_565
+		data.HighColorDepth = HIGH_COLOR_16BPP
+		data.SupportedColorDepths |= RNS_UD_16BPP_SUPPORT
+	case 24:
+		data.PostBeta2ColorDepth = RNS_UD_COLOR_24BPP
+		data.HighColorDepth = HIGH_COLOR_24BPP
+		data.SupportedColorDepths |= RNS_UD_24BPP_SUPPORT
+	case 32:
+		// 32 bpp is requested with a 24 bpp high color depth
+		data.PostBeta2ColorDepth = RNS_UD_COLOR_24BPP
+		data.HighColorDepth = HIGH_COLOR_24BPP
+		data.SupportedColorDepths |= RNS_UD_32BPP_SUPPORT
+		data.EarlyCapabilityFlags |= RNS_UD_CS_WANT_32BPP_SESSION
+	default:
+		return errors.New(fmt.Sprintf("unsupported color depth %d", bpp))
+	}
+	return nil
 }
 
 func (data *ClientCoreData) Pack() []byte {
@@ -270,6 +392,21 @@ func (data *ClientCoreData) Pack() []byte {
 	return buff.Bytes()
 }
 
+func (data *ClientCoreData) CsType() Message {
+	return CS_CORE
+}
+
+// Unpack accepts the optional trailing fields being absent
+func (data *ClientCoreData) Unpack(r io.Reader) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	full := make([]byte, 212)
+	copy(full, b)
+	return struc.Unpack(bytes.NewReader(full), data)
+}
+
 type ClientNetworkData struct {
 	ChannelCount    uint32
 	ChannelDefArray []ChannelDef
@@ -277,25 +414,27 @@ type ClientNetworkData struct {
 
 func NewClientNetworkData() *ClientNetworkData {
 	n := &ClientNetworkData{}
-	n.ChannelCount = 3
+	n.ChannelCount = 4
 	n.ChannelDefArray = make([]ChannelDef, 0, n.ChannelCount)
+	// no CHANNEL_OPTION_COMPRESS_RDP, the channels do not decompress their data
 
 	var d1 ChannelDef
 	d1.Name = plugin.RDPDR_SVC_CHANNEL_NAME
-	d1.Options = uint32(CHANNEL_OPTION_INITIALIZED | CHANNEL_OPTION_ENCRYPT_RDP |
-		CHANNEL_OPTION_COMPRESS_RDP)
+	d1.Options = uint32(CHANNEL_OPTION_INITIALIZED | CHANNEL_OPTION_ENCRYPT_RDP)
 	n.ChannelDefArray = append(n.ChannelDefArray, d1)
 
 	var d2 ChannelDef
 	d2.Name = plugin.RDPSND_SVC_CHANNEL_NAME
-	d2.Options = uint32(CHANNEL_OPTION_INITIALIZED | CHANNEL_OPTION_ENCRYPT_RDP |
-		CHANNEL_OPTION_COMPRESS_RDP | CHANNEL_OPTION_SHOW_PROTOCOL)
+	d2.Options = uint32(CHANNEL_OPTION_INITIALIZED | CHANNEL_OPTION_ENCRYPT_RDP | CHANNEL_OPTION_SHOW_PROTOCOL)
 	n.ChannelDefArray = append(n.ChannelDefArray, d2)
 	var d ChannelDef
 	d.Name = plugin.CLIPRDR_SVC_CHANNEL_NAME
-	d.Options = uint32(CHANNEL_OPTION_INITIALIZED | CHANNEL_OPTION_ENCRYPT_RDP |
-		CHANNEL_OPTION_COMPRESS_RDP | CHANNEL_OPTION_SHOW_PROTOCOL)
+	d.Options = uint32(CHANNEL_OPTION_INITIALIZED | CHANNEL_OPTION_ENCRYPT_RDP | CHANNEL_OPTION_SHOW_PROTOCOL)
 	n.ChannelDefArray = append(n.ChannelDefArray, d)
+	var d3 ChannelDef
+	d3.Name = plugin.DRDYNVC_SVC_CHANNEL_NAME
+	d3.Options = uint32(CHANNEL_OPTION_INITIALIZED | CHANNEL_OPTION_ENCRYPT_RDP)
+	n.ChannelDefArray = append(n.ChannelDefArray, d3)
 
 	return n
 }
@@ -316,6 +455,30 @@ func (d *ClientNetworkData) Pack() []byte {
 	return buff.Bytes()
 }
 
+func (d *ClientNetworkData) CsType() Message {
+	return CS_NET
+}
+
+func (d *ClientNetworkData) Unpack(r io.Reader) error {
+	var err error
+	d.ChannelCount, err = core.ReadUInt32LE(r)
+	if err != nil {
+		return err
+	}
+	d.ChannelDefArray = make([]ChannelDef, 0, d.ChannelCount)
+	for i := 0; i < int(d.ChannelCount); i++ {
+		name, err := core.ReadBytes(8, r)
+		if err != nil {
+			return err
+		}
+		var def ChannelDef
+		def.Name = string(bytes.TrimRight(name, "\x00"))
+		def.Options, _ = core.ReadUInt32LE(r)
+		d.ChannelDefArray = append(d.ChannelDefArray, def)
+	}
+	return nil
+}
+
 type ClientSecurityData struct {
 	EncryptionMethods    uint32
 	ExtEncryptionMethods uint32
@@ -336,6 +499,185 @@ func (d *ClientSecurityData) Pack() []byte {
 	return buff.Bytes()
 }
 
+func (d *ClientSecurityData) CsType() Message {
+	return CS_SECURITY
+}
+
+func (d *ClientSecurityData) Unpack(r io.Reader) error {
+	var err error
+	d.EncryptionMethods, err = core.ReadUInt32LE(r)
+	if err != nil {
+		return err
+	}
+	d.ExtEncryptionMethods, err = core.ReadUInt32LE(r)
+	return err
+}
+
+const (
+	MAX_MONITOR_COUNT  = 16
+	TS_MONITOR_PRIMARY = 0x00000001
+)
+
+/**
+ * TS_MONITOR_DEF
+ * @see MS-RDPBCGR 2.2.1.3.6.1 Monitor Definition
+ */
+type MonitorDef struct {
+	Left   int32
+	Top    int32
+	Right  int32
+	Bottom int32
+	Flags  uint32
+}
+
+/**
+ * orientations of a monitor in degrees
+ */
+const (
+	ORIENTATION_LANDSCAPE         = 0
+	ORIENTATION_PORTRAIT          = 90
+	ORIENTATION_LANDSCAPE_FLIPPED = 180
+	ORIENTATION_PORTRAIT_FLIPPED  = 270
+)
+
+/**
+ * TS_MONITOR_ATTRIBUTES, the physical size is in millimeters and the scale
+ * factors in percent, the server ignores the zero ones
+ * @see MS-RDPBCGR 2.2.1.3.9.1 Monitor Attributes
+ */
+type MonitorAttributes struct {
+	PhysicalWidth      uint32
+	PhysicalHeight     uint32
+	Orientation        uint32
+	DesktopScaleFactor uint32
+	DeviceScaleFactor  uint32
+}
+
+// Validate checks the orientation, the size and the scale factors
+func (a *MonitorAttributes) Validate() error {
+	switch a.Orientation {
+	case ORIENTATION_LANDSCAPE, ORIENTATION_PORTRAIT, ORIENTATION_LANDSCAPE_FLIPPED, ORIENTATION_PORTRAIT_FLIPPED:
+	default:
+		return errors.New(fmt.Sprintf("invalid monitor orientation %d", a.Orientation))
+	}
+	for _, size := range []uint32{a.PhysicalWidth, a.PhysicalHeight} {
+		if size != 0 && (size < 10 || size > 10000) {
+			return errors.New(fmt.Sprintf("invalid monitor physical size %dmm", size))
+		}
+	}
+	if a.DesktopScaleFactor != 0 && (a.DesktopScaleFactor < 100 || a.DesktopScaleFactor > 500) {
+		return errors.New(fmt.Sprintf("invalid desktop scale factor %d", a.DesktopScaleFactor))
+	}
+	switch a.DeviceScaleFactor {
+	case 0, 100, 140, 180:
+	default:
+		return errors.New(fmt.Sprintf("invalid device scale factor %d", a.DeviceScaleFactor))
+	}
+	return nil
+}
+
+/**
+ * TS_UD_CS_MONITOR
+ * @see MS-RDPBCGR 2.2.1.3.6 Client Monitor Data
+ */
+type ClientMonitorData struct {
+	Flags    uint32
+	Monitors []MonitorDef
+
+	// attributes of the monitors in the same order, none unless set
+	Attributes []MonitorAttributes
+}
+
+func NewClientMonitorData() *ClientMonitorData {
+	return &ClientMonitorData{}
+}
+
+func (d *ClientMonitorData) AddMonitor(left, top, right, bottom int32, primary bool) error {
+	if len(d.Monitors) >= MAX_MONITOR_COUNT {
+		return errors.New(fmt.Sprintf("too many monitors, max is %d", MAX_MONITOR_COUNT))
+	}
+	if right < left || bottom < top {
+		return errors.New("invalid monitor rectangle")
+	}
+	m := MonitorDef{Left: left, Top: top, Right: right, Bottom: bottom}
+	if primary {
+		m.Flags = TS_MONITOR_PRIMARY
+	}
+	d.Monitors = append(d.Monitors, m)
+	return nil
+}
+
+// Validate checks exactly one monitor is the primary one
+func (d *ClientMonitorData) Validate() error {
+	primary := 0
+	for _, m := range d.Monitors {
+		if m.Flags&TS_MONITOR_PRIMARY != 0 {
+			primary++
+		}
+	}
+	if primary != 1 {
+		return errors.New(fmt.Sprintf("expect one primary monitor, get %d", primary))
+	}
+	return nil
+}
+
+// SetAttributes sets the attributes of the monitor index
+func (d *ClientMonitorData) SetAttributes(index int, a MonitorAttributes) error {
+	if index < 0 || index >= len(d.Monitors) {
+		return errors.New(fmt.Sprintf("no monitor %d", index))
+	}
+	if err := a.Validate(); err != nil {
+		return err
+	}
+	for len(d.Attributes) <= index {
+		d.Attributes = append(d.Attributes, MonitorAttributes{})
+	}
+	d.Attributes[index] = a
+	return nil
+}
+
+func (d *ClientMonitorData) Pack() []byte {
+	buff := &bytes.Buffer{}
+	core.WriteUInt16LE(CS_MONITOR, buff)
+	core.WriteUInt16LE(uint16(12+20*len(d.Monitors)), buff)
+	core.WriteUInt32LE(d.Flags, buff)
+	core.WriteUInt32LE(uint32(len(d.Monitors)), buff)
+	for _, m := range d.Monitors {
+		core.WriteUInt32LE(uint32(m.Left), buff)
+		core.WriteUInt32LE(uint32(m.Top), buff)
+		core.WriteUInt32LE(uint32(m.Right), buff)
+		core.WriteUInt32LE(uint32(m.Bottom), buff)
+		core.WriteUInt32LE(m.Flags, buff)
+	}
+	return buff.Bytes()
+}
+
+/**
+ * PackExtended returns the TS_UD_CS_MONITOR_EX of the attributes, zero for
+ * the monitors without
+ * @see MS-RDPBCGR 2.2.1.3.9 Client Monitor Extended Data
+ */
+func (d *ClientMonitorData) PackExtended() []byte {
+	buff := &bytes.Buffer{}
+	core.WriteUInt16LE(CS_MONITOR_EX, buff)
+	core.WriteUInt16LE(uint16(16+20*len(d.Monitors)), buff)
+	core.WriteUInt32LE(0, buff)  // flags
+	core.WriteUInt32LE(20, buff) // monitorAttributeSize
+	core.WriteUInt32LE(uint32(len(d.Monitors)), buff)
+	for i := range d.Monitors {
+		var a MonitorAttributes
+		if i < len(d.Attributes) {
+			a = d.Attributes[i]
+		}
+		core.WriteUInt32LE(a.PhysicalWidth, buff)
+		core.WriteUInt32LE(a.PhysicalHeight, buff)
+		core.WriteUInt32LE(a.Orientation, buff)
+		core.WriteUInt32LE(a.DesktopScaleFactor, buff)
+		core.WriteUInt32LE(a.DeviceScaleFactor, buff)
+	}
+	return buff.Bytes()
+}
+
 type RSAPublicKey struct {
 	Magic   uint32 `struc:"little"` //0x31415352
 	Keylen  uint32 `struc:"little,sizeof=Modulus"`
@@ -346,7 +688,24 @@ type RSAPublicKey struct {
 	Padding []byte `struc:"[8]byte"`
 }
 
+/**
+ * Terminal Services Signing Key of proprietary certificates, little endian
+ * @see MS-RDPBCGR 5.3.3.1.1 Terminal Services Signing Key
+ */
+var (
+	TSSK_MODULUS = []byte{
+		0x3d, 0x3a, 0x5e, 0xbd, 0x72, 0x43, 0x3e, 0xc9, 0x4d, 0xbb, 0xc1, 0x1e, 0x4a, 0xba, 0x5f, 0xcb,
+		0x3e, 0x88, 0x20, 0x87, 0xef, 0xf5, 0xc1, 0xe2, 0xd7, 0xb7, 0x6b, 0x9a, 0xf2, 0x52, 0x45, 0x95,
+		0xce, 0x63, 0x65, 0x6b, 0x58, 0x3a, 0xfe, 0xef, 0x7c, 0xe7, 0xbf, 0xfe, 0x3d, 0xf6, 0x5c, 0x7d,
+		0x6c, 0x5e, 0x06, 0x09, 0x1a, 0xf5, 0x61, 0xbb, 0x20, 0x93, 0x09, 0x5f, 0x05, 0x6d, 0xea, 0x87}
+	TSSK_EXPONENT = []byte{0x5b, 0x7b, 0x88, 0xc0}
+)
+
+/**
+ * @see MS-RDPBCGR 2.2.1.4.3.1.1 Server Proprietary Certificate
+ */
 type ProprietaryServerCertificate struct {
+	dwVersion         uint32
 	DwSigAlgId        uint32       `struc:"little"` //0x00000001
 	DwKeyAlgId        uint32       `struc:"little"` //0x00000001
 	PublicKeyBlobType uint16       `struc:"little"` //0x0006
@@ -362,8 +721,55 @@ type ProprietaryServerCertificate struct {
 func (p *ProprietaryServerCertificate) GetPublicKey() (uint32, []byte) {
 	return p.PublicKeyBlob.PubExp, p.PublicKeyBlob.Modulus
 }
+
+// reversed returns a reversed copy, core.Reverse works in place
+func reversed(b []byte) []byte {
+	return core.Reverse(append([]byte{}, b...))
+}
+
+// signedData returns the certificate bytes up to the public key blob
+func (p *ProprietaryServerCertificate) signedData() []byte {
+	buff := &bytes.Buffer{}
+	core.WriteUInt32LE(p.dwVersion, buff)
+	core.WriteUInt32LE(p.DwSigAlgId, buff)
+	core.WriteUInt32LE(p.DwKeyAlgId, buff)
+	core.WriteUInt16LE(p.PublicKeyBlobType, buff)
+	core.WriteUInt16LE(p.PublicKeyBlobLen, buff)
+	b := p.PublicKeyBlob
+	core.WriteUInt32LE(b.Magic, buff)
+	core.WriteUInt32LE(b.Keylen, buff)
+	core.WriteUInt32LE(b.Bitlen, buff)
+	core.WriteUInt32LE(b.Datalen, buff)
+	core.WriteUInt32LE(b.PubExp, buff)
+	core.WriteBytes(b.Modulus, buff)
+	core.WriteBytes(b.Padding, buff)
+	return buff.Bytes()
+}
+
+/**
+ * Verify the signature made with the Terminal Services Signing Key
+ * @see MS-RDPBCGR 5.3.3.1.2 Signing a Proprietary Certificate
+ */
 func (p *ProprietaryServerCertificate) Verify() bool {
-	//todo
+	if len(p.SignatureBlob) != len(TSSK_MODULUS) {
+		return false
+	}
+	n := new(big.Int).SetBytes(reversed(TSSK_MODULUS))
+	e := new(big.Int).SetBytes(reversed(TSSK_EXPONENT))
+	s := new(big.Int).SetBytes(reversed(p.SignatureBlob))
+	sig := core.Reverse(new(big.Int).Exp(s, e, n).Bytes())
+	if len(sig) != 63 {
+		return false
+	}
+	hash := md5.Sum(p.signedData())
+	if !bytes.Equal(sig[:16], hash[:]) || sig[16] != 0x00 || sig[62] != 0x01 {
+		return false
+	}
+	for _, b := range sig[17:62] {
+		if b != 0xff {
+			return false
+		}
+	}
 	return true
 }
 func (p *ProprietaryServerCertificate) Encrypt() []byte {
@@ -402,9 +808,45 @@ type X509CertificateChain struct {
 	Padding       []byte     `struc:"little"`
 }
 
+// x509Certificate decodes only what is needed to reach the public key,
+// server certificates may use algorithms that crypto/x509 rejects
+type x509Certificate struct {
+	TBSCertificate struct {
+		Version            int `asn1:"optional,explicit,default:0,tag:0"`
+		SerialNumber       asn1.RawValue
+		SignatureAlgorithm asn1.RawValue
+		Issuer             asn1.RawValue
+		Validity           asn1.RawValue
+		Subject            asn1.RawValue
+		PublicKey          struct {
+			Algorithm asn1.RawValue
+			PublicKey asn1.BitString
+		}
+	}
+}
+
+type pkcs1PublicKey struct {
+	N *big.Int
+	E int
+}
+
+// GetPublicKey returns the key of the last certificate of the chain, the
+// modulus is little endian as in the proprietary certificate
 func (p *X509CertificateChain) GetPublicKey() (uint32, []byte) {
-	//todo
-	return 0, nil
+	if len(p.CertBlobArray) == 0 {
+		return 0, nil
+	}
+	var cert x509Certificate
+	if _, err := asn1.Unmarshal(p.CertBlobArray[len(p.CertBlobArray)-1].AbCert, &cert); err != nil {
+		glog.Error("x509 certificate:", err)
+		return 0, nil
+	}
+	var key pkcs1PublicKey
+	if _, err := asn1.Unmarshal(cert.TBSCertificate.PublicKey.PublicKey.RightAlign(), &key); err != nil {
+		glog.Error("x509 public key:", err)
+		return 0, nil
+	}
+	return uint32(key.E), core.Reverse(key.N.Bytes())
 }
 func (p *X509CertificateChain) Verify() bool {
 	return true
@@ -415,7 +857,26 @@ func (p *X509CertificateChain) Encrypt() []byte {
 	return nil
 }
 func (p *X509CertificateChain) Unpack(r io.Reader) error {
-	return struc.Unpack(r, p)
+	var err error
+	if p.NumCertBlobs, err = core.ReadUInt32LE(r); err != nil {
+		return err
+	}
+	if p.NumCertBlobs < 2 || p.NumCertBlobs > 200 {
+		return errors.New(fmt.Sprintf("invalid certificate count %d", p.NumCertBlobs))
+	}
+	p.CertBlobArray = make([]CertBlob, p.NumCertBlobs)
+	for i := range p.CertBlobArray {
+		c := &p.CertBlobArray[i]
+		if c.CbCert, err = core.ReadUInt32LE(r); err != nil {
+			return err
+		}
+		if c.AbCert, err = core.ReadBytes(int(c.CbCert), r); err != nil {
+			return err
+		}
+	}
+	// the remaining is padding
+	p.Padding, _ = io.ReadAll(r)
+	return nil
 }
 
 type ServerCoreData struct {
@@ -429,15 +890,42 @@ func NewServerCoreData() *ServerCoreData {
 		RDP_VERSION_5_PLUS, 0, 0}
 }
 
-func (d *ServerCoreData) Serialize() []byte {
-	return []byte{}
+func (d *ServerCoreData) Pack() []byte {
+	buff := &bytes.Buffer{}
+	core.WriteUInt16LE(uint16(SC_CORE), buff)
+	core.WriteUInt16LE(0x10, buff)
+	core.WriteUInt32LE(uint32(d.RdpVersion), buff)
+	core.WriteUInt32LE(d.ClientRequestedProtocol, buff)
+	core.WriteUInt32LE(d.EarlyCapabilityFlags, buff)
+	return buff.Bytes()
 }
 
 func (d *ServerCoreData) ScType() Message {
 	return SC_CORE
 }
+
+// Unpack reads the version, clientRequestedProtocols and earlyCapabilityFlags
+// are optional and left to zero when older servers omit them
 func (d *ServerCoreData) Unpack(r io.Reader) error {
-	return struc.Unpack(r, d)
+	b, err := core.ReadBytes(4, r)
+	if err != nil {
+		return err
+	}
+	d.RdpVersion = VERSION(binary.LittleEndian.Uint32(b))
+	if b, err = core.ReadBytes(4, r); err != nil {
+		return nil
+	}
+	d.ClientRequestedProtocol = binary.LittleEndian.Uint32(b)
+	if b, err = core.ReadBytes(4, r); err != nil {
+		return nil
+	}
+	d.EarlyCapabilityFlags = binary.LittleEndian.Uint32(b)
+	return nil
+}
+
+// HasEarlyCapability tells whether the server sets flag, RNS_UD_SC_*
+func (d *ServerCoreData) HasEarlyCapability(flag uint32) bool {
+	return d.EarlyCapabilityFlags&flag != 0
 }
 
 type ServerNetworkData struct {
@@ -456,6 +944,69 @@ func (d *ServerNetworkData) Unpack(r io.Reader) error {
 	return struc.Unpack(r, d)
 }
 
+func (d *ServerNetworkData) Pack() []byte {
+	buff := &bytes.Buffer{}
+	core.WriteUInt16LE(SC_NET, buff)
+	padding := d.ChannelCount % 2
+	core.WriteUInt16LE(8+2*(d.ChannelCount+padding), buff)
+	core.WriteUInt16LE(d.MCSChannelId, buff)
+	core.WriteUInt16LE(d.ChannelCount, buff)
+	for i := 0; i < int(d.ChannelCount); i++ {
+		core.WriteUInt16LE(d.ChannelIdArray[i], buff)
+	}
+	if padding != 0 {
+		core.WriteUInt16LE(0, buff)
+	}
+	return buff.Bytes()
+}
+
+/**
+ * @see MS-RDPBCGR 2.2.1.4.5 Server Message Channel Data
+ */
+type ServerMessageChannelData struct {
+	MCSChannelId uint16 `struc:"little"`
+}
+
+func (d *ServerMessageChannelData) ScType() Message {
+	return SC_MCS_MSGCHANNEL
+}
+func (d *ServerMessageChannelData) Unpack(r io.Reader) error {
+	return struc.Unpack(r, d)
+}
+
+/**
+ * @see MS-RDPBCGR 2.2.1.3.7 Client Message Channel Data
+ */
+type ClientMessageChannelData struct {
+	Flags uint32
+}
+
+func (d *ClientMessageChannelData) CsType() Message {
+	return CS_MCS_MSGCHANNEL
+}
+
+func (d *ClientMessageChannelData) Pack() []byte {
+	buff := &bytes.Buffer{}
+	core.WriteUInt16LE(CS_MCS_MSGCHANNEL, buff)
+	core.WriteUInt16LE(8, buff)
+	core.WriteUInt32LE(d.Flags, buff)
+	return buff.Bytes()
+}
+
+/**
+ * @see MS-RDPBCGR 2.2.1.4.6 Server Multitransport Channel Data
+ */
+type ServerMultitransportChannelData struct {
+	Flags uint32 `struc:"little"`
+}
+
+func (d *ServerMultitransportChannelData) ScType() Message {
+	return SC_MULTITRANSPORT
+}
+func (d *ServerMultitransportChannelData) Unpack(r io.Reader) error {
+	return struc.Unpack(r, d)
+}
+
 type CertData interface {
 	GetPublicKey() (uint32, []byte)
 	Verify() bool
@@ -472,7 +1023,7 @@ func (sc *ServerCertificate) Unpack(r io.Reader) error {
 	switch CertificateType(sc.DwVersion & 0x7fffffff) {
 	case CERT_CHAIN_VERSION_1:
 		glog.Debug("ProprietaryServerCertificate")
-		cd = &ProprietaryServerCertificate{}
+		cd = &ProprietaryServerCertificate{dwVersion: sc.DwVersion}
 	case CERT_CHAIN_VERSION_2:
 		glog.Debug("X509CertificateChain")
 		cd = &X509CertificateChain{}
@@ -508,6 +1059,18 @@ func NewServerSecurityData() *ServerSecurityData {
 func (d *ServerSecurityData) ScType() Message {
 	return SC_SECURITY
 }
+
+// Pack only supports the no encryption form, server random and
+// certificate are not sent
+func (s *ServerSecurityData) Pack() []byte {
+	buff := &bytes.Buffer{}
+	core.WriteUInt16LE(SC_SECURITY, buff)
+	core.WriteUInt16LE(0x0c, buff)
+	core.WriteUInt32LE(s.EncryptionMethod, buff)
+	core.WriteUInt32LE(s.EncryptionLevel, buff)
+	return buff.Bytes()
+}
+
 func (s *ServerSecurityData) Unpack(r io.Reader) error {
 	s.EncryptionMethod, _ = core.ReadUInt32LE(r)
 	s.EncryptionLevel, _ = core.ReadUInt32LE(r)
@@ -528,7 +1091,16 @@ func (s *ServerSecurityData) Unpack(r io.Reader) error {
 	return nil
 }
 
-func MakeConferenceCreateRequest(userData []byte) []byte {
+// the per lengths of the request take two bytes at most, the one around
+// the user data also counts the 14 bytes of the conference fields
+const maxUserDataLength = 0x3fff - 14
+
+// MakeConferenceCreateRequest fails when the client blocks overflow the
+// per lengths rather than sending a request the server drops
+func MakeConferenceCreateRequest(userData []byte) ([]byte, error) {
+	if len(userData) > maxUserDataLength {
+		return nil, errors.New(fmt.Sprintf("gcc user data of %d bytes exceeds %d", len(userData), maxUserDataLength))
+	}
 	buff := &bytes.Buffer{}
 	per.WriteChoice(0, buff)                        // 00
 	per.WriteObjectIdentifier(t124_02_98_oid, buff) // 05:00:14:7c:00:01
@@ -541,9 +1113,95 @@ func MakeConferenceCreateRequest(userData []byte) []byte {
 	per.WriteChoice(0xc0, buff)                // c0
 	per.WriteOctetStream(h221_cs_key, 4, buff) // 00 44:75:63:61
 	per.WriteOctetStream(string(userData), 0, buff)
+	return buff.Bytes(), nil
+}
+
+func MakeConferenceCreateResponse(userData []byte) []byte {
+	buff := &bytes.Buffer{}
+	per.WriteChoice(0, buff)
+	per.WriteObjectIdentifier(t124_02_98_oid, buff)
+	per.WriteLength(len(userData)+14, buff)
+	per.WriteChoice(0x14, buff)
+	per.WriteInteger16(0x79F3-1001, buff)
+	per.WriteInteger(1, buff)
+	core.WriteUInt8(0, buff) // result
+	per.WriteNumberOfSet(1, buff)
+	per.WriteChoice(0xc0, buff)
+	per.WriteOctetStream(h221_sc_key, 4, buff)
+	per.WriteOctetStream(string(userData), 0, buff)
 	return buff.Bytes()
 }
 
+type CsData interface {
+	CsType() Message
+	Unpack(io.Reader) error
+}
+
+func ReadConferenceCreateRequest(data []byte) []interface{} {
+	ret := make([]interface{}, 0, 3)
+
+	r := bytes.NewReader(data)
+	per.ReadChoice(r)
+	if !per.ReadObjectIdentifier(r, t124_02_98_oid) {
+		glog.Error("NODE_RDP_PROTOCOL_T125_GCC_BAD_OBJECT_IDENTIFIER_T124")
+		return ret
+	}
+	per.ReadLength(r)
+	per.ReadChoice(r)
+	if per.ReadChoice(r) != 0x08 {
+		glog.Error("NODE_RDP_PROTOCOL_T125_GCC_BAD_SELECTION")
+		return ret
+	}
+	if _, err := per.ReadNumericString(r, 1); err != nil {
+		glog.Error("NODE_RDP_PROTOCOL_T125_GCC_BAD_CONFERENCE_NAME", err)
+		return ret
+	}
+	// padding
+	core.ReadBytes(1, r)
+	per.ReadNumberOfSet(r)
+	if per.ReadChoice(r) != 0xc0 {
+		glog.Error("NODE_RDP_PROTOCOL_T125_GCC_BAD_CHOICE")
+		return ret
+	}
+
+	if !per.ExpectOctetStream(r, h221_cs_key, 4) {
+		glog.Error("NODE_RDP_PROTOCOL_T125_GCC_BAD_H221_CS_KEY")
+		return ret
+	}
+
+	ln, _ := per.ReadLength(r)
+	for ln > 0 {
+		t, _ := core.ReadUint16LE(r)
+		l, _ := core.ReadUint16LE(r)
+		if l < 4 {
+			glog.Error("Bad block length", l)
+			return ret
+		}
+		dataBytes, _ := core.ReadBytes(int(l)-4, r)
+		ln = ln - l
+		var d CsData
+		switch t {
+		case CS_CORE:
+			d = &ClientCoreData{}
+		case CS_SECURITY:
+			d = &ClientSecurityData{}
+		case CS_NET:
+			d = &ClientNetworkData{}
+		default:
+			glog.Info("Unhandled client block", t)
+			continue
+		}
+		err := d.Unpack(bytes.NewReader(dataBytes))
+		if err != nil {
+			glog.Error("Unpack:", err)
+			return ret
+		}
+		ret = append(ret, d)
+	}
+
+	return ret
+}
+
 type ScData interface {
 	ScType() Message
 	Unpack(io.Reader) error
@@ -566,7 +1224,7 @@ func ReadConferenceCreateResponse(data []byte) []interface{} {
 	per.ReadNumberOfSet(r)
 	per.ReadChoice(r)
 
-	if !per.ReadOctetStream(r, h221_sc_key, 4) {
+	if !per.ExpectOctetStream(r, h221_sc_key, 4) {
 		glog.Error("NODE_RDP_PROTOCOL_T125_GCC_BAD_H221_SC_KEY")
 		return ret
 	}
@@ -578,6 +1236,10 @@ func ReadConferenceCreateResponse(data []byte) []interface{} {
 	for ln > 0 {
 		t, _ := core.ReadUint16LE(r)
 		l, _ := core.ReadUint16LE(r)
+		if l < 4 || l > ln {
+			glog.Error("Bad block length", l)
+			return ret
+		}
 		dataBytes, _ := core.ReadBytes(int(l)-4, r)
 		ln = ln - l
 		var d ScData
@@ -588,6 +1250,10 @@ func ReadConferenceCreateResponse(data []byte) []interface{} {
 			d = &ServerSecurityData{}
 		case SC_NET:
 			d = &ServerNetworkData{}
+		case SC_MCS_MSGCHANNEL:
+			d = &ServerMessageChannelData{}
+		case SC_MULTITRANSPORT:
+			d = &ServerMultitransportChannelData{}
 		default:
 			glog.Error("Unknown type", t)
 			continue
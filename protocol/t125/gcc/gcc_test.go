@@ -0,0 +1,250 @@
+package gcc
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/tomatome/grdp/core"
+	"github.com/tomatome/grdp/glog"
+)
+
+func init() {
+	glog.SetLevel(glog.NONE)
+}
+
+// private exponent of the Terminal Services Signing Key, little endian
+// @see MS-RDPBCGR 5.3.3.1.1 Terminal Services Signing Key
+var tsskPrivateExponent = []byte{
+	0x87, 0xa7, 0x19, 0x32, 0xda, 0x11, 0x87, 0x55, 0x58, 0x00, 0x16, 0x16, 0x25, 0x65, 0x68, 0xf8,
+	0x24, 0x3e, 0xe6, 0xfa, 0xe9, 0x67, 0x49, 0x94, 0xcf, 0x92, 0xcc, 0x33, 0x99, 0xe8, 0x08, 0x60,
+	0x17, 0x9a, 0x12, 0x9f, 0x24, 0xdd, 0xb1, 0x24, 0x99, 0xc7, 0x3a, 0xb8, 0x0a, 0x7b, 0x0d, 0xdd,
+	0x35, 0x07, 0x79, 0x17, 0x0b, 0x51, 0x9b, 0xb3, 0xc7, 0x10, 0x01, 0x13, 0xe7, 0x3f, 0xf3, 0x5f}
+
+// proprietaryCertificate builds a certificate for modulus signed with the TSSK
+func proprietaryCertificate(modulus []byte) []byte {
+	p := &ProprietaryServerCertificate{
+		dwVersion:         uint32(CERT_CHAIN_VERSION_1),
+		DwSigAlgId:        1,
+		DwKeyAlgId:        1,
+		PublicKeyBlobType: 6,
+		PublicKeyBlobLen:  uint16(20 + len(modulus) + 8),
+		PublicKeyBlob: RSAPublicKey{
+			Magic:   0x31415352,
+			Keylen:  uint32(len(modulus) + 8),
+			Bitlen:  uint32(len(modulus) * 8),
+			Datalen: uint32(len(modulus) - 1),
+			PubExp:  0x10001,
+			Modulus: modulus,
+			Padding: make([]byte, 8),
+		},
+	}
+	hash := md5.Sum(p.signedData())
+	sig := append(hash[:], 0x00)
+	sig = append(sig, bytes.Repeat([]byte{0xff}, 45)...)
+	sig = append(sig, 0x01)
+	n := new(big.Int).SetBytes(reversed(TSSK_MODULUS))
+	d := new(big.Int).SetBytes(reversed(tsskPrivateExponent))
+	s := core.Reverse(new(big.Int).Exp(new(big.Int).SetBytes(reversed(sig)), d, n).Bytes())
+	s = append(s, make([]byte, 64-len(s))...)
+
+	buff := bytes.NewBuffer(p.signedData())
+	core.WriteUInt16LE(8, buff)
+	core.WriteUInt16LE(uint16(len(s)+8), buff)
+	core.WriteBytes(s, buff)
+	core.WriteBytes(make([]byte, 8), buff)
+	return buff.Bytes()
+}
+
+func TestProprietaryServerCertificate(t *testing.T) {
+	modulus := bytes.Repeat([]byte{0x5a}, 64)
+	data := proprietaryCertificate(modulus)
+
+	var sc ServerCertificate
+	if err := sc.Unpack(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if !sc.CertData.Verify() {
+		t.Error("TSSK signature not verified")
+	}
+	e, m := sc.CertData.GetPublicKey()
+	if e != 0x10001 || !bytes.Equal(m, modulus) {
+		t.Errorf("bad public key %x %x", e, m)
+	}
+
+	data[40] ^= 0xff
+	sc = ServerCertificate{}
+	if err := sc.Unpack(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if sc.CertData.Verify() {
+		t.Error("tampered certificate verified")
+	}
+}
+
+func TestX509CertificateChain(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buff := &bytes.Buffer{}
+	core.WriteUInt32LE(uint32(CERT_CHAIN_VERSION_2), buff)
+	core.WriteUInt32LE(2, buff)
+	for i := 0; i < 2; i++ {
+		core.WriteUInt32LE(uint32(len(der)), buff)
+		core.WriteBytes(der, buff)
+	}
+	core.WriteBytes(make([]byte, 16), buff)
+
+	var sc ServerCertificate
+	if err := sc.Unpack(buff); err != nil {
+		t.Fatal(err)
+	}
+	e, m := sc.CertData.GetPublicKey()
+	if int(e) != key.E || !bytes.Equal(core.Reverse(m), key.N.Bytes()) {
+		t.Error("bad x509 public key", e)
+	}
+}
+
+func TestMakeConferenceCreateRequestLength(t *testing.T) {
+	n := NewClientNetworkData()
+	req, err := MakeConferenceCreateRequest(n.Pack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(req, n.Pack()) {
+		t.Errorf("user data not at the end of %x", req)
+	}
+
+	// a bloated network block overflows the two byte per length
+	n.ChannelDefArray = make([]ChannelDef, 1400)
+	n.ChannelCount = 1400
+	if _, err = MakeConferenceCreateRequest(n.Pack()); err == nil {
+		t.Error("expect error on oversize user data")
+	}
+}
+
+func TestServerCoreDataOptionalFields(t *testing.T) {
+	d := &ServerCoreData{}
+	// RDP 4 servers only send the version
+	if err := d.Unpack(bytes.NewReader([]byte{0x01, 0x00, 0x08, 0x00})); err != nil {
+		t.Fatal(err)
+	}
+	if d.RdpVersion != RDP_VERSION_4 || d.EarlyCapabilityFlags != 0 {
+		t.Errorf("bad server core data %+v", d)
+	}
+
+	full := &ServerCoreData{RDP_VERSION_10_0, 3, RNS_UD_SC_SKIP_CHANNELJOIN_SUPPORTED}
+	d = &ServerCoreData{}
+	if err := d.Unpack(bytes.NewReader(full.Pack()[4:])); err != nil {
+		t.Fatal(err)
+	}
+	if *d != *full || !d.HasEarlyCapability(RNS_UD_SC_SKIP_CHANNELJOIN_SUPPORTED) || d.HasEarlyCapability(RNS_UD_SC_DYNAMIC_DST_SUPPORTED) {
+		t.Errorf("%+v not equals to %+v", d, full)
+	}
+}
+
+func TestClientCoreDataStrings(t *testing.T) {
+	d := NewClientCoreData()
+	d.SetClientName("a-very-long-workstation-name")
+	if b := d.ClientName; !bytes.Equal(b[:30], core.UnicodeEncode("a-very-long-wor")) || b[30] != 0 || b[31] != 0 {
+		t.Errorf("bad truncated name %x", b)
+	}
+	d.SetClientName("pc")
+	if !bytes.Equal(d.ClientName[:6], []byte{'p', 0, 'c', 0, 0, 0}) || d.ClientName[8] != 0 {
+		t.Errorf("bad name %x", d.ClientName)
+	}
+	// the surrogate pair would end on the terminator
+	d.SetClientName("12345678901234\U0001F600")
+	if !bytes.Equal(d.ClientName[:28], core.UnicodeEncode("12345678901234")) || d.ClientName[28] != 0 {
+		t.Errorf("split surrogate pair %x", d.ClientName)
+	}
+
+	d.SetClientProductId("00000-00000-00000-AA000")
+	if !bytes.Equal(d.ClientDigProductId[:46], core.UnicodeEncode("00000-00000-00000-AA000")) || d.ClientDigProductId[46] != 0 {
+		t.Errorf("bad product id %x", d.ClientDigProductId)
+	}
+	d.SetClientBuild(19041)
+	if d.ClientBuild != 19041 {
+		t.Error("bad build", d.ClientBuild)
+	}
+}
+
+func TestClientCoreDataConnectionType(t *testing.T) {
+	d := NewClientCoreData()
+	if err := d.SetConnectionType(CONNECTION_TYPE_AUTODETECT); err != nil {
+		t.Fatal(err)
+	}
+	if d.ConnectionType != CONNECTION_TYPE_AUTODETECT || d.EarlyCapabilityFlags&RNS_UD_CS_VALID_CONNECTION_TYPE == 0 ||
+		d.EarlyCapabilityFlags&RNS_UD_CS_SUPPORT_NETCHAR_AUTODETECT == 0 {
+		t.Errorf("bad auto-detect %d 0x%x", d.ConnectionType, d.EarlyCapabilityFlags)
+	}
+	d.SetConnectionType(CONNECTION_TYPE_LAN)
+	if d.ConnectionType != CONNECTION_TYPE_LAN || d.EarlyCapabilityFlags&RNS_UD_CS_SUPPORT_NETCHAR_AUTODETECT != 0 {
+		t.Errorf("bad lan %d 0x%x", d.ConnectionType, d.EarlyCapabilityFlags)
+	}
+	// the fields are at the end of the packed data
+	b := d.Pack()
+	if b[4+206] != CONNECTION_TYPE_LAN {
+		t.Errorf("packed connection type %d", b[4+206])
+	}
+	if err := d.SetConnectionType(8); err == nil {
+		t.Error("expect error on connection type 8")
+	}
+}
+
+func TestClientMonitorExtendedData(t *testing.T) {
+	d := NewClientMonitorData()
+	d.AddMonitor(0, 0, 1919, 1079, true)
+	d.AddMonitor(1920, 0, 3359, 2559, false)
+	for _, a := range []MonitorAttributes{
+		{Orientation: 45},
+		{PhysicalWidth: 5},
+		{DesktopScaleFactor: 600},
+		{DeviceScaleFactor: 150},
+	} {
+		if err := d.SetAttributes(1, a); err == nil {
+			t.Errorf("%+v accepted", a)
+		}
+	}
+	if err := d.SetAttributes(2, MonitorAttributes{}); err == nil {
+		t.Error("attributes of a missing monitor accepted")
+	}
+
+	portrait := MonitorAttributes{340, 600, ORIENTATION_PORTRAIT, 150, 140}
+	if err := d.SetAttributes(1, portrait); err != nil {
+		t.Fatal(err)
+	}
+	b := d.PackExtended()
+	if len(b) != 16+2*20 || binary.LittleEndian.Uint16(b) != CS_MONITOR_EX || int(binary.LittleEndian.Uint16(b[2:])) != len(b) {
+		t.Fatalf("bad header %x", b)
+	}
+	// the primary monitor has no attributes
+	if !bytes.Equal(b[16:36], make([]byte, 20)) {
+		t.Errorf("bad first monitor %x", b[16:36])
+	}
+	r := bytes.NewReader(b[36:])
+	var got MonitorAttributes
+	for _, f := range []*uint32{&got.PhysicalWidth, &got.PhysicalHeight, &got.Orientation, &got.DesktopScaleFactor, &got.DeviceScaleFactor} {
+		*f, _ = core.ReadUInt32LE(r)
+	}
+	if got != portrait {
+		t.Errorf("get %+v", got)
+	}
+}
@@ -2,11 +2,15 @@ package t125
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/tomatome/grdp/core"
 	"github.com/tomatome/grdp/emission"
@@ -40,6 +44,36 @@ const (
 	SEND_DATA_INDICATION                       = 26
 )
 
+// DisconnectReason is the reason of a DISCONNECT_PROVIDER_ULTIMATUM
+type DisconnectReason uint8
+
+const (
+	RN_DOMAIN_DISCONNECTED DisconnectReason = iota
+	RN_PROVIDER_INITIATED
+	RN_TOKEN_PURGED
+	RN_USER_REQUESTED
+	RN_CHANNEL_PURGED
+)
+
+func (r DisconnectReason) String() string {
+	switch r {
+	case RN_DOMAIN_DISCONNECTED:
+		return "rn-domain-disconnected"
+	case RN_PROVIDER_INITIATED:
+		return "rn-provider-initiated"
+	case RN_TOKEN_PURGED:
+		return "rn-token-purged"
+	case RN_USER_REQUESTED:
+		return "rn-user-requested"
+	case RN_CHANNEL_PURGED:
+		return "rn-channel-purged"
+	}
+	return fmt.Sprintf("rn-unknown(%d)", uint8(r))
+}
+
+// MCSChannel is a MCS channel id
+type MCSChannel uint16
+
 const (
 	MCS_GLOBAL_CHANNEL_ID uint16 = 1003
 	MCS_USERCHANNEL_BASE         = 1001
@@ -47,8 +81,46 @@ const (
 
 const (
 	GLOBAL_CHANNEL_NAME = "global"
+	// the MCS message channel, of the auto-detect and heartbeat PDUs
+	MESSAGE_CHANNEL_NAME = "msgchannel"
+)
+
+// T.125 Result enumeration
+const (
+	RT_SUCCESSFUL uint8 = iota
+	RT_DOMAIN_MERGING
+	RT_DOMAIN_NOT_HIERARCHICAL
+	RT_NO_SUCH_CHANNEL
+	RT_NO_SUCH_DOMAIN
+	RT_NO_SUCH_USER
+	RT_NOT_ADMITTED
+	RT_OTHER_USER_ID
+	RT_PARAMETERS_UNACCEPTABLE
+	RT_TOKEN_NOT_AVAILABLE
+	RT_TOKEN_NOT_POSSESSED
+	RT_TOO_MANY_CHANNELS
+	RT_TOO_MANY_TOKENS
+	RT_TOO_MANY_USERS
+	RT_UNSPECIFIED_FAILURE
+	RT_USER_REJECTED
 )
 
+var ErrUserRejected = errors.New("mcs server reject user")
+
+// AttachUserError is emitted when the attach user confirm result is not
+// RT_SUCCESSFUL, it matches ErrUserRejected with errors.Is
+type AttachUserError struct {
+	Result uint8
+}
+
+func (e *AttachUserError) Error() string {
+	return fmt.Sprintf("%v, result %d", ErrUserRejected, e.Result)
+}
+
+func (e *AttachUserError) Is(target error) bool {
+	return target == ErrUserRejected
+}
+
 /**
  * Format MCS PDULayer header packet
  * @param mcsPdu {integer}
@@ -63,16 +135,7 @@ func readMCSPDUHeader(options uint8, mcsPdu MCSDomainPDU) bool {
 	return (options >> 2) == uint8(mcsPdu)
 }
 
-type DomainParameters struct {
-	MaxChannelIds   int
-	MaxUserIds      int
-	MaxTokenIds     int
-	NumPriorities   int
-	MinThoughput    int
-	MaxHeight       int
-	MaxMCSPDUsize   int
-	ProtocolVersion int
-}
+type DomainParameters = ber.DomainParameters
 
 /**
  * @see http://www.itu.int/rec/T-REC-T.125-199802-I/en page 25
@@ -87,39 +150,20 @@ func NewDomainParameters(
 	maxHeight int,
 	maxMCSPDUsize int,
 	protocolVersion int) *DomainParameters {
-	return &DomainParameters{maxChannelIds, maxUserIds, maxTokenIds,
-		numPriorities, minThoughput, maxHeight, maxMCSPDUsize, protocolVersion}
-}
-
-func (d *DomainParameters) BER() []byte {
-	buff := &bytes.Buffer{}
-	ber.WriteInteger(d.MaxChannelIds, buff)
-	ber.WriteInteger(d.MaxUserIds, buff)
-	ber.WriteInteger(d.MaxTokenIds, buff)
-	ber.WriteInteger(1, buff)
-	ber.WriteInteger(0, buff)
-	ber.WriteInteger(1, buff)
-	ber.WriteInteger(d.MaxMCSPDUsize, buff)
-	ber.WriteInteger(2, buff)
-	return buff.Bytes()
+	return &DomainParameters{
+		MaxChannelIds:   maxChannelIds,
+		MaxUserIds:      maxUserIds,
+		MaxTokenIds:     maxTokenIds,
+		NumPriorities:   numPriorities,
+		MinThoughput:    minThoughput,
+		MaxHeight:       maxHeight,
+		MaxMCSPDUsize:   maxMCSPDUsize,
+		ProtocolVersion: protocolVersion,
+	}
 }
 
 func ReadDomainParameters(r io.Reader) (*DomainParameters, error) {
-	if !ber.ReadUniversalTag(ber.TAG_SEQUENCE, true, r) {
-		return nil, errors.New("bad BER tags")
-	}
-	d := &DomainParameters{}
-	ber.ReadLength(r)
-
-	d.MaxChannelIds, _ = ber.ReadInteger(r)
-	d.MaxUserIds, _ = ber.ReadInteger(r)
-	d.MaxTokenIds, _ = ber.ReadInteger(r)
-	ber.ReadInteger(r)
-	ber.ReadInteger(r)
-	ber.ReadInteger(r)
-	d.MaxMCSPDUsize, _ = ber.ReadInteger(r)
-	ber.ReadInteger(r)
-	return d, nil
+	return ber.ReadDomainParameters(r)
 }
 
 /**
@@ -178,6 +222,49 @@ func NewConnectResponse(userData []byte) *ConnectResponse {
 		userData}
 }
 
+func (c *ConnectResponse) BER() []byte {
+	buff := &bytes.Buffer{}
+	ber.WriteEnumerated(c.result, buff)
+	ber.WriteInteger(c.calledConnectId, buff)
+	ber.WriteEncodedDomainParams(c.domainParameters.BER(), buff)
+	ber.WriteOctetstring(string(c.userData), buff)
+	return buff.Bytes()
+}
+
+func ReadConnectInitial(r io.Reader) (*ConnectInitial, error) {
+	c := &ConnectInitial{}
+	var err error
+	_, err = ber.ReadApplicationTag(uint8(MCS_TYPE_CONNECT_INITIAL), r)
+	if err != nil {
+		return nil, err
+	}
+	c.CallingDomainSelector, err = ber.ReadOctetstring(r)
+	if err != nil {
+		return nil, err
+	}
+	c.CalledDomainSelector, err = ber.ReadOctetstring(r)
+	if err != nil {
+		return nil, err
+	}
+	c.UpwardFlag, err = ber.ReadBoolean(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range []*DomainParameters{&c.TargetParameters,
+		&c.MinimumParameters, &c.MaximumParameters} {
+		p, err := ReadDomainParameters(r)
+		if err != nil {
+			return nil, err
+		}
+		*d = *p
+	}
+	c.UserData, err = ber.ReadOctetstring(r)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
 func ReadConnectResponse(r io.Reader) (*ConnectResponse, error) {
 	c := &ConnectResponse{}
 	var err error
@@ -190,7 +277,14 @@ func ReadConnectResponse(r io.Reader) (*ConnectResponse, error) {
 		return nil, err
 	}
 
+	if c.result != RT_SUCCESSFUL {
+		return nil, errors.New(fmt.Sprintf("mcs connect response rejected by server, result %d", c.result))
+	}
+
 	c.calledConnectId, err = ber.ReadInteger(r)
+	if err != nil {
+		return nil, err
+	}
 	c.domainParameters, err = ReadDomainParameters(r)
 	if err != nil {
 		return nil, err
@@ -198,22 +292,56 @@ func ReadConnectResponse(r io.Reader) (*ConnectResponse, error) {
 	if !ber.ReadUniversalTag(ber.TAG_OCTET_STRING, false, r) {
 		return nil, errors.New("invalid expected BER tag")
 	}
-	dataLen, _ := ber.ReadLength(r)
+	dataLen, err := ber.ReadLength(r)
+	if err != nil {
+		return nil, err
+	}
 	c.userData, err = core.ReadBytes(dataLen, r)
-	return c, err
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
 }
 
+// MCSChannelInfo is a joined channel, the static virtual channels are named
+// as in the client network data
 type MCSChannelInfo struct {
 	ID   uint16
 	Name string
 }
 
+// Stats of the data PDUs sent and received by the MCS layer
+type Stats struct {
+	BytesRead    uint64
+	BytesWritten uint64
+	PDUsSent     map[MCSChannel]uint64
+	PDUsReceived map[MCSChannel]uint64
+}
+
+/**
+ * MCS layer, the transport read goroutine runs the connection sequence and
+ * emits the channel data while callers send from their own goroutines,
+ * so the user id and the joined channels are only touched under channelsLock
+ */
 type MCS struct {
 	emission.Emitter
 	transport  core.Transport
 	recvOpCode MCSDomainPDU
 	sendOpCode MCSDomainPDU
-	channels   []MCSChannelInfo
+
+	channelsLock sync.Mutex
+	userId       uint16
+	channels     []MCSChannelInfo
+
+	statsLock sync.Mutex
+	stats     Stats
+
+	streamsLock sync.Mutex
+	streams     map[MCSChannel]*channelStream
+
+	// non zero when the data PDU payloads are pooled rather than allocated,
+	// accessed atomically
+	pooledPayloads int32
 }
 
 func NewMCS(t core.Transport, recvOpCode MCSDomainPDU, sendOpCode MCSDomainPDU) *MCS {
@@ -222,10 +350,20 @@ func NewMCS(t core.Transport, recvOpCode MCSDomainPDU, sendOpCode MCSDomainPDU)
 		t,
 		recvOpCode,
 		sendOpCode,
+		sync.Mutex{},
+		1 + MCS_USERCHANNEL_BASE,
 		[]MCSChannelInfo{{MCS_GLOBAL_CHANNEL_ID, GLOBAL_CHANNEL_NAME}},
+		sync.Mutex{},
+		Stats{PDUsSent: map[MCSChannel]uint64{}, PDUsReceived: map[MCSChannel]uint64{}},
+		sync.Mutex{},
+		map[MCSChannel]*channelStream{},
+		0,
 	}
 
-	m.transport.On("close", func() {
+	m.transport.On("data", func(s []byte) {
+		core.Trace(core.Inbound, "mcs", s)
+	}).On("close", func() {
+		m.closeStreams()
 		m.Emit("close")
 	}).On("error", func(err error) {
 		m.Emit("error", err)
@@ -233,31 +371,222 @@ func NewMCS(t core.Transport, recvOpCode MCSDomainPDU, sendOpCode MCSDomainPDU)
 	return m
 }
 
+func (m *MCS) addChannel(info MCSChannelInfo) {
+	m.channelsLock.Lock()
+	m.channels = append(m.channels, info)
+	m.channelsLock.Unlock()
+}
+
+// joinedChannels returns a copy of the joined channels
+func (m *MCS) joinedChannels() []MCSChannelInfo {
+	m.channelsLock.Lock()
+	defer m.channelsLock.Unlock()
+	return append([]MCSChannelInfo{}, m.channels...)
+}
+
+// channelName returns the name of a joined channel
+func (m *MCS) channelName(id MCSChannel) (string, bool) {
+	m.channelsLock.Lock()
+	defer m.channelsLock.Unlock()
+	for _, ch := range m.channels {
+		if ch.ID == uint16(id) {
+			return ch.Name, true
+		}
+	}
+	return "", false
+}
+
+// channelID returns the id of a joined channel, the global one if unknown
+func (m *MCS) channelID(name string) MCSChannel {
+	m.channelsLock.Lock()
+	defer m.channelsLock.Unlock()
+	for _, ch := range m.channels {
+		if name == ch.Name {
+			return MCSChannel(ch.ID)
+		}
+	}
+	return MCSChannel(m.channels[0].ID)
+}
+
+// write traces the PDU then writes it to the transport
+func (m *MCS) write(b []byte) (int, error) {
+	core.Trace(core.Outbound, "mcs", b)
+	return m.transport.Write(b)
+}
+
 func (x *MCS) Read(b []byte) (n int, err error) {
 	return x.transport.Read(b)
 }
 
 func (x *MCS) Write(b []byte) (n int, err error) {
-	return x.transport.Write(b)
+	return x.write(b)
 }
 
 func (m *MCS) Close() error {
 	return m.transport.Close()
 }
 
+func (m *MCS) SetReadTimeout(d time.Duration) {
+	if t, ok := m.transport.(core.TimeoutSetter); ok {
+		t.SetReadTimeout(d)
+	}
+}
+
+func (m *MCS) SetWriteTimeout(d time.Duration) {
+	if t, ok := m.transport.(core.TimeoutSetter); ok {
+		t.SetWriteTimeout(d)
+	}
+}
+
+// Disconnect sends a DISCONNECT_PROVIDER_ULTIMATUM then closes the transport
+func (m *MCS) Disconnect(reason DisconnectReason) error {
+	buff := &bytes.Buffer{}
+	writeMCSPDUHeader(DISCONNECT_PROVIDER_ULTIMATUM, uint8(reason)>>1, buff)
+	core.WriteUInt8(uint8(reason&1)<<7, buff)
+	_, err := m.write(buff.Bytes())
+	if err != nil {
+		m.transport.Close()
+		return errors.New(fmt.Sprintf("mcs sendDisconnectProviderUltimatum write error %v", err))
+	}
+	return m.transport.Close()
+}
+
+/**
+ * Send data PDU (SEND_DATA_REQUEST for client, SEND_DATA_INDICATION for server)
+ * @see http://www.itu.int/rec/T-REC-T.125-199802-I/en page 44
+ */
+func (m *MCS) Send(channelId MCSChannel, data []byte) error {
+	buff := m.pack(channelId, data)
+	if glog.Enabled(glog.DEBUG) {
+		glog.Debug("mcs send", channelId, ":", hex.EncodeToString(buff.Bytes()))
+	}
+	_, err := m.write(buff.Bytes())
+	if err != nil {
+		return err
+	}
+	m.statsLock.Lock()
+	m.stats.BytesWritten += uint64(buff.Len())
+	m.stats.PDUsSent[channelId]++
+	m.statsLock.Unlock()
+	return nil
+}
+
+// pack returns the data PDU of data on channelId
+func (m *MCS) pack(channelId MCSChannel, data []byte) *bytes.Buffer {
+	m.channelsLock.Lock()
+	userId := m.userId
+	m.channelsLock.Unlock()
+	buff := &bytes.Buffer{}
+	writeMCSPDUHeader(m.sendOpCode, 0, buff)
+	per.WriteInteger16(userId-MCS_USERCHANNEL_BASE, buff)
+	per.WriteInteger16(uint16(channelId), buff)
+	core.WriteUInt8(0x70, buff)
+	per.WriteOctets(data, buff)
+	return buff
+}
+
+// SetPooledPayloads reuses the buffers of the data PDU payloads, which are
+// then only valid until the listeners return. Every listener must copy
+// what it keeps, payloads are allocated for each PDU by default
+func (m *MCS) SetPooledPayloads(pooled bool) {
+	var v int32
+	if pooled {
+		v = 1
+	}
+	atomic.StoreInt32(&m.pooledPayloads, v)
+}
+
+// Stats returns a snapshot of the data PDU counters, safe for concurrent use
+func (m *MCS) Stats() Stats {
+	m.statsLock.Lock()
+	defer m.statsLock.Unlock()
+	s := Stats{
+		BytesRead:    m.stats.BytesRead,
+		BytesWritten: m.stats.BytesWritten,
+		PDUsSent:     make(map[MCSChannel]uint64, len(m.stats.PDUsSent)),
+		PDUsReceived: make(map[MCSChannel]uint64, len(m.stats.PDUsReceived)),
+	}
+	for k, v := range m.stats.PDUsSent {
+		s.PDUsSent[k] = v
+	}
+	for k, v := range m.stats.PDUsReceived {
+		s.PDUsReceived[k] = v
+	}
+	return s
+}
+
+/**
+ * Parse a data PDU
+ * @returns channel id and payload
+ */
+func (m *MCS) Receive(s []byte) (MCSChannel, []byte, error) {
+	return m.receive(s, &bytes.Buffer{})
+}
+
+// payloadPool recycles the buffers of the received data PDUs
+var payloadPool = sync.Pool{New: func() interface{} { return &bytes.Buffer{} }}
+
+// receive parses a data PDU, the payload is appended to buff
+func (m *MCS) receive(s []byte, buff *bytes.Buffer) (MCSChannel, []byte, error) {
+	r := bytes.NewReader(s)
+	option, err := core.ReadUInt8(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if !readMCSPDUHeader(option, m.recvOpCode) {
+		return 0, nil, errors.New("Invalid expected MCS opcode receive data")
+	}
+
+	if _, err = per.ReadInteger16(r); err != nil {
+		return 0, nil, err
+	}
+	channelId, err := per.ReadInteger16(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	// data priority and segmentation
+	if _, err = per.ReadEnumerates(r); err != nil {
+		return 0, nil, err
+	}
+	if err = per.ReadOctetStreamTo(r, buff); err != nil {
+		return 0, nil, errors.New(fmt.Sprintf("mcs recvData get data error %v", err))
+	}
+	data := buff.Bytes()
+	m.statsLock.Lock()
+	m.stats.BytesRead += uint64(len(s))
+	m.stats.PDUsReceived[MCSChannel(channelId)]++
+	m.statsLock.Unlock()
+	return MCSChannel(channelId), data, nil
+}
+
+// MCSClient emits "connect-response" once the server data of the connect
+// response is read, then "connect" when the channels are joined
 type MCSClient struct {
 	*MCS
 	clientCoreData     *gcc.ClientCoreData
 	clientNetworkData  *gcc.ClientNetworkData
 	clientSecurityData *gcc.ClientSecurityData
+	clientMonitorData  *gcc.ClientMonitorData
 
-	serverCoreData     *gcc.ServerCoreData
-	serverNetworkData  *gcc.ServerNetworkData
-	serverSecurityData *gcc.ServerSecurityData
+	serverCoreData           *gcc.ServerCoreData
+	serverNetworkData        *gcc.ServerNetworkData
+	serverSecurityData       *gcc.ServerSecurityData
+	serverMessageChannelData *gcc.ServerMessageChannelData
+	serverMultitransportData *gcc.ServerMultitransportChannelData
 
 	channelsConnected  int
-	userId             uint16
 	nbChannelRequested int
+	// the join of the message channel is sent
+	messageChannelRequested bool
+
+	// domain parameters negotiated by connect response
+	domainParameters *DomainParameters
+
+	// ARC_SC_PRIVATE_PACKET of the session
+	reconnectCookie []byte
+
+	// handshake context, nil when started by transport connect event
+	ctx context.Context
 }
 
 func NewMCSClient(t core.Transport) *MCSClient {
@@ -266,28 +595,184 @@ func NewMCSClient(t core.Transport) *MCSClient {
 		clientCoreData:     gcc.NewClientCoreData(),
 		clientNetworkData:  gcc.NewClientNetworkData(),
 		clientSecurityData: gcc.NewClientSecurityData(),
-		userId:             1 + MCS_USERCHANNEL_BASE,
+		clientMonitorData:  gcc.NewClientMonitorData(),
 	}
 	c.transport.On("connect", c.connect)
 	return c
 }
 
+// AddMonitor declares a monitor of a multi monitor session,
+// coordinates are inclusive and relative to the primary monitor
+func (c *MCSClient) AddMonitor(left, top, right, bottom int32, primary bool) error {
+	return c.clientMonitorData.AddMonitor(left, top, right, bottom, primary)
+}
+
+// SetMonitorAttributes sets the physical size, orientation and scale
+// factors of the monitor index of AddMonitor, for the DPI scaling
+func (c *MCSClient) SetMonitorAttributes(index int, a gcc.MonitorAttributes) error {
+	return c.clientMonitorData.SetAttributes(index, a)
+}
+
+// SetDesktop sets the desktop size requested at connect
+func (c *MCSClient) SetDesktop(width, height uint16) error {
+	return c.clientCoreData.SetDesktop(width, height)
+}
+
+// SetColorDepth sets the color depth requested at connect
+func (c *MCSClient) SetColorDepth(bpp uint16) error {
+	return c.clientCoreData.SetColorDepth(bpp)
+}
+
+// SetConnectionType sets the connection type announced at connect
+func (c *MCSClient) SetConnectionType(t gcc.ConnectionType) error {
+	return c.clientCoreData.SetConnectionType(t)
+}
+
+// SetKeyboardLayout sets the keyboard layout announced at connect
+func (c *MCSClient) SetKeyboardLayout(layout gcc.KeyboardLayout) {
+	c.clientCoreData.KbdLayout = layout
+}
+
+// ClientCoreData returns the client core data sent at connect
+func (c *MCSClient) ClientCoreData() *gcc.ClientCoreData {
+	return c.clientCoreData
+}
+
 func (c *MCSClient) SetClientCoreData(width, height uint16) {
 	c.clientCoreData.DesktopWidth = width
 	c.clientCoreData.DesktopHeight = height
 }
 
+// MaxPDUSize returns the maximum MCS PDU size accepted by the server,
+// or the requested one before the connect response is received
+func (c *MCSClient) MaxPDUSize() int {
+	if c.domainParameters == nil {
+		return 0xffff
+	}
+	return c.domainParameters.MaxMCSPDUsize
+}
+
+/**
+ * Record the server auto-reconnect cookie (ARC_SC_PRIVATE_PACKET)
+ * received in the save session info PDU
+ * @see MS-RDPBCGR 2.2.4.2 Server Auto-Reconnect Packet
+ */
+func (c *MCSClient) SetReconnectCookie(logonId uint32, random []byte) {
+	buff := &bytes.Buffer{}
+	core.WriteUInt32LE(28, buff) // cbLen
+	core.WriteUInt32LE(1, buff)  // version
+	core.WriteUInt32LE(logonId, buff)
+	core.WriteBytes(random, buff)
+	c.reconnectCookie = buff.Bytes()
+}
+
+// ServerCoreData returns the core data of the connect response, nil before
+func (c *MCSClient) ServerCoreData() *gcc.ServerCoreData {
+	return c.serverCoreData
+}
+
+// ServerSecurityData returns the security data of the connect response, nil before
+func (c *MCSClient) ServerSecurityData() *gcc.ServerSecurityData {
+	return c.serverSecurityData
+}
+
+// ReconnectCookie returns the last ARC_SC_PRIVATE_PACKET, nil if the
+// server did not send one
+func (c *MCSClient) ReconnectCookie() []byte {
+	if c.reconnectCookie == nil {
+		return nil
+	}
+	return append([]byte{}, c.reconnectCookie...)
+}
+
 func (c *MCSClient) connect(selectedProtocol uint32) {
 	glog.Debug("mcs client on connect", selectedProtocol)
 	c.clientCoreData.ServerSelectedProtocol = selectedProtocol
+	// the x224 event runs on the read loop of the transport, which must go
+	// on for the handshake to end, so its result is only emitted
+	c.begin(context.Background())
+}
+
+// ConnectWithContext runs the MCS handshake over an already negotiated
+// transport and waits for it to finish. When ctx is done before the end
+// of the handshake, pending handlers are removed and ctx.Err() is returned.
+func (c *MCSClient) ConnectWithContext(ctx context.Context) error {
+	result, stop := c.begin(ctx)
+	defer stop()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		if t, ok := c.transport.(core.ListenerRemover); ok {
+			t.RemoveListener("data", c.recvConnectResponse)
+			t.RemoveListener("data", c.recvAttachUserConfirm)
+			t.RemoveListener("data", c.recvChannelJoinConfirm)
+		}
+		return ctx.Err()
+	}
+}
+
+// begin starts the handshake cancelled by ctx, result gets its end unless
+// stop removed the result listeners
+func (c *MCSClient) begin(ctx context.Context) (result <-chan error, stop func()) {
+	r := make(chan error, 1)
+	onConnect := func(clientData, serverData []interface{}, userId uint16, channels []MCSChannelInfo) {
+		select {
+		case r <- nil:
+		default:
+		}
+	}
+	onError := func(err error) {
+		select {
+		case r <- err:
+		default:
+		}
+	}
+	c.Once("connect", onConnect)
+	c.Once("error", onError)
+	c.start(ctx)
+	return r, func() {
+		c.RemoveListener("connect", onConnect)
+		c.RemoveListener("error", onError)
+	}
+}
+
+// expect waits for next handshake message unless the handshake is cancelled
+func (c *MCSClient) expect(handler func(s []byte)) {
+	if c.ctx != nil && c.ctx.Err() != nil {
+		glog.Debug("mcs handshake cancelled:", c.ctx.Err())
+		return
+	}
+	c.transport.Once("data", handler)
+}
+
+func (c *MCSClient) start(ctx context.Context) {
+	c.ctx = ctx
 
 	// sendConnectInitial
 	userDataBuff := bytes.Buffer{}
 	userDataBuff.Write(c.clientCoreData.Pack())
 	userDataBuff.Write(c.clientNetworkData.Pack())
 	userDataBuff.Write(c.clientSecurityData.Pack())
+	if len(c.clientMonitorData.Monitors) > 0 {
+		if err := c.clientMonitorData.Validate(); err != nil {
+			c.Emit("error", err)
+			return
+		}
+		userDataBuff.Write(c.clientMonitorData.Pack())
+		if len(c.clientMonitorData.Attributes) > 0 {
+			userDataBuff.Write(c.clientMonitorData.PackExtended())
+		}
+	}
+	if c.wantMessageChannel() {
+		userDataBuff.Write((&gcc.ClientMessageChannelData{}).Pack())
+	}
 
-	ccReq := gcc.MakeConferenceCreateRequest(userDataBuff.Bytes())
+	ccReq, err := gcc.MakeConferenceCreateRequest(userDataBuff.Bytes())
+	if err != nil {
+		c.Emit("error", err)
+		return
+	}
 	connectInitial := NewConnectInitial(ccReq)
 	connectInitialBerEncoded := connectInitial.BER()
 
@@ -295,13 +780,13 @@ func (c *MCSClient) connect(selectedProtocol uint32) {
 	ber.WriteApplicationTag(uint8(MCS_TYPE_CONNECT_INITIAL), len(connectInitialBerEncoded), dataBuff)
 	dataBuff.Write(connectInitialBerEncoded)
 
-	_, err := c.transport.Write(dataBuff.Bytes())
+	_, err = c.write(dataBuff.Bytes())
 	if err != nil {
 		c.Emit("error", errors.New(fmt.Sprintf("mcs sendConnectInitial write error %v", err)))
 		return
 	}
 	glog.Debug("mcs wait for data event")
-	c.transport.Once("data", c.recvConnectResponse)
+	c.expect(c.recvConnectResponse)
 }
 
 func (c *MCSClient) recvConnectResponse(s []byte) {
@@ -311,6 +796,7 @@ func (c *MCSClient) recvConnectResponse(s []byte) {
 		c.Emit("error", errors.New(fmt.Sprintf("ReadConnectResponse %v", err)))
 		return
 	}
+	c.domainParameters = cResp.domainParameters
 	// record server gcc block
 	serverSettings := gcc.ReadConferenceCreateResponse(cResp.userData)
 	for _, v := range serverSettings {
@@ -324,23 +810,31 @@ func (c *MCSClient) recvConnectResponse(s []byte) {
 		case *gcc.ServerNetworkData:
 			c.serverNetworkData = v.(*gcc.ServerNetworkData)
 
+		case *gcc.ServerMessageChannelData:
+			c.serverMessageChannelData = v.(*gcc.ServerMessageChannelData)
+
+		case *gcc.ServerMultitransportChannelData:
+			c.serverMultitransportData = v.(*gcc.ServerMultitransportChannelData)
+
 		default:
-			err := errors.New(fmt.Sprintf("unhandle server gcc block %v", reflect.TypeOf(v)))
-			glog.Error(err)
-			c.Emit("error", err)
-			return
+			glog.Info("skip unhandled server gcc block", reflect.TypeOf(v))
 		}
 	}
+	if c.serverCoreData == nil || c.serverNetworkData == nil || c.serverSecurityData == nil {
+		c.Emit("error", errors.New("NODE_RDP_PROTOCOL_T125_MCS_MISSING_SERVER_GCC_BLOCK"))
+		return
+	}
 	glog.Debugf("serverSecurityData: %+v", c.serverSecurityData)
 	glog.Debugf("serverCoreData: %+v", c.serverCoreData)
 	glog.Debugf("serverNetworkData: %+v", c.serverNetworkData)
+	c.Emit("connect-response")
 	glog.Debug("mcs sendErectDomainRequest")
 	c.sendErectDomainRequest()
 
 	glog.Debug("mcs sendAttachUserRequest")
 	c.sendAttachUserRequest()
 
-	c.transport.Once("data", c.recvAttachUserConfirm)
+	c.expect(c.recvAttachUserConfirm)
 }
 
 func (c *MCSClient) sendErectDomainRequest() {
@@ -348,13 +842,13 @@ func (c *MCSClient) sendErectDomainRequest() {
 	writeMCSPDUHeader(ERECT_DOMAIN_REQUEST, 0, buff)
 	per.WriteInteger(0, buff)
 	per.WriteInteger(0, buff)
-	c.transport.Write(buff.Bytes())
+	c.write(buff.Bytes())
 }
 
 func (c *MCSClient) sendAttachUserRequest() {
 	buff := &bytes.Buffer{}
 	writeMCSPDUHeader(ATTACH_USER_REQUEST, 0, buff)
-	c.transport.Write(buff.Bytes())
+	c.write(buff.Bytes())
 }
 
 func (c *MCSClient) recvAttachUserConfirm(s []byte) {
@@ -377,28 +871,48 @@ func (c *MCSClient) recvAttachUserConfirm(s []byte) {
 		c.Emit("error", err)
 		return
 	}
-	if e != 0 {
-		c.Emit("error", errors.New("NODE_RDP_PROTOCOL_T125_MCS_SERVER_REJECT_USER'"))
+	if e != RT_SUCCESSFUL {
+		c.Emit("error", &AttachUserError{e})
 		return
 	}
 
 	userId, _ := per.ReadInteger16(r)
 	userId += MCS_USERCHANNEL_BASE
+	c.channelsLock.Lock()
 	c.userId = userId
-
 	c.channels = append(c.channels, MCSChannelInfo{userId, "user"})
+	c.channelsLock.Unlock()
 	c.connectChannels()
 }
 
+// Channels returns the joined channels with their ids, all of them once
+// connected, to send the data of a channel by name
+func (c *MCSClient) Channels() []MCSChannelInfo {
+	return c.joinedChannels()
+}
+
 func (c *MCSClient) connectChannels() {
-	glog.Debug("mcs connectChannels:", c.channelsConnected, ":", len(c.channels))
-	if c.channelsConnected == len(c.channels) {
+	channels := c.joinedChannels()
+	glog.Debug("mcs connectChannels:", c.channelsConnected, ":", len(channels))
+	if c.channelsConnected == len(channels) {
 		if c.nbChannelRequested < int(c.serverNetworkData.ChannelCount) {
 			//static virtual channel
 			chanId := c.serverNetworkData.ChannelIdArray[c.nbChannelRequested]
 			c.nbChannelRequested++
-			c.sendChannelJoinRequest(chanId)
-			c.transport.Once("data", c.recvChannelJoinConfirm)
+			if err := c.sendChannelJoinRequest(chanId); err != nil {
+				c.Emit("error", err)
+				return
+			}
+			c.expect(c.recvChannelJoinConfirm)
+			return
+		}
+		if c.wantMessageChannel() && c.serverMessageChannelData != nil && !c.messageChannelRequested {
+			c.messageChannelRequested = true
+			if err := c.sendChannelJoinRequest(c.serverMessageChannelData.MCSChannelId); err != nil {
+				c.Emit("error", err)
+				return
+			}
+			c.expect(c.recvChannelJoinConfirm)
 			return
 		}
 		c.transport.On("data", c.recvData)
@@ -412,28 +926,44 @@ func (c *MCSClient) connectChannels() {
 		serverData = append(serverData, c.serverCoreData)
 		serverData = append(serverData, c.serverSecurityData)
 		glog.Debug("msc connectChannels callback to sec")
-		c.Emit("connect", clientData, serverData, c.userId, c.channels)
+		c.Emit("connect", clientData, serverData, c.userId, channels)
 		return
 	}
 
 	// sendChannelJoinRequest
-	glog.Debug("sendChannelJoinRequest:", c.channels[c.channelsConnected].Name)
-	c.sendChannelJoinRequest(c.channels[c.channelsConnected].ID)
+	glog.Debug("sendChannelJoinRequest:", channels[c.channelsConnected].Name)
+	if err := c.sendChannelJoinRequest(channels[c.channelsConnected].ID); err != nil {
+		c.Emit("error", err)
+		return
+	}
 
-	c.transport.Once("data", c.recvChannelJoinConfirm)
+	c.expect(c.recvChannelJoinConfirm)
 }
 
-func (c *MCSClient) sendChannelJoinRequest(channelId uint16) {
+// wantMessageChannel tells if the client core data needs the message channel
+func (c *MCSClient) wantMessageChannel() bool {
+	return c.clientCoreData.EarlyCapabilityFlags&gcc.RNS_UD_CS_SUPPORT_NETCHAR_AUTODETECT != 0
+}
+
+func (c *MCSClient) sendChannelJoinRequest(channelId uint16) error {
 	glog.Debug("mcs sendChannelJoinRequest", channelId)
 	buff := &bytes.Buffer{}
 	writeMCSPDUHeader(CHANNEL_JOIN_REQUEST, 0, buff)
 	per.WriteInteger16(c.userId-MCS_USERCHANNEL_BASE, buff)
 	per.WriteInteger16(channelId, buff)
-	c.transport.Write(buff.Bytes())
+	_, err := c.write(buff.Bytes())
+	if err != nil {
+		return errors.New(fmt.Sprintf("mcs sendChannelJoinRequest write error %v", err))
+	}
+	return nil
 }
 
-func (c *MCSClient) recvData(s []byte) {
-	glog.Debug("msc on data recvData:", hex.EncodeToString(s))
+/**
+ * recvData emits the payload of a data PDU as "sec", "channel-<id>" and
+ * "global-data", with SetPooledPayloads(true) the payload is only valid
+ * until the listeners return as its buffer is then reused
+ */
+func (c *MCS) recvData(s []byte) {
 
 	r := bytes.NewReader(s)
 	option, err := core.ReadUInt8(r)
@@ -443,40 +973,43 @@ func (c *MCSClient) recvData(s []byte) {
 	}
 
 	if readMCSPDUHeader(option, DISCONNECT_PROVIDER_ULTIMATUM) {
-		c.Emit("error", errors.New("MCS DISCONNECT_PROVIDER_ULTIMATUM"))
+		// reason is 3 bits, split over the header options and next byte
+		var next uint8
+		if r.Len() > 0 {
+			next, _ = core.ReadUInt8(r)
+		}
+		reason := DisconnectReason((option&0x03)<<1 | next>>7)
+		glog.Info("mcs receive disconnect provider ultimatum:", reason)
+		c.Emit("disconnect", reason)
 		c.transport.Close()
 		return
-	} else if !readMCSPDUHeader(option, c.recvOpCode) {
-		c.Emit("error", errors.New("Invalid expected MCS opcode receive data"))
-		return
 	}
 
-	userId, _ := per.ReadInteger16(r)
-	userId += MCS_USERCHANNEL_BASE
-
-	channelId, _ := per.ReadInteger16(r)
-	per.ReadEnumerates(r)
-	size, _ := per.ReadLength(r)
-	// channel ID doesn't match a requested layer
-	found := false
-	channelName := ""
-	for _, channel := range c.channels {
-		if channel.ID == channelId {
-			found = true
-			channelName = channel.Name
-			break
-		}
+	buff := &bytes.Buffer{}
+	if atomic.LoadInt32(&c.pooledPayloads) != 0 {
+		buff = payloadPool.Get().(*bytes.Buffer)
+		defer func() {
+			buff.Reset()
+			payloadPool.Put(buff)
+		}()
+	}
+	channelId, left, err := c.receive(s, buff)
+	if err != nil {
+		c.Emit("error", err)
+		return
 	}
+	// channel ID doesn't match a requested layer
+	channelName, found := c.channelName(channelId)
 	if !found {
 		glog.Error("mcs receive data for an unconnected layer")
 		return
 	}
-	left, err := core.ReadBytes(int(size), r)
-	if err != nil {
-		c.Emit("error", errors.New(fmt.Sprintf("mcs recvData get data error %v", err)))
-		return
+	glog.Debugw("mcs emit", "channel", channelId, "name", channelName, "len", len(left))
+	c.pushStream(channelId, left)
+	c.Emit(fmt.Sprintf("channel-%d", channelId), left)
+	if uint16(channelId) == MCS_GLOBAL_CHANNEL_ID {
+		c.Emit("global-data", left)
 	}
-	glog.Debugf("mcs emit channel<%s>:%v", channelName, left)
 	c.Emit("sec", channelName, left)
 }
 
@@ -494,8 +1027,16 @@ func (c *MCSClient) recvChannelJoinConfirm(s []byte) {
 		return
 	}
 
-	confirm, _ := per.ReadEnumerates(r)
-	userId, _ := per.ReadInteger16(r)
+	confirm, err := per.ReadEnumerates(r)
+	if err != nil {
+		c.Emit("error", err)
+		return
+	}
+	userId, err := per.ReadInteger16(r)
+	if err != nil {
+		c.Emit("error", err)
+		return
+	}
 	userId += MCS_USERCHANNEL_BASE
 
 	if c.userId != userId {
@@ -503,52 +1044,277 @@ func (c *MCSClient) recvChannelJoinConfirm(s []byte) {
 		return
 	}
 
-	channelId, _ := per.ReadInteger16(r)
-	if (confirm != 0) && (channelId == uint16(MCS_GLOBAL_CHANNEL_ID) || channelId == c.userId) {
-		c.Emit("error", errors.New("NODE_RDP_PROTOCOL_T125_MCS_SERVER_MUST_CONFIRM_STATIC_CHANNEL"))
+	requested, err := per.ReadInteger16(r)
+	if err != nil {
+		c.Emit("error", err)
+		return
+	}
+
+	// channelId is optional, only present on success
+	channelId := requested
+	if option&0x02 != 0 {
+		channelId, err = per.ReadInteger16(r)
+		if err != nil {
+			c.Emit("error", err)
+			return
+		}
+	}
+
+	if confirm != RT_SUCCESSFUL {
+		c.Emit("error", errors.New(fmt.Sprintf("mcs server reject join of channel %d, result %d", requested, confirm)))
 		return
 	}
 	glog.Debug("Confirm channelId:", channelId)
-	if confirm == 0 {
-		for i := 0; i < int(c.serverNetworkData.ChannelCount); i++ {
-			if channelId == c.serverNetworkData.ChannelIdArray[i] {
-				var t MCSChannelInfo
-				t.ID = channelId
-				t.Name = string(c.clientNetworkData.ChannelDefArray[i].Name[:])
-				c.channels = append(c.channels, t)
-			}
+	for i := 0; i < int(c.serverNetworkData.ChannelCount); i++ {
+		if channelId == c.serverNetworkData.ChannelIdArray[i] {
+			var t MCSChannelInfo
+			t.ID = channelId
+			t.Name = string(c.clientNetworkData.ChannelDefArray[i].Name[:])
+			c.addChannel(t)
 		}
 	}
+	if c.serverMessageChannelData != nil && channelId == c.serverMessageChannelData.MCSChannelId {
+		c.addChannel(MCSChannelInfo{channelId, MESSAGE_CHANNEL_NAME})
+	}
 	c.channelsConnected++
 	c.connectChannels()
 }
 
+// Pack returns the send data request of data on channelId, see Send
 func (c *MCSClient) Pack(data []byte, channelId uint16) []byte {
-	buff := &bytes.Buffer{}
-	writeMCSPDUHeader(c.sendOpCode, 0, buff)
-	per.WriteInteger16(c.userId-MCS_USERCHANNEL_BASE, buff)
-	per.WriteInteger16(channelId, buff)
-	core.WriteUInt8(0x70, buff)
-	per.WriteLength(len(data), buff)
-	core.WriteBytes(data, buff)
-	glog.Debug("MCSClient write", channelId, ":", hex.EncodeToString(buff.Bytes()))
-	return buff.Bytes()
+	return c.pack(MCSChannel(channelId), data).Bytes()
 }
 
 func (c *MCSClient) Write(data []byte) (n int, err error) {
-	data = c.Pack(data, c.channels[0].ID)
-	return c.transport.Write(data)
+	return c.SendToChannel(GLOBAL_CHANNEL_NAME, data)
 }
 
 func (c *MCSClient) SendToChannel(channel string, data []byte) (n int, err error) {
-	channelId := c.channels[0].ID
-	for _, ch := range c.channels {
-		if channel == ch.Name {
-			channelId = ch.ID
-			break
+	if err := c.Send(c.channelID(channel), data); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+type MCSServer struct {
+	*MCS
+	clientCoreData     *gcc.ClientCoreData
+	clientNetworkData  *gcc.ClientNetworkData
+	clientSecurityData *gcc.ClientSecurityData
+
+	serverCoreData     *gcc.ServerCoreData
+	serverNetworkData  *gcc.ServerNetworkData
+	serverSecurityData *gcc.ServerSecurityData
+
+	channelsJoined int
+}
+
+func NewMCSServer(t core.Transport) *MCSServer {
+	s := &MCSServer{
+		MCS:                NewMCS(t, SEND_DATA_REQUEST, SEND_DATA_INDICATION),
+		serverCoreData:     gcc.NewServerCoreData(),
+		serverNetworkData:  gcc.NewServerNetworkData(),
+		serverSecurityData: gcc.NewServerSecurityData(),
+	}
+	s.serverNetworkData.MCSChannelId = MCS_GLOBAL_CHANNEL_ID
+	s.transport.On("connect", s.connect)
+	return s
+}
+
+func (s *MCSServer) connect(selectedProtocol uint32) {
+	glog.Debug("mcs server on connect", selectedProtocol)
+	s.serverCoreData.ClientRequestedProtocol = selectedProtocol
+	s.transport.Once("data", s.recvConnectInitial)
+}
+
+func (s *MCSServer) recvConnectInitial(data []byte) {
+	glog.Debug("mcs recvConnectInitial", hex.EncodeToString(data))
+	cInit, err := ReadConnectInitial(bytes.NewReader(data))
+	if err != nil {
+		s.Emit("error", errors.New(fmt.Sprintf("ReadConnectInitial %v", err)))
+		return
+	}
+
+	clientSettings := gcc.ReadConferenceCreateRequest(cInit.UserData)
+	for _, v := range clientSettings {
+		switch v.(type) {
+		case *gcc.ClientCoreData:
+			s.clientCoreData = v.(*gcc.ClientCoreData)
+		case *gcc.ClientSecurityData:
+			s.clientSecurityData = v.(*gcc.ClientSecurityData)
+		case *gcc.ClientNetworkData:
+			s.clientNetworkData = v.(*gcc.ClientNetworkData)
 		}
 	}
+	if s.clientCoreData == nil {
+		s.Emit("error", errors.New("NODE_RDP_PROTOCOL_T125_MCS_NO_CLIENT_CORE_DATA"))
+		return
+	}
+	if s.clientNetworkData == nil {
+		s.clientNetworkData = &gcc.ClientNetworkData{}
+	}
 
-	data = c.Pack(data, channelId)
-	return c.transport.Write(data)
+	// allocate static virtual channel ids after the global channel
+	s.serverNetworkData.ChannelCount = uint16(s.clientNetworkData.ChannelCount)
+	s.serverNetworkData.ChannelIdArray = make([]uint16, 0, s.clientNetworkData.ChannelCount)
+	for i := 0; i < int(s.clientNetworkData.ChannelCount); i++ {
+		s.serverNetworkData.ChannelIdArray = append(s.serverNetworkData.ChannelIdArray,
+			MCS_GLOBAL_CHANNEL_ID+1+uint16(i))
+	}
+
+	if err := s.sendConnectResponse(); err != nil {
+		s.Emit("error", err)
+		return
+	}
+	s.transport.Once("data", s.recvErectDomainRequest)
+}
+
+func (s *MCSServer) sendConnectResponse() error {
+	userDataBuff := bytes.Buffer{}
+	userDataBuff.Write(s.serverCoreData.Pack())
+	userDataBuff.Write(s.serverSecurityData.Pack())
+	userDataBuff.Write(s.serverNetworkData.Pack())
+
+	ccResp := gcc.MakeConferenceCreateResponse(userDataBuff.Bytes())
+	cResp := NewConnectResponse(ccResp)
+	cRespBerEncoded := cResp.BER()
+
+	dataBuff := &bytes.Buffer{}
+	ber.WriteApplicationTag(uint8(MCS_TYPE_CONNECT_RESPONSE), len(cRespBerEncoded), dataBuff)
+	dataBuff.Write(cRespBerEncoded)
+
+	_, err := s.write(dataBuff.Bytes())
+	if err != nil {
+		return errors.New(fmt.Sprintf("mcs sendConnectResponse write error %v", err))
+	}
+	return nil
+}
+
+func (s *MCSServer) recvErectDomainRequest(data []byte) {
+	glog.Debug("mcs recvErectDomainRequest", hex.EncodeToString(data))
+	r := bytes.NewReader(data)
+	option, err := core.ReadUInt8(r)
+	if err != nil {
+		s.Emit("error", err)
+		return
+	}
+	if !readMCSPDUHeader(option, ERECT_DOMAIN_REQUEST) {
+		s.Emit("error", errors.New("NODE_RDP_PROTOCOL_T125_MCS_BAD_HEADER"))
+		return
+	}
+	// subHeight and subInterval
+	per.ReadInteger(r)
+	per.ReadInteger(r)
+
+	s.transport.Once("data", s.recvAttachUserRequest)
+}
+
+func (s *MCSServer) recvAttachUserRequest(data []byte) {
+	glog.Debug("mcs recvAttachUserRequest", hex.EncodeToString(data))
+	r := bytes.NewReader(data)
+	option, err := core.ReadUInt8(r)
+	if err != nil {
+		s.Emit("error", err)
+		return
+	}
+	if !readMCSPDUHeader(option, ATTACH_USER_REQUEST) {
+		s.Emit("error", errors.New("NODE_RDP_PROTOCOL_T125_MCS_BAD_HEADER"))
+		return
+	}
+
+	s.addChannel(MCSChannelInfo{s.userId, "user"})
+	if err := s.sendAttachUserConfirm(); err != nil {
+		s.Emit("error", err)
+		return
+	}
+	s.transport.Once("data", s.recvChannelJoinRequest)
+}
+
+func (s *MCSServer) sendAttachUserConfirm() error {
+	buff := &bytes.Buffer{}
+	writeMCSPDUHeader(ATTACH_USER_CONFIRM, 2, buff)
+	per.WriteEnumerates(RT_SUCCESSFUL, buff)
+	per.WriteInteger16(s.userId-MCS_USERCHANNEL_BASE, buff)
+	_, err := s.write(buff.Bytes())
+	return err
+}
+
+func (s *MCSServer) recvChannelJoinRequest(data []byte) {
+	glog.Debug("mcs recvChannelJoinRequest", hex.EncodeToString(data))
+	r := bytes.NewReader(data)
+	option, err := core.ReadUInt8(r)
+	if err != nil {
+		s.Emit("error", err)
+		return
+	}
+	if !readMCSPDUHeader(option, CHANNEL_JOIN_REQUEST) {
+		s.Emit("error", errors.New("NODE_RDP_PROTOCOL_T125_MCS_WAIT_CHANNEL_JOIN_REQUEST"))
+		return
+	}
+
+	userId, err := per.ReadInteger16(r)
+	if err != nil {
+		s.Emit("error", err)
+		return
+	}
+	if userId+MCS_USERCHANNEL_BASE != s.userId {
+		s.Emit("error", errors.New("NODE_RDP_PROTOCOL_T125_MCS_INVALID_USER_ID"))
+		return
+	}
+	channelId, err := per.ReadInteger16(r)
+	if err != nil {
+		s.Emit("error", err)
+		return
+	}
+
+	result := RT_NO_SUCH_CHANNEL
+	if channelId == MCS_GLOBAL_CHANNEL_ID || channelId == s.userId {
+		result = RT_SUCCESSFUL
+	}
+	for i, id := range s.serverNetworkData.ChannelIdArray {
+		if channelId == id {
+			result = RT_SUCCESSFUL
+			s.addChannel(MCSChannelInfo{id, s.clientNetworkData.ChannelDefArray[i].Name})
+		}
+	}
+	if err := s.sendChannelJoinConfirm(result, channelId); err != nil {
+		s.Emit("error", err)
+		return
+	}
+
+	s.channelsJoined++
+	if s.channelsJoined < int(s.serverNetworkData.ChannelCount)+2 {
+		s.transport.Once("data", s.recvChannelJoinRequest)
+		return
+	}
+
+	s.transport.On("data", s.recvData)
+	clientData := make([]interface{}, 0)
+	clientData = append(clientData, s.clientCoreData)
+	clientData = append(clientData, s.clientSecurityData)
+	clientData = append(clientData, s.clientNetworkData)
+
+	serverData := make([]interface{}, 0)
+	serverData = append(serverData, s.serverCoreData)
+	serverData = append(serverData, s.serverSecurityData)
+	serverData = append(serverData, s.serverNetworkData)
+	s.Emit("connect", clientData, serverData, s.userId, s.joinedChannels())
+}
+
+func (s *MCSServer) sendChannelJoinConfirm(result uint8, channelId uint16) error {
+	buff := &bytes.Buffer{}
+	writeMCSPDUHeader(CHANNEL_JOIN_CONFIRM, 2, buff)
+	per.WriteEnumerates(result, buff)
+	per.WriteInteger16(s.userId-MCS_USERCHANNEL_BASE, buff)
+	per.WriteInteger16(channelId, buff)
+	per.WriteInteger16(channelId, buff)
+	_, err := s.write(buff.Bytes())
+	return err
+}
+
+func (s *MCSServer) SendToChannel(channel string, data []byte) (n int, err error) {
+	if err := s.Send(s.channelID(channel), data); err != nil {
+		return 0, err
+	}
+	return len(data), nil
 }
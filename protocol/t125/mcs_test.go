@@ -0,0 +1,577 @@
+package t125
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tomatome/grdp/emission"
+	"github.com/tomatome/grdp/glog"
+	"github.com/tomatome/grdp/protocol/t125/ber"
+	"github.com/tomatome/grdp/protocol/t125/gcc"
+	"github.com/tomatome/grdp/protocol/tpkt"
+)
+
+func init() {
+	glog.SetLevel(glog.NONE)
+}
+
+const connectResponseHex = "7f664a0a0100020100301a020122020103020100020101020100020101020300fff8020102" +
+	"0426000500147c00012a14760a01010001c0004d63446e10010c1000040008000300000001000000"
+
+func TestReadConnectResponse(t *testing.T) {
+	data, _ := hex.DecodeString(connectResponseHex)
+	c, err := ReadConnectResponse(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.result != RT_SUCCESSFUL || c.calledConnectId != 0 {
+		t.Error("unexpected result", c.result, c.calledConnectId)
+	}
+	expected := NewDomainParameters(34, 3, 0, 1, 0, 1, 0xfff8, 2)
+	if *c.domainParameters != *expected {
+		t.Errorf("%+v not equals to %+v", *c.domainParameters, *expected)
+	}
+	if hex.EncodeToString(c.userData) != connectResponseHex[len(connectResponseHex)-76:] {
+		t.Error("bad user data", hex.EncodeToString(c.userData))
+	}
+
+	settings := gcc.ReadConferenceCreateResponse(c.userData)
+	if len(settings) != 1 {
+		t.Fatal("expect one server block, get", len(settings))
+	}
+	sc, ok := settings[0].(*gcc.ServerCoreData)
+	if !ok || sc.RdpVersion != gcc.RDP_VERSION_5_PLUS || sc.ClientRequestedProtocol != 3 {
+		t.Errorf("bad server core data %+v", settings[0])
+	}
+}
+
+func TestReadConnectResponseRejected(t *testing.T) {
+	data, _ := hex.DecodeString(connectResponseHex)
+	data[5] = RT_PARAMETERS_UNACCEPTABLE
+	if _, err := ReadConnectResponse(bytes.NewReader(data)); err == nil {
+		t.Error("expect error on non-zero result")
+	}
+}
+
+type fakeTransport struct {
+	emission.Emitter
+	lock    sync.Mutex
+	written [][]byte
+}
+
+func newFakeTransport() *fakeTransport {
+	return &fakeTransport{Emitter: *emission.NewEmitter()}
+}
+
+func (f *fakeTransport) Read(b []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (f *fakeTransport) Write(b []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.written = append(f.written, append([]byte{}, b...))
+	return len(b), nil
+}
+
+func (f *fakeTransport) Close() error {
+	return nil
+}
+
+func (f *fakeTransport) SetReadTimeout(d time.Duration) {}
+
+func (f *fakeTransport) SetWriteTimeout(d time.Duration) {}
+
+func hexData(s string) []byte {
+	b, _ := hex.DecodeString(s)
+	return b
+}
+
+// joinClient returns a client waiting for its attach user confirm with
+// two extra static channels negotiated
+func joinClient() (*MCSClient, *fakeTransport) {
+	t := newFakeTransport()
+	c := NewMCSClient(t)
+	c.clientNetworkData.ChannelDefArray = []gcc.ChannelDef{{Name: "cliprdr"}, {Name: "rdpdr"}}
+	c.clientNetworkData.ChannelCount = 2
+	c.serverNetworkData = &gcc.ServerNetworkData{
+		MCSChannelId:   MCS_GLOBAL_CHANNEL_ID,
+		ChannelCount:   2,
+		ChannelIdArray: []uint16{1004, 1005},
+	}
+	t.Once("data", c.recvAttachUserConfirm)
+	return c, t
+}
+
+func TestConnectChannels(t *testing.T) {
+	c, tr := joinClient()
+	var channels []MCSChannelInfo
+	c.On("connect", func(clientData, serverData []interface{}, userId uint16, ch []MCSChannelInfo) {
+		channels = ch
+	})
+
+	tr.Emit("data", hexData("2e000006"))
+	for _, id := range []string{"03eb", "03ef", "03ec", "03ed"} {
+		tr.Emit("data", hexData("3e000006"+id+id))
+	}
+
+	expected := []string{"38000603eb", "38000603ef", "38000603ec", "38000603ed"}
+	if len(tr.written) != len(expected) {
+		t.Fatal("expect", len(expected), "join requests, get", len(tr.written))
+	}
+	for i, e := range expected {
+		if hex.EncodeToString(tr.written[i]) != e {
+			t.Error(hex.EncodeToString(tr.written[i]), "not equals to", e)
+		}
+	}
+
+	names := []MCSChannelInfo{{1003, "global"}, {1007, "user"}, {1004, "cliprdr"}, {1005, "rdpdr"}}
+	if !reflect.DeepEqual(channels, names) {
+		t.Errorf("%+v not equals to %+v", channels, names)
+	}
+	if !reflect.DeepEqual(c.Channels(), names) {
+		t.Errorf("%+v not equals to %+v", c.Channels(), names)
+	}
+}
+
+func TestConnectMessageChannel(t *testing.T) {
+	c, tr := joinClient()
+	c.clientCoreData.SetConnectionType(gcc.CONNECTION_TYPE_AUTODETECT)
+	c.serverMessageChannelData = &gcc.ServerMessageChannelData{MCSChannelId: 1006}
+	var channels []MCSChannelInfo
+	c.On("connect", func(clientData, serverData []interface{}, userId uint16, ch []MCSChannelInfo) {
+		channels = ch
+	})
+
+	tr.Emit("data", hexData("2e000006"))
+	for _, id := range []string{"03eb", "03ef", "03ec", "03ed", "03ee"} {
+		tr.Emit("data", hexData("3e000006"+id+id))
+	}
+	if len(tr.written) != 5 || hex.EncodeToString(tr.written[4]) != "38000603ee" {
+		t.Fatal("expect the message channel join, get", len(tr.written))
+	}
+	if name, _ := c.channelName(1006); name != MESSAGE_CHANNEL_NAME || len(channels) != 5 {
+		t.Errorf("bad channels %+v", channels)
+	}
+}
+
+// run under -race, sends and listeners race the connection sequence
+func TestConnectChannelsConcurrentSend(t *testing.T) {
+	c, tr := joinClient()
+	var channels []MCSChannelInfo
+	c.On("connect", func(clientData, serverData []interface{}, userId uint16, ch []MCSChannelInfo) {
+		channels = ch
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			c.SendToChannel("cliprdr", []byte{byte(i)})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 5; i++ {
+			c.Once("channel-1004", func(b []byte) {})
+		}
+	}()
+	tr.Emit("data", hexData("2e000006"))
+	for _, id := range []string{"03eb", "03ef", "03ec", "03ed"} {
+		tr.Emit("data", hexData("3e000006"+id+id))
+	}
+	wg.Wait()
+
+	if len(channels) != 4 {
+		t.Errorf("get channels %+v", channels)
+	}
+}
+
+func TestConnectOversizeUserData(t *testing.T) {
+	tr := newFakeTransport()
+	c := NewMCSClient(tr)
+	c.clientNetworkData.ChannelDefArray = make([]gcc.ChannelDef, 1400)
+	c.clientNetworkData.ChannelCount = 1400
+	var err error
+	c.On("error", func(e error) {
+		err = e
+	})
+
+	tr.Emit("connect", uint32(1))
+	if err == nil || len(tr.written) != 0 {
+		t.Error("expect error instead of connect initial, get", err)
+	}
+}
+
+func TestRecvDataChannelEvents(t *testing.T) {
+	c := NewMCSClient(newFakeTransport())
+	c.addChannel(MCSChannelInfo{1004, "cliprdr"})
+
+	var global, clip, other []byte
+	c.On("channel-1003", func(b []byte) {
+		other = b
+	}).On("global-data", func(b []byte) {
+		global = b
+	}).On("channel-1004", func(b []byte) {
+		clip = b
+	})
+
+	c.recvData(hexData("68000603ec7002abcd"))
+	if hex.EncodeToString(clip) != "abcd" || other != nil || global != nil {
+		t.Error("channel 1004 data is dispatched to", clip, other, global)
+	}
+
+	c.recvData(hexData("68000603eb700101"))
+	if hex.EncodeToString(other) != "01" || hex.EncodeToString(global) != "01" {
+		t.Error("global channel data is dispatched to", other, global)
+	}
+}
+
+func TestRecvDataCopyPayloads(t *testing.T) {
+	c := NewMCSClient(newFakeTransport())
+	c.addChannel(MCSChannelInfo{1004, "cliprdr"})
+	// the listeners keep the payloads unless pooled
+	var payloads [][]byte
+	c.On("channel-1004", func(b []byte) {
+		payloads = append(payloads, b)
+	})
+	c.recvData(hexData("68000603ec7002abcd"))
+	c.recvData(hexData("68000603ec70020102"))
+	if len(payloads) != 2 || hex.EncodeToString(payloads[0]) != "abcd" || hex.EncodeToString(payloads[1]) != "0102" {
+		t.Errorf("get %x", payloads)
+	}
+
+	// pooled payloads are valid while the listeners run
+	c.SetPooledPayloads(true)
+	c.recvData(hexData("68000603ec70020304"))
+	if len(payloads) != 3 || hex.EncodeToString(payloads[1]) != "0102" {
+		t.Errorf("get %x", payloads)
+	}
+}
+
+// pump delivers pending writes of each side to the other until both are idle
+func pump(a, b *fakeTransport) {
+	for len(a.written) > 0 || len(b.written) > 0 {
+		for len(a.written) > 0 {
+			p := a.written[0]
+			a.written = a.written[1:]
+			b.Emit("data", p)
+		}
+		for len(b.written) > 0 {
+			p := b.written[0]
+			b.written = b.written[1:]
+			a.Emit("data", p)
+		}
+	}
+}
+
+func TestMCSServerLoopback(t *testing.T) {
+	ct, st := newFakeTransport(), newFakeTransport()
+	client := NewMCSClient(ct)
+	server := NewMCSServer(st)
+
+	var clientChannels, serverChannels []MCSChannelInfo
+	client.On("connect", func(clientData, serverData []interface{}, userId uint16, ch []MCSChannelInfo) {
+		clientChannels = ch
+	})
+	server.On("connect", func(clientData, serverData []interface{}, userId uint16, ch []MCSChannelInfo) {
+		serverChannels = ch
+	})
+	client.On("error", func(err error) {
+		t.Error("client:", err)
+	})
+	server.On("error", func(err error) {
+		t.Error("server:", err)
+	})
+
+	st.Emit("connect", uint32(1))
+	ct.Emit("connect", uint32(1))
+	pump(ct, st)
+
+	if len(clientChannels) != 6 || !reflect.DeepEqual(clientChannels, serverChannels) {
+		t.Fatalf("%+v not equals to %+v", clientChannels, serverChannels)
+	}
+	if server.clientCoreData.DesktopWidth != client.clientCoreData.DesktopWidth {
+		t.Error("bad client core data", server.clientCoreData.DesktopWidth)
+	}
+
+	var got []byte
+	server.On("channel-1006", func(b []byte) {
+		got = b
+	})
+	client.SendToChannel("cliprdr", []byte("hello"))
+	pump(ct, st)
+	if string(got) != "hello" {
+		t.Error("server get", got)
+	}
+}
+
+func TestRecvDisconnectProviderUltimatum(t *testing.T) {
+	c := NewMCSClient(newFakeTransport())
+	var reason DisconnectReason = 0xff
+	c.On("disconnect", func(r DisconnectReason) {
+		reason = r
+	}).On("error", func(err error) {
+		t.Error(err)
+	})
+
+	c.recvData(hexData("2180"))
+	if reason != RN_USER_REQUESTED {
+		t.Error(reason, "not equals to", RN_USER_REQUESTED)
+	}
+	c.recvData(hexData("2080"))
+	if reason != RN_PROVIDER_INITIATED {
+		t.Error(reason, "not equals to", RN_PROVIDER_INITIATED)
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	tr := newFakeTransport()
+	c := NewMCSClient(tr)
+	if err := c.Disconnect(RN_USER_REQUESTED); err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.written) != 1 || hex.EncodeToString(tr.written[0]) != "2180" {
+		t.Errorf("bad disconnect provider ultimatum %x", tr.written)
+	}
+}
+
+func TestConnectWithContextTimeout(t *testing.T) {
+	tr := newFakeTransport()
+	c := NewMCSClient(tr)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := c.ConnectWithContext(ctx); err != context.DeadlineExceeded {
+		t.Fatal("expect deadline exceeded, get", err)
+	}
+	if len(tr.written) != 1 {
+		t.Fatal("expect connect initial only, get", len(tr.written))
+	}
+	// a late response must not resume the handshake
+	tr.Emit("data", hexData(connectResponseHex))
+	if len(tr.written) != 1 {
+		t.Error("handshake resumed after cancellation")
+	}
+}
+
+func TestDomainParametersBER(t *testing.T) {
+	for _, d := range []*DomainParameters{
+		NewDomainParameters(34, 2, 0, 1, 0, 1, 0xffff, 2),
+		NewDomainParameters(0xffff, 0xfc17, 0xffff, 3, 5, 7, 0x420, 3),
+	} {
+		buff := &bytes.Buffer{}
+		ber.WriteEncodedDomainParams(d.BER(), buff)
+		r, err := ReadDomainParameters(buff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *r != *d {
+			t.Errorf("%+v not equals to %+v", *r, *d)
+		}
+	}
+
+	// standard values are unchanged
+	d := NewConnectInitial(nil).TargetParameters
+	result := hex.EncodeToString(d.BER())
+	expected := "0201220201020201000201010201000201010202ffff020102"
+	if result != expected {
+		t.Error(result, "not equals to", expected)
+	}
+}
+
+// asn1 struct tags, when present, must be well formed for reflection
+func TestASN1StructTags(t *testing.T) {
+	for _, v := range []interface{}{DomainParameters{}, ConnectInitial{}, ConnectResponse{}} {
+		typ := reflect.TypeOf(v)
+		for i := 0; i < typ.NumField(); i++ {
+			f := typ.Field(i)
+			if strings.Contains(string(f.Tag), "asn1") && f.Tag.Get("asn1") == "" {
+				t.Errorf("%s.%s has malformed asn1 tag %q", typ.Name(), f.Name, f.Tag)
+			}
+		}
+	}
+}
+
+func TestAttachUserRejected(t *testing.T) {
+	c, tr := joinClient()
+	var err error
+	c.On("error", func(e error) {
+		err = e
+	})
+	tr.Emit("data", hexData("2e0f"))
+
+	if !errors.Is(err, ErrUserRejected) {
+		t.Fatal("expect user rejected error, get", err)
+	}
+	var e *AttachUserError
+	if !errors.As(err, &e) || e.Result != RT_USER_REJECTED {
+		t.Error("bad reject code", err)
+	}
+	if len(tr.written) != 0 {
+		t.Error("channel joined after reject")
+	}
+}
+
+func TestStats(t *testing.T) {
+	tr := newFakeTransport()
+	c := NewMCSClient(tr)
+	c.addChannel(MCSChannelInfo{1004, "cliprdr"})
+
+	c.Send(MCSChannel(MCS_GLOBAL_CHANNEL_ID), []byte{1, 2, 3})
+	c.Send(1004, []byte{1})
+	c.Send(1004, []byte{2})
+	c.recvData(hexData("68000603ec7002abcd"))
+
+	s := c.Stats()
+	if s.BytesWritten != 10+8+8 || s.BytesRead != 9 {
+		t.Error("bad bytes count", s.BytesWritten, s.BytesRead)
+	}
+	if s.PDUsSent[1003] != 1 || s.PDUsSent[1004] != 2 || s.PDUsReceived[1004] != 1 {
+		t.Errorf("bad pdu count %+v", s)
+	}
+}
+
+func TestSetDesktopAndColorDepth(t *testing.T) {
+	c := NewMCSClient(newFakeTransport())
+	if err := c.SetDesktop(1282, 1024); err == nil {
+		t.Error("expect error on width not multiple of 4")
+	}
+	if err := c.SetDesktop(1280, 100); err == nil {
+		t.Error("expect error on too small height")
+	}
+	if err := c.SetDesktop(1920, 1080); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetColorDepth(12); err == nil {
+		t.Error("expect error on unsupported color depth")
+	}
+	if err := c.SetColorDepth(32); err != nil {
+		t.Fatal(err)
+	}
+	d := c.clientCoreData
+	if d.DesktopWidth != 1920 || d.DesktopHeight != 1080 {
+		t.Error("bad desktop size", d.DesktopWidth, d.DesktopHeight)
+	}
+	if d.HighColorDepth != gcc.HIGH_COLOR_24BPP || d.PostBeta2ColorDepth != gcc.RNS_UD_COLOR_24BPP ||
+		d.EarlyCapabilityFlags&gcc.RNS_UD_CS_WANT_32BPP_SESSION == 0 {
+		t.Errorf("bad 32 bpp core data %+v", d)
+	}
+	c.SetColorDepth(16)
+	if d.HighColorDepth != gcc.HIGH_COLOR_16BPP || d.PostBeta2ColorDepth != gcc.RNS_UD_COLOR_16BPP_565 ||
+		d.EarlyCapabilityFlags&gcc.RNS_UD_CS_WANT_32BPP_SESSION != 0 {
+		t.Errorf("bad 16 bpp core data %+v", d)
+	}
+}
+
+func TestSendLargeData(t *testing.T) {
+	tr := newFakeTransport()
+	c := NewMCSClient(tr)
+	data := bytes.Repeat([]byte{0xab}, 0x4000)
+	if err := c.Send(1004, data); err != nil {
+		t.Fatal(err)
+	}
+	s := NewMCSServer(newFakeTransport())
+	channel, result, err := s.Receive(tr.written[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if channel != 1004 || !bytes.Equal(result, data) {
+		t.Error("bad received data on channel", channel, len(result))
+	}
+	if !bytes.Equal(c.Pack(data, 1004), tr.written[0]) {
+		t.Error("Pack differs from Send")
+	}
+}
+
+func TestChannelStream(t *testing.T) {
+	tr := newFakeTransport()
+	c := NewMCSClient(tr)
+	c.addChannel(MCSChannelInfo{1004, "cliprdr"})
+	s := c.Channel(1004)
+
+	result := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(s)
+		result <- b
+	}()
+	c.recvData(hexData("68000603ec7002abcd"))
+	c.recvData(hexData("68000603eb700101"))
+	c.recvData(hexData("68000603ec7001ef"))
+	tr.Emit("close")
+
+	select {
+	case b := <-result:
+		if hex.EncodeToString(b) != "abcdef" {
+			t.Errorf("bad channel data %x", b)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("read not unblocked by close")
+	}
+
+	s = c.Channel(1004)
+	if n, err := s.Write([]byte{1, 2}); n != 2 || err != nil {
+		t.Fatal(n, err)
+	}
+	if hex.EncodeToString(tr.written[0]) != "64000103ec70020102" {
+		t.Errorf("bad send data request %x", tr.written[0])
+	}
+	s.Close()
+	if _, err := s.Read(make([]byte, 1)); err != io.EOF {
+		t.Error("expect EOF after close, get", err)
+	}
+	if _, err := s.Write([]byte{1}); err == nil {
+		t.Error("expect error on write after close")
+	}
+}
+
+func BenchmarkMCSSend(b *testing.B) {
+	for _, size := range []int{64, 1024, 0x4000, 0x10000} {
+		b.Run(fmt.Sprintf("%d", size), func(b *testing.B) {
+			client, server := net.Pipe()
+			defer client.Close()
+			go io.Copy(io.Discard, server)
+			c := NewMCSClient(tpkt.NewTransportFromConn(client))
+			data := make([]byte, size)
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := c.Send(1004, data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkMCSRecvData(b *testing.B) {
+	for _, size := range []int{64, 1024, 0x4000, 0x10000} {
+		tr := newFakeTransport()
+		NewMCSServer(tr).Send(1004, make([]byte, size))
+		pdu := tr.written[0]
+		for _, pooled := range []bool{false, true} {
+			b.Run(fmt.Sprintf("%d/pooled=%v", size, pooled), func(b *testing.B) {
+				c := NewMCSClient(newFakeTransport())
+				c.addChannel(MCSChannelInfo{1004, "cliprdr"})
+				c.SetPooledPayloads(pooled)
+				b.SetBytes(int64(size))
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					c.recvData(pdu)
+				}
+			})
+		}
+	}
+}
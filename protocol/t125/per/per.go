@@ -2,6 +2,8 @@ package per
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
 
 	"github.com/tomatome/grdp/glog"
@@ -13,6 +15,10 @@ func ReadEnumerates(r io.Reader) (uint8, error) {
 	return core.ReadUInt8(r)
 }
 
+func WriteEnumerates(enumerate uint8, w io.Writer) {
+	core.WriteUInt8(enumerate, w)
+}
+
 func WriteInteger(n int, w io.Writer) {
 	if n <= 0xff {
 		WriteLength(1, w)
@@ -26,14 +32,35 @@ func WriteInteger(n int, w io.Writer) {
 	}
 }
 
+// ReadInteger16 reads a 2 bytes unsigned constrained integer, failing when
+// truncated
 func ReadInteger16(r io.Reader) (uint16, error) {
-	return core.ReadUint16BE(r)
+	b, err := core.ReadBytes(2, r)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("per ReadInteger16 truncated %v", err))
+	}
+	return uint16(b[0])<<8 | uint16(b[1]), nil
 }
 
+// WriteInteger16 writes a 2 bytes unsigned constrained integer, as the user
+// and channel ids
 func WriteInteger16(value uint16, w io.Writer) {
 	core.WriteUInt16BE(value, w)
 }
 
+// ReadInteger32 reads a 4 bytes constrained integer, failing when truncated
+func ReadInteger32(r io.Reader) (uint32, error) {
+	b, err := core.ReadBytes(4, r)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("per ReadInteger32 truncated %v", err))
+	}
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3]), nil
+}
+
+func WriteInteger32(value uint32, w io.Writer) {
+	core.WriteUInt32BE(value, w)
+}
+
 /**
  * @param choice {integer}
  * @returns {type.UInt8} choice per encoded
@@ -55,20 +82,42 @@ func WriteLength(value int, w io.Writer) {
 }
 
 func ReadLength(r io.Reader) (uint16, error) {
+	size, fragmented, err := readLengthDeterminant(r)
+	if err != nil {
+		return 0, err
+	}
+	if fragmented {
+		return 0, errors.New("unexpected per fragmented length")
+	}
+	return uint16(size), nil
+}
+
+// fragment unit of the per length determinant, lengths above are fragmented
+const fragmentSize = 0x4000
+
+// readLengthDeterminant reads one of the three length forms, a fragmented
+// length is followed by its data and another length determinant
+func readLengthDeterminant(r io.Reader) (int, bool, error) {
 	b, err := core.ReadUInt8(r)
 	if err != nil {
-		return 0, nil
-	}
-	var size uint16
-	if b&0x80 > 0 {
-		b = b &^ 0x80
-		size = uint16(b) << 8
-		left, _ := core.ReadUInt8(r)
-		size += uint16(left)
-	} else {
-		size = uint16(b)
+		return 0, false, err
+	}
+	switch {
+	case b&0xc0 == 0xc0:
+		m := int(b & 0x3f)
+		if m < 1 || m > 4 {
+			return 0, false, errors.New(fmt.Sprintf("invalid per fragment count %d", m))
+		}
+		return m * fragmentSize, true, nil
+	case b&0x80 > 0:
+		left, err := core.ReadUInt8(r)
+		if err != nil {
+			return 0, false, err
+		}
+		return int(b&^0x80)<<8 | int(left), false, nil
+	default:
+		return int(b), false, nil
 	}
-	return size, nil
 }
 
 /**
@@ -92,12 +141,14 @@ func WriteSelection(selection uint8, w io.Writer) {
 	core.WriteUInt8(selection, w)
 }
 
+// WriteNumericString writes the digits of s packed by two in each byte,
+// s shorter than minValue is padded with zeros
 func WriteNumericString(s string, minValue int, w io.Writer) {
-	length := len(s)
-	mLength := minValue
-	if length >= minValue {
-		mLength = length - minValue
+	for len(s) < minValue {
+		s += "0"
 	}
+	length := len(s)
+	mLength := length - minValue
 	buff := &bytes.Buffer{}
 	for i := 0; i < length; i += 2 {
 		c1 := int(s[i])
@@ -113,6 +164,76 @@ func WriteNumericString(s string, minValue int, w io.Writer) {
 	w.Write(buff.Bytes())
 }
 
+// ReadNumericString reads the digits of a NumericString of at least
+// minValue characters, packed by two in each byte
+func ReadNumericString(r io.Reader, minValue int) (string, error) {
+	ln, err := ReadLength(r)
+	if err != nil {
+		return "", err
+	}
+	length := int(ln) + minValue
+	b, err := core.ReadBytes((length+1)/2, r)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("per ReadNumericString truncated %v", err))
+	}
+	s := make([]byte, length)
+	for i := range s {
+		c := b[i/2] >> 4
+		if i%2 == 1 {
+			c = b[i/2] & 0x0f
+		}
+		if c > 9 {
+			return "", errors.New(fmt.Sprintf("invalid per numeric character 0x%x", c))
+		}
+		s[i] = '0' + c
+	}
+	return string(s), nil
+}
+
+// printable tells if c belongs to the PrintableString alphabet
+func printable(c byte) bool {
+	switch {
+	case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		return true
+	}
+	return bytes.IndexByte([]byte(" '()+,-./:=?"), c) >= 0
+}
+
+// ReadPrintableString reads a PrintableString of at least minValue
+// characters, the aligned variant takes one byte per character
+func ReadPrintableString(r io.Reader, minValue int) (string, error) {
+	ln, err := ReadLength(r)
+	if err != nil {
+		return "", err
+	}
+	b, err := core.ReadBytes(int(ln)+minValue, r)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("per ReadPrintableString truncated %v", err))
+	}
+	for _, c := range b {
+		if !printable(c) {
+			return "", errors.New(fmt.Sprintf("invalid per printable character 0x%x", c))
+		}
+	}
+	return string(b), nil
+}
+
+// WritePrintableString writes s of at least minValue characters, the
+// characters out of the PrintableString alphabet are replaced by a space
+func WritePrintableString(s string, minValue int, w io.Writer) {
+	b := []byte(s)
+	for len(b) < minValue {
+		b = append(b, ' ')
+	}
+	for i, c := range b {
+		if !printable(c) {
+			b[i] = ' '
+		}
+	}
+	WriteLength(len(b)-minValue, w)
+	core.WriteBytes(b, w)
+}
+
 func WritePadding(length int, w io.Writer) {
 	b := make([]byte, length)
 	w.Write(b)
@@ -186,7 +307,57 @@ func ReadObjectIdentifier(r io.Reader, oid []byte) bool {
 	}
 	return true
 }
-func ReadOctetStream(r io.Reader, s string, min int) bool {
+
+// ReadOctetStream reads a length determinant and exactly that many bytes,
+// following fragments for streams above 16383 bytes
+func ReadOctetStream(r io.Reader) ([]byte, error) {
+	buff := &bytes.Buffer{}
+	if err := ReadOctetStreamTo(r, buff); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+// ReadOctetStreamTo appends an octet stream to buff, which may be reused
+// from a pool to save the allocation of the data
+func ReadOctetStreamTo(r io.Reader, buff *bytes.Buffer) error {
+	for {
+		size, fragmented, err := readLengthDeterminant(r)
+		if err != nil {
+			return err
+		}
+		buff.Grow(size)
+		if _, err = io.CopyN(buff, r, int64(size)); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if !fragmented {
+			return nil
+		}
+	}
+}
+
+// WriteOctets writes data with its length determinant, using the
+// fragmented form for data above 16383 bytes
+func WriteOctets(data []byte, w io.Writer) {
+	for len(data) >= fragmentSize {
+		m := len(data) / fragmentSize
+		if m > 4 {
+			m = 4
+		}
+		core.WriteUInt8(uint8(0xc0|m), w)
+		core.WriteBytes(data[:m*fragmentSize], w)
+		data = data[m*fragmentSize:]
+	}
+	// a fragmented stream always ends by a short length, even zero
+	WriteLength(len(data), w)
+	core.WriteBytes(data, w)
+}
+
+// ExpectOctetStream reads an octet stream and checks it equals s
+func ExpectOctetStream(r io.Reader, s string, min int) bool {
 	ln, _ := ReadLength(r)
 	size := int(ln) + min
 	if size != len(s) {
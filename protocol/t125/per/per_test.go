@@ -0,0 +1,177 @@
+package per_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/tomatome/grdp/protocol/t125/per"
+)
+
+func TestReadOctetStream(t *testing.T) {
+	for _, tc := range []struct {
+		size   int
+		header int
+	}{{0, 1}, {127, 1}, {128, 2}, {0x3fff, 2}} {
+		data := bytes.Repeat([]byte{0xab}, tc.size)
+		buff := &bytes.Buffer{}
+		per.WriteOctetStream(string(data), 0, buff)
+		if buff.Len() != tc.size+tc.header {
+			t.Error("bad encoded size", buff.Len(), "for", tc.size)
+		}
+
+		result, err := per.ReadOctetStream(buff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(result, data) {
+			t.Error("bad octet stream of size", tc.size)
+		}
+	}
+}
+
+func TestReadOctetStreamTruncated(t *testing.T) {
+	for _, data := range [][]byte{{}, {0x80}, {0x81, 0x00, 0xab}, {0x05, 0xab}} {
+		if _, err := per.ReadOctetStream(bytes.NewReader(data)); err == nil {
+			t.Errorf("expect error for %x", data)
+		}
+	}
+}
+
+func TestWriteOctetsFragmented(t *testing.T) {
+	for _, tc := range []struct {
+		size   int
+		header []byte
+	}{
+		{0x3fff, []byte{0xbf, 0xff}},
+		{0x4000, []byte{0xc1}},
+		{0x4001, []byte{0xc1}},
+		{0x10000, []byte{0xc4}},
+		{0x14000, []byte{0xc4}},
+	} {
+		data := make([]byte, tc.size)
+		for i := range data {
+			data[i] = byte(i)
+		}
+		buff := &bytes.Buffer{}
+		per.WriteOctets(data, buff)
+		if !bytes.HasPrefix(buff.Bytes(), tc.header) {
+			t.Errorf("bad header %x for size %d", buff.Bytes()[:2], tc.size)
+		}
+
+		result, err := per.ReadOctetStream(buff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(result, data) || buff.Len() != 0 {
+			t.Error("bad octet stream of size", tc.size)
+		}
+	}
+
+	// 16384 bytes are one fragment then a zero length
+	buff := &bytes.Buffer{}
+	per.WriteOctets(make([]byte, 0x4000), buff)
+	if buff.Len() != 0x4002 || buff.Bytes()[0x4001] != 0 {
+		t.Error("bad fragment terminator, size", buff.Len())
+	}
+}
+
+func TestReadLengthFragmented(t *testing.T) {
+	if _, err := per.ReadLength(bytes.NewReader([]byte{0xc1})); err == nil {
+		t.Error("expect error on fragmented length")
+	}
+	if _, err := per.ReadOctetStream(bytes.NewReader([]byte{0xc5})); err == nil {
+		t.Error("expect error on bad fragment count")
+	}
+}
+
+func TestInteger32(t *testing.T) {
+	for _, v := range []uint32{0, 0xffff, 0x10000, 0xffffffff} {
+		buff := &bytes.Buffer{}
+		per.WriteInteger32(v, buff)
+		if buff.Len() != 4 {
+			t.Error("bad encoded size", buff.Len(), "for", v)
+		}
+		result, err := per.ReadInteger32(buff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != v {
+			t.Errorf("get 0x%x, expect 0x%x", result, v)
+		}
+	}
+	if _, err := per.ReadInteger32(bytes.NewReader([]byte{0xff, 0xff, 0xff})); err == nil {
+		t.Error("expect error on truncated integer")
+	}
+}
+
+func TestInteger16(t *testing.T) {
+	buff := &bytes.Buffer{}
+	for v := 0; v <= 0xffff; v++ {
+		per.WriteInteger16(uint16(v), buff)
+	}
+	if buff.Len() != 2*0x10000 {
+		t.Fatal("bad encoded size", buff.Len())
+	}
+	for v := 0; v <= 0xffff; v++ {
+		result, err := per.ReadInteger16(buff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != uint16(v) {
+			t.Fatalf("get 0x%x, expect 0x%x", result, v)
+		}
+	}
+	if _, err := per.ReadInteger16(bytes.NewReader([]byte{0xff})); err == nil {
+		t.Error("expect error on truncated integer")
+	}
+}
+
+func TestNumericString(t *testing.T) {
+	for _, tc := range []struct {
+		s       string
+		min     int
+		encoded []byte
+	}{
+		// conference name of the gcc conference create request
+		{"1", 1, []byte{0x00, 0x10}},
+		{"12345", 1, []byte{0x04, 0x12, 0x34, 0x50}},
+		{"", 0, []byte{0x00}},
+	} {
+		buff := &bytes.Buffer{}
+		per.WriteNumericString(tc.s, tc.min, buff)
+		if !bytes.Equal(buff.Bytes(), tc.encoded) {
+			t.Errorf("encode %q get %x, expect %x", tc.s, buff.Bytes(), tc.encoded)
+		}
+		s, err := per.ReadNumericString(buff, tc.min)
+		if err != nil || s != tc.s {
+			t.Errorf("decode %x get %q, %v", tc.encoded, s, err)
+		}
+	}
+	if _, err := per.ReadNumericString(bytes.NewReader([]byte{0x02, 0x1a}), 0); err == nil {
+		t.Error("expect error on bad digit")
+	}
+	if _, err := per.ReadNumericString(bytes.NewReader([]byte{0x03, 0x12}), 1); err == nil {
+		t.Error("expect error on truncated string")
+	}
+}
+
+func TestPrintableString(t *testing.T) {
+	buff := &bytes.Buffer{}
+	per.WritePrintableString("Duca", 4, buff)
+	if !bytes.Equal(buff.Bytes(), []byte{0x00, 'D', 'u', 'c', 'a'}) {
+		t.Errorf("get %x", buff.Bytes())
+	}
+	s, err := per.ReadPrintableString(buff, 4)
+	if err != nil || s != "Duca" {
+		t.Error("get", s, err)
+	}
+
+	buff.Reset()
+	per.WritePrintableString("a_b", 0, buff)
+	if s, err = per.ReadPrintableString(buff, 0); err != nil || s != "a b" {
+		t.Error("get", s, err)
+	}
+	if _, err = per.ReadPrintableString(bytes.NewReader([]byte{0x01, '*'}), 0); err == nil {
+		t.Error("expect error on bad character")
+	}
+}
@@ -3,7 +3,10 @@ package tpkt
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"net"
+	"time"
 
 	"github.com/tomatome/grdp/core"
 	"github.com/tomatome/grdp/emission"
@@ -25,7 +28,9 @@ const (
 )
 
 /**
- * TPKT layer of rdp stack
+ * TPKT layer of rdp stack, the header then the body of each PDU are read
+ * in full whatever the segments of the stream, so a PDU split across reads
+ * or several PDUs in a read are emitted one by one
  */
 type TPKT struct {
 	emission.Emitter
@@ -47,11 +52,20 @@ func New(s *core.SocketLayer, ntlm *nla.NTLMv2) *TPKT {
 	return t
 }
 
+// NewTransportFromConn runs the TPKT layer over an established conn, like a
+// tunnel or a net.Pipe, so that x224 and MCS stack up without dialing
+func NewTransportFromConn(conn net.Conn) core.Transport {
+	return New(core.NewSocketLayer(conn), nil)
+}
+
 func (t *TPKT) StartTLS() error {
 	return t.Conn.StartTLS()
 }
 
 func (t *TPKT) StartNLA() error {
+	if t.ntlm == nil {
+		return errors.New("no credentials for NLA")
+	}
 	err := t.StartTLS()
 	if err != nil {
 		glog.Info("start tls failed", err)
@@ -82,11 +96,20 @@ func (t *TPKT) recvChallenge(data []byte) error {
 		return err
 	}
 	glog.Debugf("tsreq:%+v", tsreq)
+	if len(tsreq.NegoTokens) == 0 {
+		return errors.New("no NTLM challenge in TSRequest")
+	}
 	// get pubkey
 	pubkey, err := t.Conn.TlsPubKey()
+	if err != nil {
+		return err
+	}
 	glog.Debugf("pubkey=%+v", pubkey)
 
-	authMsg, ntlmSec := t.ntlm.GetAuthenticateMessage(tsreq.NegoTokens[0].Data)
+	authMsg, ntlmSec, err := t.ntlm.GetAuthenticateMessage(tsreq.NegoTokens[0].Data)
+	if err != nil {
+		return err
+	}
 	t.ntlmSec = ntlmSec
 
 	encryptPubkey := ntlmSec.GssEncrypt(pubkey)
@@ -135,12 +158,15 @@ func (t *TPKT) Read(b []byte) (n int, err error) {
 }
 
 func (t *TPKT) Write(data []byte) (n int, err error) {
+	core.Trace(core.Outbound, "tpkt", data)
 	buff := &bytes.Buffer{}
 	core.WriteUInt8(FASTPATH_ACTION_X224, buff)
 	core.WriteUInt8(0, buff)
 	core.WriteUInt16BE(uint16(len(data)+4), buff)
 	buff.Write(data)
-	glog.Debug("tpkt Write", hex.EncodeToString(buff.Bytes()))
+	if glog.Enabled(glog.DEBUG) {
+		glog.Debug("tpkt Write", hex.EncodeToString(buff.Bytes()))
+	}
 	return t.Conn.Write(buff.Bytes())
 }
 
@@ -148,82 +174,127 @@ func (t *TPKT) Close() error {
 	return t.Conn.Close()
 }
 
+func (t *TPKT) SetReadTimeout(d time.Duration) {
+	t.Conn.SetReadTimeout(d)
+}
+
+func (t *TPKT) SetWriteTimeout(d time.Duration) {
+	t.Conn.SetWriteTimeout(d)
+}
+
 func (t *TPKT) SetFastPathListener(f core.FastPathListener) {
 	t.fastPathListener = f
 }
 
+// SendFastPath writes a fast path PDU, the length takes one byte below 0x80
 func (t *TPKT) SendFastPath(secFlag byte, data []byte) (n int, err error) {
+	core.Trace(core.Outbound, "fastpath", data)
 	buff := &bytes.Buffer{}
 	core.WriteUInt8(FASTPATH_ACTION_FASTPATH|((secFlag&0x3)<<6), buff)
-	core.WriteUInt16BE(uint16(len(data)+3)|0x8000, buff)
+	if len(data)+2 < 0x80 {
+		core.WriteUInt8(uint8(len(data)+2), buff)
+	} else {
+		core.WriteUInt16BE(uint16(len(data)+3)|0x8000, buff)
+	}
 	buff.Write(data)
-	glog.Debug("TPTK SendFastPath", hex.EncodeToString(buff.Bytes()))
+	if glog.Enabled(glog.DEBUG) {
+		glog.Debug("TPTK SendFastPath", hex.EncodeToString(buff.Bytes()))
+	}
 	return t.Conn.Write(buff.Bytes())
 }
 
+// recvHeader peeks the action bits of the first byte, tpkt or fast path
+// @see MS-RDPBCGR 2.2.9.1.2 Server Fast-Path Update PDU (TS_FP_UPDATE_PDU)
 func (t *TPKT) recvHeader(s []byte, err error) {
-	glog.Debug("tpkt recvHeader", hex.EncodeToString(s), err)
+	if glog.Enabled(glog.DEBUG) {
+		glog.Debug("tpkt recvHeader", hex.EncodeToString(s), err)
+	}
 	if err != nil {
 		t.Emit("error", err)
 		return
 	}
 	r := bytes.NewReader(s)
 	version, _ := core.ReadUInt8(r)
-	if version == FASTPATH_ACTION_X224 {
+	switch version & 0x3 {
+	case FASTPATH_ACTION_X224:
 		glog.Debug("tptk recvHeader FASTPATH_ACTION_X224, wait for recvExtendedHeader")
 		core.StartReadBytes(2, t.Conn, t.recvExtendedHeader)
-	} else {
+	case FASTPATH_ACTION_FASTPATH:
 		t.secFlag = (version >> 6) & 0x3
 		length, _ := core.ReadUInt8(r)
 		t.lastShortLength = int(length)
 		if t.lastShortLength&0x80 != 0 {
 			core.StartReadBytes(1, t.Conn, t.recvExtendedFastPathHeader)
-		} else {
+		} else if t.lastShortLength > 2 {
 			core.StartReadBytes(t.lastShortLength-2, t.Conn, t.recvFastPath)
+		} else {
+			t.Emit("error", errors.New(fmt.Sprintf("invalid fast path length %d", t.lastShortLength)))
 		}
+	default:
+		t.Emit("error", errors.New(fmt.Sprintf("unknown tpkt action 0x%x", version&0x3)))
 	}
 }
 
 func (t *TPKT) recvExtendedHeader(s []byte, err error) {
-	glog.Debug("tpkt recvExtendedHeader", hex.EncodeToString(s), err)
+	if glog.Enabled(glog.DEBUG) {
+		glog.Debug("tpkt recvExtendedHeader", hex.EncodeToString(s), err)
+	}
 	if err != nil {
+		t.Emit("error", err)
 		return
 	}
 	r := bytes.NewReader(s)
 	size, _ := core.ReadUint16BE(r)
+	if size <= 4 {
+		t.Emit("error", errors.New(fmt.Sprintf("invalid tpkt length %d", size)))
+		return
+	}
 	glog.Debug("tpkt wait recvData:", size)
 	core.StartReadBytes(int(size-4), t.Conn, t.recvData)
 }
 
 func (t *TPKT) recvData(s []byte, err error) {
-	glog.Debug("tpkt recvData", hex.EncodeToString(s), err)
+	if glog.Enabled(glog.DEBUG) {
+		glog.Debug("tpkt recvData", hex.EncodeToString(s), err)
+	}
 	if err != nil {
+		t.Emit("error", err)
 		return
 	}
+	core.Trace(core.Inbound, "tpkt", s)
 	t.Emit("data", s)
 	core.StartReadBytes(2, t.Conn, t.recvHeader)
 }
 
 func (t *TPKT) recvExtendedFastPathHeader(s []byte, err error) {
-	glog.Debug("tpkt recvExtendedFastPathHeader", hex.EncodeToString(s))
-	r := bytes.NewReader(s)
-	rightPart, err := core.ReadUInt8(r)
+	if glog.Enabled(glog.DEBUG) {
+		glog.Debug("tpkt recvExtendedFastPathHeader", hex.EncodeToString(s))
+	}
 	if err != nil {
-		glog.Error("TPTK recvExtendedFastPathHeader", err)
+		t.Emit("error", err)
 		return
 	}
-
 	leftPart := t.lastShortLength & ^0x80
-	packetSize := (leftPart << 8) + int(rightPart)
+	packetSize := (leftPart << 8) + int(s[0])
+	if packetSize <= 3 {
+		t.Emit("error", errors.New(fmt.Sprintf("invalid fast path length %d", packetSize)))
+		return
+	}
 	core.StartReadBytes(packetSize-3, t.Conn, t.recvFastPath)
 }
 
 func (t *TPKT) recvFastPath(s []byte, err error) {
 	glog.Debug("tpkt recvFastPath")
 	if err != nil {
+		t.Emit("error", err)
 		return
 	}
 
-	t.fastPathListener.RecvFastPath(t.secFlag, s)
+	core.Trace(core.Inbound, "fastpath", s)
+	if t.fastPathListener == nil {
+		t.Emit("error", errors.New("fast path PDU without listener"))
+	} else {
+		t.fastPathListener.RecvFastPath(t.secFlag, s)
+	}
 	core.StartReadBytes(2, t.Conn, t.recvHeader)
 }
@@ -0,0 +1,215 @@
+package tpkt_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tomatome/grdp/core"
+	"github.com/tomatome/grdp/glog"
+	"github.com/tomatome/grdp/protocol/tpkt"
+)
+
+func init() {
+	glog.SetLevel(glog.NONE)
+}
+
+func TestSendFastPathLength(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	tp := tpkt.New(core.NewSocketLayer(client), nil)
+
+	for _, c := range []struct {
+		data   []byte
+		header string
+	}{
+		// one byte length below 0x80
+		{[]byte{0x01, 0x00, 0x1c}, "0005"},
+		// two byte length from 0x80
+		{bytes.Repeat([]byte{0xaa}, 0x7e), "008081"},
+	} {
+		go tp.SendFastPath(0, c.data)
+		header := make([]byte, len(c.header)/2)
+		if _, err := io.ReadFull(server, header); err != nil {
+			t.Fatal(err)
+		}
+		body := make([]byte, len(c.data))
+		if _, err := io.ReadFull(server, body); err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(header) != c.header || !bytes.Equal(body, c.data) {
+			t.Errorf("get %x, expect %s", header, c.header)
+		}
+	}
+}
+
+type fastPathListener chan []byte
+
+func (l fastPathListener) RecvFastPath(secFlag byte, s []byte) {
+	l <- append([]byte{secFlag}, s...)
+}
+
+func TestRecvFastPath(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	tp := tpkt.New(core.NewSocketLayer(client), nil)
+	l := make(fastPathListener, 1)
+	tp.SetFastPathListener(l)
+	errs := make(chan error, 1)
+	tp.On("error", func(e error) {
+		errs <- e
+	})
+
+	// an encrypted update with a one byte length, then with a two byte length
+	for _, c := range []struct {
+		pdu, expect string
+	}{
+		{"80050a0b0c", "020a0b0c"},
+		{"008006abcdef", "00abcdef"},
+	} {
+		b, _ := hex.DecodeString(c.pdu)
+		go server.Write(b)
+		select {
+		case s := <-l:
+			if hex.EncodeToString(s) != c.expect {
+				t.Errorf("get %x, expect %s", s, c.expect)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no fast path data for", c.pdu)
+		}
+	}
+
+	// reserved action bits
+	go server.Write([]byte{0x01, 0x02})
+	select {
+	case <-errs:
+	case <-time.After(time.Second):
+		t.Fatal("invalid action accepted")
+	}
+}
+
+func TestNewTransportFromConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	tp := tpkt.NewTransportFromConn(client)
+	data := make(chan []byte, 1)
+	tp.On("data", func(s []byte) {
+		data <- s
+	})
+
+	go tp.Write([]byte{0x02, 0xf0, 0x80})
+	b := make([]byte, 7)
+	if _, err := io.ReadFull(server, b); err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(b) != "0300000702f080" {
+		t.Errorf("get %x", b)
+	}
+
+	go server.Write([]byte{0x03, 0x00, 0x00, 0x06, 0xaa, 0xbb})
+	select {
+	case s := <-data:
+		if hex.EncodeToString(s) != "aabb" {
+			t.Errorf("get %x, expect aabb", s)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no data from the conn")
+	}
+
+	// no fast path listener
+	errs := make(chan error, 1)
+	tp.On("error", func(e error) {
+		errs <- e
+	})
+	go server.Write([]byte{0x00, 0x04, 0xaa, 0xbb})
+	select {
+	case err := <-errs:
+		if err.Error() != "fast path PDU without listener" {
+			t.Error("get", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("fast path PDU without listener accepted")
+	}
+}
+
+func TestRecvSegmented(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	tp := tpkt.NewTransportFromConn(client)
+	data := make(chan []byte, 3)
+	tp.On("data", func(s []byte) {
+		data <- s
+	})
+	l := make(fastPathListener, 1)
+	tp.(*tpkt.TPKT).SetFastPathListener(l)
+
+	// a pdu one byte at a time
+	go func() {
+		for _, b := range []byte{0x03, 0x00, 0x00, 0x07, 0xaa, 0xbb, 0xcc} {
+			server.Write([]byte{b})
+		}
+	}()
+	select {
+	case s := <-data:
+		if hex.EncodeToString(s) != "aabbcc" {
+			t.Errorf("get %x, expect aabbcc", s)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no data from the split pdu")
+	}
+
+	// two pdus and a fast path update in a write
+	b, _ := hex.DecodeString("0300000501" + "030000060203" + "00040a0b")
+	go server.Write(b)
+	for _, expect := range []string{"01", "0203"} {
+		select {
+		case s := <-data:
+			if hex.EncodeToString(s) != expect {
+				t.Errorf("get %x, expect %s", s, expect)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no data", expect)
+		}
+	}
+	select {
+	case s := <-l:
+		if hex.EncodeToString(s) != "000a0b" {
+			t.Errorf("get %x, expect 000a0b", s)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no fast path data")
+	}
+	if len(data) != 0 {
+		t.Error("unexpected data", <-data)
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	tp := tpkt.NewTransportFromConn(client)
+	errs := make(chan error, 1)
+	tp.On("error", func(e error) {
+		errs <- e
+	})
+	tp.(core.TimeoutSetter).SetReadTimeout(50 * time.Millisecond)
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("get %v, expect deadline exceeded", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("read not timed out")
+	}
+}
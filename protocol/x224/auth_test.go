@@ -0,0 +1,22 @@
+package x224
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestReadEarlyUserAuthResult(t *testing.T) {
+	if err := readEarlyUserAuthResult(bytes.NewReader([]byte{0, 0, 0, 0})); err != nil {
+		t.Error(err)
+	}
+	err := error(&NLAError{readEarlyUserAuthResult(bytes.NewReader([]byte{5, 0, 0, 0}))})
+	if !errors.Is(err, ErrAccessDenied) || !errors.Is(err, ErrNLAFailed) {
+		t.Error("get", err)
+	}
+	for _, b := range [][]byte{{1, 0, 0, 0}, {0, 0}} {
+		if err := readEarlyUserAuthResult(bytes.NewReader(b)); err == nil || err == ErrAccessDenied {
+			t.Errorf("get %v for %x", err, b)
+		}
+	}
+}
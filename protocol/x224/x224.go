@@ -2,9 +2,12 @@ package x224
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
+	"time"
 
 	"github.com/tomatome/grdp/glog"
 
@@ -40,6 +43,12 @@ const (
 	TYPE_RDP_NEG_FAILURE                 = 0x03
 )
 
+// correlation info following a negotiation request with CORRELATION_INFO_PRESENT
+const (
+	TYPE_RDP_CORRELATION_INFO NegotiationType = 0x06
+	CORRELATION_INFO_PRESENT                  = 0x08
+)
+
 /**
  * Protocols available for x224 layer
  */
@@ -51,6 +60,59 @@ const (
 	PROTOCOL_HYBRID_EX        = 0x00000008
 )
 
+/**
+ * result the server sends after CredSSP under PROTOCOL_HYBRID_EX
+ * @see MS-RDPBCGR 2.2.10.2 Early User Authorization Result PDU
+ */
+const (
+	AUTHZ_SUCCESS       uint32 = 0x00000000
+	AUTHZ_ACCESS_DENIED        = 0x00000005
+)
+
+// NegotiationFailure is the code of the negotiation failure of the server
+type NegotiationFailure uint32
+
+/**
+ * @see MS-RDPBCGR 2.2.1.2.2 RDP Negotiation Failure (RDP_NEG_FAILURE)
+ */
+const (
+	SSL_REQUIRED_BY_SERVER                NegotiationFailure = 0x00000001
+	SSL_NOT_ALLOWED_BY_SERVER             NegotiationFailure = 0x00000002
+	SSL_CERT_NOT_ON_SERVER                NegotiationFailure = 0x00000003
+	INCONSISTENT_FLAGS                    NegotiationFailure = 0x00000004
+	HYBRID_REQUIRED_BY_SERVER             NegotiationFailure = 0x00000005
+	SSL_WITH_USER_AUTH_REQUIRED_BY_SERVER NegotiationFailure = 0x00000006
+)
+
+var negotiationFailureMessages = map[NegotiationFailure]string{
+	SSL_REQUIRED_BY_SERVER:                "the server requires TLS security (PROTOCOL_SSL)",
+	SSL_NOT_ALLOWED_BY_SERVER:             "the server only allows standard RDP security (PROTOCOL_RDP)",
+	SSL_CERT_NOT_ON_SERVER:                "the server has no certificate for TLS security",
+	INCONSISTENT_FLAGS:                    "the requested protocols are inconsistent",
+	HYBRID_REQUIRED_BY_SERVER:             "the server requires NLA (PROTOCOL_HYBRID)",
+	SSL_WITH_USER_AUTH_REQUIRED_BY_SERVER: "the server requires TLS with user authentication",
+}
+
+func (f NegotiationFailure) Error() string {
+	if m, ok := negotiationFailureMessages[f]; ok {
+		return fmt.Sprintf("%s (negotiation failure %d)", m, uint32(f))
+	}
+	return fmt.Sprintf("negotiation failure %d", uint32(f))
+}
+
+// RequiredProtocol returns the protocol the server asks for, if any
+func (f NegotiationFailure) RequiredProtocol() (uint32, bool) {
+	switch f {
+	case SSL_REQUIRED_BY_SERVER, SSL_WITH_USER_AUTH_REQUIRED_BY_SERVER:
+		return PROTOCOL_SSL, true
+	case SSL_NOT_ALLOWED_BY_SERVER:
+		return PROTOCOL_RDP, true
+	case HYBRID_REQUIRED_BY_SERVER:
+		return PROTOCOL_HYBRID, true
+	}
+	return 0, false
+}
+
 /**
  * Use to negotiate security layer of RDP stack
  * In node-rdpjs only ssl is available
@@ -70,43 +132,65 @@ func NewNegotiation() *Negotiation {
 	return &Negotiation{0, 0, 0x0008 /*constant*/, PROTOCOL_RDP}
 }
 
+/**
+ * Correlation id of the connection, in the event logs of the server
+ * @see MS-RDPBCGR 2.2.1.1.2 RDP Correlation Info (RDP_NEG_CORRELATION_INFO)
+ */
+type CorrelationInfo struct {
+	Type          NegotiationType `struc:"byte"`
+	Flag          uint8           `struc:"uint8"`
+	Length        uint16          `struc:"little"`
+	CorrelationId [16]byte
+	Reserved      [16]byte
+}
+
+func NewCorrelationInfo(id [16]byte) *CorrelationInfo {
+	return &CorrelationInfo{TYPE_RDP_CORRELATION_INFO, 0, 36, id, [16]byte{}}
+}
+
 /**
  * X224 client connection request
  * @param opt {object} component type options
  * @see	http://msdn.microsoft.com/en-us/library/cc240470.aspx
  */
 type ClientConnectionRequestPDU struct {
-	Len         uint8
-	Code        MessageType
-	Padding1    uint16
-	Padding2    uint16
-	Padding3    uint8
-	Cookie      []byte
-	ProtocolNeg *Negotiation
+	Len      uint8
+	Code     MessageType
+	Padding1 uint16
+	Padding2 uint16
+	Padding3 uint8
+	// routing token or cookie, without the CR LF ending it
+	Cookie          []byte
+	ProtocolNeg     *Negotiation
+	CorrelationInfo *CorrelationInfo
 }
 
 func NewClientConnectionRequestPDU(coockie []byte) *ClientConnectionRequestPDU {
 	x := ClientConnectionRequestPDU{0, TPDU_CONNECTION_REQUEST, 0, 0, 0,
-		coockie, NewNegotiation()}
+		coockie, NewNegotiation(), nil}
 	x.Len = uint8(len(x.Serialize()) - 1)
 	return &x
 }
 
+// Serialize also updates Len to the length of the request
 func (x *ClientConnectionRequestPDU) Serialize() []byte {
 	buff := &bytes.Buffer{}
-	core.WriteUInt8(x.Len, buff)
 	core.WriteUInt8(uint8(x.Code), buff)
 	core.WriteUInt16BE(x.Padding1, buff)
 	core.WriteUInt16BE(x.Padding2, buff)
 	core.WriteUInt8(x.Padding3, buff)
 
-	buff.Write(x.Cookie)
-	if x.Len > 14 {
+	if len(x.Cookie) > 0 {
+		buff.Write(x.Cookie)
 		core.WriteUInt16LE(0x0A0D, buff)
 	}
 	struc.Pack(buff, x.ProtocolNeg)
+	if x.CorrelationInfo != nil {
+		struc.Pack(buff, x.CorrelationInfo)
+	}
 
-	return buff.Bytes()
+	x.Len = uint8(buff.Len())
+	return append([]byte{x.Len}, buff.Bytes()...)
 }
 
 /**
@@ -137,6 +221,70 @@ func NewDataHeader() *DataHeader {
 	return &DataHeader{2, TPDU_DATA /* constant */, 0x80 /*constant*/}
 }
 
+var ErrNLAFailed = errors.New("NLA authentication failed")
+
+// NLAError is emitted when NLA does not complete, it matches ErrNLAFailed
+// with errors.Is
+type NLAError struct {
+	Err error
+}
+
+func (e *NLAError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrNLAFailed, e.Err)
+}
+
+func (e *NLAError) Is(target error) bool {
+	return target == ErrNLAFailed
+}
+
+func (e *NLAError) Unwrap() error {
+	return e.Err
+}
+
+// ErrAccessDenied is the NLAError of a user the server denies in its early
+// user authorization result
+var ErrAccessDenied = errors.New("access denied by the server")
+
+// readEarlyUserAuthResult reads the early user authorization result, nil
+// on success
+func readEarlyUserAuthResult(r io.Reader) error {
+	b, err := core.ReadBytes(4, r)
+	if err != nil {
+		return errors.New(fmt.Sprintf("read early user authorization result %v", err))
+	}
+	switch result := binary.LittleEndian.Uint32(b); result {
+	case AUTHZ_SUCCESS:
+		return nil
+	case AUTHZ_ACCESS_DENIED:
+		return ErrAccessDenied
+	default:
+		return errors.New(fmt.Sprintf("unknown early user authorization result 0x%08x", result))
+	}
+}
+
+// ProtocolError is emitted when the server does not select the protocol
+// required by SetRequiredProtocol
+type ProtocolError struct {
+	Required uint32
+	// selected by the server, unless it sent the Failure code
+	Selected uint32
+	Failure  NegotiationFailure
+}
+
+func (e *ProtocolError) Error() string {
+	if e.Failure != 0 {
+		return fmt.Sprintf("negotiation of protocol %d failed: %v", e.Required, e.Failure)
+	}
+	return fmt.Sprintf("server selected protocol %d instead of %d", e.Selected, e.Required)
+}
+
+func (e *ProtocolError) Unwrap() error {
+	if e.Failure != 0 {
+		return e.Failure
+	}
+	return nil
+}
+
 /**
  * Common X224 Automata
  * @param presentation {Layer} presentation layer
@@ -147,6 +295,10 @@ type X224 struct {
 	requestedProtocol uint32
 	selectedProtocol  uint32
 	dataHeader        *DataHeader
+	// fail unless the server selects requestedProtocol
+	required      bool
+	cookie        []byte
+	correlationId *[16]byte
 }
 
 func New(t core.Transport) *X224 {
@@ -156,6 +308,9 @@ func New(t core.Transport) *X224 {
 		PROTOCOL_RDP | PROTOCOL_SSL | PROTOCOL_HYBRID,
 		PROTOCOL_SSL,
 		NewDataHeader(),
+		false,
+		nil,
+		nil,
 	}
 
 	t.On("close", func() {
@@ -179,7 +334,9 @@ func (x *X224) Write(b []byte) (n int, err error) {
 	}
 	buff.Write(b)
 
-	glog.Debug("x224 write:", hex.EncodeToString(buff.Bytes()))
+	if glog.Enabled(glog.DEBUG) {
+		glog.Debug("x224 write:", hex.EncodeToString(buff.Bytes()))
+	}
 	return x.transport.Write(buff.Bytes())
 }
 
@@ -187,17 +344,67 @@ func (x *X224) Close() error {
 	return x.transport.Close()
 }
 
+func (x *X224) SetReadTimeout(d time.Duration) {
+	if t, ok := x.transport.(core.TimeoutSetter); ok {
+		t.SetReadTimeout(d)
+	}
+}
+
+func (x *X224) SetWriteTimeout(d time.Duration) {
+	if t, ok := x.transport.(core.TimeoutSetter); ok {
+		t.SetWriteTimeout(d)
+	}
+}
+
 func (x *X224) SetRequestedProtocol(p uint32) {
 	x.requestedProtocol = p
 }
 
+// SetRequiredProtocol requests p alone, the connection fails with a
+// ProtocolError when the server selects another protocol
+func (x *X224) SetRequiredProtocol(p uint32) {
+	x.requestedProtocol = p
+	x.required = true
+}
+
+// SetCookie sends cookie, such as "Cookie: mstshash=user" or the routing
+// token of a redirection, for the load balancer of the server farm
+func (x *X224) SetCookie(cookie string) {
+	x.cookie = []byte(cookie)
+}
+
+// SetCorrelationId sends id, which must not start with 0x00 or 0xf4 nor
+// hold 0x0d bytes
+func (x *X224) SetCorrelationId(id [16]byte) {
+	x.correlationId = &id
+}
+
+// SelectedProtocol returns the protocol selected by the server in the
+// connection confirm
+func (x *X224) SelectedProtocol() uint32 {
+	return x.selectedProtocol
+}
+
 func (x *X224) Connect() error {
 	if x.transport == nil {
 		return errors.New("no transport")
 	}
-	message := NewClientConnectionRequestPDU(make([]byte, 0))
+	if bytes.ContainsAny(x.cookie, "\r\n") {
+		return errors.New("cookie with a line break")
+	}
+	message := NewClientConnectionRequestPDU(x.cookie)
 	message.ProtocolNeg.Type = TYPE_RDP_NEG_REQ
 	message.ProtocolNeg.Result = uint32(x.requestedProtocol)
+	if id := x.correlationId; id != nil {
+		if id[0] == 0x00 || id[0] == 0xf4 || bytes.IndexByte(id[:], 0x0d) >= 0 {
+			return errors.New(fmt.Sprintf("invalid correlation id %x", id[:]))
+		}
+		message.ProtocolNeg.Flag |= CORRELATION_INFO_PRESENT
+		message.CorrelationInfo = NewCorrelationInfo(*id)
+	}
+	if len(message.Serialize()) > 255 {
+		return errors.New(fmt.Sprintf("connection request of %d bytes too long", len(message.Serialize())))
+	}
 
 	glog.Debug("x224 sendConnectionRequest", hex.EncodeToString(message.Serialize()))
 	_, err := x.transport.Write(message.Serialize())
@@ -214,12 +421,12 @@ func (x *X224) recvConnectionConfirm(s []byte) {
 	}
 	glog.Debugf("message: %+v", *message.ProtocolNeg)
 	if message.ProtocolNeg.Type == TYPE_RDP_NEG_FAILURE {
-		glog.Error(fmt.Sprintf("NODE_RDP_PROTOCOL_X224_NEG_FAILURE with code: %d,see https://msdn.microsoft.com/en-us/library/cc240507.aspx",
-			message.ProtocolNeg.Result))
-		//only use Standard RDP Security mechanisms
-		if message.ProtocolNeg.Result == 2 {
-			glog.Info("Only use Standard RDP Security mechanisms, Reconnect with Standard RDP")
+		var err error = NegotiationFailure(message.ProtocolNeg.Result)
+		glog.Error("x224 negotiation failure:", err)
+		if x.required {
+			err = &ProtocolError{Required: x.requestedProtocol, Failure: NegotiationFailure(message.ProtocolNeg.Result)}
 		}
+		x.Emit("error", err)
 		x.Close()
 		return
 	}
@@ -229,8 +436,10 @@ func (x *X224) recvConnectionConfirm(s []byte) {
 		x.selectedProtocol = message.ProtocolNeg.Result
 	}
 
-	if x.selectedProtocol == PROTOCOL_HYBRID_EX {
-		glog.Error("NODE_RDP_PROTOCOL_HYBRID_EX_NOT_SUPPORTED")
+	if x.required && x.selectedProtocol != x.requestedProtocol {
+		glog.Error("server downgraded protocol", x.requestedProtocol, "to", x.selectedProtocol)
+		x.Emit("error", &ProtocolError{Required: x.requestedProtocol, Selected: x.selectedProtocol})
+		x.Close()
 		return
 	}
 
@@ -247,17 +456,23 @@ func (x *X224) recvConnectionConfirm(s []byte) {
 		err := x.transport.(*tpkt.TPKT).StartTLS()
 		if err != nil {
 			glog.Error("start tls failed:", err)
+			x.Emit("error", err)
 			return
 		}
 		x.Emit("connect", x.selectedProtocol)
 		return
 	}
 
-	if x.selectedProtocol == PROTOCOL_HYBRID {
+	if x.selectedProtocol == PROTOCOL_HYBRID || x.selectedProtocol == PROTOCOL_HYBRID_EX {
 		glog.Info("*** NLA Security selected ***")
 		err := x.transport.(*tpkt.TPKT).StartNLA()
+		if err == nil && x.selectedProtocol == PROTOCOL_HYBRID_EX {
+			// read before the tpkt layer waits for the next PDU
+			err = readEarlyUserAuthResult(x.transport)
+		}
 		if err != nil {
 			glog.Error("start NLA failed:", err)
+			x.Emit("error", &NLAError{err})
 			return
 		}
 		x.Emit("connect", x.selectedProtocol)
@@ -266,7 +481,9 @@ func (x *X224) recvConnectionConfirm(s []byte) {
 }
 
 func (x *X224) recvData(s []byte) {
-	glog.Debug("x224 recvData", hex.EncodeToString(s), "emit data")
+	if glog.Enabled(glog.DEBUG) {
+		glog.Debug("x224 recvData", hex.EncodeToString(s), "emit data")
+	}
 	// x224 header takes 3 bytes
 	x.Emit("data", s[3:])
 }
@@ -0,0 +1,191 @@
+package x224_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	rdptls "github.com/icodeface/tls"
+	"github.com/tomatome/grdp/core"
+	"github.com/tomatome/grdp/glog"
+	"github.com/tomatome/grdp/protocol/t125"
+	"github.com/tomatome/grdp/protocol/tpkt"
+	"github.com/tomatome/grdp/protocol/x224"
+)
+
+func init() {
+	glog.SetLevel(glog.NONE)
+}
+
+// connection confirm selecting PROTOCOL_SSL
+const sslConfirmHex = "030000130ed00000000000" + "0200080001000000"
+
+func selfSignedCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func readTPKT(r io.Reader) ([]byte, error) {
+	header, err := core.ReadBytes(4, r)
+	if err != nil {
+		return nil, err
+	}
+	body, err := core.ReadBytes(int(header[2])<<8|int(header[3])-4, r)
+	return append(header, body...), err
+}
+
+// serveSSL confirms PROTOCOL_SSL, upgrades to TLS and returns the first packet
+func serveSSL(t *testing.T, l net.Listener, result chan<- []byte) {
+	conn, err := l.Accept()
+	if err != nil {
+		t.Error(err)
+		close(result)
+		return
+	}
+	defer conn.Close()
+	defer close(result)
+	if _, err = readTPKT(conn); err != nil {
+		t.Error("read connection request", err)
+		return
+	}
+	confirm, _ := hex.DecodeString(sslConfirmHex)
+	conn.Write(confirm)
+
+	tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{selfSignedCert(t)}})
+	if err = tlsConn.Handshake(); err != nil {
+		return
+	}
+	if p, err := readTPKT(tlsConn); err == nil {
+		result <- p
+	}
+}
+
+func dial(t *testing.T, l net.Listener, config *rdptls.Config) *x224.X224 {
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := core.NewSocketLayer(conn)
+	socket.SetTLSConfig(config)
+	x := x224.New(tpkt.New(socket, nil))
+	x.SetRequestedProtocol(x224.PROTOCOL_SSL)
+	t125.NewMCSClient(x)
+	return x
+}
+
+func TestConnectUpgradesToTLS(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	result := make(chan []byte, 1)
+	go serveSSL(t, l, result)
+
+	x := dial(t, l, nil)
+	defer x.Close()
+	if err = x.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case p := <-result:
+		// connect initial sent inside TLS after the x224 data header
+		if hex.EncodeToString(p[4:9]) != "02f0807f65" {
+			t.Errorf("expect connect initial, get %x", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no connect initial received over TLS")
+	}
+}
+
+func TestConnectVerifiesCertificate(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	result := make(chan []byte, 1)
+	go serveSSL(t, l, result)
+
+	x := dial(t, l, &rdptls.Config{})
+	defer x.Close()
+	errs := make(chan error, 1)
+	x.On("error", func(err error) {
+		errs <- err
+	})
+	if err = x.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-errs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("self-signed certificate accepted")
+	}
+	if _, ok := <-result; ok {
+		t.Error("connect initial sent without a verified certificate")
+	}
+}
+
+func TestNegotiationFailure(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		readTPKT(server)
+		// negotiation failure HYBRID_REQUIRED_BY_SERVER
+		failure, _ := hex.DecodeString("030000130ed000000000000300080005000000")
+		server.Write(failure)
+	}()
+	x := x224.New(tpkt.New(core.NewSocketLayer(client), nil))
+	t125.NewMCSClient(x)
+	errs := make(chan error, 1)
+	x.On("error", func(err error) {
+		errs <- err
+	})
+	if err := x.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-errs:
+		var f x224.NegotiationFailure
+		if !errors.As(err, &f) || f != x224.HYBRID_REQUIRED_BY_SERVER {
+			t.Fatal("get", err)
+		}
+		if p, ok := f.RequiredProtocol(); !ok || p != x224.PROTOCOL_HYBRID {
+			t.Error("get required protocol", p, ok)
+		}
+		if err.Error() != "the server requires NLA (PROTOCOL_HYBRID) (negotiation failure 5)" {
+			t.Error("get", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no negotiation failure")
+	}
+	if _, ok := x224.NegotiationFailure(9).RequiredProtocol(); ok || x224.NegotiationFailure(9).Error() != "negotiation failure 9" {
+		t.Error("unknown failure")
+	}
+}